@@ -0,0 +1,162 @@
+/**
+ * エディタの共同編集者の管理
+ * 所有者は招待、権限の変更、共同編集者を外すことができ、共同編集者はゲームから抜けることができる
+ * @file
+ */
+$(function() {
+	var section = $('#collaborators');
+	var roleNames = {owner: '所有者', editor: '編集者', viewer: '閲覧者'};
+
+	// 共同編集者の一覧の更新
+	var updateCollaborators = function() {
+		$.ajax('/get_collaborators', {
+			method: 'GET',
+			dataType: 'json',
+			data: {
+				game_key: gameKey
+			},
+			success: function(data) {
+				var members = section.find('.members').empty();
+				$('<li>').text(data.owner.name + ' (' + roleNames.owner + ')').appendTo(members);
+				$.each(data.collaborators, function(i, collaborator) {
+					var li = $('<li>').attr('user_key', collaborator.user_key).text(collaborator.name + ' ');
+					if(data.role == 'owner') {
+						var select = $('<select class="role">');
+						$.each(['editor', 'viewer'], function(j, role) {
+							$('<option>').val(role).text(roleNames[role]).prop('selected', role == collaborator.role).appendTo(select);
+						});
+						li.append(select).append($('<button class="remove">外す</button>'));
+					} else {
+						li.append($('<span>').text('(' + roleNames[collaborator.role] + ')'));
+						if(collaborator.user_key == data.user_key) {
+							li.append($('<button class="remove">抜ける</button>'));
+						}
+					}
+					li.appendTo(members);
+				});
+
+				var invitations = section.find('.invitations').empty();
+				$.each(data.invitations, function(i, invitation) {
+					var target = invitation.mail != '' ? invitation.mail : '登録済みのユーザ';
+					$('<li>').attr('key', invitation.key)
+						.text('招待中: ' + target + ' (' + roleNames[invitation.role] + ') ')
+						.append($('<button class="cancel">取り消す</button>'))
+						.appendTo(invitations);
+				});
+			},
+			error: function() {
+				console.log('get collaborators error');
+			}
+		});
+	};
+
+	// 共同編集者の表示切り替えボタン
+	$('#collaborators_mode').click(function() {
+		section.toggle();
+		if(section.is(':visible')) {
+			updateCollaborators();
+		}
+	});
+
+	// 招待ボタン
+	$('#invite_collaborator').click(function() {
+		var div = section.find('.invite');
+		if(!validateInputs(div.find('input, select'))) {
+			return false;
+		}
+		$.ajax('/invite_collaborator', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				target: div.find('.target').val(),
+				role: div.find('.role').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				div.find('.target').val('');
+				updateCollaborators();
+			},
+			error: function() {
+				console.log('invite collaborator error');
+			}
+		});
+	});
+
+	// 権限の変更
+	section.on('change', '.members .role', function() {
+		$.ajax('/set_collaborator_role', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				user_key: $(this).closest('li').attr('user_key'),
+				role: $(this).val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				}
+				updateCollaborators();
+			},
+			error: function() {
+				console.log('set collaborator role error');
+			}
+		});
+	});
+
+	// 共同編集者を外すボタン
+	section.on('click', '.members .remove', function() {
+		var userKey = $(this).closest('li').attr('user_key');
+		var leaving = gameRole != 'owner';
+		if(!window.confirm(leaving ? 'このゲームから抜けますか？' : 'この共同編集者を外しますか？')) {
+			return false;
+		}
+		$.ajax('/remove_collaborator', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				user_key: userKey
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				if(leaving) {
+					location.href = '/gamelist';
+					return;
+				}
+				updateCollaborators();
+			},
+			error: function() {
+				console.log('remove collaborator error');
+			}
+		});
+	});
+
+	// 招待を取り消すボタン
+	section.on('click', '.invitations .cancel', function() {
+		$.ajax('/cancel_invitation', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				key: $(this).closest('li').attr('key')
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				}
+				updateCollaborators();
+			},
+			error: function() {
+				console.log('cancel invitation error');
+			}
+		});
+	});
+});
@@ -0,0 +1,11 @@
+/**
+ * CSRF対策のスクリプト
+ * ページに埋め込まれたトークンをすべての Ajax リクエストに付ける
+ * jQuery の後に読み込むこと
+ * @file
+ */
+$.ajaxSetup({
+	headers: {
+		'X-CSRF-Token': $('meta[name="csrf-token"]').attr('content')
+	}
+});
@@ -54,7 +54,7 @@ $(function() {
 		var selected = $('#interim_users option:selected');
 		var key = selected.val();
 		$.ajax('/registration', {
-			method: 'GET',
+			method: 'POST',
 			data: {
 				key: key
 			},
@@ -87,6 +87,188 @@ $(function() {
 		});
 	});
 	
+	// 権限変更
+	$('#set_user_role').click(function() {
+		$.ajax('/set_user_role', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				user_key: $('#users option:selected').val(),
+				role: $('#user_role option:selected').val()
+			},
+			success: function() {
+				update();
+			},
+			error: function() {
+				console.log('set user role error');
+			}
+		});
+	});
+	
+	// ロック解除
+	$('#unlock_user').click(function() {
+		$.ajax('/unlock_user', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				user_key: $('#users option:selected').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert('ロックを解除できませんでした');
+				}
+				update();
+			},
+			error: function() {
+				console.log('unlock user error');
+			}
+		});
+	});
+	
+	// 二段階認証の解除
+	$('#reset_totp').click(function() {
+		if(!window.confirm('二段階認証を解除しますか？')) {
+			return false;
+		}
+		$.ajax('/reset_totp', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				user_key: $('#users option:selected').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert('二段階認証を解除できませんでした');
+				}
+				update();
+			},
+			error: function() {
+				console.log('reset totp error');
+			}
+		});
+	});
+	
+	// ユーザ統合
+	$('#merge_users').click(function() {
+		if(!window.confirm('統合元のユーザは削除されます。統合しますか？')) {
+			return false;
+		}
+		$.ajax('/merge_users', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				target_key: $('#users option:selected').val(),
+				source_key: $('#merge_source').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert('統合に失敗しました');
+				}
+				update();
+			},
+			error: function() {
+				console.log('merge users error');
+			}
+		});
+	});
+	
+	// 古いユーザのメールアドレスの使用登録
+	$('#backfill_user_mails').click(function() {
+		$.ajax('/backfill_user_mails', {
+			method: 'POST',
+			dataType: 'json',
+			success: function(data) {
+				if(data.result == false) {
+					alert('登録に失敗しました');
+					return;
+				}
+				alert(data.count + '件のアドレスを登録しました');
+			},
+			error: function() {
+				console.log('backfill user mails error');
+			}
+		});
+	});
+	
+	// タグ統合
+	$('#merge_tags').click(function() {
+		var sources = $('#merge_tag_sources').val();
+		var target = $('#merge_tag_target').val();
+		if(!window.confirm('すべてのゲームの「' + sources + '」を「' + target + '」に置き換えます。統合しますか？')) {
+			return false;
+		}
+		$.ajax('/merge_tags', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				sources: sources,
+				target: target
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				alert(data.count + '件のゲームのタグを変更しました');
+				update();
+			},
+			error: function() {
+				console.log('merge tags error');
+			}
+		});
+	});
+	
+	// カテゴリ追加・変更
+	$('#put_category').click(function() {
+		var section = $('#categories');
+		$.ajax('/put_category', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				axis: section.find('.axis').val(),
+				id: section.find('.id').val(),
+				name: section.find('.name').val(),
+				order: section.find('.order').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				update();
+			},
+			error: function() {
+				console.log('put category error');
+			}
+		});
+	});
+	
+	// カテゴリ削除
+	$('#categories').on('click', '.delete_category', function() {
+		var axis = $(this).attr('axis');
+		var id = $(this).attr('category_id');
+		if(!window.confirm('カテゴリ ' + id + ' を削除しますか？\n選んでいたゲームは未設定に戻ります')) {
+			return false;
+		}
+		$.ajax('/delete_category', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				axis: axis,
+				id: id
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				}
+				update();
+			},
+			error: function() {
+				console.log('delete category error');
+			}
+		});
+	});
+	
 	// セッション作成
 	$('#start_session').click(function() {
 		var session = $('#session');
@@ -134,7 +316,7 @@ $(function() {
 			success: function(data) {
 				users.empty();
 				for(var key in data) {
-					var option = $('<option></option>').html(data[key]).val(key);
+					var option = $('<option></option>').text(data[key].name + ' (' + data[key].role + ')').val(key);
 					users.append(option);
 				}
 			},
@@ -142,6 +324,48 @@ $(function() {
 				console.log('user error');
 			}
 		});
+		
+		var categories = $('#categories .list');
+		$.ajax('/get_categories', {
+			method: 'GET',
+			dataType: 'json',
+			success: function(data) {
+				categories.empty();
+				for(var axis in data.categories) {
+					$.each(data.categories[axis], function(i, category) {
+						var li = $('<li></li>').text(axis + ': ' + category.id + ' (' + category.name + ', ' + category.order + ')');
+						li.append($('<button class="delete_category">削除</button>').attr('axis', axis).attr('category_id', category.id));
+						categories.append(li);
+					});
+				}
+			},
+			error: function() {
+				console.log('categories error');
+			}
+		});
+		
+		var logs = $('#audit_logs tbody');
+		$.ajax('/get_audit_logs', {
+			method: 'GET',
+			dataType: 'json',
+			success: function(data) {
+				logs.empty();
+				for(var i = 0; i < data.length; i++) {
+					var log = data[i];
+					var tr = $('<tr></tr>');
+					tr.append($('<td></td>').text(log.Date));
+					tr.append($('<td></td>').text(log.UserKey));
+					tr.append($('<td></td>').text(log.Action));
+					tr.append($('<td></td>').text(log.Method + ' ' + log.Path));
+					tr.append($('<td></td>').text(log.IP));
+					tr.append($('<td></td>').text(log.Detail));
+					logs.append(tr);
+				}
+			},
+			error: function() {
+				console.log('audit log error');
+			}
+		});
 	};
 	
 	update();
@@ -0,0 +1,99 @@
+/**
+ * エディタの下書きの自動保存
+ * 編集中の内容 (gameContent) が変わっていれば定期的にサーバへ下書きとして保存する
+ * ゲームを開いた時に保存したゲームより新しい下書きがあれば、復元するか尋ねる
+ * 下書きはゲームを保存するとサーバで破棄される
+ * @file
+ */
+$(function() {
+	if(gameRole == 'viewer') {
+		return;
+	}
+	var interval = 30000;
+	var lastContent = JSON.stringify(gameContent);
+
+	// 変わっていれば下書きを保存する
+	var autosave = function() {
+		var content = JSON.stringify(gameContent);
+		if(content == lastContent) {
+			return;
+		}
+		$.ajax('/autosave', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				content: content,
+				base_revision: gameRevision
+			},
+			success: function(data) {
+				if(data.result == false) {
+					console.log(data.message);
+					return;
+				}
+				lastContent = content;
+			},
+			error: function() {
+				console.log('autosave error');
+			}
+		});
+	};
+
+	// 新しい下書きがあれば復元するか尋ねる
+	$.ajax('/get_draft', {
+		method: 'GET',
+		dataType: 'json',
+		data: {
+			game_key: gameKey
+		},
+		success: function(data) {
+			if(data.result == false || data.draft == null) {
+				return;
+			}
+			var message = new Date(data.draft.date).toLocaleString() + ' に自動保存した下書きがあります。復元しますか？';
+			if(data.draft.base_revision != gameRevision) {
+				message += '\n(下書きはリビジョン ' + data.draft.base_revision + ' から編集したもので、その後ゲームが保存されています)';
+			}
+			if(confirm(message)) {
+				gameContent = data.draft.content;
+				$(document).trigger('game:loaded', [gameContent]);
+			} else {
+				$.ajax('/discard_draft', {
+					method: 'POST',
+					dataType: 'json',
+					data: {
+						game_key: gameKey
+					},
+					error: function() {
+						console.log('discard draft error');
+					}
+				});
+			}
+		},
+		error: function() {
+			console.log('get draft error');
+		}
+	});
+
+	setInterval(autosave, interval);
+
+	// 保存したら下書きはサーバで破棄される
+	$(document).on('game:saved', function(e, revision) {
+		gameRevision = revision.number;
+		lastContent = JSON.stringify(gameContent);
+	});
+
+	// タブを閉じる時に未保存の変更があれば下書きに残す
+	$(window).on('beforeunload', function() {
+		var content = JSON.stringify(gameContent);
+		if(content == lastContent || !navigator.sendBeacon) {
+			return;
+		}
+		var form = new FormData();
+		form.append('game_key', gameKey);
+		form.append('content', content);
+		form.append('base_revision', gameRevision);
+		form.append('csrf_token', $('meta[name="csrf-token"]').attr('content'));
+		navigator.sendBeacon('/autosave', form);
+	});
+});
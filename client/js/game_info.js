@@ -0,0 +1,96 @@
+/**
+ * エディタのゲームの情報の編集
+ * 名前、説明、サムネイル、最初のシーン、タグ、カテゴリ、設定を変更する
+ * タグは入力中の最後のタグを公開されているゲームのタグから補完する
+ * @file
+ */
+$(function() {
+	var suggestTimer = null;
+
+	// ゲームの情報の表示切り替えボタン
+	$('#game_info_mode').click(function() {
+		$('#game_info').toggle();
+	});
+
+	// 入力中のタグの候補を表示する
+	$('#game_info .tags').on('input', function() {
+		var value = $(this).val();
+		var separator = Math.max(value.lastIndexOf(','), value.lastIndexOf('、'));
+		var before = value.slice(0, separator + 1);
+		var current = $.trim(value.slice(separator + 1));
+		clearTimeout(suggestTimer);
+		if(current == '') {
+			$('#tag_suggestions').empty();
+			return;
+		}
+		suggestTimer = setTimeout(function() {
+			$.ajax('/suggest_tags', {
+				method: 'GET',
+				dataType: 'json',
+				data: {
+					q: current
+				},
+				success: function(data) {
+					if(data.result == false) {
+						return;
+					}
+					var list = $('#tag_suggestions').empty();
+					$.each(data.tags, function(i, tag) {
+						$('<option>').attr('value', before + (before == '' ? '' : ' ') + tag).appendTo(list);
+					});
+				},
+				error: function() {
+					console.log('suggest tags error');
+				}
+			});
+		}, 300);
+	});
+
+	// ゲームの情報の保存ボタン
+	$('#update_game').click(function() {
+		var section = $('#game_info');
+		if(!validateInputs(section.find('input, textarea'))) {
+			return false;
+		}
+		var settings = section.find('.settings').val();
+		if(settings != '') {
+			try {
+				JSON.parse(settings);
+			} catch(e) {
+				alert('ゲームの設定は JSON のオブジェクトで指定してください');
+				return false;
+			}
+		}
+		var params = {
+			game_key: gameKey,
+			name: section.find('.name').val(),
+			description: section.find('.description').val(),
+			thumbnail: section.find('.thumbnail').val(),
+			first_scene: section.find('.first_scene').val(),
+			tags: section.find('.tags').val(),
+			settings: settings
+		};
+		section.find('.category').each(function() {
+			params[$(this).attr('axis')] = $(this).val();
+		});
+		$.ajax('/update_game', {
+			method: 'POST',
+			dataType: 'json',
+			data: params,
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				$('#game_title').text(data.game.name);
+				$('#game_description').text(data.game.description);
+				section.find('.tags').val(data.game.tags.join(', '));
+				document.title = data.game.name + ' - ESCPAE 3DS';
+				alert('ゲームの情報を保存しました');
+			},
+			error: function() {
+				console.log('update game error');
+			}
+		});
+	});
+});
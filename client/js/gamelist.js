@@ -9,11 +9,7 @@ $(function() {
 		var div = $('#add_game_div');
 		var name = div.find('.name').val();
 		var description = div.find('.description').val();
-		if(name == "") {
-			alert('ゲームの名前が入力されていません');
-			return false;
-		} else if(description == "") {
-			alert('ゲームの説明が入力されていません');
+		if(!validateInputs(div.find('input'))) {
 			return false;
 		}
 		$.ajax('/add_game', {
@@ -34,7 +30,7 @@ $(function() {
 	
 	// ゲーム削除ボタン
 	$('.game .delete').click(function() {
-		if(!window.confirm('ゲームを削除しますか？')) {
+		if(!window.confirm('ゲームをゴミ箱に移しますか？30日以内なら元に戻せます。')) {
 			return false;
 		}
 		var key = $(this).parent('.game').attr('key');
@@ -47,8 +43,510 @@ $(function() {
 			error: function() {
 				console.log('delete game error');
 			},
-			success: function() {
-				console.log('success');
+			success: function(data) {
+				if(data.result == false) {
+					alert('ゲームを削除できませんでした');
+					return;
+				}
+				location.reload();
+			}
+		});
+	});
+	
+	// 招待に参加するボタン
+	$('#invitations .accept').click(function() {
+		var key = $(this).closest('.invitation').attr('key');
+		$.ajax('/accept_invitation', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				key: key
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				location.reload();
+			},
+			error: function() {
+				console.log('accept invitation error');
+			}
+		});
+	});
+	
+	// 招待を断るボタン
+	$('#invitations .decline').click(function() {
+		var item = $(this).closest('.invitation');
+		$.ajax('/decline_invitation', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				key: item.attr('key')
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				item.remove();
+			},
+			error: function() {
+				console.log('decline invitation error');
+			}
+		});
+	});
+	
+	// ゴミ箱から元に戻すボタン
+	$('#trash .restore').click(function() {
+		var key = $(this).closest('.game').attr('key');
+		$.ajax('/restore_game', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: key
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				location.reload();
+			},
+			error: function() {
+				console.log('restore game error');
+			}
+		});
+	});
+	
+	// ゴミ箱から完全に削除するボタン
+	$('#trash .purge').click(function() {
+		if(!window.confirm('ゲームを完全に削除しますか？元に戻すことはできません。')) {
+			return false;
+		}
+		var item = $(this).closest('.game');
+		$.ajax('/purge_game', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: item.attr('key')
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				item.remove();
+			},
+			error: function() {
+				console.log('purge game error');
+			}
+		});
+	});
+	
+	// ゲーム複製ボタン
+	$('.game .copy').click(function() {
+		var key = $(this).closest('.game').attr('key');
+		$.ajax('/clone_game', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: key
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				location.reload();
+			},
+			error: function() {
+				console.log('clone game error');
+			}
+		});
+	});
+	
+	// メールアドレス変更ボタン
+	$('#change_mail').click(function() {
+		var mail = $('#change_mail_div .mail').val();
+		if(mail == "") {
+			alert('メールアドレスが入力されていません');
+			return false;
+		}
+		$.ajax('/change_mail', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				mail: mail
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				} else {
+					alert('確認メールを送信しました。メール内のリンクを開くと変更が完了します。');
+				}
+			},
+			error: function() {
+				console.log('change mail error');
+			}
+		});
+	});
+	
+	// アカウント連携の解除ボタン
+	$('.identity .unlink').click(function() {
+		if(!window.confirm('連携を解除しますか？')) {
+			return false;
+		}
+		var li = $(this).parent('.identity');
+		$.ajax('/unlink_identity', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				provider: li.attr('provider'),
+				oauth_id: li.attr('oauth_id')
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				} else {
+					li.remove();
+				}
+			},
+			error: function() {
+				console.log('unlink identity error');
+			}
+		});
+	});
+	
+	// メールアドレス連携の解除ボタン
+	$('.mail_identity .unlink_mail').click(function() {
+		if(!window.confirm('メールアドレスでのログインを解除しますか？')) {
+			return false;
+		}
+		$.ajax('/unlink_mail', {
+			method: 'POST',
+			dataType: 'json',
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				} else {
+					location.reload();
+				}
+			},
+			error: function() {
+				console.log('unlink mail error');
+			}
+		});
+	});
+	
+	// メールアドレス連携ボタン
+	$('#link_mail').click(function() {
+		var div = $('#link_mail_div');
+		var mail = div.find('.mail').val();
+		var pass = div.find('.pass').val();
+		if(mail == "" || pass == "") {
+			alert('メールアドレスとパスワードを入力してください');
+			return false;
+		}
+		$.ajax('/link_mail', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				mail: mail,
+				pass: pass
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				} else {
+					alert('確認メールを送信しました。メール内のリンクを開くと連携が完了します。');
+				}
+			},
+			error: function() {
+				console.log('link mail error');
+			}
+		});
+	});
+	
+	// 二段階認証の登録ボタン
+	$('#enroll_totp').click(function() {
+		var div = $('#totp_div');
+		$.ajax('/enroll_totp', {
+			method: 'POST',
+			dataType: 'json',
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				div.find('.qr').attr('src', data.qr + '?' + new Date().getTime());
+				div.find('.secret').text(data.secret);
+				div.find('.enrollment').show();
+			},
+			error: function() {
+				console.log('enroll totp error');
+			}
+		});
+	});
+	
+	// 二段階認証の確認ボタン
+	$('#confirm_totp').click(function() {
+		var div = $('#totp_div');
+		$.ajax('/confirm_totp', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				code: div.find('.enrollment .code').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				var list = div.find('.recovery_codes');
+				$.each(data.recovery_codes, function(i, code) {
+					list.append($('<li>').text(code));
+				});
+				div.find('#enroll_totp, .enrollment').hide();
+				div.find('.recovery').show();
+			},
+			error: function() {
+				console.log('confirm totp error');
+			}
+		});
+	});
+	
+	// 二段階認証の無効化ボタン
+	$('#disable_totp').click(function() {
+		if(!window.confirm('二段階認証を無効にしますか？')) {
+			return false;
+		}
+		$.ajax('/disable_totp', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				code: $('#totp_div .code').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				} else {
+					location.reload();
+				}
+			},
+			error: function() {
+				console.log('disable totp error');
+			}
+		});
+	});
+	
+	// 退会ボタン
+	$('#delete_account').click(function() {
+		if(!window.confirm('退会するとアカウントとすべてのゲームが削除されます。退会しますか？')) {
+			return false;
+		}
+		var div = $('#delete_account_div');
+		$.ajax('/delete_account', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				pass: div.find('.pass').val(),
+				code: div.find('.code').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				} else {
+					alert('退会を申請しました。');
+					location.href = data.to;
+				}
+			},
+			error: function() {
+				console.log('delete account error');
+			}
+		});
+	});
+	
+	// プロフィール保存ボタン
+	$('#update_profile').click(function() {
+		var div = $('#profile_div');
+		$.ajax('/update_profile', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				name: div.find('.name').val(),
+				handle: div.find('.handle').val(),
+				bio: div.find('.bio').val(),
+				language: div.find('.language').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				} else {
+					location.reload();
+				}
+			},
+			error: function() {
+				console.log('update profile error');
+			}
+		});
+	});
+	
+	// アイコンのアップロードボタン
+	$('#upload_avatar').click(function() {
+		var div = $('#profile_div');
+		var file = div.find('.avatar_file')[0].files[0];
+		if(!file) {
+			alert('画像を選んでください');
+			return false;
+		}
+		var form = new FormData();
+		form.append('avatar', file);
+		$.ajax('/upload_avatar', {
+			method: 'POST',
+			dataType: 'json',
+			data: form,
+			processData: false,
+			contentType: false,
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				} else {
+					div.find('.avatar').attr('src', data.avatar + '&' + new Date().getTime());
+				}
+			},
+			error: function() {
+				console.log('upload avatar error');
+			}
+		});
+	});
+	
+	// パスワード変更ボタン
+	$('#change_password').click(function() {
+		var div = $('#change_password_div');
+		$.ajax('/change_password', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				current_pass: div.find('.current_pass').val(),
+				new_pass: div.find('.new_pass').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+				} else {
+					alert('パスワードを変更しました');
+					div.find('input').val('');
+				}
+			},
+			error: function() {
+				console.log('change password error');
+			}
+		});
+	});
+	
+	// ゲームの公開チェックボックス
+	$('.game .published').change(function() {
+		var checkbox = $(this);
+		$.ajax('/set_game_published', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: checkbox.closest('.game').attr('key'),
+				published: checkbox.prop('checked')
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert('公開状態を変更できませんでした');
+					checkbox.prop('checked', !checkbox.prop('checked'));
+				}
+			},
+			error: function() {
+				console.log('set game published error');
+			}
+		});
+	});
+	
+	// API トークン一覧の更新
+	var updateAPITokens = function() {
+		var tbody = $('#api_tokens_div tbody');
+		$.ajax('/get_api_tokens', {
+			method: 'GET',
+			dataType: 'json',
+			success: function(data) {
+				tbody.empty();
+				$.each(data, function(key, token) {
+					var expires = token.expires.indexOf('0001-') == 0 ? '無期限' : new Date(token.expires).toLocaleString();
+					var lastUsed = token.last_used.indexOf('0001-') == 0 ? '-' : new Date(token.last_used).toLocaleString();
+					var button = $('<button class="revoke">無効にする</button>').attr('key', key);
+					$('<tr>')
+						.append($('<td>').text(token.name))
+						.append($('<td>').text(token.scopes.join(', ')))
+						.append($('<td>').text('...' + token.hint))
+						.append($('<td>').text(expires))
+						.append($('<td>').text(lastUsed))
+						.append($('<td>').append(button))
+						.appendTo(tbody);
+				});
+			},
+			error: function() {
+				console.log('get api tokens error');
+			}
+		});
+	};
+	if($('#api_tokens_div').length > 0) {
+		updateAPITokens();
+	}
+	
+	// API トークン作成ボタン
+	$('#create_api_token').click(function() {
+		var div = $('#api_tokens_div');
+		var scopes = div.find('.scope:checked').map(function() {
+			return $(this).val();
+		}).get();
+		$.ajax('/create_api_token', {
+			method: 'POST',
+			dataType: 'json',
+			traditional: true,
+			data: {
+				name: div.find('.name').val(),
+				scopes: scopes,
+				expires_days: div.find('.expires_days').val()
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				div.find('.new_token code').text(data.token);
+				div.find('.new_token').show();
+				updateAPITokens();
+			},
+			error: function() {
+				console.log('create api token error');
+			}
+		});
+	});
+	
+	// API トークン無効化ボタン
+	$('#api_tokens_div').on('click', '.revoke', function() {
+		if(!window.confirm('このトークンを無効にしますか？')) {
+			return false;
+		}
+		$.ajax('/revoke_api_token', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				token_key: $(this).attr('key')
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert('トークンを無効にできませんでした');
+				}
+				updateAPITokens();
+			},
+			error: function() {
+				console.log('revoke api token error');
 			}
 		});
 	});
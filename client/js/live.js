@@ -0,0 +1,133 @@
+/**
+ * エディタの共同編集のライブ配信
+ * 他のエディタでのシーン、イベント、アイテムの変更を受け取って live:change イベントで知らせる
+ * 自分の変更は live.send() で配信する
+ * シーンのロックの変更は live:locks イベントで知らせる
+ * 誰がどのシーンを見ているかを #presence に表示する
+ * @file
+ */
+var live = (function() {
+	// 自分の変更を見分けるためのエディタのID
+	var clientId = Math.random().toString(36).slice(2) + Date.now().toString(36);
+	var scene = '';
+	var presenceInterval = 20000;
+
+	// 在席状況を送る
+	var sendPresence = function() {
+		$.ajax('/live_presence', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				scene: scene
+			},
+			error: function() {
+				console.log('live presence error');
+			}
+		});
+	};
+
+	// 在席状況を表示する
+	var showPresence = function(list) {
+		var ul = $('#presence').empty();
+		$.each(list, function(i, presence) {
+			var text = presence.name;
+			if(presence.scene != '') {
+				text += ' (シーン' + presence.scene + ')';
+			}
+			$('<li>').attr('user_key', presence.user_key).text(text).appendTo(ul);
+		});
+	};
+
+	$(function() {
+		if(!window.EventSource) {
+			console.log('EventSource is not supported');
+			return;
+		}
+		var source = new EventSource('/live?game_key=' + encodeURIComponent(gameKey));
+		source.addEventListener('change', function(e) {
+			var change = JSON.parse(e.data);
+			if(change.client_id == clientId) {
+				return;
+			}
+			$(document).trigger('live:change', [change]);
+		});
+		source.addEventListener('presence', function(e) {
+			showPresence(JSON.parse(e.data));
+		});
+		source.addEventListener('locks', function(e) {
+			$(document).trigger('live:locks', [JSON.parse(e.data)]);
+		});
+		source.addEventListener('reset', function() {
+			// 取りこぼした変更があるので読み込み直す
+			alert('他のユーザの変更を受け取れなかったため、ページを読み込み直します');
+			location.reload();
+		});
+
+		sendPresence();
+		setInterval(sendPresence, presenceInterval);
+
+		// 見ているシーンが変わったら知らせる
+		$('#scene_list').on('click', 'li', function() {
+			live.setScene($(this).find('.scene_id').text());
+		});
+
+		// ページを閉じたら退席する
+		$(window).on('unload', function() {
+			if(navigator.sendBeacon) {
+				var form = new FormData();
+				form.append('game_key', gameKey);
+				form.append('leave', 'true');
+				form.append('csrf_token', $('meta[name="csrf-token"]').attr('content'));
+				navigator.sendBeacon('/live_presence', form);
+			}
+		});
+	});
+
+	return {
+		/**
+		 * 変更を他のエディタへ配信する
+		 * @param {string} target 変更したもの (scene, event, item)
+		 * @param {string} op 操作 (add, update, remove)
+		 * @param {string} id 変更したもののID
+		 * @param {object} data 変更後の内容、削除なら null
+		 * @param {string} scene イベントの変更ならイベントのあるシーンのID
+		 */
+		send: function(target, op, id, data, scene) {
+			$.ajax('/live_change', {
+				method: 'POST',
+				dataType: 'json',
+				data: {
+					game_key: gameKey,
+					target: target,
+					op: op,
+					id: id,
+					scene: scene || '',
+					data: data == null ? '' : JSON.stringify(data),
+					client_id: clientId
+				},
+				success: function(data) {
+					if(!data.result) {
+						console.log(data.message);
+					}
+				},
+				error: function(xhr) {
+					if(xhr.status == 409) {
+						console.log(xhr.responseJSON.message);
+					} else {
+						console.log('live change error');
+					}
+				}
+			});
+		},
+
+		/**
+		 * 見ているシーンを変えて在席状況を送る
+		 * @param {string} id シーンのID、シーンを選んでいなければ空文字
+		 */
+		setScene: function(id) {
+			scene = id;
+			sendPresence();
+		}
+	};
+})();
@@ -0,0 +1,168 @@
+/**
+ * エディタのシーンの編集ロック
+ * シーンを選ぶとロックし、選んでいる間はハートビートを送ってロックを延長する
+ * シーン一覧にロックしているユーザを表示し、ハートビートが途絶えたロックは解除できる
+ * @file
+ */
+$(function() {
+	var heartbeatInterval = 20000;
+	var refreshInterval = 30000;
+	var myUserKey = '';
+	var lockedScene = '';
+
+	// シーン一覧にロックしているユーザを表示する
+	var showLocks = function(locks) {
+		var list = $('#scene_list');
+		list.find('.lock_holder').remove();
+		$.each(locks, function(i, lock) {
+			list.find('li').filter(function() {
+				return $(this).find('.scene_id').text() == lock.scene;
+			}).each(function() {
+				var holder = $('<div class="lock_holder">');
+				if(lock.user_key == myUserKey) {
+					holder.text('編集中 (自分)');
+				} else {
+					holder.text(lock.name + ' が編集中');
+					if(gameRole != 'viewer' && (lock.stale || gameRole == 'owner')) {
+						holder.append($('<button class="break_lock">ロックを解除</button>').attr('scene', lock.scene));
+					}
+				}
+				holder.appendTo(this);
+			});
+		});
+	};
+
+	// ロックの一覧を読み込む
+	var refreshLocks = function() {
+		$.ajax('/get_scene_locks', {
+			method: 'GET',
+			dataType: 'json',
+			data: {
+				game_key: gameKey
+			},
+			success: function(data) {
+				if(data.result == false) {
+					return;
+				}
+				myUserKey = data.user_key;
+				showLocks(data.locks);
+			},
+			error: function() {
+				console.log('get scene locks error');
+			}
+		});
+	};
+
+	// シーンのロックを解除する
+	var unlock = function(scene, success) {
+		$.ajax('/unlock_scene', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				scene: scene
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				if(success) {
+					success();
+				}
+			},
+			error: function() {
+				console.log('unlock scene error');
+			}
+		});
+	};
+
+	// シーンをロックする
+	var lock = function(scene) {
+		if(lockedScene != '' && lockedScene != scene) {
+			unlock(lockedScene);
+		}
+		lockedScene = '';
+		$.ajax('/lock_scene', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				scene: scene
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message + '\n変更しても保存できません');
+					return;
+				}
+				lockedScene = scene;
+			},
+			error: function() {
+				console.log('lock scene error');
+			}
+		});
+	};
+
+	// ロックを延長する
+	var heartbeat = function() {
+		if(lockedScene == '') {
+			return;
+		}
+		$.ajax('/heartbeat_scene_lock', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				scene: lockedScene
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					lockedScene = '';
+				}
+			},
+			error: function() {
+				console.log('heartbeat scene lock error');
+			}
+		});
+	};
+
+	refreshLocks();
+	setInterval(refreshLocks, refreshInterval);
+	$(document).on('live:locks', function(e, locks) {
+		showLocks(locks);
+	});
+
+	if(gameRole == 'viewer') {
+		return;
+	}
+	setInterval(heartbeat, heartbeatInterval);
+
+	// シーンを選んだらロックする
+	$('#scene_list').on('click', 'li', function(e) {
+		if($(e.target).is('.break_lock')) {
+			return;
+		}
+		lock($(this).find('.scene_id').text());
+	});
+
+	// ロックを解除ボタン
+	$('#scene_list').on('click', '.break_lock', function() {
+		var scene = $(this).attr('scene');
+		if(!confirm('シーン' + scene + 'のロックを解除しますか？\n編集中のユーザは変更を保存できなくなります')) {
+			return;
+		}
+		unlock(scene, refreshLocks);
+	});
+
+	// ページを閉じたらロックを解除する
+	$(window).on('unload', function() {
+		if(lockedScene != '' && navigator.sendBeacon) {
+			var form = new FormData();
+			form.append('game_key', gameKey);
+			form.append('scene', lockedScene);
+			form.append('csrf_token', $('meta[name="csrf-token"]').attr('content'));
+			navigator.sendBeacon('/unlock_scene', form);
+		}
+	});
+});
@@ -9,6 +9,9 @@ $(function() {
 	loginForm.find('.submit').click(function() {
 		var mail = loginForm.find('.mail').val();
 		var pass = loginForm.find('.pass').val();
+		if(!validateInputs(loginForm.find('input'))) {
+			return false;
+		}
 		$.ajax('/login', {
 			method: 'POST',
 			data: {
@@ -19,6 +22,10 @@ $(function() {
 			success: function(data) {
 				if(data.result == false) {
 					alert(data.message);
+				} else if(data.totp) {
+					loginForm.hide();
+					totpForm.show();
+					totpForm.find('.code').focus();
 				} else {
 					console.log(data.to);
 					location.href = data.to;
@@ -29,4 +36,29 @@ $(function() {
 			}
 		});
 	});
+	
+	// 二段階認証
+	var totpForm = $('.totp_login');
+	totpForm.find('.submit').click(function() {
+		$.ajax('/login_totp', {
+			method: 'POST',
+			data: {
+				code: totpForm.find('.code').val()
+			},
+			dataType: 'json',
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					if(data.to) {
+						location.href = data.to;
+					}
+				} else {
+					location.href = data.to;
+				}
+			},
+			error: function() {
+				console.log('login totp error');
+			}
+		});
+	});
 });
\ No newline at end of file
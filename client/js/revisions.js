@@ -0,0 +1,172 @@
+/**
+ * エディタのゲームの保存とリビジョン履歴
+ * 保存するたびにリビジョンが作成され、履歴から差分の確認と古いリビジョンの復元ができる
+ * 編集中の内容は gameContent に置く
+ * @file
+ */
+$(function() {
+	var section = $('#revisions');
+	var nextCursor = '';
+	var listNames = {scenes: 'シーン', events: 'イベント', items: 'アイテム'};
+	var changeNames = {added: '追加', removed: '削除', changed: '変更'};
+
+	// リビジョンを一覧に追加する
+	var appendRevisions = function(revisions) {
+		var list = section.find('.list');
+		$.each(revisions, function(i, revision) {
+			var text = '#' + revision.number + ' ' + new Date(revision.date).toLocaleString() + ' ' + revision.author;
+			if(revision.message != '') {
+				text += ': ' + revision.message;
+			}
+			var li = $('<li>').attr('number', revision.number).text(text + ' ');
+			if(revision.number > 1) {
+				li.append($('<button class="diff">前との差分</button>'));
+			}
+			if(gameRole != 'viewer') {
+				li.append($('<button class="restore">復元</button>'));
+			}
+			li.append($('<div class="diff_result">'));
+			li.appendTo(list);
+		});
+	};
+
+	// リビジョンの一覧を読み込む
+	var loadRevisions = function(cursor) {
+		$.ajax('/get_revisions', {
+			method: 'GET',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				cursor: cursor
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				if(cursor == '') {
+					section.find('.list').empty();
+				}
+				appendRevisions(data.revisions);
+				nextCursor = data.next_cursor;
+				section.find('.more').toggle(nextCursor != '');
+			},
+			error: function() {
+				console.log('get revisions error');
+			}
+		});
+	};
+
+	// 差分を表示する
+	var showDiff = function(target, diff) {
+		target.empty();
+		$.each(listNames, function(list, listName) {
+			$.each(changeNames, function(change, changeName) {
+				if(diff[list][change].length > 0) {
+					$('<div>').text(listName + 'の' + changeName + ': ' + diff[list][change].join(', ')).appendTo(target);
+				}
+			});
+		});
+		if(target.is(':empty')) {
+			target.text('変更はありません');
+		}
+	};
+
+	// リビジョン履歴の表示切り替えボタン
+	$('#revisions_mode').click(function() {
+		section.toggle();
+		if(section.is(':visible')) {
+			loadRevisions('');
+		}
+	});
+
+	// 続きを読み込むボタン
+	section.find('.more').click(function() {
+		loadRevisions(nextCursor);
+	});
+
+	// 前のリビジョンとの差分ボタン
+	section.on('click', '.diff', function() {
+		var li = $(this).closest('li');
+		var number = parseInt(li.attr('number'), 10);
+		$.ajax('/diff_revisions', {
+			method: 'GET',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				from: number - 1,
+				to: number
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				showDiff(li.find('.diff_result'), data.diff);
+			},
+			error: function() {
+				console.log('diff revisions error');
+			}
+		});
+	});
+
+	// 復元ボタン
+	section.on('click', '.restore', function() {
+		var number = $(this).closest('li').attr('number');
+		if(!confirm('リビジョン ' + number + ' の内容を新しいリビジョンとして復元しますか？')) {
+			return;
+		}
+		$.ajax('/restore_revision', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				number: number
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				gameContent = data.content;
+				$(document).trigger('game:saved', [data.revision]);
+				$(document).trigger('game:loaded', [gameContent]);
+				loadRevisions('');
+			},
+			error: function() {
+				console.log('restore revision error');
+			}
+		});
+	});
+
+	// ゲームの保存ボタン
+	$('#save').click(function() {
+		var message = prompt('変更の説明 (省略可)', '');
+		if(message == null) {
+			return;
+		}
+		$.ajax('/save_game', {
+			method: 'POST',
+			dataType: 'json',
+			data: {
+				game_key: gameKey,
+				content: JSON.stringify(gameContent),
+				message: message
+			},
+			success: function(data) {
+				if(data.result == false) {
+					alert(data.message);
+					return;
+				}
+				$(document).trigger('game:saved', [data.revision]);
+				if(section.is(':visible')) {
+					loadRevisions('');
+				}
+				alert('リビジョン ' + data.revision.number + ' として保存しました');
+			},
+			error: function() {
+				console.log('save game error');
+			}
+		});
+	});
+});
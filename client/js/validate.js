@@ -0,0 +1,23 @@
+/**
+ * 入力値の検証
+ * サーバのスキーマから出力された属性 (required, maxlength, pattern など) で検証する
+ * @file
+ */
+
+/**
+ * 入力欄を検証し、不正なら最初の入力欄のメッセージを表示する
+ * @param {jQuery} inputs 検証する入力欄
+ * @returns {boolean} すべて正しければ true
+ */
+function validateInputs(inputs) {
+	var valid = true;
+	inputs.each(function() {
+		if(this.checkValidity && !this.checkValidity()) {
+			alert(this.validationMessage);
+			this.focus();
+			valid = false;
+			return false;
+		}
+	});
+	return valid;
+}
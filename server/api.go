@@ -0,0 +1,1520 @@
+/**
+ * REST API (バージョン1)
+ * /api/v1 以下でユーザ、ゲーム、セッションをリソースとして扱う
+ * HTTP メソッドで操作を、ステータスコードで結果を表す
+ * 成功した場合は {"result":true, "data":...} を、
+ * 失敗した場合は {"result":false, "error":{"status":..., "code":..., "message":...}} を返す
+ * 一覧は {"result":true, "data":[...], "next_cursor":...} の形で1ページずつ返す
+ * リクエストの値はフォームでも JSON でも送信できる
+ * @file
+ */
+package escape3ds
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * API の URL の接頭辞
+ * @const
+ */
+const apiPrefix = "/api/v1"
+
+/**
+ * API で成功した結果を返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {int} status HTTP ステータスコード
+ * @param {interface{}} data 返すリソース
+ */
+func apiJSON(c appengine.Context, w http.ResponseWriter, status int, data interface{}) {
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"data": data,
+	})
+	check(c, err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
+
+/**
+ * API で一覧の1ページを返す
+ * 次のページがあれば next_cursor にカーソルを含める
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {interface{}} data 返すリソースの配列
+ * @param {string} next 次のページのカーソル、最後のページなら空文字
+ */
+func apiPage(c appengine.Context, w http.ResponseWriter, data interface{}, next string) {
+	result := map[string]interface{}{
+		"result": true,
+		"data": data,
+		"next_cursor": nil,
+	}
+	if next != "" {
+		result["next_cursor"] = next
+	}
+	bytes, err := json.Marshal(result)
+	check(c, err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+/**
+ * API のエラーを返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {int} status HTTP ステータスコード
+ * @param {string} code エラーの種類
+ * @param {string} message 利用者に表示するメッセージ
+ */
+func apiError(w http.ResponseWriter, status int, code string, message string) {
+	bytes, _ := json.Marshal(map[string]interface{}{
+		"result": false,
+		"error": map[string]interface{}{
+			"status": status,
+			"code": code,
+			"message": message,
+		},
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
+
+/**
+ * 許可されていないメソッドのエラーを返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {...string} allowed 許可するメソッド
+ */
+func apiMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	apiError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("%s で送信してください", strings.Join(allowed, "、")))
+}
+
+/**
+ * リクエストの値を取り出す
+ * JSON の場合はオブジェクトの値を文字列にする
+ * 値がオブジェクトか配列なら JSON の文字列にする
+ * 送信されなかった項目はマップに含まれない
+ * @function
+ * @param {*http.Request} r リクエスト
+ * @returns {map[string]string} 項目名と値の対応表
+ * @returns {error} JSON が不正ならエラー
+ */
+func apiParams(r *http.Request) (map[string]string, error) {
+	result := make(map[string]string)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		values := make(map[string]interface{})
+		err := json.NewDecoder(io.LimitReader(r.Body, 1 << 20)).Decode(&values)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range values {
+			switch v := value.(type) {
+			case string:
+				result[key] = v
+			case nil:
+				result[key] = ""
+			case map[string]interface{}, []interface{}:
+				bytes, err := json.Marshal(v)
+				if err != nil {
+					return nil, err
+				}
+				result[key] = string(bytes)
+			default:
+				result[key] = fmt.Sprint(v)
+			}
+		}
+		return result, nil
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range r.Form {
+		if len(values) > 0 {
+			result[key] = values[0]
+		}
+	}
+	return result, nil
+}
+
+/**
+ * ゲームを API で返す形にする
+ * @function
+ * @param {string} key エンコード済みのゲームキー
+ * @param {*Game} game ゲーム
+ * @returns {map[string]interface{}} ゲームのリソース
+ */
+func gameResource(key string, game *Game) map[string]interface{} {
+	tags := game.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return map[string]interface{}{
+		"key": key,
+		"name": game.Name,
+		"description": game.Description,
+		"thumbnail": game.Thumbnail,
+		"first_scene": game.FirstScene,
+		"published": game.Published,
+		"settings": game.settings(),
+		"revision": game.Revision,
+		"tags": tags,
+		"difficulty": game.Difficulty,
+		"length": game.Length,
+		"theme": game.Theme,
+		"created": game.Created,
+		"updated": game.Updated,
+		"owner": game.UserKey,
+	}
+}
+
+/**
+ * 検索結果を API で返す形にする
+ * @function
+ * @param {SearchResult} result 検索結果
+ * @returns {map[string]interface{}} 検索結果のリソース
+ */
+func searchResultResource(result SearchResult) map[string]interface{} {
+	tags := result.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return map[string]interface{}{
+		"key": result.Key,
+		"name": result.Name,
+		"description": result.Description,
+		"thumbnail": result.Thumbnail,
+		"tags": tags,
+		"owner": result.UserKey,
+		"author": result.Author,
+		"score": result.Score,
+		"updated": result.Updated,
+	}
+}
+
+/**
+ * カテゴリの一覧を API で返す形にする
+ * @function
+ * @param {map[string][]*Category} categories 軸ごとのカテゴリ
+ * @returns {map[string][]map[string]interface{}} 軸ごとのカテゴリのリソース
+ */
+func categoryResources(categories map[string][]*Category) map[string][]map[string]interface{} {
+	result := make(map[string][]map[string]interface{}, len(categories))
+	for axis, list := range categories {
+		result[axis] = make([]map[string]interface{}, 0, len(list))
+		for _, category := range list {
+			result[axis] = append(result[axis], map[string]interface{}{
+				"id": category.Id,
+				"name": category.Name,
+				"order": category.Order,
+			})
+		}
+	}
+	return result
+}
+
+/**
+ * 共同編集者を API で返す形にする
+ * @function
+ * @param {*Collaborator} collaborator 共同編集者
+ * @param {*User} user 共同編集者のユーザ
+ * @returns {map[string]interface{}} 共同編集者のリソース
+ */
+func collaboratorResource(collaborator *Collaborator, user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"user_key": collaborator.UserKey,
+		"name": user.Name,
+		"handle": user.Handle,
+		"avatar": fmt.Sprintf("/avatar?user_key=%s", collaborator.UserKey),
+		"role": collaborator.Role,
+		"date": collaborator.Date,
+	}
+}
+
+/**
+ * リビジョンを API で返す形にする
+ * 内容は含めない
+ * @function
+ * @param {*Revision} revision リビジョン
+ * @param {*User} author 保存したユーザ
+ * @returns {map[string]interface{}} リビジョンのリソース
+ */
+func revisionResource(revision *Revision, author *User) map[string]interface{} {
+	return map[string]interface{}{
+		"number": revision.Number,
+		"user_key": revision.UserKey,
+		"author": author.Name,
+		"message": revision.Message,
+		"restored_from": revision.RestoredFrom,
+		"date": revision.Date,
+	}
+}
+
+/**
+ * リビジョンの一覧を API で返す形にする
+ * 同じユーザは一度だけ読み込む
+ * @function
+ * @param {*Model} model モデル
+ * @param {[]*Revision} revisions リビジョン
+ * @returns {[]map[string]interface{}} リビジョンのリソース
+ */
+func revisionResources(model *Model, revisions []*Revision) []map[string]interface{} {
+	authors := make(map[string]*User)
+	result := make([]map[string]interface{}, 0, len(revisions))
+	for _, revision := range revisions {
+		author, ok := authors[revision.UserKey]
+		if !ok {
+			author = model.getUser(revision.UserKey)
+			authors[revision.UserKey] = author
+		}
+		result = append(result, revisionResource(revision, author))
+	}
+	return result
+}
+
+/**
+ * 下書きを API で返す形にする
+ * @function
+ * @param {*Draft} draft 下書き
+ * @param {bool} newer 保存したゲームより新しければtrue
+ * @returns {map[string]interface{}} 下書きのリソース
+ */
+func draftResource(draft *Draft, newer bool) map[string]interface{} {
+	return map[string]interface{}{
+		"content": json.RawMessage(draft.Content),
+		"base_revision": draft.BaseRevision,
+		"date": draft.Date,
+		"newer": newer,
+	}
+}
+
+/**
+ * シーンのロックを API で返す形にする
+ * stale はハートビートが途絶えていて、編集者が解除できることを表す
+ * @function
+ * @param {string} sceneId シーンの ID
+ * @param {*SceneLock} lock ロック
+ * @param {*User} user ロックしているユーザ
+ * @returns {map[string]interface{}} ロックのリソース
+ */
+func sceneLockResource(sceneId string, lock *SceneLock, user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"scene": sceneId,
+		"user_key": lock.UserKey,
+		"name": user.Name,
+		"acquired": lock.Acquired,
+		"heartbeat": lock.Heartbeat,
+		"expires": lock.Expires(),
+		"stale": lock.stale(time.Now()),
+	}
+}
+
+/**
+ * シーンのロックの一覧を API で返す形にする
+ * 同じユーザは一度だけ読み込む
+ * @function
+ * @param {*Model} model モデル
+ * @param {map[string]*SceneLock} locks シーンの ID とロックの対応表
+ * @returns {[]map[string]interface{}} ロックのリソース (シーンの ID 順)
+ */
+func sceneLockResources(model *Model, locks map[string]*SceneLock) []map[string]interface{} {
+	sceneIds := make([]string, 0, len(locks))
+	for sceneId := range locks {
+		sceneIds = append(sceneIds, sceneId)
+	}
+	sort.Strings(sceneIds)
+	users := make(map[string]*User)
+	result := make([]map[string]interface{}, 0, len(locks))
+	for _, sceneId := range sceneIds {
+		lock := locks[sceneId]
+		user, ok := users[lock.UserKey]
+		if !ok {
+			user = model.getUser(lock.UserKey)
+			users[lock.UserKey] = user
+		}
+		result = append(result, sceneLockResource(sceneId, lock, user))
+	}
+	return result
+}
+
+/**
+ * 招待を API で返す形にする
+ * キーは招待メールのリンクと同じく招待を受けるのに使えるので、所有者にだけ返すこと
+ * @function
+ * @param {string} key エンコード済みの招待キー
+ * @param {*Invitation} invitation 招待
+ * @returns {map[string]interface{}} 招待のリソース
+ */
+func invitationResource(key string, invitation *Invitation) map[string]interface{} {
+	return map[string]interface{}{
+		"key": key,
+		"game_key": invitation.GameKey,
+		"role": invitation.Role,
+		"user_key": invitation.UserKey,
+		"mail": invitation.Mail,
+		"created": invitation.Created,
+		"expires": invitation.Expires,
+	}
+}
+
+/**
+ * ユーザを API で返す形にする
+ * private が false の場合は公開プロフィールの項目だけを含める
+ * @function
+ * @param {string} key エンコード済みのユーザキー
+ * @param {*User} user ユーザ
+ * @param {bool} private 本人に返すならtrue
+ * @returns {map[string]interface{}} ユーザのリソース
+ */
+func userResource(key string, user *User, private bool) map[string]interface{} {
+	result := map[string]interface{}{
+		"key": key,
+		"name": user.Name,
+		"handle": user.Handle,
+		"bio": user.Bio,
+		"avatar": fmt.Sprintf("/avatar?user_key=%s", key),
+	}
+	if private {
+		role := user.Role
+		if role == "" {
+			role = defaultRole
+		}
+		language := user.Language
+		if language == "" {
+			language = languages[0]
+		}
+		result["type"] = user.Type
+		result["mail"] = user.Mail
+		result["role"] = role
+		result["language"] = language
+		result["totp_enabled"] = user.TotpEnabled
+	}
+	return result
+}
+
+/**
+ * /api/v1 以下の処理をルータに登録する
+ * @function
+ * @param {*Router} router 登録先のルータ
+ */
+func apiRoutes(router *Router) {
+	api := router.Group(apiPrefix)
+	api.GET("/users/me", apiGetMe, withScope(""))
+	api.PATCH("/users/me", apiUpdateMe, withScope(""))
+	api.PUT("/users/me", apiUpdateMe, withScope(""))
+	api.GET("/users/{handle}", apiGetUser)
+	api.GET("/search", apiSearchGames)
+	api.GET("/browse", apiBrowseGames)
+	api.GET("/tags", apiSuggestTags)
+	api.GET("/categories", apiListCategories)
+
+	api.GET("/games", apiListGames, withScope("read_games"))
+	api.POST("/games", apiCreateGame, withScope("write_games"))
+	api.GET("/games/{key}", apiGetGame)
+	api.PATCH("/games/{key}", apiUpdateGame, withScope("write_games"), withGameRole("key", "editor"))
+	api.PUT("/games/{key}", apiUpdateGame, withScope("write_games"), withGameRole("key", "editor"))
+	api.DELETE("/games/{key}", apiDeleteGame, withScope("write_games"), ownGame("key"))
+	api.POST("/games/{key}/clone", apiCloneGame, withScope("write_games"), withGameRole("key", "editor"))
+	api.GET("/games/{key}/content", apiGetContent, withScope("read_games"), withGameRole("key", "viewer"))
+	api.PUT("/games/{key}/content", apiSaveContent, withScope("write_games"), withGameRole("key", "editor"))
+	api.GET("/games/{key}/draft", apiGetDraft, withScope("read_games"), withGameRole("key", "editor"))
+	api.PUT("/games/{key}/draft", apiSaveDraft, withScope("write_games"), withGameRole("key", "editor"))
+	api.DELETE("/games/{key}/draft", apiDiscardDraft, withScope("write_games"), withGameRole("key", "editor"))
+	api.GET("/games/{key}/locks", apiListSceneLocks, withScope("read_games"), withGameRole("key", "viewer"))
+	api.PUT("/games/{key}/locks/{scene}", apiLockScene, withScope("write_games"), withGameRole("key", "editor"))
+	api.POST("/games/{key}/locks/{scene}/heartbeat", apiHeartbeatSceneLock, withScope("write_games"), withGameRole("key", "editor"))
+	api.DELETE("/games/{key}/locks/{scene}", apiUnlockScene, withScope("write_games"), withGameRole("key", "editor"))
+	api.GET("/games/{key}/revisions", apiListRevisions, withScope("read_games"), withGameRole("key", "viewer"))
+	api.GET("/games/{key}/revisions/{number}", apiGetRevision, withScope("read_games"), withGameRole("key", "viewer"))
+	api.POST("/games/{key}/revisions/{number}/restore", apiRestoreRevision, withScope("write_games"), withGameRole("key", "editor"))
+	api.GET("/games/{key}/diff", apiDiffRevisions, withScope("read_games"), withGameRole("key", "viewer"))
+	api.GET("/games/{key}/collaborators", apiListCollaborators, withScope("read_games"), withGameRole("key", "viewer"))
+	api.POST("/games/{key}/collaborators", apiInviteCollaborator, withScope("write_games"), ownGame("key"))
+	api.PATCH("/games/{key}/collaborators/{user}", apiUpdateCollaborator, withScope("write_games"), ownGame("key"))
+	api.DELETE("/games/{key}/collaborators/{user}", apiRemoveCollaborator, withScope("write_games"), withGameRole("key", "viewer"))
+	api.GET("/trash", apiListTrash, withScope("read_games"))
+	api.POST("/trash/{key}/restore", apiRestoreGame, withScope("write_games"), ownTrashedGame("key"))
+	api.DELETE("/trash/{key}", apiPurgeGame, withScope("write_games"), ownTrashedGame("key"))
+	api.GET("/games/{key}/assets", apiListAssets, withScope("read_games"), withGameRole("key", "viewer"))
+	api.POST("/games/{key}/assets", apiUploadAsset, withScope("upload_assets"), withGameRole("key", "editor"))
+	// game_key をフォームで指定する古い形式
+	api.POST("/assets", apiUploadAsset, withScope("upload_assets"), withGameRole("game_key", "editor"))
+
+	api.POST("/sessions", apiCreateSession)
+	api.GET("/sessions/current", apiGetSession, withScope(""))
+	api.DELETE("/sessions/current", apiDeleteSession, withScope(""))
+}
+
+/**
+ * API: 自分のユーザ情報を返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiGetMe(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	apiJSON(ctx.c, w, http.StatusOK, userResource(ctx.UserKey, ctx.User, true))
+}
+
+/**
+ * API: 自分のプロフィールを更新する
+ * アカウントの乗っ取りに使われないよう API トークンでは変更できない
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiUpdateMe(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	userKey, user := ctx.UserKey, ctx.User
+	if ctx.APIToken != nil {
+		apiError(w, http.StatusForbidden, "session_required", "プロフィールはログインしてから変更してください")
+		return
+	}
+	params, err := apiParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", "JSON が不正です")
+		return
+	}
+
+	// 送信されなかった項目は現在の値のままにする
+	profile := map[string]string{
+		"name": user.Name,
+		"handle": user.Handle,
+		"bio": user.Bio,
+		"language": user.Language,
+	}
+	for key := range profile {
+		if value, ok := params[key]; ok {
+			profile[key] = value
+		}
+	}
+
+	model := NewModel(c)
+	err = model.updateProfile(userKey, profile)
+	if verr, ok := err.(*ValidationError); ok {
+		validationError(c, w, r, verr)
+		return
+	} else if err == ErrHandleAlreadyUsed {
+		apiError(w, http.StatusConflict, "handle_already_used", err.Error())
+		return
+	} else if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	audit(c, r, userKey, "update_profile", "")
+	apiJSON(c, w, http.StatusOK, userResource(userKey, model.getUser(userKey), true))
+}
+
+/**
+ * API: 公開プロフィールを返す
+ * 認証は不要
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiGetUser(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	handle := pathParam(r, "handle")
+	model := NewModel(c)
+	userKey := model.getUserKeyByHandle(handle)
+	if userKey == "" {
+		apiError(w, http.StatusNotFound, "not_found", "ユーザが見つかりません")
+		return
+	}
+
+	user := userResource(userKey, model.getUser(userKey), false)
+	games := make([]map[string]interface{}, 0)
+	for key, game := range model.getPublishedGames(userKey) {
+		games = append(games, gameResource(key, game))
+	}
+	user["games"] = games
+	apiJSON(c, w, http.StatusOK, user)
+}
+
+/**
+ * API: 公開しているゲームを検索する
+ * q で検索語を、cursor と limit でページを指定する
+ * 一致した候補のうち最大 searchMaxCandidates 件 (500件) に順位を付けて返すので、それを超える結果は返さない
+ * 次のページがあれば next_cursor にカーソルを返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiSearchGames(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	params := searchSchema.formValues(r)
+	verr := searchSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	offset, _ := strconv.Atoi(params["cursor"])
+	limit := searchPageSize
+	if params["limit"] != "" {
+		limit, _ = strconv.Atoi(params["limit"])
+	}
+
+	model := NewModel(c)
+	results, next, err := model.searchGames(params["q"], offset, limit)
+	if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "ゲームを検索できませんでした")
+		return
+	}
+	data := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		data = append(data, searchResultResource(result))
+	}
+	nextCursor := ""
+	if next > 0 {
+		nextCursor = strconv.Itoa(next)
+	}
+	apiPage(c, w, data, nextCursor)
+}
+
+/**
+ * API: 公開しているゲームをタグとカテゴリで絞り込んで返す
+ * tag、difficulty、length、theme で絞り込み、cursor と limit でページを指定する
+ * 次のページがあれば next_cursor にカーソルを返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiBrowseGames(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	params := browseSchema.formValues(r)
+	verr := browseSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	limit := browsePageSize
+	if params["limit"] != "" {
+		limit, _ = strconv.Atoi(params["limit"])
+	}
+	filters := map[string]string{"tag": params["tag"]}
+	for _, axis := range categoryAxes {
+		filters[axis] = params[axis]
+	}
+
+	model := NewModel(c)
+	games, next, err := model.browseGames(filters, params["cursor"], limit)
+	if err == ErrInvalidCursor {
+		apiError(w, http.StatusBadRequest, "invalid_cursor", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "ゲームを取得できませんでした")
+		return
+	}
+	data := make([]map[string]interface{}, 0, len(games))
+	for _, game := range games {
+		data = append(data, gameResource(game.Key, game.Game))
+	}
+	apiPage(c, w, data, next)
+}
+
+/**
+ * API: 入力中のタグを補完する候補を返す
+ * 公開しているゲームのタグから q に前方一致するものを返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiSuggestTags(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	params := tagSuggestSchema.formValues(r)
+	verr := tagSuggestSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	limit := tagSuggestLimit
+	if params["limit"] != "" {
+		limit, _ = strconv.Atoi(params["limit"])
+	}
+
+	model := NewModel(c)
+	tags, err := model.suggestTags(params["q"], limit)
+	if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "タグの候補を取得できませんでした")
+		return
+	}
+	apiJSON(c, w, http.StatusOK, tags)
+}
+
+/**
+ * API: カテゴリの一覧を軸ごとに返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiListCategories(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	model := NewModel(c)
+	apiJSON(c, w, http.StatusOK, categoryResources(model.getCategories()))
+}
+
+/**
+ * API: 自分のゲームの一覧を返す
+ * sort で並び順を、q で絞り込みを、cursor と limit でページを指定する
+ * 次のページがあれば next_cursor にカーソルを返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiListGames(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c, userKey := ctx.c, ctx.UserKey
+	params := gameListSchema.formValues(r)
+	verr := gameListSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	limit := gameListPageSize
+	if params["limit"] != "" {
+		limit, _ = strconv.Atoi(params["limit"])
+	}
+
+	model := NewModel(c)
+	page, next, err := model.getGamePage(userKey, params["sort"], params["q"], params["cursor"], limit)
+	if err == ErrInvalidCursor {
+		apiError(w, http.StatusBadRequest, "invalid_cursor", err.Error())
+		return
+	}
+	check(c, err)
+	games := make([]map[string]interface{}, 0, len(page))
+	for _, item := range page {
+		games = append(games, gameResource(item.Key, item.Game))
+	}
+	apiPage(c, w, games, next)
+}
+
+/**
+ * API: ゲームを作成する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiCreateGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c, userKey := ctx.c, ctx.UserKey
+	params, err := apiParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", "JSON が不正です")
+		return
+	}
+	verr := gameSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	game := model.NewGame(map[string]string{
+		"name": params["name"],
+		"description": params["description"],
+		"thumbnail": "",
+		"user_key": userKey,
+	})
+	gameKey := model.addGame(game)
+	w.Header().Set("Location", fmt.Sprintf("%s/games/%s", apiPrefix, gameKey))
+	apiJSON(c, w, http.StatusCreated, gameResource(gameKey, game))
+}
+
+/**
+ * API: ゲームを返す
+ * 公開されたゲームは誰でも、公開されていないゲームは所有者だけが取得できる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiGetGame(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	gameKey := pathParam(r, "key")
+	key, err := decodeGameKey(gameKey)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "not_found", "ゲームが見つかりません")
+		return
+	}
+	game := new(Game)
+	err = datastore.Get(c, key, game)
+	if err != nil || game.trashed() {
+		apiError(w, http.StatusNotFound, "not_found", "ゲームが見つかりません")
+		return
+	}
+	if !game.Published {
+		chain(func(w http.ResponseWriter, r *http.Request) {
+			apiJSON(c, w, http.StatusOK, gameResource(gameKey, game))
+		}, []Middleware{withScope("read_games"), withGameRole("key", "viewer")})(w, r)
+		return
+	}
+	apiJSON(c, w, http.StatusOK, gameResource(gameKey, game))
+}
+
+/**
+ * API: ゲームの情報を更新する
+ * 送信された項目だけを変更する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiUpdateGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c, gameKey := ctx.c, ctx.GameKey
+	params, err := apiParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", "JSON が不正です")
+		return
+	}
+	fields := make(map[string]string)
+	for _, key := range []string{"name", "description", "thumbnail", "first_scene", "settings", "published", "tags", "difficulty", "length", "theme"} {
+		if value, ok := params[key]; ok {
+			fields[key] = value
+		}
+	}
+	if _, ok := fields["published"]; ok && ctx.GameRole != "owner" {
+		apiError(w, http.StatusForbidden, "forbidden", "公開状態は所有者だけが変更できます")
+		return
+	}
+
+	model := NewModel(c)
+	game, err := model.updateGame(gameKey, fields)
+	if verr, ok := err.(*ValidationError); ok {
+		validationError(c, w, r, verr)
+		return
+	} else if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	apiJSON(c, w, http.StatusOK, gameResource(gameKey, game))
+}
+
+/**
+ * API: ゲームをゴミ箱に移す
+ * 30日以内なら /trash/{key}/restore で元に戻せる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiDeleteGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	model := NewModel(ctx.c)
+	err := model.trashGame(ctx.GameKey)
+	if err != nil {
+		ctx.c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "ゲームを削除できませんでした")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * API: ゲームの内容 (最後に保存したもの) を返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiGetContent(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	apiJSON(ctx.c, w, http.StatusOK, map[string]interface{}{
+		"revision": ctx.Game.Revision,
+		"content": ctx.Game.content(),
+	})
+}
+
+/**
+ * API: ゲームの内容を保存する
+ * content にゲームの内容、message に変更の説明を指定する
+ * 保存するたびに新しいリビジョンを作成して返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiSaveContent(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params, err := apiParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", "JSON が不正です")
+		return
+	}
+
+	model := NewModel(c)
+	revision, err := model.saveGameContent(ctx.GameKey, ctx.UserKey, params["content"], params["message"], 0)
+	if verr, ok := err.(*ValidationError); ok {
+		validationError(c, w, r, verr)
+		return
+	} else if _, ok := err.(*SceneLockedError); ok {
+		apiError(w, http.StatusConflict, "scene_locked", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "ゲームを保存できませんでした")
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/games/%s/revisions/%d", apiPrefix, ctx.GameKey, revision.Number))
+	apiJSON(c, w, http.StatusCreated, revisionResource(revision, ctx.User))
+}
+
+/**
+ * API: 自分の下書きを返す
+ * newer は保存したゲームより新しく、復元する価値があるかを表す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiGetDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	model := NewModel(ctx.c)
+	draft := model.getDraft(ctx.GameKey, ctx.UserKey)
+	if draft == nil {
+		apiError(w, http.StatusNotFound, "not_found", "下書きがありません")
+		return
+	}
+	apiJSON(ctx.c, w, http.StatusOK, draftResource(draft, model.isNewerDraft(ctx.GameKey, ctx.Game, draft)))
+}
+
+/**
+ * API: 編集中の内容を下書きとして自動保存する
+ * content にゲームの内容、base_revision に編集を始めたリビジョンの番号を指定する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiSaveDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params, err := apiParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", "JSON が不正です")
+		return
+	}
+	verr := draftSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	baseRevision, _ := strconv.Atoi(params["base_revision"])
+
+	model := NewModel(c)
+	draft, err := model.saveDraft(ctx.GameKey, ctx.UserKey, params["content"], baseRevision)
+	if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "下書きを保存できませんでした")
+		return
+	}
+	apiJSON(c, w, http.StatusOK, draftResource(draft, true))
+}
+
+/**
+ * API: 自分の下書きを破棄する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiDiscardDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	model := NewModel(ctx.c)
+	err := model.discardDraft(ctx.GameKey, ctx.UserKey)
+	if err != nil {
+		ctx.c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "下書きを破棄できませんでした")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * API: ゲームのシーンのロックの一覧を返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiListSceneLocks(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	model := NewModel(ctx.c)
+	apiJSON(ctx.c, w, http.StatusOK, sceneLockResources(model, model.getSceneLocks(ctx.GameKey)))
+}
+
+/**
+ * API: シーンをロックする
+ * 自分が既にロックしていれば延長する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiLockScene(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	sceneId := pathParam(r, "scene")
+	verr := sceneLockSchema.validate(map[string]string{"scene": sceneId})
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	lock, err := model.lockScene(ctx.GameKey, sceneId, ctx.UserKey)
+	if err == ErrSceneLocked {
+		apiError(w, http.StatusConflict, "scene_locked", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "シーンをロックできませんでした")
+		return
+	}
+	publishSceneLocks(c, ctx.GameKey)
+	apiJSON(c, w, http.StatusOK, sceneLockResource(sceneId, lock, ctx.User))
+}
+
+/**
+ * API: ロックしているシーンのハートビートを送る
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiHeartbeatSceneLock(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	sceneId := pathParam(r, "scene")
+	model := NewModel(c)
+	lock, err := model.heartbeatSceneLock(ctx.GameKey, sceneId, ctx.UserKey)
+	if err == ErrSceneLockLost {
+		apiError(w, http.StatusConflict, "scene_lock_lost", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "シーンのロックを延長できませんでした")
+		return
+	}
+	apiJSON(c, w, http.StatusOK, sceneLockResource(sceneId, lock, ctx.User))
+}
+
+/**
+ * API: シーンのロックを解除する
+ * 他のユーザのロックは、所有者ならいつでも、編集者ならハートビートが途絶えていれば解除できる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiUnlockScene(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	sceneId := pathParam(r, "scene")
+	model := NewModel(c)
+	broken, err := model.unlockScene(ctx.GameKey, sceneId, ctx.UserKey, ctx.GameRole)
+	if err == ErrSceneLockActive {
+		apiError(w, http.StatusConflict, "scene_lock_active", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "シーンのロックを解除できませんでした")
+		return
+	}
+	if broken != nil {
+		audit(c, r, ctx.UserKey, "break_scene_lock", fmt.Sprintf("ゲームキー: %s シーン: %s ユーザキー: %s", ctx.GameKey, sceneId, broken.UserKey))
+	}
+	publishSceneLocks(c, ctx.GameKey)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * API: ゲームのリビジョンの一覧を新しい順に返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiListRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := revisionListSchema.formValues(r)
+	verr := revisionListSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	limit := revisionPageSize
+	if params["limit"] != "" {
+		limit, _ = strconv.Atoi(params["limit"])
+	}
+
+	model := NewModel(c)
+	revisions, next, err := model.getRevisionPage(ctx.GameKey, params["cursor"], limit)
+	if err == ErrInvalidCursor {
+		apiError(w, http.StatusBadRequest, "invalid_cursor", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "リビジョンを取得できませんでした")
+		return
+	}
+	apiPage(c, w, revisionResources(model, revisions), next)
+}
+
+/**
+ * API: リビジョンを内容と共に返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiGetRevision(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	number, _ := strconv.Atoi(pathParam(r, "number"))
+	model := NewModel(ctx.c)
+	revision, err := model.getRevision(ctx.GameKey, number)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "not_found", "リビジョンが見つかりません")
+		return
+	}
+	result := revisionResource(revision, model.getUser(revision.UserKey))
+	result["content"] = json.RawMessage(revision.Content)
+	apiJSON(ctx.c, w, http.StatusOK, result)
+}
+
+/**
+ * API: 古いリビジョンを新しいリビジョンとして復元する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiRestoreRevision(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	number, _ := strconv.Atoi(pathParam(r, "number"))
+	model := NewModel(c)
+	revision, err := model.restoreRevision(ctx.GameKey, ctx.UserKey, number)
+	if err == datastore.ErrNoSuchEntity {
+		apiError(w, http.StatusNotFound, "not_found", "リビジョンが見つかりません")
+		return
+	} else if _, ok := err.(*SceneLockedError); ok {
+		apiError(w, http.StatusConflict, "scene_locked", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "リビジョンを復元できませんでした")
+		return
+	}
+	audit(c, r, ctx.UserKey, "restore_revision", fmt.Sprintf("ゲームキー: %s リビジョン: %d", ctx.GameKey, number))
+	w.Header().Set("Location", fmt.Sprintf("%s/games/%s/revisions/%d", apiPrefix, ctx.GameKey, revision.Number))
+	apiJSON(c, w, http.StatusCreated, revisionResource(revision, ctx.User))
+}
+
+/**
+ * API: 2つのリビジョンの差分を返す
+ * from と to にリビジョンの番号を指定する
+ * シーン、イベント、アイテムごとに追加、削除、変更された ID を返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiDiffRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := revisionDiffSchema.formValues(r)
+	verr := revisionDiffSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	from, _ := strconv.Atoi(params["from"])
+	to, _ := strconv.Atoi(params["to"])
+
+	model := NewModel(c)
+	diff, err := model.diffRevisions(ctx.GameKey, from, to)
+	if err == datastore.ErrNoSuchEntity {
+		apiError(w, http.StatusNotFound, "not_found", "リビジョンが見つかりません")
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "差分を求められませんでした")
+		return
+	}
+	apiJSON(c, w, http.StatusOK, map[string]interface{}{
+		"from": from,
+		"to": to,
+		"scenes": diff.Scenes,
+		"events": diff.Events,
+		"items": diff.Items,
+	})
+}
+
+/**
+ * API: ゲームの共同編集者の一覧を返す
+ * 所有者が呼び出した場合は有効な招待の一覧も返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiListCollaborators(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	model := NewModel(ctx.c)
+	result := map[string]interface{}{
+		"owner": collaboratorResource(&Collaborator{UserKey: ctx.Game.UserKey, Role: "owner"}, model.getUser(ctx.Game.UserKey)),
+	}
+	collaborators := make([]map[string]interface{}, 0)
+	for _, collaborator := range model.getCollaborators(ctx.GameKey) {
+		collaborators = append(collaborators, collaboratorResource(collaborator, model.getUser(collaborator.UserKey)))
+	}
+	result["collaborators"] = collaborators
+	if ctx.GameRole == "owner" {
+		invitations := make([]map[string]interface{}, 0)
+		for key, invitation := range model.getInvitations("GameKey", ctx.GameKey) {
+			invitations = append(invitations, invitationResource(key, invitation))
+		}
+		result["invitations"] = invitations
+	}
+	apiJSON(ctx.c, w, http.StatusOK, result)
+}
+
+/**
+ * API: ゲームにユーザを招待する
+ * target にハンドルまたはメールアドレス、role に権限を指定する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiInviteCollaborator(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params, err := apiParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", "JSON が不正です")
+		return
+	}
+	verr := invitationSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	key, invitation, err := model.inviteCollaborator(ctx.GameKey, ctx.UserKey, params["target"], params["role"])
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	sendInvitationMail(c, ctx.User, ctx.Game, key, invitation)
+	audit(c, r, ctx.UserKey, "invite_collaborator", fmt.Sprintf("ゲームキー: %s 招待キー: %s 権限: %s", ctx.GameKey, key, invitation.Role))
+	apiJSON(c, w, http.StatusCreated, invitationResource(key, invitation))
+}
+
+/**
+ * API: 共同編集者の権限を変更する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiUpdateCollaborator(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params, err := apiParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", "JSON が不正です")
+		return
+	}
+	verr := invitationSchema.validatePartial(map[string]string{"role": params["role"]})
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	userKey := pathParam(r, "user")
+	model := NewModel(c)
+	err = model.setCollaboratorRole(ctx.GameKey, userKey, params["role"])
+	if err != nil {
+		apiError(w, http.StatusNotFound, "not_found", "共同編集者が見つかりません")
+		return
+	}
+	audit(c, r, ctx.UserKey, "set_collaborator_role", fmt.Sprintf("ゲームキー: %s ユーザキー: %s 権限: %s", ctx.GameKey, userKey, params["role"]))
+	collaborator := &Collaborator{UserKey: userKey, Role: params["role"]}
+	apiJSON(c, w, http.StatusOK, collaboratorResource(collaborator, model.getUser(userKey)))
+}
+
+/**
+ * API: 共同編集者をゲームから外す
+ * 所有者は誰でも外せ、共同編集者は自分だけを外せる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiRemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	userKey := pathParam(r, "user")
+	if ctx.GameRole != "owner" && userKey != ctx.UserKey {
+		apiError(w, http.StatusForbidden, "forbidden", "共同編集者を外す権限がありません")
+		return
+	}
+	model := NewModel(c)
+	err := model.removeCollaborator(ctx.GameKey, userKey)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "not_found", "共同編集者が見つかりません")
+		return
+	}
+	audit(c, r, ctx.UserKey, "remove_collaborator", fmt.Sprintf("ゲームキー: %s ユーザキー: %s", ctx.GameKey, userKey))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * API: ゴミ箱のゲームの一覧を返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiListTrash(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	model := NewModel(ctx.c)
+	games := model.getTrashedGames(ctx.UserKey)
+	result := make([]map[string]interface{}, len(games))
+	for i, game := range games {
+		result[i] = gameResource(game.Key, game.Game)
+		result[i]["deleted"] = game.Deleted
+		result[i]["purge_at"] = game.PurgeAt()
+	}
+	apiJSON(ctx.c, w, http.StatusOK, result)
+}
+
+/**
+ * API: ゴミ箱のゲームを元に戻す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiRestoreGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	model := NewModel(ctx.c)
+	game, err := model.restoreGame(ctx.GameKey)
+	if err == ErrTrashExpired {
+		apiError(w, http.StatusGone, "trash_expired", err.Error())
+		return
+	} else if err != nil {
+		ctx.c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "ゲームを元に戻せませんでした")
+		return
+	}
+	apiJSON(ctx.c, w, http.StatusOK, gameResource(ctx.GameKey, game))
+}
+
+/**
+ * API: ゴミ箱のゲームを完全に削除する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiPurgeGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	model := NewModel(ctx.c)
+	err := model.purgeGame(ctx.GameKey)
+	if err != nil {
+		ctx.c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "ゲームを削除できませんでした")
+		return
+	}
+	audit(ctx.c, r, ctx.UserKey, "purge_game", fmt.Sprintf("ゲームキー: %s", ctx.GameKey))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * API: ゲームを複製する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiCloneGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	model := NewModel(c)
+	gameKey, game, err := model.cloneGame(ctx.GameKey, ctx.UserKey)
+	if err != nil {
+		c.Errorf(err.Error())
+		apiError(w, http.StatusInternalServerError, "internal_error", "ゲームを複製できませんでした")
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/games/%s", apiPrefix, gameKey))
+	apiJSON(c, w, http.StatusCreated, gameResource(gameKey, game))
+}
+
+/**
+ * API: ゲームの素材の一覧を返す
+ * 素材の中身は含めない
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiListAssets(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c, gameKey := ctx.c, ctx.GameKey
+	model := NewModel(c)
+
+	assets := make([]map[string]interface{}, 0)
+	for key, asset := range model.getAssets(gameKey) {
+		assets = append(assets, map[string]interface{}{
+			"key": key,
+			"name": asset.Name,
+			"content_type": asset.ContentType,
+			"size": len(asset.Data),
+			"date": asset.Date,
+		})
+	}
+	apiJSON(c, w, http.StatusOK, assets)
+}
+
+/**
+ * API: ゲームに素材をアップロードする
+ * multipart/form-data の file にファイルを入れて送信する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiUploadAsset(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c, userKey, gameKey := ctx.c, ctx.UserKey, ctx.GameKey
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_parameter", "file を指定してください")
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, assetMaxSize + 1))
+	check(c, err)
+	if len(data) > assetMaxSize {
+		apiError(w, http.StatusRequestEntityTooLarge, "too_large", "ファイルは900KB以下にしてください")
+		return
+	}
+
+	model := NewModel(c)
+	asset := new(Asset)
+	asset.GameKey = gameKey
+	asset.UserKey = userKey
+	asset.Name = header.Filename
+	asset.ContentType = http.DetectContentType(data)
+	asset.Data = data
+	assetKey := model.addAsset(asset)
+	apiJSON(c, w, http.StatusCreated, map[string]interface{}{
+		"key": assetKey,
+		"name": asset.Name,
+		"content_type": asset.ContentType,
+		"size": len(asset.Data),
+		"date": asset.Date,
+	})
+}
+
+/**
+ * API: ログインしてセッションを開始する
+ * mail と pass を送信し、二段階認証が必要なら続けて code を送信する
+ * ブラウザから呼び出すのでCSRFトークンを要求する (JSON の場合は X-CSRF-Token ヘッダで送信する)
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiCreateSession(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	params, err := apiParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", "JSON が不正です")
+		return
+	}
+	if !validCsrfToken(c, r) {
+		apiError(w, http.StatusForbidden, "invalid_csrf_token", "不正なリクエストです。ページを再読み込みしてからやり直してください")
+		return
+	}
+
+	var result int
+	var userKey string
+	var wait time.Duration
+	if _, ok := params["code"]; !ok {
+		verr := loginSchema.validate(params)
+		if verr != nil {
+			validationError(c, w, r, verr)
+			return
+		}
+	}
+	if code, ok := params["code"]; ok {
+		result, userKey, wait = tryLoginTotp(c, w, r, code)
+	} else {
+		result, userKey, wait = tryLogin(c, w, r, params["mail"], params["pass"])
+	}
+
+	switch result {
+	case loginSucceeded:
+		model := NewModel(c)
+		apiJSON(c, w, http.StatusCreated, map[string]interface{}{
+			"user": userResource(userKey, model.getUser(userKey), true),
+		})
+	case loginNeedsTotp:
+		apiJSON(c, w, http.StatusAccepted, map[string]interface{}{
+			"totp_required": true,
+		})
+	case loginThrottled:
+		seconds := int(wait.Seconds()) + 1
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+		apiError(w, http.StatusTooManyRequests, "too_many_attempts", fmt.Sprintf("ログインの試行回数が多すぎます。%d秒後に再度お試しください", seconds))
+	case loginExpired:
+		apiError(w, http.StatusUnauthorized, "login_expired", "時間切れです。もう一度ログインしてください")
+	default:
+		apiError(w, http.StatusUnauthorized, "invalid_credentials", "認証情報が間違っています")
+	}
+}
+
+/**
+ * API: 現在のセッションを返す
+ * 状態を変更する API を呼び出すためのCSRFトークンも返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiGetSession(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c, userKey, user := ctx.c, ctx.UserKey, ctx.User
+	if ctx.APIToken != nil {
+		apiError(w, http.StatusBadRequest, "session_required", "セッションで認証していません")
+		return
+	}
+	apiJSON(c, w, http.StatusOK, map[string]interface{}{
+		"user": userResource(userKey, user, true),
+		"csrf_token": csrfToken(c, w, r),
+	})
+}
+
+/**
+ * API: ログアウトする
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func apiDeleteSession(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	if ctx.APIToken != nil {
+		apiError(w, http.StatusBadRequest, "session_required", "セッションで認証していません")
+		return
+	}
+	closeSession(c, w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,235 @@
+/**
+ * 権限によるアクセス制御
+ * URL ごとに必要な権限を決めて、権限の無いアクセスを拒否して監査ログに残す
+ * @file
+ */
+package escape3ds
+
+import (
+	"appengine"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/**
+ * リクエストしたユーザを取得する
+ * ログインしていない場合は空文字と nil を返す
+ * セッションが残っていても、削除されたユーザや退会を申請中のユーザは apiAuth と同じくログインしていないものとして扱う
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*http.Request} r リクエスト
+ * @returns {string} エンコード済みのユーザキー
+ * @returns {*User} ユーザ
+ */
+func getSessionUser(c appengine.Context, r *http.Request) (string, *User) {
+	sessionId := getSession(c, r)
+	if sessionId == "" {
+		return "", nil
+	}
+	model := NewModel(c)
+	userKey := model.getUserKeyFromSession(sessionId)
+	if userKey == "" {
+		return "", nil
+	}
+	user := model.getUser(userKey)
+	if user.Type == "" || !user.DeleteAt.IsZero() {
+		return "", nil
+	}
+	return userKey, user
+}
+
+/**
+ * Ajax によるリクエストかどうか調べる
+ * @function
+ * @param {*http.Request} r リクエスト
+ * @returns {bool} Ajax ならtrue
+ */
+func isAjax(r *http.Request) bool {
+	return r.Header.Get("X-Requested-With") == "XMLHttpRequest" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+/**
+ * リクエストの内容を監査ログに残す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*http.Request} r リクエスト
+ * @param {string} userKey 操作したユーザのキー
+ * @param {string} action 出来事の種類
+ * @param {string} detail 詳細
+ */
+func audit(c appengine.Context, r *http.Request, userKey string, action string, detail string) {
+	log := new(AuditLog)
+	log.UserKey = userKey
+	log.Action = action
+	log.Method = r.Method
+	log.Path = r.URL.Path
+	log.IP = r.RemoteAddr
+	log.Detail = detail
+	NewModel(c).addAuditLog(log)
+}
+
+/**
+ * アクセスを拒否する
+ * Ajax なら 403 の JSON を、それ以外ならメッセージページを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {string} message 利用者に表示するメッセージ
+ */
+func forbidden(c appengine.Context, w http.ResponseWriter, r *http.Request, message string) {
+	if isAjax(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"result":false, "error":"forbidden", "message":"%s"}`, message)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+	view := NewView(c, w, r)
+	view.message("アクセスできません", message)
+}
+
+/**
+ * 権限を要求するミドルウェア
+ * ログインしたユーザが role 以上の権限を持っていなければ拒否して監査ログに残す
+ * 許可したユーザは requestContext(r) の UserKey と User で取り出せる
+ * @function
+ * @param {string} role 必要な権限
+ * @param {http.HandlerFunc} handler 保護する処理
+ * @returns {http.HandlerFunc} 権限を検証してから handler を呼び出す処理
+ */
+func requireRole(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		c := ctx.c
+		userKey, user := ctx.getSessionUser(r)
+		if user == nil {
+			audit(c, r, "", "forbidden", fmt.Sprintf("未ログインのアクセス 必要な権限: %s", role))
+			forbidden(c, w, r, "ログインしてください")
+			return
+		}
+		if !user.hasRole(role) {
+			audit(c, r, userKey, "forbidden", fmt.Sprintf("権限: %s 必要な権限: %s", user.Role, role))
+			forbidden(c, w, r, "このページを表示する権限がありません")
+			return
+		}
+		ctx.UserKey = userKey
+		ctx.User = user
+		handler(w, r)
+	}
+}
+
+/**
+ * cron からの呼び出しのみ許可するミドルウェア
+ * App Engine は外部からのリクエストの X-AppEngine-Cron ヘッダを取り除くので、
+ * このヘッダがあれば cron からの呼び出しとみなせる
+ * @function
+ * @param {http.HandlerFunc} handler 保護する処理
+ * @returns {http.HandlerFunc} 呼び出し元を検証してから handler を呼び出す処理
+ */
+func cronOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-AppEngine-Cron") != "true" {
+			c := appengine.NewContext(r)
+			audit(c, r, "", "forbidden", "cron 以外からの呼び出し")
+			forbidden(c, w, r, "このページを表示する権限がありません")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+/**
+ * Authorization ヘッダから Bearer トークンを取り出す
+ * @function
+ * @param {*http.Request} r リクエスト
+ * @returns {string} トークン、無ければ空文字
+ */
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+/**
+ * API を呼び出したユーザを取得する
+ * Bearer トークンがあればトークンの所有者を、無ければセッションのユーザを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*http.Request} r リクエスト
+ * @returns {string} エンコード済みのユーザキー
+ * @returns {*User} ユーザ、認証できなければ nil
+ * @returns {*APIToken} 使われたトークン、セッションで認証した場合は nil
+ */
+func apiUser(c appengine.Context, r *http.Request) (string, *User, *APIToken) {
+	token := bearerToken(r)
+	if token == "" {
+		userKey, user := getSessionUser(c, r)
+		return userKey, user, nil
+	}
+	model := NewModel(c)
+	apiToken := model.getAPIToken(token)
+	if apiToken == nil {
+		return "", nil, nil
+	}
+	return apiToken.UserKey, model.getUser(apiToken.UserKey), apiToken
+}
+
+/**
+ * 権限ごとに必要なユーザの権限
+ * @const
+ */
+var apiScopeRoles = map[string]string{
+	"read_games": "player",
+	"write_games": "author",
+	"upload_assets": "author",
+}
+
+/**
+ * API の認証を行うミドルウェア
+ * Bearer トークンなら scope が与えられているか調べる
+ * セッションで認証する場合はすべての権限を持つが、状態を変更するリクエストにはCSRFトークンを要求する
+ * 認証したユーザは requestContext(r) の UserKey、User、APIToken で取り出せる
+ * @function
+ * @param {string} scope 必要な権限、空文字なら認証だけを行う
+ * @param {http.HandlerFunc} handler 保護する処理
+ * @returns {http.HandlerFunc} 認証してから handler を呼び出す処理
+ */
+func apiAuth(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(r)
+		c := ctx.c
+		userKey, user, apiToken := ctx.getAPIUser(r)
+		if user == nil || user.Type == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="escape3ds"`)
+			apiError(w, http.StatusUnauthorized, "unauthorized", "認証が必要です")
+			return
+		}
+		if !user.DeleteAt.IsZero() {
+			apiError(w, http.StatusForbidden, "account_deleted", "退会を申請しているアカウントです")
+			return
+		}
+		if scope != "" && apiToken != nil && !apiToken.hasScope(scope) {
+			audit(c, r, userKey, "forbidden", fmt.Sprintf("トークン: %s 必要な権限: %s", apiToken.Name, scope))
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="escape3ds", error="insufficient_scope", scope="%s"`, scope))
+			apiError(w, http.StatusForbidden, "insufficient_scope", "トークンに権限がありません")
+			return
+		}
+		if apiToken == nil && !isSafeMethod(r.Method) && !validCsrfToken(c, r) {
+			apiError(w, http.StatusForbidden, "invalid_csrf_token", "不正なリクエストです。ページを再読み込みしてからやり直してください")
+			return
+		}
+		if scope != "" && !user.hasRole(apiScopeRoles[scope]) {
+			audit(c, r, userKey, "forbidden", fmt.Sprintf("権限: %s 必要な権限: %s", user.Role, apiScopeRoles[scope]))
+			apiError(w, http.StatusForbidden, "forbidden", "この操作を行う権限がありません")
+			return
+		}
+		ctx.UserKey = userKey
+		ctx.User = user
+		ctx.APIToken = apiToken
+		handler(w, r)
+	}
+}
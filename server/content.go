@@ -0,0 +1,326 @@
+/**
+ * ゲームの内容 (シーン、イベント、アイテム)
+ * 内容は JSON で保存し、サーバはシーン、イベント、アイテムの ID だけを解釈する
+ * それ以外の項目はエディタが自由に持てる
+ * {
+ *     "scenes": [{"id": "...", "events": [{"id": "...", ...}], ...}],
+ *     "items": [{"id": "...", ...}]
+ * }
+ * @file
+ */
+package escape3ds
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/**
+ * ゲームの内容の最大のバイト数 (JSON)
+ * エンティティの上限に収まるようにする
+ * @const
+ */
+const gameContentMaxLength = 500000
+
+/**
+ * 空のゲームの内容
+ * @const
+ */
+const emptyGameContent = `{"scenes":[],"items":[]}`
+
+/**
+ * シーン、イベント、アイテムの ID の形式
+ * @var
+ */
+var contentIdPattern = regexp.MustCompile("^[A-Za-z0-9_-]{1,100}$")
+
+/**
+ * ID を持つ要素
+ * @struct
+ * @property {string} Id ID
+ * @property {map[string]json.RawMessage} Fields ID と子要素を含むすべての項目
+ */
+type contentNode struct {
+	Id string
+	Fields map[string]json.RawMessage
+}
+
+/**
+ * シーン
+ * @struct
+ * @property {[]contentNode} Events シーンのイベント
+ */
+type contentScene struct {
+	contentNode
+	Events []contentNode
+}
+
+/**
+ * 解釈したゲームの内容
+ * @struct
+ * @property {[]contentScene} Scenes シーン
+ * @property {[]contentNode} Items アイテム
+ */
+type gameContent struct {
+	Scenes []contentScene
+	Items []contentNode
+}
+
+/**
+ * ゲームの内容を解釈する
+ * 空文字は空のゲームとみなす
+ * @function
+ * @param {string} data ゲームの内容 (JSON)
+ * @returns {*gameContent} 解釈した内容
+ * @returns {error} 形式が正しくなければエラー
+ */
+func parseGameContent(data string) (*gameContent, error) {
+	if data == "" {
+		data = emptyGameContent
+	}
+	if len(data) > gameContentMaxLength {
+		return nil, fmt.Errorf("ゲームの内容は%dバイト以内にしてください", gameContentMaxLength)
+	}
+	var root struct {
+		Scenes []map[string]json.RawMessage `json:"scenes"`
+		Items []map[string]json.RawMessage `json:"items"`
+	}
+	var object map[string]json.RawMessage
+	if json.Unmarshal([]byte(data), &object) != nil || object == nil || json.Unmarshal([]byte(data), &root) != nil {
+		return nil, errors.New("ゲームの内容は scenes と items の配列を持つ JSON のオブジェクトで指定してください")
+	}
+
+	content := &gameContent{
+		Scenes: make([]contentScene, 0, len(root.Scenes)),
+		Items: make([]contentNode, 0, len(root.Items)),
+	}
+	sceneIds := make(map[string]bool)
+	for _, fields := range root.Scenes {
+		node, err := newContentNode("シーン", fields, sceneIds)
+		if err != nil {
+			return nil, err
+		}
+		scene := contentScene{contentNode: node, Events: make([]contentNode, 0)}
+		if raw, ok := fields["events"]; ok {
+			events := make([]map[string]json.RawMessage, 0)
+			if json.Unmarshal(raw, &events) != nil {
+				return nil, fmt.Errorf("シーン %s の events はオブジェクトの配列で指定してください", node.Id)
+			}
+			eventIds := make(map[string]bool)
+			for _, eventFields := range events {
+				event, err := newContentNode("イベント", eventFields, eventIds)
+				if err != nil {
+					return nil, err
+				}
+				scene.Events = append(scene.Events, event)
+			}
+		}
+		content.Scenes = append(content.Scenes, scene)
+	}
+	itemIds := make(map[string]bool)
+	for _, fields := range root.Items {
+		node, err := newContentNode("アイテム", fields, itemIds)
+		if err != nil {
+			return nil, err
+		}
+		content.Items = append(content.Items, node)
+	}
+	return content, nil
+}
+
+/**
+ * 要素の ID を取り出す
+ * ID は ids の中で重複してはいけない
+ * @function
+ * @param {string} label 要素の名前 (エラーメッセージ用)
+ * @param {map[string]json.RawMessage} fields 要素の項目
+ * @param {map[string]bool} ids 既に使われている ID、取り出した ID を追加する
+ * @returns {contentNode} 要素
+ * @returns {error} ID が無いか不正か重複していればエラー
+ */
+func newContentNode(label string, fields map[string]json.RawMessage, ids map[string]bool) (contentNode, error) {
+	var id string
+	if fields == nil || json.Unmarshal(fields["id"], &id) != nil || !contentIdPattern.MatchString(id) {
+		return contentNode{}, fmt.Errorf("%sの id には英数字、ハイフン、アンダースコアで100文字以内の文字列を指定してください", label)
+	}
+	if ids[id] {
+		return contentNode{}, fmt.Errorf("%sの id が重複しています: %s", label, id)
+	}
+	ids[id] = true
+	return contentNode{id, fields}, nil
+}
+
+/**
+ * ゲームの内容を検証する
+ * @function
+ * @param {string} data ゲームの内容 (JSON)
+ * @returns {error} エラー
+ */
+func validateGameContent(data string) error {
+	_, err := parseGameContent(data)
+	return err
+}
+
+/**
+ * ゲームの内容の空白を取り除く
+ * 空文字は空のゲームにする
+ * @function
+ * @param {string} data 検証済みのゲームの内容 (JSON)
+ * @returns {string} 空白を取り除いた内容
+ */
+func compactGameContent(data string) string {
+	if data == "" {
+		return emptyGameContent
+	}
+	compact := new(bytes.Buffer)
+	if json.Compact(compact, []byte(data)) != nil {
+		return data
+	}
+	return compact.String()
+}
+
+/**
+ * 要素の子要素以外の項目を比較できる形にする
+ * オブジェクトのキーを並べ替えるので、項目の順が違うだけなら同じになる
+ * @method
+ * @memberof contentNode
+ * @param {string} children 比較から除く子要素の項目名、無ければ空文字
+ * @returns {string} 正規化した JSON
+ */
+func (this contentNode) canonical(children string) string {
+	values := make(map[string]interface{}, len(this.Fields))
+	for name, raw := range this.Fields {
+		if name == children {
+			continue
+		}
+		var value interface{}
+		json.Unmarshal(raw, &value)
+		values[name] = value
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+/**
+ * 追加、削除、変更された要素の ID
+ * @struct
+ */
+type contentChanges struct {
+	Added []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+/**
+ * ゲームの内容の差分
+ * イベントの ID は "シーンID/イベントID" で表す
+ * @struct
+ */
+type gameContentDiff struct {
+	Scenes contentChanges `json:"scenes"`
+	Events contentChanges `json:"events"`
+	Items contentChanges `json:"items"`
+}
+
+/**
+ * 2つの要素の一覧を ID で突き合わせて差分を求める
+ * 並び順の違いは変更とみなさない
+ * @function
+ * @param {map[string]string} from 変更前の ID と正規化した内容の対応表
+ * @param {map[string]string} to 変更後の ID と正規化した内容の対応表
+ * @returns {contentChanges} 差分 (ID の昇順)
+ */
+func diffContentNodes(from map[string]string, to map[string]string) contentChanges {
+	changes := contentChanges{make([]string, 0), make([]string, 0), make([]string, 0)}
+	for id, value := range to {
+		old, ok := from[id]
+		if !ok {
+			changes.Added = append(changes.Added, id)
+		} else if old != value {
+			changes.Changed = append(changes.Changed, id)
+		}
+	}
+	for id := range from {
+		if _, ok := to[id]; !ok {
+			changes.Removed = append(changes.Removed, id)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+	return changes
+}
+
+/**
+ * 比較のためにシーン、イベント、アイテムを ID と正規化した内容の対応表にする
+ * シーンの内容にはイベントを含めない
+ * @method
+ * @memberof gameContent
+ * @returns {map[string]string} シーン
+ * @returns {map[string]string} イベント ("シーンID/イベントID" がキー)
+ * @returns {map[string]string} アイテム
+ */
+func (this *gameContent) index() (map[string]string, map[string]string, map[string]string) {
+	scenes := make(map[string]string, len(this.Scenes))
+	events := make(map[string]string)
+	items := make(map[string]string, len(this.Items))
+	for _, scene := range this.Scenes {
+		scenes[scene.Id] = scene.canonical("events")
+		for _, event := range scene.Events {
+			events[scene.Id + "/" + event.Id] = event.canonical("")
+		}
+	}
+	for _, item := range this.Items {
+		items[item.Id] = item.canonical("")
+	}
+	return scenes, events, items
+}
+
+/**
+ * ゲームの内容の構造的な差分を求める
+ * @function
+ * @param {*gameContent} from 変更前の内容
+ * @param {*gameContent} to 変更後の内容
+ * @returns {*gameContentDiff} 差分
+ */
+func diffGameContent(from *gameContent, to *gameContent) *gameContentDiff {
+	fromScenes, fromEvents, fromItems := from.index()
+	toScenes, toEvents, toItems := to.index()
+	return &gameContentDiff{
+		Scenes: diffContentNodes(fromScenes, toScenes),
+		Events: diffContentNodes(fromEvents, toEvents),
+		Items: diffContentNodes(fromItems, toItems),
+	}
+}
+
+/**
+ * 差分に関わるシーンの ID を返す
+ * シーン自体の追加、削除、変更と、イベントの追加、削除、変更があったシーンを含む
+ * @method
+ * @memberof gameContentDiff
+ * @returns {[]string} シーンの ID (昇順)
+ */
+func (this *gameContentDiff) touchedScenes() []string {
+	touched := make(map[string]bool)
+	for _, ids := range [][]string{this.Scenes.Added, this.Scenes.Removed, this.Scenes.Changed} {
+		for _, id := range ids {
+			touched[id] = true
+		}
+	}
+	for _, ids := range [][]string{this.Events.Added, this.Events.Removed, this.Events.Changed} {
+		for _, id := range ids {
+			touched[strings.SplitN(id, "/", 2)[0]] = true
+		}
+	}
+	result := make([]string, 0, len(touched))
+	for id := range touched {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,137 @@
+package escape3ds
+
+import (
+	"reflect"
+	"testing"
+)
+
+/**
+ * 差分の元にするゲームの内容
+ * @const
+ */
+const diffBaseContent = `{
+	"scenes": [
+		{"id": "hall", "name": "広間", "events": [{"id": "door", "type": "move"}, {"id": "clock", "type": "look"}]},
+		{"id": "cellar", "name": "地下室", "events": []}
+	],
+	"items": [{"id": "key", "name": "鍵"}]
+}`
+
+/**
+ * シーン、イベント、アイテムの追加、削除、変更の差分と、差分に関わるシーン
+ */
+func TestDiffGameContent(t *testing.T) {
+	cases := []struct {
+		name string
+		to string
+		scenes contentChanges
+		events contentChanges
+		items contentChanges
+		touched []string
+	}{
+		{
+			name: "変更なし (項目と要素の順だけが違う)",
+			to: `{"items": [{"name": "鍵", "id": "key"}], "scenes": [
+				{"id": "cellar", "events": [], "name": "地下室"},
+				{"name": "広間", "id": "hall", "events": [{"id": "clock", "type": "look"}, {"type": "move", "id": "door"}]}
+			]}`,
+			touched: []string{},
+		},
+		{
+			name: "シーンの追加",
+			to: `{"scenes": [
+				{"id": "hall", "name": "広間", "events": [{"id": "door", "type": "move"}, {"id": "clock", "type": "look"}]},
+				{"id": "cellar", "name": "地下室", "events": []},
+				{"id": "attic", "name": "屋根裏", "events": [{"id": "box", "type": "look"}]}
+			], "items": [{"id": "key", "name": "鍵"}]}`,
+			scenes: contentChanges{Added: []string{"attic"}},
+			events: contentChanges{Added: []string{"attic/box"}},
+			touched: []string{"attic"},
+		},
+		{
+			name: "シーンの削除",
+			to: `{"scenes": [
+				{"id": "cellar", "name": "地下室", "events": []}
+			], "items": [{"id": "key", "name": "鍵"}]}`,
+			scenes: contentChanges{Removed: []string{"hall"}},
+			events: contentChanges{Removed: []string{"hall/clock", "hall/door"}},
+			touched: []string{"hall"},
+		},
+		{
+			name: "シーンの変更",
+			to: `{"scenes": [
+				{"id": "hall", "name": "大広間", "events": [{"id": "door", "type": "move"}, {"id": "clock", "type": "look"}]},
+				{"id": "cellar", "name": "地下室", "events": []}
+			], "items": [{"id": "key", "name": "鍵"}]}`,
+			scenes: contentChanges{Changed: []string{"hall"}},
+			touched: []string{"hall"},
+		},
+		{
+			name: "イベントだけの変更",
+			to: `{"scenes": [
+				{"id": "hall", "name": "広間", "events": [{"id": "door", "type": "open"}, {"id": "clock", "type": "look"}]},
+				{"id": "cellar", "name": "地下室", "events": [{"id": "torch", "type": "take"}]}
+			], "items": [{"id": "key", "name": "鍵"}]}`,
+			events: contentChanges{Added: []string{"cellar/torch"}, Changed: []string{"hall/door"}},
+			touched: []string{"cellar", "hall"},
+		},
+		{
+			name: "イベントだけの削除",
+			to: `{"scenes": [
+				{"id": "hall", "name": "広間", "events": [{"id": "door", "type": "move"}]},
+				{"id": "cellar", "name": "地下室", "events": []}
+			], "items": [{"id": "key", "name": "鍵"}]}`,
+			events: contentChanges{Removed: []string{"hall/clock"}},
+			touched: []string{"hall"},
+		},
+		{
+			name: "アイテムだけの変更はシーンに関わらない",
+			to: `{"scenes": [
+				{"id": "hall", "name": "広間", "events": [{"id": "door", "type": "move"}, {"id": "clock", "type": "look"}]},
+				{"id": "cellar", "name": "地下室", "events": []}
+			], "items": [{"id": "key", "name": "錆びた鍵"}, {"id": "map", "name": "地図"}]}`,
+			items: contentChanges{Added: []string{"map"}, Changed: []string{"key"}},
+			touched: []string{},
+		},
+	}
+
+	from, err := parseGameContent(diffBaseContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		to, err := parseGameContent(c.to)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err.Error())
+		}
+		diff := diffGameContent(from, to)
+		expected := map[string][2]contentChanges{
+			"scenes": {normalizeChanges(c.scenes), diff.Scenes},
+			"events": {normalizeChanges(c.events), diff.Events},
+			"items": {normalizeChanges(c.items), diff.Items},
+		}
+		for kind, pair := range expected {
+			if !reflect.DeepEqual(pair[0], pair[1]) {
+				t.Errorf("%s: %s = %+v, want %+v", c.name, kind, pair[1], pair[0])
+			}
+		}
+		if touched := diff.touchedScenes(); !reflect.DeepEqual(touched, c.touched) {
+			t.Errorf("%s: touchedScenes() = %v, want %v", c.name, touched, c.touched)
+		}
+	}
+}
+
+/**
+ * 期待値の nil を diffContentNodes が返す空の配列にそろえる
+ * @function
+ * @param {contentChanges} changes 期待値
+ * @returns {contentChanges} 空の配列にそろえた期待値
+ */
+func normalizeChanges(changes contentChanges) contentChanges {
+	for _, ids := range []*[]string{&changes.Added, &changes.Removed, &changes.Changed} {
+		if *ids == nil {
+			*ids = make([]string, 0)
+		}
+	}
+	return changes
+}
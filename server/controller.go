@@ -8,12 +8,31 @@ package escape3ds
 
 import (
 	"net/http"
-	"net/url"
 	"appengine"
+	appengineuser "appengine/user"
+	"appengine/datastore"
 	"fmt"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
 )
 
+/**
+ * 送信元のメールアドレス
+ * @const
+ */
+const mailSender = "infomation@escape-3ds.appspotmail.com"
+
+/**
+ * サイトのURL
+ * コールバックURLやメール中のリンクに使う
+ * @const
+ */
+const siteUrl = "http://escape-3ds.appspot.com"
+
 /**
  * ログインページの表示
  * @param {http.ResponseWriter} w 応答先
@@ -21,10 +40,10 @@ import (
  */
 func top(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	view := NewView(c, w)
-	sessionId := getSession(c, r)
+	view := NewView(c, w, r)
+	userKey, _ := getSessionUser(c, r)
 
-	if sessionId != "" {
+	if userKey != "" {
 		http.Redirect(w, r, "/gamelist", 302)
 	} else {
 		view.login()
@@ -38,158 +57,426 @@ func top(w http.ResponseWriter, r *http.Request) {
  */
 func loginTwitter(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	oauth := NewOAuth1(c, fmt.Sprintf("http://escape-3ds.appspot.com/callback_twitter"))
-	result := oauth.requestToken("https://api.twitter.com/oauth/request_token")
-	oauth.authenticate(w, r, "https://api.twitter.com/oauth/authenticate", result["oauth_token"])
+	oauth := NewOAuth1(c)
+	result, err := oauth.requestToken("https://api.twitter.com/oauth/request_token", fmt.Sprintf("%s/callback_twitter", siteUrl))
+	if err != nil {
+		c.Errorf(err.Error())
+		view := NewView(c, w, r)
+		view.message("ログイン", "Twitter に接続できませんでした")
+		return
+	}
+
+	// アクセストークンとの交換に使うのでシークレットを保存しておく
+	// コールバックが同じブラウザからか確かめるためにトークンをクッキーにも保存する
+	model := NewModel(c)
+	model.setRequestTokenSecret(result.Get("oauth_token"), result.Get("oauth_token_secret"), getSession(c, r))
+	http.SetCookie(w, NewCookie(oauth1TokenCookieName, result.Get("oauth_token"), "localhost", "/", 1))
+	oauth.authenticate(w, r, "https://api.twitter.com/oauth/authenticate", result.Get("oauth_token"))
 }
 
 /**
- * Twitter からのコールバック * @param {http.ResponseWriter} w 応答先
+ * Twitter からのコールバック
+ * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
  */
 func callbackTwitter(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	token := r.FormValue("oauth_token")
 	verifier := r.FormValue("oauth_verifier")
-	
-	oauth := NewOAuth1(c, "http://escape-3ds.appspotcom/callback_twitter")
-	result := oauth.exchangeToken(token, verifier, "https://api.twitter.com/oauth/access_token")
-	
-	view := NewView(c, w)
+	view := NewView(c, w, r)
+
+	// このブラウザで開始していない認証は受け付けない
+	cookie, err := r.Cookie(oauth1TokenCookieName)
+	if err != nil || token == "" || cookie.Value != token {
+		c.Warningf("リクエストトークン: %s がクッキーと一致しません", token)
+		view.message("ログイン", "ログインに失敗しました。もう一度やり直してください")
+		return
+	}
+	http.SetCookie(w, NewCookie(oauth1TokenCookieName, "", "localhost", "/", -1))
+
+	// 自分が発行を要求していないリクエストトークンは受け付けない
 	model := NewModel(c)
-	
-	if result["oauth_token"] != "" {
-		// ログイン成功
-		key := ""
-		if model.existOAuthUser("Twitter", result["user_id"]) {
-			// 既存ユーザ
-			params := make(map[string]string, 2)
-			params["Type"] = "Twitter"
-			params["OAuthId"] = result["user_id"]
-			key = model.getUserKey(params)
+	state := model.popRequestTokenSecret(token)
+	if state == nil {
+		c.Warningf("不明なリクエストトークン: %s でコールバックされました", token)
+		view.message("ログイン", "ログインに失敗しました。もう一度やり直してください")
+		return
+	}
+
+	oauth := NewOAuth1(c)
+	result, err := oauth.exchangeToken("https://api.twitter.com/oauth/access_token", token, state.Secret, verifier)
+	if err != nil || result.Get("oauth_token") == "" {
+		// ログイン失敗
+		if err != nil {
+			c.Errorf(err.Error())
+		}
+		view.message("ログイン", "ログインに失敗しました")
+		return
+	}
+
+	// ログイン成功
+	// 署名付きでAPIを呼び出せるようにアクセストークンも渡す
+	oauthLogin(c, w, r, "Twitter", result.Get("user_id"), result.Get("screen_name"), result.Get("oauth_token"), result.Get("oauth_token_secret"), state.SessionId)
+}
+
+/**
+ * OAuth 2.0 のサービスでログイン
+ * 認可ページへリダイレクトする処理を返す
+ * @function
+ * @param {*OAuth2Provider} provider サービスプロバイダ
+ * @returns {http.HandlerFunc} ログイン処理
+ */
+func loginOAuth2(provider *OAuth2Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+		if !provider.enabled() {
+			c.Warningf("%s のクライアントIDが設定されていません", provider.Name)
+			http.NotFound(w, r)
+			return
+		}
+		oauth := NewOAuth2(c, provider)
+		oauth.requestAuthorizationCode(w, r)
+	}
+}
+
+/**
+ * OAuth 2.0 のサービスからのコールバック
+ * state を検証してから認証コードをアクセストークンに交換し、ユーザ情報でログインする処理を返す
+ * @function
+ * @param {*OAuth2Provider} provider サービスプロバイダ
+ * @returns {http.HandlerFunc} コールバック処理
+ */
+func callbackOAuth2(provider *OAuth2Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+		view := NewView(c, w, r)
+		oauth := NewOAuth2(c, provider)
+
+		state, err := oauth.verifyState(w, r)
+		if err != nil {
+			c.Warningf("%s の state が不正です: %s", provider.Name, err.Error())
+			view.message("ログイン", "ログインに失敗しました。もう一度やり直してください")
+			return
+		}
+		if r.FormValue("error") != "" {
+			c.Infof("%s の認可が拒否されました: %s", provider.Name, r.FormValue("error"))
+			view.message("ログイン", "ログインがキャンセルされました")
+			return
+		}
+
+		token, err := oauth.requestAccessToken(r.FormValue("code"), state.Verifier)
+		if err != nil {
+			c.Errorf(err.Error())
+			view.message("ログイン", "ログインに失敗しました")
+			return
+		}
+		userInfo, err := oauth.requestUserInfo(token)
+		if err != nil {
+			c.Errorf(err.Error())
+			view.message("ログイン", "ログインに失敗しました")
+			return
+		}
+
+		oauthLogin(c, w, r, provider.Name, userInfo["oauth_id"], userInfo["name"], token.AccessToken, "", state.SessionId)
+	}
+}
+
+/**
+ * 外部サービスのアカウントでログインする
+ * 未ログインなら連携されているユーザでログインし、連携されていなければユーザを新規作成する
+ * ログイン済みなら現在のユーザにアカウントを連携するか確認する
+ * 別のユーザに連携済みのアカウントだった場合はユーザの統合を確認する
+ * 他人が開始した認証のコールバックを踏まされて連携されないように、認証を開始したセッションでなければ連携しない
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {string} provider サービス名 "Twitter" または OAuth2Provider.Name
+ * @param {string} oauthId サービスが決めたユーザID
+ * @param {string} name サービス上の名前
+ * @param {string} token アクセストークン
+ * @param {string} tokenSecret アクセストークンのシークレット、OAuth 2.0 では空文字
+ * @param {string} startedSession 認証を開始したセッションID、未ログインで開始したなら空文字
+ */
+func oauthLogin(c appengine.Context, w http.ResponseWriter, r *http.Request, provider string, oauthId string, name string, token string, tokenSecret string, startedSession string) {
+	model := NewModel(c)
+	view := NewView(c, w, r)
+	ownerKey := model.getIdentityOwner(provider, oauthId)
+
+	// ログイン済みならアカウントを連携する
+	userKey, user := getSessionUser(c, r)
+	if userKey != "" {
+		sessionId := getSession(c, r)
+		if startedSession != sessionId {
+			c.Warningf("%s の認証を開始したセッションと一致しません。ユーザキー：%s", provider, userKey)
+			view.message("アカウント連携", "アカウントの連携に失敗しました。もう一度やり直してください")
+			return
+		}
+		if ownerKey == userKey {
+			check(c, model.setIdentityToken(provider, oauthId, token, tokenSecret))
+			view.message("アカウント連携", fmt.Sprintf("%s のアカウントは既に連携されています", provider))
+		} else if ownerKey != "" {
+			model.setPendingMerge(sessionId, ownerKey)
+			view.mergeAccount(model.getUser(ownerKey), user)
 		} else {
-			// 新規ユーザ
-			params := make(map[string]string, 4)
-			params["user_type"] = "Twitter"
-			params["user_name"] = result["screen_name"]
-			params["user_oauth_id"] = result["user_id"]
-			params["user_pass"] = ""
-			user := model.NewUser(params)
-			key = model.addUser(user)
+			link := new(PendingLink)
+			link.Provider = provider
+			link.OAuthId = oauthId
+			link.Name = name
+			link.AccessToken = token
+			link.AccessTokenSecret = tokenSecret
+			model.setPendingLink(sessionId, link)
+			view.confirm("アカウント連携", fmt.Sprintf("%s のアカウント「%s」を「%s」に連携しますか？", provider, name, user.Name), "/link_identity", "")
 		}
-		if getSession(c, r) == "" {
-			startSession(w, r, key)
+		return
+	}
+
+	if ownerKey == "" {
+		// 新規ユーザ
+		params := make(map[string]string, 4)
+		params["user_type"] = provider
+		params["user_name"] = name
+		params["user_oauth_id"] = oauthId
+		params["user_pass"] = ""
+		user := model.NewUser(params)
+		key, err := model.addOAuthUser(user)
+		if err != nil {
+			c.Errorf(err.Error())
+			view.message("ログイン", "ログインに失敗しました")
+			return
 		}
-		view.editor(key)
-	} else {
-		// ログイン失敗
-		view.login()
-		fmt.Fprintf(w, "ログインに失敗しました")
+		ownerKey = key
 	}
+
+	check(c, model.setIdentityToken(provider, oauthId, token, tokenSecret))
+	startSession(w, r, ownerKey)
+	http.Redirect(w, r, "/gamelist", 302)
 }
 
 /**
- * Facebook でログイン
+ * 確認ページで確定された外部サービスのアカウントを連携する
+ * 連携するのは直前にこのセッションで認証したアカウントのみ
+ * @function
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
  */
-func loginFacebook(w http.ResponseWriter, r *http.Request) {
+func linkIdentity(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	oauth := NewOAuth2(c, config["facebook_client_id"], config["facebook_client_secret"])
-	oauth.requestAuthorizationCode(w, r, "https://www.facebook.com/dialog/oauth", url.QueryEscape("http://escape-3ds.appspot.com/callback_facebook"))
+	userKey, _ := getSessionUser(c, r)
+
+	model := NewModel(c)
+	view := NewView(c, w, r)
+	link := model.popPendingLink(getSession(c, r))
+	if link == nil {
+		view.message("アカウント連携", "連携の有効期限が切れています。もう一度アカウントを連携してください")
+		return
+	}
+
+	err := model.linkIdentity(userKey, link.Provider, link.OAuthId, link.Name)
+	if err != nil {
+		c.Errorf(err.Error())
+		view.message("アカウント連携", "アカウントの連携に失敗しました")
+		return
+	}
+	check(c, model.setIdentityToken(link.Provider, link.OAuthId, link.AccessToken, link.AccessTokenSecret))
+	audit(c, r, userKey, "link_identity", fmt.Sprintf("%s: %s", link.Provider, link.OAuthId))
+	view.message("アカウント連携", fmt.Sprintf("%s のアカウントを連携しました", link.Provider))
 }
 
 /**
- * Facebook へアクセストークンを要求する
- * この関数は Facebook から認証コードをリダイレクトで渡された時に呼ばれる
+ * 外部サービスのアカウントの連携を解除する
+ * @function
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
- * @returns {map[string]string} ユーザ情報
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
  */
-func requestFacebookToken(w http.ResponseWriter, r *http.Request) map[string]string {
+func unlinkIdentity(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	code := r.FormValue("code")
-	oauth := NewOAuth2(c, config["facebook_client_id"], config["facebook_client_secret"])
-	token := oauth.requestAccessToken(w, r, "https://graph.facebook.com/oauth/access_token", url.QueryEscape("http://escape-3ds.appspot.com/callback_facebook"), code)
-	response := oauth.requestAPI(w, "https://graph.facebook.com/me", token)
-	
-	// JSON を解析
-	type UserInfo struct {
-		Id string `json:"id"`
-		Name string `json:"name"`
+	userKey, _ := getSessionUser(c, r)
+	provider := r.FormValue("provider")
+	oauthId := r.FormValue("oauth_id")
+
+	model := NewModel(c)
+	err := model.unlinkIdentity(userKey, provider, oauthId)
+	if err == ErrLastIdentity {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"連携の解除に失敗しました"}`)
+		return
 	}
-	userInfo := new(UserInfo)
-	err := json.Unmarshal(response, userInfo)
-	check(c, err)
-	
-	result := make(map[string]string, 2)
-	result["oauth_id"] = userInfo.Id
-	result["name"] = userInfo.Name
-	
-	return result
+
+	audit(c, r, userKey, "unlink_identity", fmt.Sprintf("%s: %s", provider, oauthId))
+	fmt.Fprintf(w, `{"result":true}`)
 }
 
 /**
- * Facebookからのコールバック
+ * メールアドレスでのログインを連携する
+ * パスワードを設定して、メールアドレスは確認リンクが開かれた時に設定する
  * @function
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
  */
-func callbackFacebook(w http.ResponseWriter, r*http.Request) {
+func linkMail(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	userInfo := requestFacebookToken(w, r)
-	
+	userKey, user := getSessionUser(c, r)
+	mail := r.FormValue("mail")
+	pass := r.FormValue("pass")
+
+	verr := linkMailSchema.validate(linkMailSchema.formValues(r))
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	if user.Mail != "" {
+		fmt.Fprintf(w, `{"result":false, "message":"メールアドレスは既に連携されています"}`)
+		return
+	}
+
 	model := NewModel(c)
-	view := NewView(c, w)
-	
-	key := ""
-	if model.existOAuthUser("Facebook", userInfo["oauth_id"]) {
-		// 既存ユーザ
-		params := make(map[string]string, 2)
-		params["OAuthId"] = userInfo["oauth_id"]
-		params["Type"] = "Facebook"
-		key = model.getUserKey(params)
-	} else {
-		// 新規ユーザ
-		params := make(map[string]string, 4)
-		params["user_type"] = "Facebook"
-		params["user_name"] = userInfo["name"]
-		params["user_oauth_id"] = userInfo["oauth_id"]
-		params["user_pass"] = ""
-		user := model.NewUser(params)
-		key = model.addUser(user)
+	key, err := model.requestMailChange(userKey, mail)
+	if err == ErrMailAlreadyUsed {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"メールアドレスの連携に失敗しました"}`)
+		return
 	}
-	
-	if getSession(c, r) == "" {
-		startSession(w, r, key)
+	err = model.setPassword(userKey, pass)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"メールアドレスの連携に失敗しました"}`)
+		return
 	}
-	view.editor(key)
+
+	body := fmt.Sprintf("%s 様\n\nメールアドレスでのログインの連携を受け付けました。\n以下のURLを24時間以内に開くと連携が完了します。\n\n%s/confirm_mail_change?key=%s\n\n心当たりがない場合はこのメールを破棄してください。\n", user.Name, siteUrl, key)
+	sendMail(c, mailSender, mail, "メールアドレス連携の確認", body)
+	fmt.Fprintf(w, `{"result":true}`)
 }
 
 /**
- * エディタの表示
- * @param {http.ResponseWRiter} w 応答先
+ * メールアドレスでのログインの連携を解除する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func unlinkMail(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, _ := getSessionUser(c, r)
+
+	model := NewModel(c)
+	err := model.unlinkMail(userKey)
+	if err == ErrLastIdentity {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"連携の解除に失敗しました"}`)
+		return
+	}
+
+	audit(c, r, userKey, "unlink_mail", "")
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * ログイン中のユーザへ重複したユーザを統合する
+ * 統合するユーザは直前に外部サービスで認証したもののみ
+ * @function
+ * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
  */
-func editor(w http.ResponseWriter, r *http.Request) {
-	userKey := session(w, r)
+func mergeAccount(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
+	userKey, _ := getSessionUser(c, r)
+	sessionId := getSession(c, r)
+
 	model := NewModel(c)
+	view := NewView(c, w, r)
+	sourceKey := model.getPendingMerge(sessionId)
+	if sourceKey == "" {
+		view.message("アカウントの統合", "統合の有効期限が切れています。もう一度アカウントを連携してください")
+		return
+	}
 
-	gameKey := r.FormValue("game_key")
-	if gameKey == "" {
-		c.Warningf("ゲームキー無しでゲームを編集しようとしました")
-		http.Redirect(w, r, "/", 302)
+	err := model.mergeUsers(userKey, sourceKey)
+	model.removePendingMerge(sessionId)
+	if err != nil {
+		c.Errorf(err.Error())
+		view.message("アカウントの統合", "アカウントの統合に失敗しました")
+		return
 	}
-	
-	game := model.getGame(gameKey)
-	if game.UserKey != userKey {
-		c.Warningf("ユーザキー: %s が他人のゲーム: %s を編集しようとしました", userKey, gameKey)
-		http.Redirect(w, r, "/gamelist", 302)
+
+	audit(c, r, userKey, "merge_users", fmt.Sprintf("統合元: %s", sourceKey))
+	view.message("アカウントの統合", "アカウントを統合しました")
+}
+
+/**
+ * 管理者がユーザを統合する
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ */
+func mergeUsers(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	adminKey, _ := getSessionUser(c, r)
+	targetKey := r.FormValue("target_key")
+	sourceKey := r.FormValue("source_key")
+
+	model := NewModel(c)
+	err := model.mergeUsers(targetKey, sourceKey)
+	if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false}`)
+		return
 	}
-	
-	view := NewView(c, w)
-	view.editor(gameKey)
+
+	audit(c, r, adminKey, "merge_users", fmt.Sprintf("統合先: %s 統合元: %s", targetKey, sourceKey))
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 使用状況が登録されていない古いユーザのメールアドレスをすべて登録する
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func backfillUserMails(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	adminKey, _ := getSessionUser(c, r)
+
+	model := NewModel(c)
+	count, err := model.backfillUserMails()
+	if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false}`)
+		return
+	}
+
+	audit(c, r, adminKey, "backfill_user_mails", fmt.Sprintf("登録したアドレス数: %d", count))
+	fmt.Fprintf(w, `{"result":true,"count":%d}`, count)
+}
+
+/**
+ * エディタの表示
+ * 閲覧者以上の権限の確認は withGameRole() で行う
+ * @param {http.ResponseWRiter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func editor(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	view := NewView(ctx.c, w, r)
+	view.editor(ctx.GameKey, ctx.Game, ctx.GameRole)
 }
 
 /**
@@ -207,53 +494,1945 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 	params["user_mail"] = r.FormValue("user_mail")
 	params["user_oauth_id"] = r.FormValue("user_oauth_id")
 	
+	verr := userSchema(params["user_type"]).validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
 	model := NewModel(c)
 	user := model.NewUser(params)
 	model.addUser(user)
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * デバッグツールの表示
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func debug(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	view := NewView(c, w, r)
+	view.debug()
+}
+
+/**
+ * ログイン処理の結果
+ * @const
+ */
+const (
+	loginSucceeded = iota
+	loginFailed
+	loginThrottled
+	loginNeedsTotp
+	loginExpired
+)
+
+/**
+ * メールアドレスとパスワードでログインを試みる
+ * 試行回数の制限を確認し、成功したらセッションを開始する
+ * 二段階認証を有効にしているユーザはセッションを開始せずに二段階目を待つ
+ * 空のメールアドレスは全員が同じ制限を共有してしまうので、制限を確認する前に失敗とする
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {string} mail メールアドレス
+ * @param {string} pass パスワード
+ * @returns {int} ログイン処理の結果
+ * @returns {string} 成功した場合はユーザキー
+ * @returns {time.Duration} 制限されている場合は次に試せるまでの時間
+ */
+func tryLogin(c appengine.Context, w http.ResponseWriter, r *http.Request, mail string, pass string) (int, string, time.Duration) {
+	if normalizeMail(mail) == "" {
+		return loginFailed, "", 0
+	}
+	ip := r.RemoteAddr
+	model := NewModel(c)
+	wait := model.loginWait(mail, ip)
+	if wait > 0 {
+		c.Warningf("ログインの試行が制限されています。アドレス：%s IP：%s", mail, ip)
+		return loginThrottled, "", wait
+	}
+
+	key, _ := model.loginCheck(mail, pass)
+	if key == "" {
+		if model.recordLoginFailure(mail, ip) {
+			notifyAccountLocked(c, r, mail)
+		}
+		return loginFailed, "", 0
+	}
+
+	if model.getUser(key).TotpEnabled {
+		// パスワードは正しいので二段階認証へ進む
+		// 失敗回数は二段階目が成功するまで消さない
+		token := model.setPendingLogin(key)
+		cookie := NewCookie(totpCookieName, token, "localhost", "/", 1)
+		http.SetCookie(w, cookie)
+		return loginNeedsTotp, key, 0
+	}
+
+	model.resetLoginThrottle(mail)
+	if sessionKey, _ := getSessionUser(c, r); sessionKey != key {
+		startSession(w, r, key)
+	}
+	return loginSucceeded, key, 0
+}
+
+/**
+ * ログインの2段階目を試みる
+ * パスワードの確認が済んだログインについて、ワンタイムパスワードまたはリカバリーコードを検証する
+ * 失敗はパスワードの失敗と同じくアカウントとIPアドレスの両方に記録する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {string} code ワンタイムパスワードまたはリカバリーコード
+ * @returns {int} ログイン処理の結果
+ * @returns {string} 成功した場合はユーザキー
+ * @returns {time.Duration} 制限されている場合は次に試せるまでの時間
+ */
+func tryLoginTotp(c appengine.Context, w http.ResponseWriter, r *http.Request, code string) (int, string, time.Duration) {
+	ip := r.RemoteAddr
+	token := ""
+	cookie, err := r.Cookie(totpCookieName)
+	if err == nil {
+		token = cookie.Value
+	}
+	model := NewModel(c)
+	userKey := model.getPendingLogin(token)
+	if userKey == "" {
+		return loginExpired, "", 0
+	}
+	user := model.getUser(userKey)
+
+	wait := model.loginWait(user.Mail, ip)
+	if wait > 0 {
+		c.Warningf("二段階認証の試行が制限されています。ユーザキー：%s IP：%s", userKey, ip)
+		return loginThrottled, "", wait
+	}
+
+	usedRecovery, err := model.verifySecondFactor(userKey, code)
+	if err == ErrInvalidTotpCode {
+		if model.recordLoginFailure(user.Mail, ip) {
+			model.removePendingLogin(token)
+			notifyAccountLocked(c, r, user.Mail)
+		}
+		return loginFailed, "", 0
+	} else if err != nil {
+		// 確認できなかったコードでログインさせない
+		c.Errorf(err.Error())
+		return loginFailed, "", 0
+	}
+
+	model.removePendingLogin(token)
+	http.SetCookie(w, NewCookie(totpCookieName, "", "localhost", "/", -1))
+	model.resetLoginThrottle(user.Mail)
+	if usedRecovery {
+		audit(c, r, userKey, "use_recovery_code", fmt.Sprintf("残り: %d", len(model.getUser(userKey).RecoveryCodes)))
+	}
+	startSession(w, r, userKey)
+	return loginSucceeded, userKey, 0
+}
+
+/**
+ * ログイン
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} to 成功した時のリダイレクト先URL
+ * @returns {Ajax JSON} totp 二段階認証が必要ならtrue
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func login(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	verr := loginSchema.validate(loginSchema.formValues(r))
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	result, _, wait := tryLogin(c, w, r, r.FormValue("mail"), r.FormValue("pass"))
+	switch result {
+	case loginThrottled:
+		seconds := int(wait.Seconds()) + 1
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+		fmt.Fprintf(w, `{"result":false, "message":"ログインの試行回数が多すぎます。%d秒後に再度お試しください", "retry_after":%d}`, seconds, seconds)
+	case loginNeedsTotp:
+		fmt.Fprintf(w, `{"result":true, "totp":true}`)
+	case loginSucceeded:
+		fmt.Fprintf(w, `{"result":true, "to":"/gamelist"}`)
+	default:
+		// メールアドレスとパスワードのどちらが間違っていたかは返さない
+		fmt.Fprintf(w, `{"result":false, "message":"メールアドレスまたはパスワードが間違っています"}`)
+	}
+}
+
+/**
+ * アカウントがロックされたことを持ち主に知らせる
+ * 存在しないアドレスの場合は監査ログだけを残す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*http.Request} r リクエスト
+ * @param {string} mail ロックされたメールアドレス
+ */
+func notifyAccountLocked(c appengine.Context, r *http.Request, mail string) {
+	model := NewModel(c)
+	userKey := model.getUserKeyByMail(mail)
+	audit(c, r, userKey, "account_locked", fmt.Sprintf("アドレス：%s", mail))
+	if userKey == "" {
+		return
+	}
+
+	user := model.getUser(userKey)
+	body := fmt.Sprintf("%s 様\n\nログインの失敗が続いたため、アカウントを%d分間ロックしました。\n最後に失敗したアクセス元: %s\n\n心当たりがない場合はパスワードの変更をおすすめします。\n", user.Name, int(loginLockDuration.Minutes()), r.RemoteAddr)
+	sendMail(c, mailSender, user.Mail, "アカウントロックのお知らせ", body)
+}
+
+/**
+ * 管理者がアカウントのロックを解除する
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ */
+func unlockUser(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	adminKey, _ := getSessionUser(c, r)
+	userKey := r.FormValue("user_key")
+
+	model := NewModel(c)
+	user := model.getUser(userKey)
+	if user.Mail == "" {
+		fmt.Fprintf(w, `{"result":false}`)
+		return
+	}
+	model.resetLoginThrottle(user.Mail)
+
+	audit(c, r, adminKey, "unlock_user", fmt.Sprintf("ユーザキー: %s", userKey))
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 二段階認証を待っているログインのトークンを保存するクッキーの名前
+ * @const
+ */
+const totpCookieName = "escape3ds_totp"
+
+/**
+ * ログインの2段階目
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} to 成功した時の移動先
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func loginTotp(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	result, _, wait := tryLoginTotp(c, w, r, r.FormValue("code"))
+	switch result {
+	case loginExpired:
+		fmt.Fprintf(w, `{"result":false, "message":"時間切れです。もう一度ログインしてください", "to":"/"}`)
+	case loginThrottled:
+		seconds := int(wait.Seconds()) + 1
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+		fmt.Fprintf(w, `{"result":false, "message":"ログインの試行回数が多すぎます。%d秒後に再度お試しください", "retry_after":%d}`, seconds, seconds)
+	case loginSucceeded:
+		fmt.Fprintf(w, `{"result":true, "to":"/gamelist"}`)
+	default:
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, ErrInvalidTotpCode.Error())
+	}
+}
+
+/**
+ * 二段階認証の登録を始める
+ * メールアドレスでログインできるユーザのみ登録できる
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} uri 認証アプリに登録する otpauth:// 形式の URI
+ * @returns {Ajax JSON} secret 手入力用のシークレット
+ * @returns {Ajax JSON} qr URI を表す QR コード画像のパス
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func enrollTotp(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, user := getSessionUser(c, r)
+	if user.Mail == "" {
+		fmt.Fprintf(w, `{"result":false, "message":"二段階認証はメールアドレスでログインするアカウントのみ利用できます"}`)
+		return
+	}
+
+	model := NewModel(c)
+	secret, err := model.startTotpEnrollment(userKey)
+	if err == ErrTotpAlreadyEnabled {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	}
+	check(c, err)
+
+	result := map[string]interface{}{
+		"result": true,
+		"uri": totpProvisioningUri(secret, user.Mail),
+		"secret": secret,
+		"qr": "/totp_qr",
+	}
+	bytes, err := json.Marshal(result)
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * 登録中の二段階認証の QR コードを PNG で返す
+ * シークレットを含むのでキャッシュさせない
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func totpQr(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	_, user := getSessionUser(c, r)
+	if user.TotpPending == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	code, err := NewQRCode(totpProvisioningUri(user.TotpPending, user.Mail))
+	check(c, err)
+	image, err := code.PNG(4)
+	check(c, err)
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(image)
+}
+
+/**
+ * 確認コードを検証して二段階認証を有効にする
+ * リカバリーコードはこの応答でしか表示できない
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} recovery_codes リカバリーコード
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func confirmTotp(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, _ := getSessionUser(c, r)
+	code := r.FormValue("code")
+
+	model := NewModel(c)
+	codes, err := model.enableTotp(userKey, code)
+	if err == ErrInvalidTotpCode || err == ErrTotpAlreadyEnabled {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"二段階認証を有効にできませんでした"}`)
+		return
+	}
+
+	audit(c, r, userKey, "enable_totp", "")
+	result := map[string]interface{}{
+		"result": true,
+		"recovery_codes": codes,
+	}
+	bytes, err := json.Marshal(result)
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * 本人が二段階認証を無効にする
+ * 現在のワンタイムパスワードまたはリカバリーコードを要求する
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func disableTotp(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, _ := getSessionUser(c, r)
+	code := r.FormValue("code")
+
+	model := NewModel(c)
+	_, err := model.verifySecondFactor(userKey, code)
+	if err == ErrInvalidTotpCode {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"コードを確認できませんでした"}`)
+		return
+	}
+	err = model.disableTotp(userKey)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"二段階認証を無効にできませんでした"}`)
+		return
+	}
+
+	audit(c, r, userKey, "disable_totp", "")
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 管理者がユーザの二段階認証を解除する
+ * 認証アプリとリカバリーコードを両方なくしたユーザの救済に使う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ */
+func resetTotp(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	adminKey, _ := getSessionUser(c, r)
+	userKey := r.FormValue("user_key")
+
+	model := NewModel(c)
+	err := model.disableTotp(userKey)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false}`)
+		return
+	}
+
+	audit(c, r, adminKey, "reset_totp", fmt.Sprintf("ユーザキー: %s", userKey))
+	user := model.getUser(userKey)
+	if user.Mail != "" {
+		body := fmt.Sprintf("%s 様\n\n管理者によってアカウントの二段階認証が解除されました。\n心当たりがない場合はお問い合わせください。\n", user.Name)
+		sendMail(c, mailSender, user.Mail, "二段階認証解除のお知らせ", body)
+	}
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 個人データを ZIP でダウンロードする
+ * part が無ければダウンロードする ZIP の一覧ページを表示する
+ * part が 0 ならプロフィールとゲームを、1 以上ならその番号の素材を ZIP で返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func exportAccount(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, _ := getSessionUser(c, r)
+	model := NewModel(c)
+	view := NewView(c, w, r)
+
+	parts, err := exportAssetParts(c, model.getGameList(userKey))
+	if err != nil {
+		c.Errorf(err.Error())
+		view.message("個人データのダウンロード", "ダウンロードの準備に失敗しました")
+		return
+	}
+	if r.FormValue("part") == "" {
+		view.exportAccount(len(parts))
+		return
+	}
+	part, err := strconv.Atoi(r.FormValue("part"))
+	if err != nil || part < 0 || part > len(parts) {
+		http.NotFound(w, r)
+		return
+	}
+
+	audit(c, r, userKey, "export_account", fmt.Sprintf("part: %d/%d", part, len(parts)))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="escape3ds-%s-%d.zip"`, time.Now().Format("20060102"), part))
+	w.Header().Set("Cache-Control", "no-store")
+	if part == 0 {
+		err = writeAccountExport(c, w, userKey, parts)
+	} else {
+		err = writeAssetExport(c, w, parts[part - 1])
+	}
+	check(c, err)
+}
+
+/**
+ * 退会を申請する
+ * 本人確認のため、パスワードを設定しているユーザにはパスワードを、
+ * 二段階認証を有効にしているユーザには確認コードも要求する
+ * 申請するとすべてのセッションを終了し、猶予期間が過ぎると削除される
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} delete_at 削除予定日時
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, user := getSessionUser(c, r)
+	model := NewModel(c)
+
+	if user.Mail != "" {
+		key, _ := model.loginCheck(user.Mail, r.FormValue("pass"))
+		if key != userKey {
+			model.recordLoginFailure(user.Mail, r.RemoteAddr)
+			fmt.Fprintf(w, `{"result":false, "message":"パスワードが間違っています"}`)
+			return
+		}
+	}
+	if user.TotpEnabled {
+		_, err := model.verifySecondFactor(userKey, r.FormValue("code"))
+		if err == ErrInvalidTotpCode {
+			fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+			return
+		} else if err != nil {
+			c.Errorf(err.Error())
+			fmt.Fprintf(w, `{"result":false, "message":"コードを確認できませんでした"}`)
+			return
+		}
+	}
+
+	deleteAt, err := model.requestAccountDeletion(userKey)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"退会の申請に失敗しました"}`)
+		return
+	}
+	model.removeUserSessions(userKey)
+	deleteCookie(w)
+
+	audit(c, r, userKey, "request_account_deletion", fmt.Sprintf("削除予定: %s", deleteAt.Format(time.RFC3339)))
+	if user.Mail != "" {
+		body := fmt.Sprintf("%s 様\n\n退会の申請を受け付けました。\n%s にアカウントとすべてのゲームを削除します。\n\n取り消す場合はそれまでにログインしてください。ログインすると退会の申請は取り消されます。\n%s\n", user.Name, deleteAt.Format("2006/01/02 15:04"), siteUrl)
+		sendMail(c, mailSender, user.Mail, "退会申請の受付", body)
+	}
+	fmt.Fprintf(w, `{"result":true, "delete_at":"%s", "to":"/"}`, deleteAt.Format(time.RFC3339))
+}
+
+/**
+ * 削除予定日時を過ぎたユーザを削除する
+ * cron から定期的に呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func purgeUsers(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	model := NewModel(c)
+
+	count := 0
+	for _, userKey := range model.getExpiredDeletions(time.Now()) {
+		user := model.getUser(userKey)
+		err := model.deleteUser(userKey)
+		if err != nil {
+			c.Errorf("ユーザの削除に失敗しました。ユーザキー：%s %s", userKey, err.Error())
+			continue
+		}
+		count++
+		audit(c, r, "", "delete_account", fmt.Sprintf("ユーザキー: %s", userKey))
+		if user.Mail != "" {
+			body := fmt.Sprintf("%s 様\n\nお申し込みいただいた退会の手続きが完了し、アカウントとすべてのゲームを削除しました。\nご利用ありがとうございました。\n", user.Name)
+			sendMail(c, mailSender, user.Mail, "退会完了のお知らせ", body)
+		}
+	}
+	fmt.Fprintf(w, `{"result":true, "deleted":%d}`, count)
+}
+
+/**
+ * ゴミ箱に移してから30日を過ぎたゲームと、参照されていない素材を削除する
+ * cron から定期的に呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func purgeGames(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	model := NewModel(c)
+	now := time.Now()
+
+	count := 0
+	for _, gameKey := range model.getExpiredTrash(now) {
+		err := model.purgeGame(gameKey)
+		if err != nil {
+			c.Errorf("ゲームの削除に失敗しました。ゲームキー：%s %s", gameKey, err.Error())
+			continue
+		}
+		count++
+		audit(c, r, "", "purge_game", fmt.Sprintf("ゲームキー: %s", gameKey))
+	}
+	assets, err := model.purgeOrphanAssets(now)
+	if err != nil {
+		c.Errorf("素材の削除に失敗しました: %s", err.Error())
+	}
+	fmt.Fprintf(w, `{"result":true, "deleted":%d, "assets":%d}`, count, assets)
+}
+
+/**
+ * 自分のプロフィールを返す
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} name, handle, bio, language, avatar (画像のURL、未設定なら空文字)
+ */
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, user := getSessionUser(c, r)
+
+	language := user.Language
+	if language == "" {
+		language = languages[0]
+	}
+	avatar := ""
+	if user.Avatar != "" {
+		avatar = fmt.Sprintf("/avatar?user_key=%s", userKey)
+	}
+	result := map[string]string{
+		"name": user.Name,
+		"handle": user.Handle,
+		"bio": user.Bio,
+		"language": language,
+		"avatar": avatar,
+	}
+	bytes, err := json.Marshal(result)
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * 自分のプロフィールを更新する
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func updateProfile(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, _ := getSessionUser(c, r)
+
+	profile := map[string]string{
+		"name": r.FormValue("name"),
+		"handle": r.FormValue("handle"),
+		"bio": r.FormValue("bio"),
+		"language": r.FormValue("language"),
+	}
+	model := NewModel(c)
+	err := model.updateProfile(userKey, profile)
+	if verr, ok := err.(*ValidationError); ok {
+		validationError(c, w, r, verr)
+		return
+	} else if err != nil {
+		result := map[string]interface{}{
+			"result": false,
+			"message": err.Error(),
+		}
+		bytes, err := json.Marshal(result)
+		check(c, err)
+		fmt.Fprintf(w, "%s", bytes)
+		return
+	}
+
+	audit(c, r, userKey, "update_profile", "")
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * アイコン画像をアップロードする
+ * multipart/form-data の avatar に画像を入れて送信する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, _ := getSessionUser(c, r)
+
+	file, header, err := r.FormFile("avatar")
+	if err != nil {
+		fmt.Fprintf(w, `{"result":false, "message":"画像を選んでください"}`)
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, avatarMaxSize + 1))
+	check(c, err)
+
+	model := NewModel(c)
+	err = model.setAvatar(userKey, header.Filename, data)
+	if err != nil {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	}
+	fmt.Fprintf(w, `{"result":true, "avatar":"/avatar?user_key=%s"}`, userKey)
+}
+
+/**
+ * ユーザのアイコン画像を返す
+ * 公開プロフィールで使うのでログインしていなくても表示できる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func avatar(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey := r.FormValue("user_key")
+	if _, err := datastore.DecodeKey(userKey); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	model := NewModel(c)
+	user := model.getUser(userKey)
+	asset := (*Asset)(nil)
+	if user.Avatar != "" {
+		asset = model.getAsset(user.Avatar)
+	}
+	if asset == nil {
+		http.Redirect(w, r, "/client/img/logo.png", 302)
+		return
+	}
+	w.Header().Set("Content-Type", asset.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(asset.Data)
+}
+
+/**
+ * パスワードを変更する
+ * 現在のパスワードを要求し、変更したら他のセッションをすべて終了する
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, user := getSessionUser(c, r)
+
+	model := NewModel(c)
+	err := model.changePassword(userKey, r.FormValue("current_pass"), r.FormValue("new_pass"))
+	if err == ErrWrongPassword {
+		model.recordLoginFailure(user.Mail, r.RemoteAddr)
+	}
+	if verr, ok := err.(*ValidationError); ok {
+		validationError(c, w, r, verr)
+		return
+	} else if err != nil {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	}
+
+	model.removeUserSessions(userKey)
+	startSession(w, r, userKey)
+	audit(c, r, userKey, "change_password", "")
+	body := fmt.Sprintf("%s 様\n\nアカウントのパスワードが変更されました。\n心当たりがない場合はお問い合わせください。\n", user.Name)
+	sendMail(c, mailSender, user.Mail, "パスワード変更のお知らせ", body)
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * ゲームの公開状態を変更する
+ * 公開したゲームは公開プロフィールに表示される
+ * 所有者の確認は ownGame() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ */
+func setGamePublished(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+
+	model := NewModel(c)
+	err := model.setGamePublished(ctx.GameKey, r.FormValue("published") == "true")
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false}`)
+		return
+	}
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * ゲームの情報を更新する
+ * 送信された項目 (name, description, thumbnail, first_scene, settings, published) だけを変更する
+ * 編集者以上の権限の確認は withGameRole() で行い、公開状態は所有者だけが変更できる
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func updateGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := gameSchema.submittedValues(r)
+	if _, ok := params["published"]; ok && ctx.GameRole != "owner" {
+		forbidden(c, w, r, "公開状態は所有者だけが変更できます")
+		return
+	}
+
+	model := NewModel(c)
+	game, err := model.updateGame(ctx.GameKey, params)
+	if verr, ok := err.(*ValidationError); ok {
+		validationError(c, w, r, verr)
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"ゲームの情報を更新できませんでした"}`)
+		return
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"game": gameResource(ctx.GameKey, game),
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * ゲームを複製する
+ * 複製したゲームはリクエストしたユーザが所有する非公開のゲームになる
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func cloneGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+
+	model := NewModel(c)
+	gameKey, game, err := model.cloneGame(ctx.GameKey, ctx.UserKey)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"ゲームを複製できませんでした"}`)
+		return
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"game": gameResource(gameKey, game),
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * ゲームの内容を保存する
+ * 保存するたびに新しいリビジョンを作成する
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func saveGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := saveGameSchema.formValues(r)
+
+	model := NewModel(c)
+	revision, err := model.saveGameContent(ctx.GameKey, ctx.UserKey, params["content"], params["message"], 0)
+	if verr, ok := err.(*ValidationError); ok {
+		validationError(c, w, r, verr)
+		return
+	} else if lerr, ok := err.(*SceneLockedError); ok {
+		sceneLockedError(c, w, lerr)
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"ゲームを保存できませんでした"}`)
+		return
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"revision": revisionResource(revision, ctx.User),
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * 編集中の内容を下書きとして自動保存する
+ * エディタが定期的に呼び出す
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func autosave(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := draftSchema.formValues(r)
+	verr := draftSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	baseRevision, _ := strconv.Atoi(params["base_revision"])
+
+	model := NewModel(c)
+	draft, err := model.saveDraft(ctx.GameKey, ctx.UserKey, params["content"], baseRevision)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"下書きを保存できませんでした"}`)
+		return
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"date": draft.Date,
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * 保存したゲームより新しい下書きがあれば返す
+ * エディタはゲームを開いた時に呼び出し、下書きがあれば復元するか尋ねる
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	model := NewModel(c)
+	result := map[string]interface{}{
+		"result": true,
+		"draft": nil,
+	}
+	draft := model.getDraft(ctx.GameKey, ctx.UserKey)
+	if draft != nil && model.isNewerDraft(ctx.GameKey, ctx.Game, draft) {
+		result["draft"] = draftResource(draft, true)
+	}
+	bytes, err := json.Marshal(result)
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * 下書きを破棄する
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func discardDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	model := NewModel(c)
+	err := model.discardDraft(ctx.GameKey, ctx.UserKey)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"下書きを破棄できませんでした"}`)
+		return
+	}
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 他のユーザがロックしているシーンを保存しようとしたことを返す
+ * scenes にロックされているシーンの ID を含める
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*SceneLockedError} err エラー
+ */
+func sceneLockedError(c appengine.Context, w http.ResponseWriter, err *SceneLockedError) {
+	bytes, e := json.Marshal(map[string]interface{}{
+		"result": false,
+		"error": "scene_locked",
+		"message": err.Error(),
+		"scenes": err.Scenes,
+	})
+	check(c, e)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * ゲームのシーンのロックの一覧を返す
+ * 閲覧者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getSceneLocks(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	model := NewModel(c)
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"user_key": ctx.UserKey,
+		"locks": sceneLockResources(model, model.getSceneLocks(ctx.GameKey)),
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * シーンをロックする
+ * 自分が既にロックしていれば延長する
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func lockScene(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := sceneLockSchema.formValues(r)
+	verr := sceneLockSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	lock, err := model.lockScene(ctx.GameKey, params["scene"], ctx.UserKey)
+	if err == ErrSceneLocked {
+		fmt.Fprintf(w, `{"result":false, "error":"scene_locked", "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"シーンをロックできませんでした"}`)
+		return
+	}
+	publishSceneLocks(c, ctx.GameKey)
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"lock": sceneLockResource(params["scene"], lock, ctx.User),
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * ロックしているシーンのハートビートを受け取る
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func heartbeatSceneLock(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := sceneLockSchema.formValues(r)
+	verr := sceneLockSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	_, err := model.heartbeatSceneLock(ctx.GameKey, params["scene"], ctx.UserKey)
+	if err == ErrSceneLockLost {
+		fmt.Fprintf(w, `{"result":false, "error":"scene_lock_lost", "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"シーンのロックを延長できませんでした"}`)
+		return
+	}
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * シーンのロックを解除する
+ * 他のユーザのロックは、所有者ならいつでも、編集者ならハートビートが途絶えていれば解除できる
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func unlockScene(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := sceneLockSchema.formValues(r)
+	verr := sceneLockSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	broken, err := model.unlockScene(ctx.GameKey, params["scene"], ctx.UserKey, ctx.GameRole)
+	if err == ErrSceneLockActive {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"シーンのロックを解除できませんでした"}`)
+		return
+	}
+	if broken != nil {
+		audit(c, r, ctx.UserKey, "break_scene_lock", fmt.Sprintf("ゲームキー: %s シーン: %s ユーザキー: %s", ctx.GameKey, params["scene"], broken.UserKey))
+	}
+	publishSceneLocks(c, ctx.GameKey)
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * ゲームのリビジョンの一覧を新しい順に返す
+ * 閲覧者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := revisionListSchema.formValues(r)
+	verr := revisionListSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	revisions, next, err := model.getRevisionPage(ctx.GameKey, params["cursor"], revisionPageSize)
+	if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"リビジョンを取得できませんでした"}`)
+		return
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"revisions": revisionResources(model, revisions),
+		"next_cursor": next,
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * 2つのリビジョンの差分を返す
+ * 閲覧者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func diffRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := revisionDiffSchema.formValues(r)
+	verr := revisionDiffSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	from, _ := strconv.Atoi(params["from"])
+	to, _ := strconv.Atoi(params["to"])
+
+	model := NewModel(c)
+	diff, err := model.diffRevisions(ctx.GameKey, from, to)
+	if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"リビジョンが見つかりません"}`)
+		return
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"diff": diff,
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * 古いリビジョンを新しいリビジョンとして復元する
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func restoreRevision(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	number, _ := strconv.Atoi(r.FormValue("number"))
+
+	model := NewModel(c)
+	revision, err := model.restoreRevision(ctx.GameKey, ctx.UserKey, number)
+	if lerr, ok := err.(*SceneLockedError); ok {
+		sceneLockedError(c, w, lerr)
+		return
+	} else if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"リビジョンを復元できませんでした"}`)
+		return
+	}
+	audit(c, r, ctx.UserKey, "restore_revision", fmt.Sprintf("ゲームキー: %s リビジョン: %d", ctx.GameKey, number))
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"revision": revisionResource(revision, ctx.User),
+		"content": json.RawMessage(revision.Content),
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * ゲームの共同編集者の一覧を返す
+ * 所有者には有効な招待の一覧も返す
+ * 権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} user_key (自分のキー), role (自分の権限), owner, collaborators, invitations
+ */
+func getCollaborators(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	model := NewModel(c)
+
+	owner := model.getUser(ctx.Game.UserKey)
+	collaborators := make([]map[string]interface{}, 0)
+	for _, collaborator := range model.getCollaborators(ctx.GameKey) {
+		collaborators = append(collaborators, collaboratorResource(collaborator, model.getUser(collaborator.UserKey)))
+	}
+	invitations := make([]map[string]interface{}, 0)
+	if ctx.GameRole == "owner" {
+		for key, invitation := range model.getInvitations("GameKey", ctx.GameKey) {
+			invitations = append(invitations, invitationResource(key, invitation))
+		}
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"user_key": ctx.UserKey,
+		"role": ctx.GameRole,
+		"owner": collaboratorResource(&Collaborator{UserKey: ctx.Game.UserKey, Role: "owner"}, owner),
+		"collaborators": collaborators,
+		"invitations": invitations,
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * ゲームにユーザを招待する
+ * 招待した相手にメールアドレスがあれば招待メールを送る
+ * 所有者の確認は ownGame() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func inviteCollaborator(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := invitationSchema.formValues(r)
+	verr := invitationSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	key, invitation, err := model.inviteCollaborator(ctx.GameKey, ctx.UserKey, params["target"], params["role"])
+	if err != nil {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	}
+	sendInvitationMail(c, ctx.User, ctx.Game, key, invitation)
+	audit(c, r, ctx.UserKey, "invite_collaborator", fmt.Sprintf("ゲームキー: %s 招待キー: %s 権限: %s", ctx.GameKey, key, invitation.Role))
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 招待メールを送る
+ * メールアドレスで招待した場合はそのアドレスへ、ハンドルで招待した場合は相手のメールアドレスへ送る
+ * 送り先が無ければ送らない (招待はゲーム一覧に表示される)
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*User} inviter 招待したユーザ
+ * @param {*Game} game 招待先のゲーム
+ * @param {string} key エンコード済みの招待キー
+ * @param {*Invitation} invitation 招待
+ */
+func sendInvitationMail(c appengine.Context, inviter *User, game *Game, key string, invitation *Invitation) {
+	to := invitation.Mail
+	if to == "" && invitation.UserKey != "" {
+		to = NewModel(c).getUser(invitation.UserKey).Mail
+	}
+	if to == "" {
+		return
+	}
+	body := fmt.Sprintf("%s さんからゲーム「%s」の共同編集に招待されました。\n以下のURLを%s までに開くと参加できます。\n\n%s/invitation?key=%s\n\n心当たりがない場合はこのメールを破棄してください。\n", inviter.Name, game.Name, invitation.Expires.Format("2006/01/02 15:04"), siteUrl, key)
+	sendMail(c, mailSender, to, "ゲームへの招待", body)
+}
+
+/**
+ * 招待の確認ページを表示する
+ * 招待メールのリンクから呼び出される
+ * メールソフトがリンクを先読みしても参加しないように、ここでは状態を変更せず POST で送信させる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func invitationForm(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	view := NewView(c, w, r)
+	key := r.FormValue("key")
+
+	model := NewModel(c)
+	invitation := model.getInvitation(key)
+	if invitation == nil || time.Now().After(invitation.Expires) {
+		view.message("ゲームへの招待", "招待が見つからないか、有効期限が切れています")
+		return
+	}
+	game := model.getGame(invitation.GameKey)
+	view.confirm("ゲームへの招待", fmt.Sprintf("下のボタンを押すとゲーム「%s」の共同編集に参加します", game.Name), "/accept_invitation", key)
+}
+
+/**
+ * 招待を受けてゲームに参加する
+ * 招待の確認ページからはフォームで、ゲーム一覧からは Ajax で呼び出される
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func acceptInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	model := NewModel(c)
+	gameKey, err := model.acceptInvitation(r.FormValue("key"), ctx.UserKey)
+	message := ""
+	if err == ErrInvitationExpired || err == ErrInvitationForOther {
+		message = err.Error()
+	} else if err != nil {
+		c.Errorf(err.Error())
+		message = "招待が見つかりません"
+	} else {
+		audit(c, r, ctx.UserKey, "accept_invitation", fmt.Sprintf("ゲームキー: %s", gameKey))
+	}
+
+	if isAjax(r) {
+		if message != "" {
+			fmt.Fprintf(w, `{"result":false, "message":"%s"}`, message)
+		} else {
+			fmt.Fprintf(w, `{"result":true, "game_key":"%s"}`, gameKey)
+		}
+		return
+	}
+	if message != "" {
+		view := NewView(c, w, r)
+		view.message("ゲームへの招待", message)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/editor?game_key=%s", gameKey), http.StatusFound)
+}
+
+/**
+ * 自分宛ての招待を断る
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func declineInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	key := r.FormValue("key")
+	model := NewModel(c)
+	invitation := model.getInvitation(key)
+	if invitation == nil || invitation.UserKey != ctx.UserKey {
+		fmt.Fprintf(w, `{"result":false, "message":"招待が見つかりません"}`)
+		return
+	}
+	err := model.deleteInvitation(key)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"招待を断れませんでした"}`)
+		return
+	}
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * ゲームへの招待を取り消す
+ * 所有者の確認は ownGame() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func cancelInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	key := r.FormValue("key")
+	model := NewModel(c)
+	invitation := model.getInvitation(key)
+	if invitation == nil || invitation.GameKey != ctx.GameKey {
+		fmt.Fprintf(w, `{"result":false, "message":"招待が見つかりません"}`)
+		return
+	}
+	err := model.deleteInvitation(key)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"招待を取り消せませんでした"}`)
+		return
+	}
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 共同編集者の権限を変更する
+ * 所有者の確認は ownGame() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func setCollaboratorRole(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	userKey := r.FormValue("user_key")
+	role := r.FormValue("role")
+	model := NewModel(c)
+	err := model.setCollaboratorRole(ctx.GameKey, userKey, role)
+	if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"権限を変更できませんでした"}`)
+		return
+	}
+	audit(c, r, ctx.UserKey, "set_collaborator_role", fmt.Sprintf("ゲームキー: %s ユーザキー: %s 権限: %s", ctx.GameKey, userKey, role))
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 共同編集者をゲームから外す
+ * 所有者は誰でも外せ、共同編集者は自分だけを外せる (ゲームから抜ける)
+ * 権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func removeCollaborator(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	userKey := r.FormValue("user_key")
+	if ctx.GameRole != "owner" && userKey != ctx.UserKey {
+		forbidden(c, w, r, "共同編集者を外す権限がありません")
+		return
+	}
+	model := NewModel(c)
+	err := model.removeCollaborator(ctx.GameKey, userKey)
+	if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"共同編集者が見つかりません"}`)
+		return
+	}
+	audit(c, r, ctx.UserKey, "remove_collaborator", fmt.Sprintf("ゲームキー: %s ユーザキー: %s", ctx.GameKey, userKey))
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 共同編集のイベントを Server-Sent Events で配信する
+ * 受け取った最後の連番は Last-Event-ID ヘッダか last_event_id パラメータで受け取る
+ * App Engine は応答をまとめて返すことがあるので、イベントを送ったら応答を終えて EventSource に再接続させる
+ * 閲覧者以上の権限の確認は withGameRole() で行う
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func live(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.FormValue("last_event_id")
+	}
+	lastId, _ := strconv.ParseInt(lastEventId, 10, 64)
+
+	subscriber, missed := broker.subscribe(ctx.GameKey, lastId)
+	defer broker.unsubscribe(ctx.GameKey, subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "retry: %d\n\n", liveRetry / time.Millisecond)
+	changed := false
+	for _, event := range missed {
+		writeLiveEvent(w, event)
+		changed = changed || event.Type != "presence"
+	}
+	flushLive(w)
+	if changed {
+		return
+	}
+
+	timeout := time.After(liveStreamTimeout)
+	for {
+		select {
+		case event, ok := <-subscriber.events:
+			if !ok {
+				return
+			}
+			writeLiveEvent(w, event)
+			// 同時に届いた変更はまとめて送る
+			for len(subscriber.events) > 0 {
+				writeLiveEvent(w, <-subscriber.events)
+			}
+			flushLive(w)
+			return
+		case <-timeout:
+			fmt.Fprintf(w, ": timeout\n\n")
+			flushLive(w)
+			return
+		}
+	}
+}
+
+/**
+ * 共同編集での変更を配信する
+ * 保存はしないので、各エディタは受け取った変更を連番の順に適用し、保存は従来通り行う
+ * 受け取ったエディタが保存するとロックを迂回できてしまうので、他のユーザがロックしているシーンへの変更は 409 で拒否する
+ * イベントの変更には scene でイベントのあるシーンを指定する
+ * 編集者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func publishLiveChange(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := liveChangeSchema.formValues(r)
+	verr := liveChangeSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	if params["op"] != "remove" && params["data"] == "" {
+		fmt.Fprintf(w, `{"result":false, "message":"変更の内容を指定してください"}`)
+		return
+	}
+	scene := params["scene"]
+	if params["target"] == "scene" {
+		scene = params["id"]
+	} else if params["target"] == "event" && scene == "" {
+		fmt.Fprintf(w, `{"result":false, "message":"イベントのあるシーンを指定してください"}`)
+		return
+	} else if params["target"] == "item" {
+		scene = ""
+	}
+
+	if scene != "" {
+		model := NewModel(c)
+		err := model.checkSceneLock(ctx.GameKey, scene, ctx.UserKey)
+		if lerr, ok := err.(*SceneLockedError); ok {
+			w.WriteHeader(http.StatusConflict)
+			sceneLockedError(c, w, lerr)
+			return
+		} else if err != nil {
+			c.Errorf(err.Error())
+			fmt.Fprintf(w, `{"result":false, "message":"シーンのロックを確認できませんでした"}`)
+			return
+		}
+	}
+
+	change := &liveChange{
+		Target: params["target"],
+		Op: params["op"],
+		Id: params["id"],
+		Scene: scene,
+		Data: json.RawMessage("null"),
+		UserKey: ctx.UserKey,
+		ClientId: params["client_id"],
+		Date: time.Now(),
+	}
+	if params["op"] != "remove" {
+		change.Data = json.RawMessage(params["data"])
+	}
+	id := broker.publishChange(ctx.GameKey, change)
+	fmt.Fprintf(w, `{"result":true, "id":%d}`, id)
+}
+
+/**
+ * 共同編集での在席状況を更新して配信する
+ * エディタは定期的に呼び出し、呼び出さなくなったユーザは退席とみなす
+ * 閲覧者以上の権限の確認は withGameRole() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func updateLivePresence(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	params := livePresenceSchema.formValues(r)
+	verr := livePresenceSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	presence := &livePresence{
+		UserKey: ctx.UserKey,
+		Name: ctx.User.Name,
+		Scene: params["scene"],
+		Seen: time.Now(),
+	}
+	broker.updatePresence(ctx.GameKey, presence, params["leave"] == "true")
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 公開プロフィールページ
+ * /u/{ハンドル} で表示する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func publicProfile(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	handle := pathParam(r, "handle")
+	view := NewView(c, w, r)
+
+	model := NewModel(c)
+	userKey := model.getUserKeyByHandle(handle)
+	if userKey == "" {
+		w.WriteHeader(http.StatusNotFound)
+		view.message("ユーザが見つかりません", "指定されたユーザは存在しません")
+		return
+	}
+	view.publicProfile(userKey)
+}
+
+/**
+ * ゲームの検索ページ
+ * 公開しているゲームを名前、説明、タグ、作者名で検索する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func search(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	view := NewView(c, w, r)
+	params := searchSchema.formValues(r)
+	verr := searchSchema.validate(params)
+	if verr != nil {
+		view.message("ゲームの検索", verr.Error())
+		return
+	}
+	offset, _ := strconv.Atoi(params["cursor"])
+
+	model := NewModel(c)
+	results, next, err := model.searchGames(params["q"], offset, searchPageSize)
+	check(c, err)
+	view.search(params["q"], results, next)
+}
+
+/**
+ * タグとカテゴリでゲームを探すページ
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func browse(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	view := NewView(c, w, r)
+	params := browseSchema.formValues(r)
+	verr := browseSchema.validate(params)
+	if verr != nil {
+		view.message("ゲームを探す", verr.Error())
+		return
+	}
+	filters := map[string]string{"tag": normalizeTag(params["tag"])}
+	for _, axis := range categoryAxes {
+		filters[axis] = params[axis]
+	}
+
+	model := NewModel(c)
+	games, next, err := model.browseGames(filters, params["cursor"], browsePageSize)
+	if err == ErrInvalidCursor {
+		view.message("ゲームを探す", err.Error())
+		return
+	}
+	check(c, err)
+	view.browse(filters, games, next)
+}
+
+/**
+ * 入力中のタグを補完する候補を返す
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func suggestTags(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	params := tagSuggestSchema.formValues(r)
+	verr := tagSuggestSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	tags, err := model.suggestTags(params["q"], tagSuggestLimit)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"タグの候補を取得できませんでした"}`)
+		return
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"tags": tags,
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * カテゴリの一覧を軸ごとに返す
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getCategories(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	model := NewModel(c)
+	bytes, err := json.Marshal(map[string]interface{}{
+		"result": true,
+		"categories": categoryResources(model.getCategories()),
+	})
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * カテゴリを追加するか、表示名と表示順を変更する
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func putCategory(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	adminKey, _ := getSessionUser(c, r)
+	params := categorySchema.formValues(r)
+	verr := categorySchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	order, _ := strconv.Atoi(params["order"])
+
+	model := NewModel(c)
+	category, err := model.putCategory(params["axis"], params["id"], params["name"], order)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"カテゴリを保存できませんでした"}`)
+		return
+	}
+
+	audit(c, r, adminKey, "put_category", fmt.Sprintf("%s: %s (%s)", categoryAxisLabels[category.Axis], category.Id, category.Name))
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * カテゴリを削除し、選んでいたゲームを未設定に戻す
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	adminKey, _ := getSessionUser(c, r)
+	params := deleteCategorySchema.formValues(r)
+	verr := deleteCategorySchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	count, err := model.deleteCategory(params["axis"], params["id"])
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"カテゴリを削除できませんでした"}`)
+		return
+	}
+
+	audit(c, r, adminKey, "delete_category", fmt.Sprintf("%s: %s 未設定に戻したゲーム数: %d", categoryAxisLabels[params["axis"]], params["id"], count))
+	fmt.Fprintf(w, `{"result":true,"count":%d}`, count)
+}
+
+/**
+ * すべてのゲームのタグを統合する
+ * 統合元が1つならタグの名前の変更になる
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func mergeTags(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	adminKey, _ := getSessionUser(c, r)
+	params := mergeTagsSchema.formValues(r)
+	verr := mergeTagsSchema.validate(params)
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	sources, _ := parseTags(params["sources"])
+	targets, _ := parseTags(params["target"])
+
+	model := NewModel(c)
+	count, err := model.mergeTags(sources, targets[0])
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"タグを統合できませんでした"}`)
+		return
+	}
+
+	audit(c, r, adminKey, "merge_tags", fmt.Sprintf("統合先: %s 統合元: %s 変更したゲーム数: %d", targets[0], strings.Join(sources, ", "), count))
+	fmt.Fprintf(w, `{"result":true,"count":%d}`, count)
+}
+
+/**
+ * すべてのゲームの検索の索引を作り直す
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func reindexGames(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	adminKey, _ := getSessionUser(c, r)
+
+	model := NewModel(c)
+	count, err := model.reindexGames()
+	if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false}`)
+		return
+	}
+
+	audit(c, r, adminKey, "reindex_games", fmt.Sprintf("索引のゲーム数: %d", count))
+	fmt.Fprintf(w, `{"result":true,"count":%d}`, count)
+}
+
+/**
+ * API トークンの一覧を返す
+ * 平文のトークンは返さない
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getAPITokens(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, _ := getSessionUser(c, r)
+
+	model := NewModel(c)
+	result := make(map[string]map[string]interface{})
+	for key, token := range model.getAPITokens(userKey) {
+		result[key] = map[string]interface{}{
+			"name": token.Name,
+			"scopes": token.Scopes,
+			"hint": token.Hint,
+			"created": token.Created,
+			"expires": token.Expires,
+			"last_used": token.LastUsed,
+		}
+	}
+	bytes, err := json.Marshal(result)
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
 }
 
 /**
- * デバッグツールの表示
+ * API トークンを作成する
+ * 平文のトークンはこの応答でしか表示できない
+ * Ajax で呼び出す
+ * @function
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ * @returns {Ajax JSON} token 平文のトークン
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
  */
-func debug(w http.ResponseWriter, r *http.Request) {
+func createAPIToken(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	view := NewView(c, w)
-	view.debug()
+	userKey, _ := getSessionUser(c, r)
+	r.ParseForm()
+
+	verr := apiTokenSchema.validate(apiTokenSchema.formValues(r))
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+	lifetime := time.Duration(0)
+	days, err := strconv.Atoi(r.FormValue("expires_days"))
+	if err == nil && days > 0 {
+		lifetime = time.Hour * 24 * time.Duration(days)
+	}
+
+	model := NewModel(c)
+	token, err := model.createAPIToken(userKey, r.FormValue("name"), r.Form["scopes"], lifetime)
+	result := map[string]interface{}{
+		"result": err == nil,
+	}
+	if err != nil {
+		result["message"] = err.Error()
+	} else {
+		result["token"] = token
+		audit(c, r, userKey, "create_api_token", fmt.Sprintf("名前: %s 権限: %s", r.FormValue("name"), strings.Join(r.Form["scopes"], ",")))
+	}
+	bytes, err := json.Marshal(result)
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
 }
 
 /**
- * ログイン
+ * API トークンを無効にする
+ * Ajax で呼び出す
+ * @function
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
  * @returns {Ajax JSON} result 成功したらtrue
- * @returns {Ajax JSON} to 成功した時のリダイレクト先URL
- * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
  */
-func login(w http.ResponseWriter, r *http.Request) {
+func revokeAPIToken(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
-	mail := r.FormValue("mail")
-	pass := r.FormValue("pass")
-	
+	userKey, _ := getSessionUser(c, r)
+	tokenKey := r.FormValue("token_key")
+
 	model := NewModel(c)
-	key, _ := model.loginCheck(mail, pass)
-	if key != "" {
-		// ログイン成功
-		sessionId := getSession(c, r)
-		if sessionId == "" {
-			startSession(w, r, key)
-		}
-		fmt.Fprintf(w, `{"result":true, "to":"/gamelist"}`)
-	} else {
-		// ログイン失敗
-		fmt.Fprintf(w, `{"result":false, "message":"メールアドレスまたはパスワードが間違っています"}`)
+	err := model.revokeAPIToken(userKey, tokenKey)
+	if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false}`)
+		return
 	}
+	audit(c, r, userKey, "revoke_api_token", fmt.Sprintf("トークンキー: %s", tokenKey))
+	fmt.Fprintf(w, `{"result":true}`)
 }
 
 /**
  * ログアウト
  * クッキーとmemcacheに保存されたセッション情報を削除する
+ * 他のサイトからログアウトさせられないように POST でCSRFトークンを要求する
  * @function
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
@@ -261,11 +2440,10 @@ func login(w http.ResponseWriter, r *http.Request) {
 func logout(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	cookie, err := r.Cookie("escape3ds")
-	check(c, err)
-	sessionId := cookie.Value
-	
-	model := NewModel(c)
-	model.removeSession(sessionId)
+	if err == nil {
+		model := NewModel(c)
+		model.removeSession(cookie.Value)
+	}
 	deleteCookie(w)
 	
 	http.Redirect(w, r, "/", 302)
@@ -284,14 +2462,42 @@ func interimRegistration(w http.ResponseWriter, r *http.Request) {
 	pass := r.FormValue("password")
 	
 	model := NewModel(c)
-	key := model.interimRegistration(name, mail, pass)
-	
-	sendMail(c, "infomation@escape-3ds.appspotmail.com", mail, "仮登録完了のお知らせ", fmt.Sprintf(config["interimMailBody"], name, key))
-	
-	view := NewView(c, w)
+	view := NewView(c, w, r)
+	verr := interimRegistrationSchema.validate(interimRegistrationSchema.formValues(r))
+	if verr != nil {
+		view.message("仮登録", verr.Error())
+		return
+	}
+	key, err := model.interimRegistration(name, mail, pass)
+	if err == ErrMailAlreadyUsed {
+		c.Warningf("登録済みのメールアドレス: %s で仮登録しようとしました", mail)
+		view.message("仮登録", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		view.message("仮登録", "仮登録に失敗しました")
+		return
+	}
+
+	sendMail(c, mailSender, mail, "仮登録完了のお知らせ", fmt.Sprintf(config["interimMailBody"], name, key))
+
 	view.interimRegistration()
 }
 
+/**
+ * 本登録の確認ページを表示する
+ * 確認メールのリンクから呼び出される
+ * メールソフトがリンクを先読みしても登録されないように、ここでは状態を変更せず POST で送信させる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func registrationForm(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	view := NewView(c, w, r)
+	view.confirm("本登録", "下のボタンを押すと本登録が完了します", "/registration", r.FormValue("key"))
+}
+
 /**
  * 本登録する
  * @function
@@ -301,24 +2507,142 @@ func interimRegistration(w http.ResponseWriter, r *http.Request) {
 func registration(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	key := r.FormValue("key")
-	
+
 	model := NewModel(c)
-	model.registration(key)
-	
-	view := NewView(c, w)
+	view := NewView(c, w, r)
+	err := model.registration(key)
+	if err == ErrMailAlreadyUsed {
+		c.Warningf("仮登録キー: %s のメールアドレスは既に本登録されています", key)
+		view.message("本登録", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		view.message("本登録", "本登録に失敗しました")
+		return
+	}
+
 	view.registration()
 }
 
+/**
+ * メールアドレスの変更を申請する
+ * 新しいアドレスへ確認リンクを送信する
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 申請できたらtrue
+ * @returns {Ajax JSON} message 失敗した時のエラーメッセージ
+ */
+func changeMail(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, user := getSessionUser(c, r)
+	mail := r.FormValue("mail")
+
+	if userKey == "" {
+		fmt.Fprintf(w, `{"result":false}`)
+		c.Warningf("ログインせずに changeMail() が呼び出されました")
+		return
+	}
+	verr := changeMailSchema.validate(changeMailSchema.formValues(r))
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
+	}
+
+	model := NewModel(c)
+	if user.Mail == "" {
+		fmt.Fprintf(w, `{"result":false, "message":"メールアドレスでのログインが連携されていません"}`)
+		return
+	}
+
+	key, err := model.requestMailChange(userKey, mail)
+	if err == ErrMailAlreadyUsed {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"メールアドレスの変更に失敗しました"}`)
+		return
+	}
+
+	body := fmt.Sprintf("%s 様\n\nメールアドレスの変更を受け付けました。\n以下のURLを24時間以内に開くと変更が完了します。\n\n%s/confirm_mail_change?key=%s\n\n心当たりがない場合はこのメールを破棄してください。\n", user.Name, siteUrl, key)
+	sendMail(c, mailSender, mail, "メールアドレス変更の確認", body)
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * メールアドレスの変更の確認ページを表示する
+ * 確認メールのリンクから呼び出される
+ * メールソフトがリンクを先読みしても変更されないように、ここでは状態を変更せず POST で送信させる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func confirmMailChangeForm(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	view := NewView(c, w, r)
+	view.confirm("メールアドレスの変更", "下のボタンを押すとメールアドレスの変更が完了します", "/confirm_mail_change", r.FormValue("key"))
+}
+
+/**
+ * メールアドレスの変更を確定する
+ * 確認ページから POST で呼び出される
+ * 変更後は古いアドレスへ通知を送る
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func confirmMailChange(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	key := r.FormValue("key")
+
+	model := NewModel(c)
+	view := NewView(c, w, r)
+	oldMail, newMail, err := model.confirmMailChange(key)
+	if err == ErrMailAlreadyUsed || err == ErrMailChangeExpired {
+		view.message("メールアドレスの変更", err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		view.message("メールアドレスの変更", "メールアドレスの変更に失敗しました")
+		return
+	}
+
+	if oldMail != "" {
+		body := fmt.Sprintf("アカウントのメールアドレスが %s に変更されました。\n\n心当たりがない場合は管理者へ連絡してください。\n", newMail)
+		sendMail(c, mailSender, oldMail, "メールアドレス変更のお知らせ", body)
+	}
+	view.message("メールアドレスの変更", "メールアドレスを変更しました")
+}
+
 /**
  * ゲーム一覧の表示
+ * sort で並び順を、q で絞り込みを、cursor でページを指定する
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
  */
 func gamelist(w http.ResponseWriter, r *http.Request) {
 	userKey := session(w, r)
+	if userKey == "" {
+		return
+	}
 	c := appengine.NewContext(r)
-	view := NewView(c, w)
-	view.gamelist(userKey)
+	view := NewView(c, w, r)
+	params := gameListSchema.formValues(r)
+	verr := gameListSchema.validate(params)
+	if verr != nil {
+		view.message("ゲーム一覧", verr.Error())
+		return
+	}
+
+	model := NewModel(c)
+	games, next, err := model.getGamePage(userKey, params["sort"], params["q"], params["cursor"], gameListPageSize)
+	if err == ErrInvalidCursor {
+		view.message("ゲーム一覧", err.Error())
+		return
+	}
+	check(c, err)
+	view.gamelist(userKey, games, params["sort"], params["q"], next, model.getTrashedGames(userKey))
 }
 
 /**
@@ -328,67 +2652,100 @@ func gamelist(w http.ResponseWriter, r *http.Request) {
  */
 func addGame(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
+	userKey, _ := getSessionUser(c, r)
 	gameName := r.FormValue("game_name")
 	gameDescription := r.FormValue("game_description")
 	
-	if gameName == "" {
-		fmt.Fprintf(w, `{"result": false}`)
-		c.Warningf("空のゲーム名でゲームを作成しようとしました")
-	} else if gameDescription == "" {
-		fmt.Fprintf(w, `{"result": false}`)
-		c.Warningf("ゲーム説明文が空のゲームを作成しようとしました")
-	}
-
-	sessionId := getSession(c, r)
-	if sessionId == "" {
-		fmt.Fprintf(w, `{"result": false}`)
-		c.Warningf("セッションIDなしでゲームを作成しようとしました")
+	verr := addGameSchema.validate(addGameSchema.formValues(r))
+	if verr != nil {
+		validationError(c, w, r, verr)
+		return
 	}
 	
 	model := NewModel(c)
-	userKey := model.getUserKeyFromSession(sessionId)
 	params := make(map[string]string, 4)
 	params["name"] = gameName
 	params["description"] = gameDescription
 	params["thumbnail"] = ""
 	params["user_key"] = userKey
 	game := model.NewGame(params)
-	model.addGame(game)
+	gameKey := model.addGame(game)
 	
-	fmt.Fprintf(w, `{"result":true, "name":"%s", "description":"%s"}`, gameName, gameDescription)
+	result := map[string]interface{}{
+		"result": true,
+		"key": gameKey,
+		"name": gameName,
+		"description": gameDescription,
+	}
+	bytes, err := json.Marshal(result)
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
 }
 
 /**
  * ゲームの削除
+ * ゲームはゴミ箱に移し、30日後に cron で完全に削除する
  * ゲームの所有者しか削除することはできない
+ * 所有者の確認は ownGame() で行う
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
  */
 func deleteGame(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	sessionId := getSession(c, r)
-	gameKey := r.FormValue("game_key")
-	
-	if sessionId == "" {
+	ctx := requestContext(r)
+	c := ctx.c
+	model := NewModel(c)
+	err := model.trashGame(ctx.GameKey)
+	if err != nil {
+		c.Errorf(err.Error())
 		fmt.Fprintf(w, `{"result":false}`)
-		c.Warningf("セッションIDなしで deleteGame() が呼び出されました")
 		return
-	} else if gameKey == "" {
-		fmt.Fprintf(w, `{"result":false}`)
-		c.Warningf("ゲームキー無しで deleteGame() が呼び出されました")
+	}
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * ゴミ箱のゲームを元に戻す
+ * 所有者の確認は ownTrashedGame() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func restoreGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
+	model := NewModel(c)
+	_, err := model.restoreGame(ctx.GameKey)
+	if err == ErrTrashExpired {
+		fmt.Fprintf(w, `{"result":false, "message":"%s"}`, err.Error())
+		return
+	} else if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"ゲームを元に戻せませんでした"}`)
 		return
 	}
-	
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * ゴミ箱のゲームをすぐに完全に削除する
+ * 所有者の確認は ownTrashedGame() で行う
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func purgeGame(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	c := ctx.c
 	model := NewModel(c)
-	userKey := model.getUserKeyFromSession(sessionId)
-	game := model.getGame(gameKey)
-	if game.UserKey != userKey {
-		fmt.Fprintf(w, `{"result":false}`)
-		c.Warningf("ユーザキー: %s が他のユーザのゲームを削除しようとしました", userKey)
+	err := model.purgeGame(ctx.GameKey)
+	if err != nil {
+		c.Errorf(err.Error())
+		fmt.Fprintf(w, `{"result":false, "message":"ゲームを削除できませんでした"}`)
 		return
 	}
-	
-	model.deleteGame(gameKey)
+	audit(c, r, ctx.UserKey, "purge_game", fmt.Sprintf("ゲームキー: %s", ctx.GameKey))
 	fmt.Fprintf(w, `{"result":true}`)
 }
 
@@ -427,9 +2784,13 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 	model := NewModel(c)
 	users := model.getAllUser()
 	
-	result := make(map[string]string, len(users))
+	result := make(map[string]map[string]string, len(users))
 	for key, val := range users {
-		result[key] = val.Name
+		role := val.Role
+		if role == "" {
+			role = defaultRole
+		}
+		result[key] = map[string]string{"name": val.Name, "role": role}
 	}
 	
 	bytes, err := json.Marshal(result)
@@ -437,9 +2798,136 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", bytes)
 }
 
+/**
+ * ユーザの権限を変更する
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {Ajax JSON} result 成功したらtrue
+ */
+func setUserRole(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	adminKey, _ := getSessionUser(c, r)
+	userKey := r.FormValue("user_key")
+	role := r.FormValue("role")
+
+	model := NewModel(c)
+	err := model.setUserRole(userKey, role)
+	if err != nil {
+		c.Warningf(err.Error())
+		fmt.Fprintf(w, `{"result":false}`)
+		return
+	}
+
+	audit(c, r, adminKey, "set_role", fmt.Sprintf("ユーザキー: %s 権限: %s", userKey, role))
+	fmt.Fprintf(w, `{"result":true}`)
+}
+
+/**
+ * 監査ログの取得
+ * Ajax で呼び出す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func getAuditLogs(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	model := NewModel(c)
+	logs := model.getAuditLogs(100)
+
+	bytes, err := json.Marshal(logs)
+	check(c, err)
+	fmt.Fprintf(w, "%s", bytes)
+}
+
+/**
+ * 最初の管理者を登録できるか確かめる
+ * 管理者が一人もいない時だけ、App Engine のプロジェクト管理者としてログインしていれば登録できる
+ * 登録できなければ応答を書き込んで ok に false を返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {string} returnUrl App Engine のログイン後に戻る URL
+ * @returns {string} userKey ログインしているユーザのキー
+ * @returns {*User} user ログインしているユーザ
+ * @returns {bool} ok 登録できるならtrue
+ */
+func checkBootstrapAdmin(c appengine.Context, w http.ResponseWriter, r *http.Request, returnUrl string) (string, *User, bool) {
+	userKey, user := getSessionUser(c, r)
+	if user == nil {
+		http.Redirect(w, r, "/", 302)
+		return "", nil, false
+	}
+
+	if appengineuser.Current(c) == nil {
+		loginUrl, err := appengineuser.LoginURL(c, returnUrl)
+		check(c, err)
+		http.Redirect(w, r, loginUrl, 302)
+		return "", nil, false
+	}
+	if !appengineuser.IsAdmin(c) {
+		audit(c, r, userKey, "forbidden", "App Engine の管理者でないユーザが管理者の登録を試みました")
+		forbidden(c, w, r, "このページを表示する権限がありません")
+		return "", nil, false
+	}
+	if NewModel(c).existAdmin() {
+		audit(c, r, userKey, "forbidden", "管理者が既に存在する状態で管理者の登録を試みました")
+		forbidden(c, w, r, "管理者は既に登録されています")
+		return "", nil, false
+	}
+	return userKey, user, true
+}
+
+/**
+ * 最初の管理者の登録の確認ページ
+ * GET では登録せず、確認ボタンで /bootstrap_admin へ POST させる
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func bootstrapAdminForm(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	_, user, ok := checkBootstrapAdmin(c, w, r, r.URL.String())
+	if !ok {
+		return
+	}
+	view := NewView(c, w, r)
+	view.confirm("管理者の登録", fmt.Sprintf("%s を管理者にしますか？", user.Name), "/bootstrap_admin", "")
+}
+
+/**
+ * 最初の管理者を登録する
+ * 管理者が一人もいない時だけ、App Engine のプロジェクト管理者としてログインしていれば
+ * 現在ログインしているユーザを管理者にする
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func bootstrapAdmin(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	userKey, user, ok := checkBootstrapAdmin(c, w, r, "/bootstrap_admin")
+	if !ok {
+		return
+	}
+
+	model := NewModel(c)
+	err := model.setUserRole(userKey, "admin")
+	view := NewView(c, w, r)
+	if err != nil {
+		c.Errorf(err.Error())
+		view.message("管理者の登録", "管理者の登録に失敗しました")
+		return
+	}
+	audit(c, r, userKey, "bootstrap_admin", fmt.Sprintf("App Engine 管理者: %s", appengineuser.Current(c).Email))
+	view.message("管理者の登録", fmt.Sprintf("%s を管理者にしました", user.Name))
+}
+
 /**
  * セッションを開始する
  * ユーザーキーに関連付いたセッションIDを生成して memcache, cookie に保存する。
+ * 退会を申請中のユーザのセッションは getSessionUser で拒否されるので、ログインした時点で申請を取り消す
  * @function
  * @param w {http.ResponseWriter} w 応答先
  * @param r {*http.Request} r リクエスト
@@ -449,6 +2937,14 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 func startSession(w http.ResponseWriter, r *http.Request, key string) {
 	c := appengine.NewContext(r)
 	model := NewModel(c)
+	if !model.getUser(key).DeleteAt.IsZero() {
+		err := model.cancelAccountDeletion(key)
+		if err != nil {
+			c.Errorf(err.Error())
+		} else {
+			audit(c, r, key, "cancel_account_deletion", "ログインによる取り消し")
+		}
+	}
 	sessionId := model.startSession(key)
 	cookie := NewCookie("escape3ds", sessionId, "localhost", "/", 24)
 	http.SetCookie(w, cookie)
@@ -506,6 +3002,7 @@ func deleteCookie(w http.ResponseWriter) {
  * クライアントがセッションIDを持っているかどうか調べて
  * 持っていなければトップページへ飛ばして空文字を返す
  * 持っていたら対応するユーザIDを返す
+ * 削除されたユーザや退会を申請中のユーザのセッションは getSessionUser と同じく持っていないものとして扱う
  * @function
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
@@ -520,10 +3017,9 @@ func session(w http.ResponseWriter, r *http.Request) string {
 		return ""
 	}
 	
-	model := NewModel(c)
-	userKey := model.getUserKeyFromSession(sessionId)
+	userKey, _ := getSessionUser(c, r)
 	if userKey == "" {
-		c.Warningf("セッションID: %s に該当するユーザーキが存在しません")
+		c.Warningf("セッションID: %s に該当するユーザーが存在しません", sessionId)
 		http.Redirect(w, r, "/", 302)
 		return ""
 	}
@@ -0,0 +1,134 @@
+/**
+ * CSRF 対策
+ * 状態を変更するリクエストにはページ表示時に埋め込んだトークンを要求する
+ * ログイン済みならセッションごとのトークン、未ログインならクッキーに保存したトークンを使う
+ * @file
+ */
+package escape3ds
+
+import (
+	"appengine"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+)
+
+/**
+ * 未ログイン時のトークンを保存するクッキーの名前
+ * @const
+ */
+const csrfCookieName = "escape3ds_csrf"
+
+/**
+ * フォームでトークンを送信する時のパラメータ名
+ * @const
+ */
+const csrfFormName = "csrf_token"
+
+/**
+ * Ajax でトークンを送信する時のヘッダ名
+ * @const
+ */
+const csrfHeaderName = "X-CSRF-Token"
+
+/**
+ * 現在のリクエストで有効なCSRFトークンを返す
+ * ログイン済みならセッションのトークンを返す
+ * 未ログインならクッキーのトークンを返し、無ければ作成してクッキーに保存する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @returns {string} CSRFトークン
+ */
+func csrfToken(c appengine.Context, w http.ResponseWriter, r *http.Request) string {
+	token := expectedCsrfToken(c, r)
+	if token != "" {
+		return token
+	}
+
+	token = getSecureRandomString(32)
+	cookie := NewCookie(csrfCookieName, token, "localhost", "/", 24)
+	http.SetCookie(w, cookie)
+	return token
+}
+
+/**
+ * リクエストに対して期待されるCSRFトークンを返す
+ * トークンが発行されていない場合は空文字を返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*http.Request} r リクエスト
+ * @returns {string} CSRFトークンまたは空文字
+ */
+func expectedCsrfToken(c appengine.Context, r *http.Request) string {
+	sessionId := getSession(c, r)
+	if sessionId != "" {
+		model := NewModel(c)
+		token := model.getCsrfTokenFromSession(sessionId)
+		if token != "" {
+			return token
+		}
+	}
+
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+/**
+ * リクエストに含まれるCSRFトークンが正しいかどうか調べる
+ * トークンはヘッダ、フォームの順に探す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*http.Request} r リクエスト
+ * @returns {bool} 正しければtrue
+ */
+func validCsrfToken(c appengine.Context, r *http.Request) bool {
+	expected := expectedCsrfToken(c, r)
+	if expected == "" {
+		return false
+	}
+
+	actual := r.Header.Get(csrfHeaderName)
+	if actual == "" {
+		actual = r.FormValue(csrfFormName)
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+/**
+ * 安全なメソッドかどうか調べる
+ * 安全なメソッドはサーバの状態を変更しないのでトークンを検証しない
+ * @function
+ * @param {string} method HTTPメソッド
+ * @returns {bool} GET/HEAD/OPTIONS ならtrue
+ */
+func isSafeMethod(method string) bool {
+	return exist([]string{"GET", "HEAD", "OPTIONS"}, method)
+}
+
+/**
+ * CSRFトークンを検証するミドルウェア
+ * 安全でないメソッドのリクエストでトークンが正しくなければ 403 を返す
+ * @function
+ * @param {http.HandlerFunc} handler 保護する処理
+ * @returns {http.HandlerFunc} トークンを検証してから handler を呼び出す処理
+ */
+func csrfProtect(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isSafeMethod(r.Method) {
+			c := appengine.NewContext(r)
+			if !validCsrfToken(c, r) {
+				c.Warningf("CSRFトークンが不正なリクエストを拒否しました: %s %s", r.Method, r.URL.Path)
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, `{"result":false, "error":"invalid_csrf_token", "message":"不正なリクエストです。ページを再読み込みしてからやり直してください"}`)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
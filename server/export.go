@@ -0,0 +1,399 @@
+/**
+ * 個人データのエクスポート
+ * プロフィールとすべてのゲームを素材ごと ZIP にまとめる
+ * ゲームは他のツールでも読めるように、データストアの構造に依存しない JSON で書き出す
+ * App Engine は応答を 32MB までしか返せないので、素材は一定数ごとに別の ZIP に分ける
+ * @file
+ */
+package escape3ds
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+)
+
+/**
+ * エクスポートしたゲームの形式名
+ * @const
+ */
+const gameExportFormat = "escape3ds-game"
+
+/**
+ * エクスポートしたゲームの形式のバージョン
+ * 互換性の無い変更をしたら上げる
+ * @const
+ */
+const gameExportVersion = 1
+
+/**
+ * 素材を入れる ZIP 1つあたりの素材の数
+ * 最大サイズの素材だけでも 18MB 程度に収まり、応答の上限 (32MB) を超えない
+ * @const
+ */
+const exportAssetsPerPart = 20
+
+/**
+ * エクスポートするプロフィール
+ * @struct
+ */
+type profileExport struct {
+	Key string `json:"key"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Handle string `json:"handle,omitempty"`
+	Bio string `json:"bio,omitempty"`
+	Language string `json:"language,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+	Mail string `json:"mail,omitempty"`
+	Role string `json:"role"`
+	TotpEnabled bool `json:"totp_enabled"`
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+	AssetParts int `json:"asset_parts"`
+	Identities []identityExport `json:"identities"`
+	Games []string `json:"games"`
+	Drafts []draftExport `json:"drafts"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+/**
+ * エクスポートする連携アカウント
+ * @struct
+ */
+type identityExport struct {
+	Provider string `json:"provider"`
+	OAuthId string `json:"oauth_id"`
+	Name string `json:"name"`
+	Date time.Time `json:"date"`
+}
+
+/**
+ * エクスポートする下書き
+ * 他のユーザのゲームの下書きも含む
+ * @struct
+ */
+type draftExport struct {
+	GameKey string `json:"game_key"`
+	BaseRevision int `json:"base_revision"`
+	Content json.RawMessage `json:"content"`
+	Date time.Time `json:"date"`
+}
+
+/**
+ * エクスポートするゲーム
+ * @struct
+ */
+type gameExport struct {
+	Format string `json:"format"`
+	Version int `json:"version"`
+	Key string `json:"key"`
+	Name string `json:"name"`
+	Description string `json:"description"`
+	Thumbnail string `json:"thumbnail"`
+	FirstScene string `json:"first_scene"`
+	Published bool `json:"published"`
+	Settings json.RawMessage `json:"settings"`
+	Content json.RawMessage `json:"content"`
+	Revision int `json:"revision"`
+	Tags []string `json:"tags"`
+	Difficulty string `json:"difficulty"`
+	Length string `json:"length"`
+	Theme string `json:"theme"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Deleted *time.Time `json:"deleted,omitempty"`
+	Collaborators []collaboratorExport `json:"collaborators"`
+	Revisions []revisionExport `json:"revisions"`
+	Assets []assetExport `json:"assets"`
+}
+
+/**
+ * エクスポートする共同編集者
+ * @struct
+ */
+type collaboratorExport struct {
+	UserKey string `json:"user_key"`
+	Role string `json:"role"`
+	Date time.Time `json:"date"`
+}
+
+/**
+ * エクスポートするリビジョン
+ * 内容は含めず、履歴だけを書き出す
+ * @struct
+ */
+type revisionExport struct {
+	Number int `json:"number"`
+	UserKey string `json:"user_key"`
+	Message string `json:"message"`
+	RestoredFrom int `json:"restored_from,omitempty"`
+	Date time.Time `json:"date"`
+}
+
+/**
+ * エクスポートする素材
+ * 中身は Part 番目の素材の ZIP 内の Path に置く
+ * @struct
+ */
+type assetExport struct {
+	Key string `json:"key"`
+	Name string `json:"name"`
+	ContentType string `json:"content_type"`
+	Path string `json:"path"`
+	Part int `json:"part"`
+	Date time.Time `json:"date"`
+}
+
+/**
+ * 書き出す素材のキーを ZIP ごとに分けて返す
+ * ゲームのキー順、素材のキー順に並べて exportAssetsPerPart 個ずつに分ける
+ * データが変わらなければ何度呼んでも同じ分け方になる
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {map[string]*Game} games ユーザのゲーム
+ * @returns {[][]*datastore.Key} ZIP ごとの素材のキー
+ * @returns {error} エラー
+ */
+func exportAssetParts(c appengine.Context, games map[string]*Game) ([][]*datastore.Key, error) {
+	gameKeys := make([]string, 0, len(games))
+	for gameKey := range games {
+		gameKeys = append(gameKeys, gameKey)
+	}
+	sort.Strings(gameKeys)
+
+	parts := make([][]*datastore.Key, 0)
+	var part []*datastore.Key
+	for _, gameKey := range gameKeys {
+		keys, err := datastore.NewQuery("Asset").Filter("GameKey =", gameKey).Order("__key__").KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			part = append(part, key)
+			if len(part) == exportAssetsPerPart {
+				parts = append(parts, part)
+				part = nil
+			}
+		}
+	}
+	if len(part) > 0 {
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+/**
+ * 素材を置く ZIP 内のパスを返す
+ * @function
+ * @param {string} gameKey エンコード済みのゲームキー
+ * @param {string} assetKey エンコード済みの素材キー
+ * @param {*Asset} asset 素材
+ * @returns {string} assets/{ゲームキー}/{素材キー}/{ファイル名}
+ */
+func assetExportPath(gameKey string, assetKey string, asset *Asset) string {
+	return fmt.Sprintf("assets/%s/%s/%s", gameKey, assetKey, path.Base("/" + asset.Name))
+}
+
+/**
+ * ユーザの個人データを ZIP で書き出す
+ * profile.json、games/{ゲームキー}.json、assets/avatar/{ファイル名} を含む
+ * ゲームの素材の中身は含めず、どの ZIP のどこにあるかだけを書く
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {io.Writer} w 書き出し先
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {[][]*datastore.Key} parts exportAssetParts で分けた素材のキー
+ * @returns {error} エラー
+ */
+func writeAccountExport(c appengine.Context, w io.Writer, userKey string, parts [][]*datastore.Key) error {
+	model := NewModel(c)
+	user := model.getUser(userKey)
+	games := model.getGameList(userKey)
+	archive := zip.NewWriter(w)
+
+	profile := profileExport{
+		Key: userKey,
+		Type: user.Type,
+		Name: user.Name,
+		Handle: user.Handle,
+		Bio: user.Bio,
+		Language: user.Language,
+		Mail: user.Mail,
+		Role: user.Role,
+		TotpEnabled: user.TotpEnabled,
+		AssetParts: len(parts),
+		Identities: make([]identityExport, 0),
+		Games: make([]string, 0, len(games)),
+		Drafts: make([]draftExport, 0),
+		ExportedAt: time.Now(),
+	}
+	if profile.Role == "" {
+		profile.Role = defaultRole
+	}
+	if !user.DeleteAt.IsZero() {
+		profile.DeleteAt = &user.DeleteAt
+	}
+	if user.Avatar != "" {
+		asset := model.getAsset(user.Avatar)
+		if asset != nil {
+			profile.Avatar = fmt.Sprintf("assets/avatar/%s", path.Base("/" + asset.Name))
+			err := writeZipFile(archive, profile.Avatar, asset.Date, asset.Data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, identity := range model.getIdentities(userKey) {
+		profile.Identities = append(profile.Identities, identityExport{identity.Provider, identity.OAuthId, identity.Name, identity.Date})
+	}
+	assetParts := make(map[string]int)
+	for i, part := range parts {
+		for _, key := range part {
+			assetParts[key.Encode()] = i + 1
+		}
+	}
+	for gameKey, draft := range model.getDrafts(userKey) {
+		profile.Drafts = append(profile.Drafts, draftExport{gameKey, draft.BaseRevision, json.RawMessage(draft.Content), draft.Date})
+	}
+
+	for gameKey, game := range games {
+		profile.Games = append(profile.Games, fmt.Sprintf("games/%s.json", gameKey))
+		export := gameExport{
+			Format: gameExportFormat,
+			Version: gameExportVersion,
+			Key: gameKey,
+			Name: game.Name,
+			Description: game.Description,
+			Thumbnail: game.Thumbnail,
+			FirstScene: game.FirstScene,
+			Published: game.Published,
+			Settings: game.settings(),
+			Content: game.content(),
+			Revision: game.Revision,
+			Tags: game.Tags,
+			Difficulty: game.Difficulty,
+			Length: game.Length,
+			Theme: game.Theme,
+			Created: game.Created,
+			Updated: game.Updated,
+			Collaborators: make([]collaboratorExport, 0),
+			Revisions: make([]revisionExport, 0),
+			Assets: make([]assetExport, 0),
+		}
+		for _, collaborator := range model.getCollaborators(gameKey) {
+			export.Collaborators = append(export.Collaborators, collaboratorExport{collaborator.UserKey, collaborator.Role, collaborator.Date})
+		}
+		if game.trashed() {
+			export.Deleted = &game.Deleted
+		}
+		for cursor := ""; ; {
+			revisions, next, err := model.getRevisionPage(gameKey, cursor, 100)
+			if err != nil {
+				return err
+			}
+			for _, revision := range revisions {
+				export.Revisions = append(export.Revisions, revisionExport{revision.Number, revision.UserKey, revision.Message, revision.RestoredFrom, revision.Date})
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		// 中身は書き出さないので、すべてを一度に読み込まずに1つずつ読む
+		iterator := datastore.NewQuery("Asset").Filter("GameKey =", gameKey).Order("__key__").Run(c)
+		for {
+			asset := new(Asset)
+			key, err := iterator.Next(asset)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return err
+			}
+			assetKey := key.Encode()
+			export.Assets = append(export.Assets, assetExport{assetKey, asset.Name, asset.ContentType, assetExportPath(gameKey, assetKey, asset), assetParts[assetKey], asset.Date})
+		}
+		err := writeZipJSON(archive, fmt.Sprintf("games/%s.json", gameKey), export)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writeZipJSON(archive, "profile.json", profile)
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+/**
+ * ゲームの素材の中身を ZIP で書き出す
+ * パスは writeAccountExport で書いた games/{ゲームキー}.json の path と同じになる
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {io.Writer} w 書き出し先
+ * @param {[]*datastore.Key} keys 書き出す素材のキー
+ * @returns {error} エラー
+ */
+func writeAssetExport(c appengine.Context, w io.Writer, keys []*datastore.Key) error {
+	assets := make([]Asset, len(keys))
+	err := datastore.GetMulti(c, keys, assets)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	for i, key := range keys {
+		asset := &assets[i]
+		err = writeZipFile(archive, assetExportPath(asset.GameKey, key.Encode(), asset), asset.Date, asset.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+/**
+ * ZIP にファイルを追加する
+ * @function
+ * @param {*zip.Writer} archive 追加先
+ * @param {string} name ZIP 内のパス
+ * @param {time.Time} date 更新日時
+ * @param {[]byte} data ファイルの中身
+ * @returns {error} エラー
+ */
+func writeZipFile(archive *zip.Writer, name string, date time.Time, data []byte) error {
+	header := &zip.FileHeader{
+		Name: name,
+		Method: zip.Deflate,
+	}
+	header.SetModTime(date)
+	file, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return err
+}
+
+/**
+ * ZIP に JSON ファイルを追加する
+ * 人が読めるように字下げする
+ * @function
+ * @param {*zip.Writer} archive 追加先
+ * @param {string} name ZIP 内のパス
+ * @param {interface{}} value JSON にする値
+ * @returns {error} エラー
+ */
+func writeZipJSON(archive *zip.Writer, name string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeZipFile(archive, name, time.Now(), data)
+}
@@ -0,0 +1,400 @@
+/**
+ * 共同編集のライブ配信
+ * ゲームごとのチャンネルで、シーン、イベント、アイテムの変更と在席状況 (誰がどのシーンを見ているか)、シーンのロックを
+ * 開いているすべてのエディタへ Server-Sent Events で配信する
+ * 外部のサービスを使わず、インスタンス内のブローカーで配信する
+ * そのため同じゲームを編集する接続は同じインスタンスに届く必要がある (開発サーバや1インスタンスの構成を想定している)
+ * 変更にはチャンネル内の連番を付けて、すべてのエディタが同じ順に適用するようにする
+ * 接続が切れたエディタは Last-Event-ID で続きから受け取れる
+ * @file
+ */
+package escape3ds
+
+import (
+	"appengine"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/**
+ * チャンネルが再送のために保持するイベントの数
+ * @const
+ */
+const liveBacklogSize = 200
+
+/**
+ * 購読者ごとの送信待ちのイベントの数
+ * 溢れた購読者は切断し、再接続時に再送させる
+ * @const
+ */
+const liveBufferSize = 64
+
+/**
+ * 在席状況を更新しなかったユーザを退席とみなすまでの時間
+ * @const
+ */
+const livePresenceTimeout = time.Minute
+
+/**
+ * 変更の内容を検証する
+ * 空文字 (削除) か JSON の値に限る
+ * @function
+ * @param {string} data 変更の内容
+ * @returns {error} エラー
+ */
+func validateLiveChangeData(data string) error {
+	if len(data) > liveChangeMaxLength {
+		return fmt.Errorf("変更の内容は%dバイト以内にしてください", liveChangeMaxLength)
+	}
+	if data == "" {
+		return nil
+	}
+	var value interface{}
+	if json.Unmarshal([]byte(data), &value) != nil {
+		return errors.New("変更の内容は JSON で指定してください")
+	}
+	return nil
+}
+
+/**
+ * 1回の接続でイベントを待つ最大の時間
+ * リクエストの期限より短くする
+ * @const
+ */
+const liveStreamTimeout = 25 * time.Second
+
+/**
+ * 接続が終わってから EventSource が再接続するまでの時間
+ * @const
+ */
+const liveRetry = 500 * time.Millisecond
+
+/**
+ * 配信するイベント
+ * @struct
+ * @property {int64} Id チャンネル内の連番
+ * @property {string} Type 種類 (change, presence, locks, reset)
+ * @property {[]byte} Data JSON
+ */
+type liveEvent struct {
+	Id int64
+	Type string
+	Data []byte
+}
+
+/**
+ * 共同編集での変更
+ * @struct
+ * @property {string} Target 変更したもの (scene, event, item)
+ * @property {string} Op 操作 (add, update, remove)
+ * @property {string} Id 変更したもののID
+ * @property {string} Scene 変更したシーンの ID、イベントならイベントのあるシーン、アイテムなら空文字
+ * @property {json.RawMessage} Data 変更後の内容、削除なら null
+ * @property {string} UserKey 変更したユーザのエンコード済みキー
+ * @property {string} ClientId 変更したエディタのID、自分の変更を見分けるのに使う
+ * @property {time.Time} Date 変更日時
+ */
+type liveChange struct {
+	Target string `json:"target"`
+	Op string `json:"op"`
+	Id string `json:"id"`
+	Scene string `json:"scene,omitempty"`
+	Data json.RawMessage `json:"data"`
+	UserKey string `json:"user_key"`
+	ClientId string `json:"client_id"`
+	Date time.Time `json:"date"`
+}
+
+/**
+ * 在席しているユーザ
+ * @struct
+ * @property {string} UserKey ユーザのエンコード済みキー
+ * @property {string} Name 表示名
+ * @property {string} Scene 見ているシーンのID、シーンを選んでいなければ空文字
+ * @property {time.Time} Seen 最後に在席を確認した日時
+ */
+type livePresence struct {
+	UserKey string `json:"user_key"`
+	Name string `json:"name"`
+	Scene string `json:"scene"`
+	Seen time.Time `json:"seen"`
+}
+
+/**
+ * イベントの購読者
+ * @struct
+ * @property {chan liveEvent} events 送信待ちのイベント、購読を解除すると閉じる
+ */
+type liveSubscriber struct {
+	events chan liveEvent
+}
+
+/**
+ * ゲームごとのチャンネル
+ * @struct
+ * @property {int64} seq 最後に配信したイベントの連番
+ * @property {[]liveEvent} backlog 再送のために保持するイベント
+ * @property {map[*liveSubscriber]bool} subscribers 購読者
+ * @property {map[string]*livePresence} presence ユーザキーと在席状況の対応表
+ */
+type liveChannel struct {
+	seq int64
+	backlog []liveEvent
+	subscribers map[*liveSubscriber]bool
+	presence map[string]*livePresence
+}
+
+/**
+ * インスタンス内のブローカー
+ * @class
+ */
+type liveBroker struct {
+	sync.Mutex
+	channels map[string]*liveChannel
+}
+
+/**
+ * ブローカーを作成する
+ * @function
+ * @returns {*liveBroker} ブローカー
+ */
+func newLiveBroker() *liveBroker {
+	return &liveBroker{channels: make(map[string]*liveChannel)}
+}
+
+/**
+ * アプリケーションで共有するブローカー
+ * @var
+ */
+var broker = newLiveBroker()
+
+/**
+ * ゲームのチャンネルを返す
+ * 無ければ作成する
+ * ロックを取得してから呼び出すこと
+ * @method
+ * @memberof liveBroker
+ * @param {string} gameKey エンコード済みのゲームキー
+ * @returns {*liveChannel} チャンネル
+ */
+func (this *liveBroker) channel(gameKey string) *liveChannel {
+	channel := this.channels[gameKey]
+	if channel == nil {
+		channel = &liveChannel{
+			subscribers: make(map[*liveSubscriber]bool),
+			presence: make(map[string]*livePresence),
+		}
+		this.channels[gameKey] = channel
+	}
+	return channel
+}
+
+/**
+ * イベントに連番を付けて購読者へ配信する
+ * 送信待ちが溢れた購読者は切断する
+ * ロックを取得してから呼び出すこと
+ * @method
+ * @memberof liveChannel
+ * @param {string} eventType 種類
+ * @param {[]byte} data JSON
+ * @returns {int64} 付けた連番
+ */
+func (this *liveChannel) publish(eventType string, data []byte) int64 {
+	this.seq++
+	event := liveEvent{this.seq, eventType, data}
+	this.backlog = append(this.backlog, event)
+	if len(this.backlog) > liveBacklogSize {
+		this.backlog = this.backlog[len(this.backlog) - liveBacklogSize:]
+	}
+	for subscriber := range this.subscribers {
+		select {
+		case subscriber.events <- event:
+		default:
+			delete(this.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+	return this.seq
+}
+
+/**
+ * 退席とみなす時間を過ぎたユーザを在席状況から取り除く
+ * ロックを取得してから呼び出すこと
+ * @method
+ * @memberof liveChannel
+ * @param {time.Time} now 現在時刻
+ */
+func (this *liveChannel) prunePresence(now time.Time) {
+	for userKey, presence := range this.presence {
+		if now.Sub(presence.Seen) > livePresenceTimeout {
+			delete(this.presence, userKey)
+		}
+	}
+}
+
+/**
+ * 在席状況の一覧を JSON にする
+ * ロックを取得してから呼び出すこと
+ * @method
+ * @memberof liveChannel
+ * @param {time.Time} now 現在時刻
+ * @returns {[]byte} 在席しているユーザの配列の JSON
+ */
+func (this *liveChannel) presenceJSON(now time.Time) []byte {
+	this.prunePresence(now)
+	list := make([]*livePresence, 0, len(this.presence))
+	for _, presence := range this.presence {
+		list = append(list, presence)
+	}
+	data, _ := json.Marshal(list)
+	return data
+}
+
+/**
+ * チャンネルを購読する
+ * lastId より後のイベントが残っていれば、それも返す
+ * 残っていなければ再読み込みを促す reset イベントを返す
+ * 最後に現在の在席状況を返す
+ * @method
+ * @memberof liveBroker
+ * @param {string} gameKey エンコード済みのゲームキー
+ * @param {int64} lastId 受け取った最後のイベントの連番、初めての接続なら0
+ * @returns {*liveSubscriber} 購読者
+ * @returns {[]liveEvent} 再送するイベント
+ */
+func (this *liveBroker) subscribe(gameKey string, lastId int64) (*liveSubscriber, []liveEvent) {
+	this.Lock()
+	defer this.Unlock()
+	channel := this.channel(gameKey)
+	subscriber := &liveSubscriber{make(chan liveEvent, liveBufferSize)}
+	channel.subscribers[subscriber] = true
+
+	// 連番が戻っている場合はインスタンスが再起動したので、続きを送れない
+	missed := make([]liveEvent, 0)
+	if lastId > 0 && lastId != channel.seq {
+		if lastId > channel.seq || len(channel.backlog) == 0 || channel.backlog[0].Id > lastId + 1 {
+			missed = append(missed, liveEvent{channel.seq, "reset", []byte("{}")})
+		} else {
+			for _, event := range channel.backlog {
+				if event.Id > lastId {
+					missed = append(missed, event)
+				}
+			}
+		}
+	}
+	missed = append(missed, liveEvent{channel.seq, "presence", channel.presenceJSON(time.Now())})
+	return subscriber, missed
+}
+
+/**
+ * 購読を解除する
+ * 購読者がいなくなり、在席しているユーザもいなくなったチャンネルは破棄する
+ * @method
+ * @memberof liveBroker
+ * @param {string} gameKey エンコード済みのゲームキー
+ * @param {*liveSubscriber} subscriber 購読者
+ */
+func (this *liveBroker) unsubscribe(gameKey string, subscriber *liveSubscriber) {
+	this.Lock()
+	defer this.Unlock()
+	channel := this.channels[gameKey]
+	if channel == nil {
+		return
+	}
+	if channel.subscribers[subscriber] {
+		delete(channel.subscribers, subscriber)
+		close(subscriber.events)
+	}
+	channel.prunePresence(time.Now())
+	if len(channel.subscribers) == 0 && len(channel.presence) == 0 {
+		delete(this.channels, gameKey)
+	}
+}
+
+/**
+ * 変更を配信する
+ * @method
+ * @memberof liveBroker
+ * @param {string} gameKey エンコード済みのゲームキー
+ * @param {*liveChange} change 変更
+ * @returns {int64} 変更に付けた連番
+ */
+func (this *liveBroker) publishChange(gameKey string, change *liveChange) int64 {
+	data, _ := json.Marshal(change)
+	this.Lock()
+	defer this.Unlock()
+	return this.channel(gameKey).publish("change", data)
+}
+
+/**
+ * シーンのロックの一覧を配信する
+ * @method
+ * @memberof liveBroker
+ * @param {string} gameKey エンコード済みのゲームキー
+ * @param {[]byte} locks ロックの配列の JSON
+ */
+func (this *liveBroker) publishLocks(gameKey string, locks []byte) {
+	this.Lock()
+	defer this.Unlock()
+	this.channel(gameKey).publish("locks", locks)
+}
+
+/**
+ * ユーザの在席状況を更新して配信する
+ * @method
+ * @memberof liveBroker
+ * @param {string} gameKey エンコード済みのゲームキー
+ * @param {*livePresence} presence 在席状況
+ * @param {bool} leave 退席するならtrue
+ */
+func (this *liveBroker) updatePresence(gameKey string, presence *livePresence, leave bool) {
+	this.Lock()
+	defer this.Unlock()
+	channel := this.channel(gameKey)
+	if leave {
+		delete(channel.presence, presence.UserKey)
+	} else {
+		channel.presence[presence.UserKey] = presence
+	}
+	channel.publish("presence", channel.presenceJSON(presence.Seen))
+}
+
+/**
+ * イベントを Server-Sent Events の形式で書き込む
+ * @function
+ * @param {io.Writer} w 書き込み先
+ * @param {liveEvent} event イベント
+ */
+func writeLiveEvent(w io.Writer, event liveEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, event.Data)
+}
+
+/**
+ * 書き込んだイベントをすぐに送信する
+ * 応答先が対応していなければ何もしない
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ */
+func flushLive(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/**
+ * ゲームのシーンのロックの一覧を読み込んで配信する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} gameKey エンコード済みのゲームキー
+ */
+func publishSceneLocks(c appengine.Context, gameKey string) {
+	model := NewModel(c)
+	data, err := json.Marshal(sceneLockResources(model, model.getSceneLocks(gameKey)))
+	check(c, err)
+	broker.publishLocks(gameKey, data)
+}
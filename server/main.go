@@ -1,7 +1,10 @@
 /**
  * エントリポイント
- * URLパターンから該当する処理へ振り分ける
- * 処理は controller.go に記載されている
+ * メソッドと URL パターンから該当する処理へ振り分ける
+ * 処理は controller.go と api.go に記載されている
+ * すべてのリクエストで logRequest() と recoverPanic() を通す
+ * 画面と Ajax の状態を変更する処理は POST で登録し、csrfProtect() でCSRFトークンを要求する
+ * 権限が必要な処理は withRole() で、ゲームを操作する処理は ownGame() か withGameRole() で保護する
  * @file
  */
 package escape3ds
@@ -13,32 +16,128 @@ import "net/http"
  * @function
  */
 func init() {
+	router := NewRouter()
+	router.Use(logRequest, recoverPanic)
+
+	site := router.Group("", csrfProtect)
+	player := site.Group("", withRole("player"))
+	author := site.Group("", withRole("author"))
+	admin := site.Group("", withRole("admin"))
+
 	// 通常アクセス
-	http.HandleFunc("/", top)
-	http.HandleFunc("/editor", editor)
-	http.HandleFunc("/gamelist", gamelist)
-	http.HandleFunc("/logout", logout)
-	
+	site.GET("/", top)
+	player.GET("/editor", editor, withGameRole("game_key", "viewer"))
+	site.GET("/gamelist", gamelist)
+	site.POST("/logout", logout)
+	site.GET("/u/{handle}", publicProfile)
+	site.GET("/search", search)
+	site.GET("/browse", browse)
+	site.GET("/suggest_tags", suggestTags)
+	site.GET("/get_categories", getCategories)
+	site.GET("/avatar", avatar)
+
 	// OAuth 関係
-	http.HandleFunc("/login_twitter", loginTwitter)
-	http.HandleFunc("/callback_twitter", callbackTwitter)
-	http.HandleFunc("/login_facebook", loginFacebook)
-	http.HandleFunc("/callback_facebook", callbackFacebook)
+	site.GET("/login_twitter", loginTwitter)
+	site.GET("/callback_twitter", callbackTwitter)
+	for _, provider := range oauth2Providers {
+		site.GET(provider.LoginPath(), loginOAuth2(provider))
+		site.GET(provider.CallbackPath(), callbackOAuth2(provider))
+	}
+	player.POST("/link_identity", linkIdentity)
+	player.POST("/unlink_identity", unlinkIdentity)
+	player.POST("/link_mail", linkMail)
+	player.POST("/unlink_mail", unlinkMail)
+	player.POST("/merge_account", mergeAccount)
 
 	// アカウント登録関係
-	http.HandleFunc("/interim_registration", interimRegistration)
-	http.HandleFunc("/registration", registration)
+	// メールのリンクは GET で確認ページを表示し、確認ページから POST で確定する
+	site.POST("/interim_registration", interimRegistration)
+	site.GET("/registration", registrationForm)
+	site.POST("/registration", registration)
+	site.GET("/confirm_mail_change", confirmMailChangeForm)
+	site.POST("/confirm_mail_change", confirmMailChange)
 
 	// Ajax
-	http.HandleFunc("/add_user", addUser)
-	http.HandleFunc("/login", login)
-	http.HandleFunc("/add_game", addGame)
-	http.HandleFunc("/delete_game", deleteGame)
-	
+	site.POST("/login", login)
+	author.POST("/add_game", addGame)
+	author.POST("/delete_game", deleteGame, ownGame("game_key"))
+	site.POST("/change_mail", changeMail)
+	author.POST("/set_game_published", setGamePublished, ownGame("game_key"))
+	author.POST("/update_game", updateGame, withGameRole("game_key", "editor"))
+	author.POST("/clone_game", cloneGame, withGameRole("game_key", "editor"))
+	author.POST("/save_game", saveGame, withGameRole("game_key", "editor"))
+	author.POST("/autosave", autosave, withGameRole("game_key", "editor"))
+	author.GET("/get_draft", getDraft, withGameRole("game_key", "editor"))
+	author.POST("/discard_draft", discardDraft, withGameRole("game_key", "editor"))
+	player.GET("/get_scene_locks", getSceneLocks, withGameRole("game_key", "viewer"))
+	author.POST("/lock_scene", lockScene, withGameRole("game_key", "editor"))
+	author.POST("/heartbeat_scene_lock", heartbeatSceneLock, withGameRole("game_key", "editor"))
+	author.POST("/unlock_scene", unlockScene, withGameRole("game_key", "editor"))
+	player.GET("/get_revisions", getRevisions, withGameRole("game_key", "viewer"))
+	player.GET("/diff_revisions", diffRevisions, withGameRole("game_key", "viewer"))
+	author.POST("/restore_revision", restoreRevision, withGameRole("game_key", "editor"))
+	author.POST("/restore_game", restoreGame, ownTrashedGame("game_key"))
+	author.POST("/purge_game", purgeGame, ownTrashedGame("game_key"))
+
+	// 共同編集
+	player.GET("/get_collaborators", getCollaborators, withGameRole("game_key", "viewer"))
+	author.POST("/invite_collaborator", inviteCollaborator, ownGame("game_key"))
+	author.POST("/cancel_invitation", cancelInvitation, ownGame("game_key"))
+	author.POST("/set_collaborator_role", setCollaboratorRole, ownGame("game_key"))
+	player.POST("/remove_collaborator", removeCollaborator, withGameRole("game_key", "viewer"))
+	player.GET("/invitation", invitationForm)
+	player.POST("/accept_invitation", acceptInvitation)
+	player.POST("/decline_invitation", declineInvitation)
+	player.GET("/live", live, withGameRole("game_key", "viewer"))
+	author.POST("/live_change", publishLiveChange, withGameRole("game_key", "editor"))
+	player.POST("/live_presence", updateLivePresence, withGameRole("game_key", "viewer"))
+
+	// プロフィール
+	player.GET("/get_profile", getProfile)
+	player.POST("/update_profile", updateProfile)
+	player.POST("/upload_avatar", uploadAvatar)
+	player.POST("/change_password", changePassword)
+	player.GET("/get_api_tokens", getAPITokens)
+	player.POST("/create_api_token", createAPIToken)
+	player.POST("/revoke_api_token", revokeAPIToken)
+
+	// API (Bearer トークンまたはセッションで認証する)
+	apiRoutes(router)
+
+	// 二段階認証
+	site.POST("/login_totp", loginTotp)
+	player.POST("/enroll_totp", enrollTotp)
+	player.GET("/totp_qr", totpQr)
+	player.POST("/confirm_totp", confirmTotp)
+	player.POST("/disable_totp", disableTotp)
+
+	// 個人データ
+	player.GET("/export_account", exportAccount)
+	player.POST("/delete_account", deleteAccount)
+
 	// 管理者専用 通常アクセス
-	http.HandleFunc("/debug", debug)
-	
+	admin.GET("/debug", debug)
+	site.GET("/bootstrap_admin", bootstrapAdminForm)
+	site.POST("/bootstrap_admin", bootstrapAdmin)
+
 	// 管理者専用 Ajax
-	http.HandleFunc("/get_users", getUsers)
-	http.HandleFunc("/get_interim_users", getInterimUsers)
-}
\ No newline at end of file
+	admin.GET("/get_users", getUsers)
+	admin.GET("/get_interim_users", getInterimUsers)
+	admin.POST("/add_user", addUser)
+	admin.POST("/set_user_role", setUserRole)
+	admin.GET("/get_audit_logs", getAuditLogs)
+	admin.POST("/merge_users", mergeUsers)
+	admin.POST("/backfill_user_mails", backfillUserMails)
+	admin.POST("/unlock_user", unlockUser)
+	admin.POST("/reset_totp", resetTotp)
+	admin.POST("/reindex_games", reindexGames)
+	admin.POST("/merge_tags", mergeTags)
+	admin.POST("/put_category", putCategory)
+	admin.POST("/delete_category", deleteCategory)
+
+	// cron
+	router.GET("/cron/purge_users", purgeUsers, cronOnly)
+	router.GET("/cron/purge_games", purgeGames, cronOnly)
+
+	http.Handle("/", router)
+}
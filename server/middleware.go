@@ -0,0 +1,259 @@
+/**
+ * ルータで使う共通のミドルウェア
+ * パニックからの復帰、リクエストのログ、権限とゲームに対する権限の確認を行う
+ * 認証とCSRF対策のミドルウェアは auth.go と csrf.go にある
+ * @file
+ */
+package escape3ds
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	runtimedebug "runtime/debug"
+	"strings"
+	"time"
+)
+
+/**
+ * 応答のステータスコードを記録する ResponseWriter
+ * @struct
+ * @property {int} status 書き込んだステータスコード、まだ書き込んでいなければ0
+ */
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+/**
+ * ステータスコードを記録してから書き込む
+ * @method
+ * @memberof statusWriter
+ * @param {int} status ステータスコード
+ */
+func (this *statusWriter) WriteHeader(status int) {
+	if this.status == 0 {
+		this.status = status
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+/**
+ * 本文を書き込む
+ * ステータスコードを書き込んでいなければ 200 とみなす
+ * @method
+ * @memberof statusWriter
+ * @param {[]byte} data 本文
+ * @returns {int} 書き込んだバイト数
+ * @returns {error} エラー
+ */
+func (this *statusWriter) Write(data []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	return this.ResponseWriter.Write(data)
+}
+
+/**
+ * 書き込んだ内容をすぐに送信する
+ * 元の ResponseWriter が対応していなければ何もしない
+ * @method
+ * @memberof statusWriter
+ */
+func (this *statusWriter) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/**
+ * ResponseWriter をステータスコードを記録するものにする
+ * 既に記録するものならそのまま返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @returns {*statusWriter} ステータスコードを記録する応答先
+ */
+func newStatusWriter(w http.ResponseWriter) *statusWriter {
+	if sw, ok := w.(*statusWriter); ok {
+		return sw
+	}
+	return &statusWriter{ResponseWriter: w}
+}
+
+/**
+ * パニックから復帰するミドルウェア
+ * スタックトレースをログに残し、まだ応答していなければ 500 を返す
+ * @function
+ * @param {http.HandlerFunc} handler 処理
+ * @returns {http.HandlerFunc} パニックを捕まえて handler を呼び出す処理
+ */
+func recoverPanic(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := newStatusWriter(w)
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			c := appengine.NewContext(r)
+			c.Criticalf("%s %s でパニックが発生しました: %v\n%s", r.Method, r.URL.Path, err, runtimedebug.Stack())
+			if sw.status != 0 {
+				return
+			}
+			if isAPI(r) {
+				apiError(sw, http.StatusInternalServerError, "internal_error", "サーバでエラーが発生しました")
+			} else if isAjax(r) {
+				sw.Header().Set("Content-Type", "application/json; charset=utf-8")
+				sw.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(sw, `{"result":false, "error":"internal_error", "message":"サーバでエラーが発生しました"}`)
+			} else {
+				view := NewView(c, sw, r)
+				sw.WriteHeader(http.StatusInternalServerError)
+				view.message("エラー", "サーバでエラーが発生しました。時間をおいてからやり直してください")
+			}
+		}()
+		handler(sw, r)
+	}
+}
+
+/**
+ * リクエストをログに残すミドルウェア
+ * メソッド、パス、ステータスコード、処理時間を記録する
+ * @function
+ * @param {http.HandlerFunc} handler 処理
+ * @returns {http.HandlerFunc} 処理後にログを残す処理
+ */
+func logRequest(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := newStatusWriter(w)
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			c := appengine.NewContext(r)
+			c.Infof("%s %s %d %s", r.Method, r.URL.Path, status, time.Since(start))
+		}()
+		handler(sw, r)
+	}
+}
+
+/**
+ * API へのリクエストかどうか調べる
+ * @function
+ * @param {*http.Request} r リクエスト
+ * @returns {bool} /api/v1 以下ならtrue
+ */
+func isAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix + "/")
+}
+
+/**
+ * requireRole() をミドルウェアにする
+ * @function
+ * @param {string} role 必要な権限
+ * @returns {Middleware} ミドルウェア
+ */
+func withRole(role string) Middleware {
+	return func(handler http.HandlerFunc) http.HandlerFunc {
+		return requireRole(role, handler)
+	}
+}
+
+/**
+ * apiAuth() をミドルウェアにする
+ * @function
+ * @param {string} scope 必要な権限、空文字なら認証だけを行う
+ * @returns {Middleware} ミドルウェア
+ */
+func withScope(scope string) Middleware {
+	return func(handler http.HandlerFunc) http.HandlerFunc {
+		return apiAuth(scope, handler)
+	}
+}
+
+/**
+ * ゲームの所有者だけが呼び出せるようにするミドルウェア
+ * 認証のミドルウェアの後に使う
+ * ゲームキーはパスパラメータ、無ければフォームの値から取り出す
+ * 確認したゲームは requestContext(r).Game で取り出せる
+ * 存在しないゲーム、権限の無いゲーム、ゴミ箱のゲーム、ゲーム以外のキーは区別しない
+ * @function
+ * @param {string} name ゲームキーのパスパラメータ名またはフォームの項目名
+ * @returns {Middleware} ミドルウェア
+ */
+func ownGame(name string) Middleware {
+	return gamePermission(name, "owner", false)
+}
+
+/**
+ * ゴミ箱にあるゲームの所有者だけが呼び出せるようにするミドルウェア
+ * ゴミ箱から元に戻す処理と完全に削除する処理に使う
+ * @function
+ * @param {string} name ゲームキーのパスパラメータ名またはフォームの項目名
+ * @returns {Middleware} ミドルウェア
+ */
+func ownTrashedGame(name string) Middleware {
+	return gamePermission(name, "owner", true)
+}
+
+/**
+ * ゲームに対して role 以上の権限を持つユーザだけが呼び出せるようにするミドルウェア
+ * 共同編集者も呼び出せる処理に使う
+ * 確認した権限は requestContext(r).GameRole で取り出せる
+ * @function
+ * @param {string} name ゲームキーのパスパラメータ名またはフォームの項目名
+ * @param {string} role 必要な権限 (gameRoles)
+ * @returns {Middleware} ミドルウェア
+ */
+func withGameRole(name string, role string) Middleware {
+	return gamePermission(name, role, false)
+}
+
+/**
+ * ゲームに対する権限を確認するミドルウェアを作る
+ * @function
+ * @param {string} name ゲームキーのパスパラメータ名またはフォームの項目名
+ * @param {string} role 必要な権限 (gameRoles)
+ * @param {bool} trashed ゴミ箱にあるゲームを対象にするならtrue、ゴミ箱に無いゲームを対象にするならfalse
+ * @returns {Middleware} ミドルウェア
+ */
+func gamePermission(name string, role string, trashed bool) Middleware {
+	return func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := requestContext(r)
+			gameKey := pathParam(r, name)
+			if gameKey == "" {
+				gameKey = r.FormValue(name)
+			}
+
+			game := new(Game)
+			key, err := decodeGameKey(gameKey)
+			if err == nil {
+				err = datastore.Get(ctx.c, key, game)
+			}
+			gameRole := ""
+			if err == nil && game.trashed() == trashed {
+				gameRole = NewModel(ctx.c).getGameRole(gameKey, game, ctx.UserKey)
+			}
+			if gameRole == "" || gameRoleRank(gameRole) < gameRoleRank(role) {
+				ctx.c.Warningf("ユーザキー: %s がゲーム: %s を操作しようとしました 権限: %s 必要な権限: %s", ctx.UserKey, gameKey, gameRole, role)
+				// 閲覧できるユーザにはゲームの存在を隠さない
+				if isAPI(r) && gameRole == "" {
+					apiError(w, http.StatusNotFound, "not_found", "ゲームが見つかりません")
+				} else if isAPI(r) {
+					apiError(w, http.StatusForbidden, "forbidden", "このゲームを操作する権限がありません")
+				} else {
+					forbidden(ctx.c, w, r, "このゲームを操作する権限がありません")
+				}
+				return
+			}
+			ctx.GameKey = gameKey
+			ctx.Game = game
+			ctx.GameRole = gameRole
+			handler(w, r)
+		}
+	}
+}
@@ -12,9 +12,90 @@ import (
 	"bytes"
 	"fmt"
 	"time"
+	"errors"
 	"encoding/json"
+	"crypto/subtle"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sort"
 )
 
+/**
+ * 既に使われているメールアドレスを登録しようとした時のエラー
+ * @const
+ */
+var ErrMailAlreadyUsed = errors.New("このメールアドレスは既に登録されています")
+
+/**
+ * 期限切れの確認リンクが使われた時のエラー
+ * @const
+ */
+var ErrMailChangeExpired = errors.New("メールアドレス変更の有効期限が切れています")
+
+/**
+ * 別のユーザに連携済みのアカウントを連携しようとした時のエラー
+ * @const
+ */
+var ErrIdentityAlreadyLinked = errors.New("このアカウントは別のユーザに連携されています")
+
+/**
+ * 最後のログイン方法を解除しようとした時のエラー
+ * @const
+ */
+var ErrLastIdentity = errors.New("ログイン方法がなくなるため解除できません")
+
+/**
+ * 二段階認証のコードが間違っていた時のエラー
+ * @const
+ */
+var ErrInvalidTotpCode = errors.New("確認コードが間違っています")
+
+/**
+ * 二段階認証を有効にしているユーザが再登録しようとした時のエラー
+ * @const
+ */
+var ErrTotpAlreadyEnabled = errors.New("二段階認証は既に有効です")
+
+/**
+ * 既に使われているハンドルを設定しようとした時のエラー
+ * @const
+ */
+var ErrHandleAlreadyUsed = errors.New("このハンドルは既に使われています")
+
+/**
+ * 現在のパスワードが間違っていた時のエラー
+ * @const
+ */
+var ErrWrongPassword = errors.New("現在のパスワードが間違っています")
+
+/**
+ * ページングのカーソルが不正な時のエラー
+ * @const
+ */
+var ErrInvalidCursor = errors.New("カーソルが不正です")
+
+/**
+ * 復元できる期間を過ぎたゲームを元に戻そうとした時のエラー
+ * @const
+ */
+var ErrTrashExpired = errors.New("ゴミ箱に移してから30日を過ぎたゲームは元に戻せません")
+
+/**
+ * ゴミ箱のゲームを元に戻せる期間
+ * 過ぎたゲームは cron で完全に削除する
+ * @const
+ */
+const gameTrashPeriod = 30 * 24 * time.Hour
+
+/**
+ * 追加した素材を参照されていなくても削除しない期間
+ * 素材を追加してから参照を保存するまでの間に削除しないようにする
+ * @const
+ */
+const assetGracePeriod = 24 * time.Hour
+
 /**
  * モデル
  * @class
@@ -39,11 +120,22 @@ func NewModel(c appengine.Context) *Model {
 /**
  * ユーザデータ
  * @struct
- * @property {string} Type ユーザアカウントの種類 "Twitter"/"Facebook"/"normal"
+ * @property {string} Type ユーザ作成時のアカウントの種類 "Twitter"/"normal"/OAuth2Provider.Name
  * @property {string} Name ユーザ名
  * @property {[]byte} Pass ユーザの暗号化済パスワード（user_type == "normal"の場合のみ）
  * @property {string} Mail ユーザのメールアドレス（user_type == "normal"の場合のみ）
  * @property {string} OAuthId OAuthのサービスプロバイダが決めたユーザID
+ * @property {string} Role 権限 "player"/"author"/"moderator"/"admin"、空文字は "author" として扱う
+ * @property {bool} TotpEnabled 二段階認証を有効にしていればtrue
+ * @property {string} TotpSecret 二段階認証のシークレット (base32)
+ * @property {string} TotpPending 登録中でまだ確認されていないシークレット
+ * @property {int64} TotpLastStep 最後に受け付けたワンタイムパスワードのステップ数
+ * @property {[]string} RecoveryCodes 未使用のリカバリーコードのハッシュ
+ * @property {time.Time} DeleteAt 退会を申請した場合の削除予定日時、申請していなければゼロ値
+ * @property {string} Handle 公開プロフィールの URL に使う一意な名前、未設定なら空文字
+ * @property {string} Avatar アイコン画像の素材キー、未設定なら空文字
+ * @property {string} Bio 自己紹介
+ * @property {string} Language 表示言語 languages のいずれか、空文字は "ja" として扱う
  */
 type User struct {
 	Type string
@@ -52,10 +144,69 @@ type User struct {
 	Mail string
 	Salt string
 	OAuthId string
+	Role string
+	TotpEnabled bool
+	TotpSecret string `datastore:",noindex"`
+	TotpPending string `datastore:",noindex"`
+	TotpLastStep int64 `datastore:",noindex"`
+	RecoveryCodes []string `datastore:",noindex"`
+	DeleteAt time.Time
+	Handle string
+	Avatar string
+	Bio string `datastore:",noindex"`
+	Language string
+}
+
+/**
+ * 権限の一覧
+ * 後ろにあるものほど強い権限を持ち、前にある権限をすべて含む
+ * player: 公開されたゲームを遊ぶ
+ * author: ゲームを作成する
+ * moderator: 他のユーザのゲームを管理する
+ * admin: ユーザと権限を管理する
+ * @const
+ */
+var roles = []string{"player", "author", "moderator", "admin"}
+
+/**
+ * 新規ユーザに与える権限
+ * @const
+ */
+const defaultRole = "author"
+
+/**
+ * 権限の強さを返す
+ * 存在しない権限の場合は -1 を返す
+ * @function
+ * @param {string} role 権限
+ * @returns {int} 権限の強さ
+ */
+func roleRank(role string) int {
+	if role == "" {
+		role = defaultRole
+	}
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+/**
+ * ユーザが指定された権限以上の権限を持っているか調べる
+ * @method
+ * @memberof User
+ * @param {string} role 必要な権限
+ * @returns {bool} 持っていればtrue
+ */
+func (this *User) hasRole(role string) bool {
+	return roleRank(this.Role) >= roleRank(role)
 }
 
 /**
  * ユーザを作成する
+ * 入力値は userSchema() で検証する
  * @method
  * @memberof Model
  * @param {map[string]string} ユーザの設定項目を含んだマップ
@@ -65,43 +216,28 @@ type User struct {
  *     user_mail: string
  *     user_oauth_id: string
  *     user_pass: string
+ *     user_role: string 省略した場合は defaultRole
  * }
  * @returns {*User} ユーザ、失敗したらnil
  */
 func (this *Model) NewUser(data map[string]string) *User {
-	// ユーザタイプチェック
-	if !exist([]string {"Twitter", "Facebook", "normal"}, data["user_type"]) {
-		this.c.Errorf("不正なユーザタイプが入力されました")
+	verr := userSchema(data["user_type"]).validate(data)
+	if verr != nil {
+		this.c.Errorf(verr.Error())
 		return nil
 	}
-	
-	// OAuthアカウントチェック
-	if data["user_type"] == "Twitter" || data["user_type"] == "Facebook" {
-		if data["user_oauth_id"] == "" {
-			this.c.Errorf("OAuthアカウントのidが設定されていません")
-			return nil
-		}
-	}
-	
-	// 通常アカウントチェック
-	if data["user_type"] == "normal"{
-		if data["user_mail"] == "" {
-			this.c.Errorf("メールアドレスが入力されていません")
-			return nil
-		}
-		if data["user_pass"] == "" {
-			this.c.Errorf("パスワードが入力されていません")
-			return nil
-		}
+	role := data["user_role"]
+	if role == "" {
+		role = defaultRole
 	}
 	
-	
 	user := new(User)
 	user.Type = data["user_type"]
 	user.Name = data["user_name"]
-	user.Mail = data["user_mail"]
+	user.Mail = normalizeMail(data["user_mail"])
 	user.OAuthId = data["user_oauth_id"]
 	user.Pass, user.Salt = this.hashPassword(data["user_pass"], "")
+	user.Role = role
 	return user
 }
 
@@ -142,6 +278,17 @@ func (this *Model) NewInterimUser(name string, mail string, pass string) *Interi
  * @member {string} Thumbnail サムネイルの画像パス
  * @member {string} UserKey 所有ユーザのエンコード済みキー
  * @member {string} FirstScene 最初のシーンのエンコード済みキー
+ * @member {bool} Published 公開プロフィールに表示するならtrue
+ * @member {string} Settings ゲームの設定 (JSON のオブジェクト)、未設定なら空文字
+ * @member {string} Content 最後に保存したゲームの内容 (content.go)、一度も保存していなければ空文字
+ * @member {int} Revision 最後に保存したリビジョンの番号、一度も保存していなければ0
+ * @member {[]string} Tags 作者が付けたタグ (正規化済み、tag.go)
+ * @member {string} Difficulty 難易度のカテゴリの ID、未設定なら空文字
+ * @member {string} Length 長さのカテゴリの ID、未設定なら空文字
+ * @member {string} Theme テーマのカテゴリの ID、未設定なら空文字
+ * @member {time.Time} Created 作成日時
+ * @member {time.Time} Updated 最後に変更した日時
+ * @member {time.Time} Deleted ゴミ箱に移した日時、移していなければゼロ値
  */
 type Game struct {
 	Name string
@@ -149,6 +296,17 @@ type Game struct {
 	Thumbnail string
 	UserKey string
 	FirstScene string
+	Published bool
+	Settings string `datastore:",noindex"`
+	Content string `datastore:",noindex"`
+	Revision int
+	Tags []string
+	Difficulty string
+	Length string
+	Theme string
+	Created time.Time
+	Updated time.Time
+	Deleted time.Time
 }
 
 /**
@@ -171,9 +329,155 @@ func (this *Model) NewGame(params map[string]string) *Game {
 	game.Thumbnail = params["thumbnail"]
 	game.UserKey = params["user_key"]
 	game.FirstScene = ""
+	game.Created = time.Now()
+	game.Updated = game.Created
 	return game
 }
 
+/**
+ * ゲームの設定を JSON のオブジェクトとして返す
+ * 未設定なら空のオブジェクトを返す
+ * @method
+ * @memberof Game
+ * @returns {json.RawMessage} 設定
+ */
+func (this *Game) settings() json.RawMessage {
+	if this.Settings == "" {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(this.Settings)
+}
+
+/**
+ * ゲームの内容を JSON として返す
+ * 一度も保存していなければ空のゲームを返す
+ * @method
+ * @memberof Game
+ * @returns {json.RawMessage} ゲームの内容
+ */
+func (this *Game) content() json.RawMessage {
+	if this.Content == "" {
+		return json.RawMessage(emptyGameContent)
+	}
+	return json.RawMessage(this.Content)
+}
+
+/**
+ * ゲームの設定が JSON のオブジェクトか調べる
+ * 中身の項目はエディタとプレイヤーが決めるので、サーバでは形式と大きさだけを検証する
+ * @function
+ * @param {string} settings 設定
+ * @returns {error} 不正なら理由を表すエラー
+ */
+func validateGameSettings(settings string) error {
+	if len(settings) > gameSettingsMaxLength {
+		return fmt.Errorf("ゲームの設定は%dバイト以内にしてください", gameSettingsMaxLength)
+	}
+	values := make(map[string]interface{})
+	if json.Unmarshal([]byte(settings), &values) != nil || values == nil {
+		return errors.New("ゲームの設定は JSON のオブジェクトで指定してください")
+	}
+	return nil
+}
+
+/**
+ * ゴミ箱にあるか調べる
+ * @method
+ * @memberof Game
+ * @returns {bool} ゴミ箱にあればtrue
+ */
+func (this *Game) trashed() bool {
+	return !this.Deleted.IsZero()
+}
+
+/**
+ * ゴミ箱から完全に削除される日時を返す
+ * @method
+ * @memberof Game
+ * @returns {time.Time} 削除される日時、ゴミ箱に無ければゼロ値
+ */
+func (this *Game) PurgeAt() time.Time {
+	if !this.trashed() {
+		return time.Time{}
+	}
+	return this.Deleted.Add(gameTrashPeriod)
+}
+
+/**
+ * 名前か説明に文字列を含むか調べる
+ * 大文字小文字は区別しない
+ * @method
+ * @memberof Game
+ * @param {string} filter 小文字にした検索する文字列、空文字ならすべてに一致する
+ * @returns {bool} 含んでいればtrue
+ */
+func (this *Game) matches(filter string) bool {
+	if filter == "" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(this.Name), filter) || strings.Contains(strings.ToLower(this.Description), filter)
+}
+
+/**
+ * ゲームで使う画像などの素材
+ * ゲームの削除や退会でゲームと一緒に削除される
+ * @struct
+ * @member {string} GameKey 素材を使うゲームのエンコード済みキー
+ * @member {string} UserKey 所有者のエンコード済みキー
+ * @member {string} Name ファイル名
+ * @member {string} ContentType MIME タイプ
+ * @member {[]byte} Data ファイルの中身
+ * @member {time.Time} Date 追加日時
+ */
+type Asset struct {
+	GameKey string
+	UserKey string
+	Name string
+	ContentType string
+	Data []byte `datastore:",noindex"`
+	Date time.Time
+}
+
+/**
+ * 素材の最大サイズ
+ * データストアのエンティティの上限 (1MB) に収まるようにする
+ * @const
+ */
+const assetMaxSize = 900 * 1024
+
+/**
+ * データストアに素材を追加する
+ * @method
+ * @memberof Model
+ * @param {*Asset} asset 追加する素材
+ * @returns {string} エンコード済みの素材キー
+ */
+func (this *Model) addAsset(asset *Asset) string {
+	asset.Date = time.Now()
+	key, err := datastore.Put(this.c, datastore.NewIncompleteKey(this.c, "Asset", nil), asset)
+	check(this.c, err)
+	return key.Encode()
+}
+
+/**
+ * ゲームの素材一覧を返す
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @returns {map[string]*Asset} エンコード済みの素材キーと素材の対応表
+ */
+func (this *Model) getAssets(encodedGameKey string) map[string]*Asset {
+	assets := make([]*Asset, 0)
+	keys, err := datastore.NewQuery("Asset").Filter("GameKey =", encodedGameKey).GetAll(this.c, &assets)
+	check(this.c, err)
+
+	result := make(map[string]*Asset, len(keys))
+	for i, key := range keys {
+		result[key.Encode()] = assets[i]
+	}
+	return result
+}
+
 /**
  * ユーザのパスワードをハッシュ化する
  * @method
@@ -206,6 +510,27 @@ func (this *Model) addUser(user *User) string {
 		this.c.Errorf("ユーザの追加を中止しました")
 		return ""
 	}
+
+	// メールアドレスを持つユーザはアドレスの使用登録と同時に追加する
+	if user.Mail != "" {
+		_, err := this.claimLegacyMail(user.Mail)
+		if err != nil {
+			this.c.Errorf("ユーザの追加を中止しました: %s", err.Error())
+			return ""
+		}
+		var encodedKey string
+		err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+			var err error
+			encodedKey, err = putUserWithMail(tc, user)
+			return err
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			this.c.Errorf("ユーザの追加を中止しました: %s", err.Error())
+			return ""
+		}
+		return encodedKey
+	}
+
 	incompleteKey := datastore.NewIncompleteKey(this.c, "User", nil)
 	completeKey, err := datastore.Put(this.c, incompleteKey, user)
 	check(this.c, err)
@@ -213,6 +538,233 @@ func (this *Model) addUser(user *User) string {
 	return encodedKey
 }
 
+/**
+ * メールアドレスの使用状況
+ * キー名に正規化したメールアドレスを使うことで同じアドレスを複数のユーザが使えないようにする
+ * @struct
+ * @property {string} UserKey アドレスを使用しているユーザのエンコード済みキー
+ */
+type UserMail struct {
+	UserKey string
+}
+
+/**
+ * メールアドレスを正規化する
+ * 前後の空白を取り除いて小文字にする
+ * @function
+ * @param {string} mail メールアドレス
+ * @returns {string} 正規化したメールアドレス
+ */
+func normalizeMail(mail string) string {
+	return strings.ToLower(strings.TrimSpace(mail))
+}
+
+/**
+ * メールアドレスの使用状況を表すキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} mail メールアドレス
+ * @returns {*datastore.Key} UserMail のキー
+ */
+func userMailKey(c appengine.Context, mail string) *datastore.Key {
+	return datastore.NewKey(c, "UserMail", normalizeMail(mail), 0, nil)
+}
+
+/**
+ * メールアドレスが既に使われているかどうか調べる
+ * トランザクション内で呼び出せるようにコンテキストを引数で受け取る
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} mail メールアドレス
+ * @returns {bool} 使われていたらtrue
+ * @returns {error} データストアのエラー
+ */
+func usedMail(c appengine.Context, mail string) (bool, error) {
+	err := datastore.Get(c, userMailKey(c, mail), new(UserMail))
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/**
+ * ユーザとメールアドレスの使用状況を保存する
+ * XG トランザクション内で呼び出すこと
+ * @function
+ * @param {appengine.Context} tc トランザクションのコンテキスト
+ * @param {*User} user 追加するユーザ
+ * @returns {string} エンコードされたユーザキー
+ * @returns {error} アドレスが使用済みなら ErrMailAlreadyUsed
+ */
+func putUserWithMail(tc appengine.Context, user *User) (string, error) {
+	used, err := usedMail(tc, user.Mail)
+	if err != nil {
+		return "", err
+	}
+	if used {
+		return "", ErrMailAlreadyUsed
+	}
+
+	userKey, err := datastore.Put(tc, datastore.NewIncompleteKey(tc, "User", nil), user)
+	if err != nil {
+		return "", err
+	}
+
+	userMail := new(UserMail)
+	userMail.UserKey = userKey.Encode()
+	_, err = datastore.Put(tc, userMailKey(tc, user.Mail), userMail)
+	if err != nil {
+		return "", err
+	}
+	return userMail.UserKey, nil
+}
+
+/**
+ * メールアドレスの使用状況を登録する
+ * 既に登録されていれば変更しない
+ * XG トランザクション内で呼び出すこと
+ * @function
+ * @param {appengine.Context} tc トランザクションのコンテキスト
+ * @param {string} mail メールアドレス
+ * @param {string} userKey アドレスを使用しているユーザのエンコード済みキー
+ * @returns {string} アドレスを使用しているユーザのエンコード済みキー
+ * @returns {error} エラー
+ */
+func putUserMailIfAbsent(tc appengine.Context, mail string, userKey string) (string, error) {
+	userMail := new(UserMail)
+	err := datastore.Get(tc, userMailKey(tc, mail), userMail)
+	if err == nil {
+		return userMail.UserKey, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return "", err
+	}
+	userMail.UserKey = userKey
+	_, err = datastore.Put(tc, userMailKey(tc, mail), userMail)
+	if err != nil {
+		return "", err
+	}
+	return userKey, nil
+}
+
+/**
+ * 使用状況が登録されていない古いユーザのメールアドレスを登録する
+ * 使用状況を導入する前のユーザは User.Mail にしかアドレスが無く、大文字を含むこともあるので、
+ * 入力されたままのアドレスと正規化したアドレスの両方で探す
+ * トランザクション内ではクエリを使えないので、アドレスを使用済みか調べるトランザクションの前に呼び出す
+ * 大文字と小文字だけが異なるアドレスまでは探せないので、backfillUserMails() で事前にすべて登録しておく
+ * @method
+ * @memberof Model
+ * @param {string} mail メールアドレス
+ * @returns {string} アドレスを使用しているユーザのエンコード済みキー、いなければ空文字
+ * @returns {error} エラー
+ */
+func (this *Model) claimLegacyMail(mail string) (string, error) {
+	if strings.TrimSpace(mail) == "" {
+		return "", nil
+	}
+	userMail := new(UserMail)
+	err := datastore.Get(this.c, userMailKey(this.c, mail), userMail)
+	if err == nil {
+		return userMail.UserKey, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return "", err
+	}
+
+	candidates := []string{normalizeMail(mail)}
+	if raw := strings.TrimSpace(mail); raw != candidates[0] {
+		candidates = append(candidates, raw)
+	}
+	for _, candidate := range candidates {
+		keys, err := datastore.NewQuery("User").Filter("Mail =", candidate).KeysOnly().Limit(1).GetAll(this.c, nil)
+		if err != nil {
+			return "", err
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		userKey := ""
+		err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+			var err error
+			userKey, err = putUserMailIfAbsent(tc, mail, keys[0].Encode())
+			return err
+		}, nil)
+		if err != nil {
+			return "", err
+		}
+		return userKey, nil
+	}
+	return "", nil
+}
+
+/**
+ * メールアドレスを持つすべてのユーザの使用状況を登録する
+ * 使用状況を導入する前のユーザのアドレスを、後から登録するユーザが使えないようにする
+ * 正規化すると同じになるアドレスを複数のユーザが使っていた場合は先に見つけたユーザに登録し、記録を残す
+ * @method
+ * @memberof Model
+ * @returns {int} 新しく登録したアドレスの数
+ * @returns {error} エラー
+ */
+func (this *Model) backfillUserMails() (int, error) {
+	count := 0
+	iterator := datastore.NewQuery("User").Project("Mail").Run(this.c)
+	for {
+		user := new(User)
+		key, err := iterator.Next(user)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if user.Mail == "" {
+			continue
+		}
+		owner := ""
+		created := false
+		err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+			userMail := new(UserMail)
+			err := datastore.Get(tc, userMailKey(tc, user.Mail), userMail)
+			if err == nil {
+				owner, created = userMail.UserKey, false
+				return nil
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			owner, err = putUserMailIfAbsent(tc, user.Mail, key.Encode())
+			created = true
+			return err
+		}, nil)
+		if err != nil {
+			return count, err
+		}
+		if created {
+			count++
+		}
+		if owner != key.Encode() {
+			this.c.Warningf("同じメールアドレスを複数のユーザが使っています。アドレス：%s ユーザキー：%s %s", user.Mail, owner, key.Encode())
+		}
+	}
+	return count, nil
+}
+
+/**
+ * メールアドレスからユーザキーを取得する
+ * アドレスの使用状況が登録されていない古いユーザはクエリで探して登録する
+ * 存在しない場合は空文字を返す
+ * @method
+ * @memberof Model
+ * @param {string} mail メールアドレス
+ * @returns {string} エンコードされたユーザキー
+ */
+func (this *Model) getUserKeyByMail(mail string) string {
+	userKey, err := this.claimLegacyMail(mail)
+	check(this.c, err)
+	return userKey
+}
+
 /**
  * 指定されたメールアドレスとパスワードのユーザがいるか調べる
  * 存在しない場合は戻り値がすべて空文字になる
@@ -222,16 +774,12 @@ func (this *Model) addUser(user *User) string {
  * @returns {string} ユーザ名
  */
 func (this *Model) loginCheck(mail string, pass string) (string, string) {
-	query := datastore.NewQuery("User").Filter("Mail =", mail)
-	iterator := query.Run(this.c)
-	key, err := iterator.Next(nil)
-	
-	if err != nil {
+	encodedKey := this.getUserKeyByMail(mail)
+	if encodedKey == "" {
 		this.c.Warningf("存在しないメールアドレスによるログインが試されました。アドレス：%s", mail)
 		return "", ""
 	}
-	
-	encodedKey := key.Encode()
+
 	user := this.getUser(encodedKey)
 	
 	hashedPass, _ := this.hashPassword(pass, user.Salt)
@@ -261,68 +809,323 @@ func (this *Model) getUser(encodedKey string) *User {
 }
 
 /**
- * ユーザを仮登録する
- * 仮登録したユーザは24時間以内に本登録する
- * 本登録されなかった場合は24時間後に削除される
+ * ユーザの権限を変更する
  * @method
  * @memberof Model
- * @param {string} name ユーザ名
- * @param {string} mail メールアドレス
- * @param {string} pass パスワード
- * @returns {string} 仮登録ユーザのエンコードされたキー
+ * @param {string} encodedKey エンコードされたユーザキー
+ * @param {string} role 新しい権限
+ * @returns {error} エラー
  */
-func (this *Model) interimRegistration(name string, mail string, pass string) string {
-	user := this.NewInterimUser(name, mail, pass)
-	incompleteKey := datastore.NewIncompleteKey(this.c, "InterimUser", nil)
-	completeKey, err := datastore.Put(this.c, incompleteKey, user)
-	check(this.c, err)
-	return completeKey.Encode()
+func (this *Model) setUserRole(encodedKey string, role string) error {
+	if !exist(roles, role) {
+		return fmt.Errorf("不正な権限です: %s", role)
+	}
+	key, err := datastore.DecodeKey(encodedKey)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		user.Role = role
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, nil)
+}
+
+/**
+ * 管理者が存在するかどうか調べる
+ * @method
+ * @memberof Model
+ * @returns {bool} 一人でも存在すればtrue
+ */
+func (this *Model) existAdmin() bool {
+	query := datastore.NewQuery("User").Filter("Role =", "admin").KeysOnly().Limit(1)
+	count, err := query.Count(this.c)
+	check(this.c, err)
+	return count > 0
+}
+
+/**
+ * 監査ログ
+ * 権限の無い操作や権限の変更など、後から追跡が必要な出来事を記録する
+ * @struct
+ * @property {string} UserKey 操作したユーザのエンコード済みキー、未ログインなら空文字
+ * @property {string} Action 出来事の種類
+ * @property {string} Method HTTPメソッド
+ * @property {string} Path リクエストされたパス
+ * @property {string} IP クライアントのIPアドレス
+ * @property {string} Detail 詳細
+ * @property {time.Time} Date 発生日時
+ */
+type AuditLog struct {
+	UserKey string
+	Action string
+	Method string
+	Path string
+	IP string
+	Detail string
+	Date time.Time
+}
+
+/**
+ * 監査ログを追加する
+ * @method
+ * @memberof Model
+ * @param {*AuditLog} log 追加するログ
+ */
+func (this *Model) addAuditLog(log *AuditLog) {
+	if log.Date.IsZero() {
+		log.Date = time.Now()
+	}
+	_, err := datastore.Put(this.c, datastore.NewIncompleteKey(this.c, "AuditLog", nil), log)
+	check(this.c, err)
+}
+
+/**
+ * 新しい順に監査ログを取得する
+ * @method
+ * @memberof Model
+ * @param {int} limit 取得する最大件数
+ * @returns {[]*AuditLog} 監査ログ
+ */
+func (this *Model) getAuditLogs(limit int) []*AuditLog {
+	logs := make([]*AuditLog, 0, limit)
+	query := datastore.NewQuery("AuditLog").Order("-Date").Limit(limit)
+	_, err := query.GetAll(this.c, &logs)
+	check(this.c, err)
+	return logs
+}
+
+/**
+ * ユーザを仮登録する
+ * 仮登録したユーザは24時間以内に本登録する
+ * 本登録されなかった場合は24時間後に削除される
+ * @method
+ * @memberof Model
+ * @param {string} name ユーザ名
+ * @param {string} mail メールアドレス
+ * @param {string} pass パスワード
+ * @returns {string} 仮登録ユーザのエンコードされたキー
+ * @returns {error} アドレスが使用済みなら ErrMailAlreadyUsed
+ */
+func (this *Model) interimRegistration(name string, mail string, pass string) (string, error) {
+	user := this.NewInterimUser(name, normalizeMail(mail), pass)
+	_, err := this.claimLegacyMail(mail)
+	if err != nil {
+		return "", err
+	}
+	encodedKey := ""
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		used, err := usedMail(tc, user.Mail)
+		if err != nil {
+			return err
+		}
+		if used {
+			return ErrMailAlreadyUsed
+		}
+		incompleteKey := datastore.NewIncompleteKey(tc, "InterimUser", nil)
+		completeKey, err := datastore.Put(tc, incompleteKey, user)
+		if err != nil {
+			return err
+		}
+		encodedKey = completeKey.Encode()
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return "", err
+	}
+	return encodedKey, nil
 }
 
 /**
  * ユーザを本登録する
- * 仮登録データベース
+ * 仮登録ユーザを削除して同じ内容のユーザを追加する
+ * 仮登録後に同じアドレスが本登録されていた場合は失敗する
  * @method
  * @memberof Model
  * @param {string} encodedKey エンコード済みの仮登録キー
+ * @returns {error} アドレスが使用済みなら ErrMailAlreadyUsed
  */
-func (this *Model) registration(encodedKey string) {
+func (this *Model) registration(encodedKey string) error {
 	key, err := datastore.DecodeKey(encodedKey)
-	check(this.c, err)
-	
+	if err != nil {
+		return err
+	}
 	interimUser := new(InterimUser)
 	err = datastore.Get(this.c, key, interimUser)
-	check(this.c, err)
-	
-	params := make(map[string]string, 5)
-	params["user_type"] = "normal"
-	params["user_name"] = interimUser.Name
-	params["user_mail"] = interimUser.Mail
-	params["user_pass"] = interimUser.Pass
-	params["user_oauth_path"] = ""
-	user := this.NewUser(params)
-	this.addUser(user)
-	
-	err = datastore.Delete(this.c, key)
-	check(this.c, err)
+	if err != nil {
+		return err
+	}
+	_, err = this.claimLegacyMail(interimUser.Mail)
+	if err != nil {
+		return err
+	}
+
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		interimUser := new(InterimUser)
+		err := datastore.Get(tc, key, interimUser)
+		if err != nil {
+			return err
+		}
+
+		params := make(map[string]string, 5)
+		params["user_type"] = "normal"
+		params["user_name"] = interimUser.Name
+		params["user_mail"] = interimUser.Mail
+		params["user_pass"] = interimUser.Pass
+		params["user_oauth_path"] = ""
+		user := NewModel(tc).NewUser(params)
+		if user == nil {
+			return errors.New("仮登録ユーザの内容が不正です")
+		}
+
+		_, err = putUserWithMail(tc, user)
+		if err != nil {
+			return err
+		}
+		return datastore.Delete(tc, key)
+	}, &datastore.TransactionOptions{XG: true})
 }
 
 /**
- * 指定されたOAuthユーザが既にデータベース上に存在するかどうか調べる
+ * メールアドレスの変更申請
+ * 新しいアドレスへ確認リンクを送り、リンクが開かれるまでは変更しない
+ * @struct
+ * @property {string} UserKey 変更するユーザのエンコード済みキー
+ * @property {string} NewMail 正規化済みの新しいメールアドレス
+ * @property {time.Time} Expire 申請の有効期限
+ */
+type MailChange struct {
+	UserKey string
+	NewMail string
+	Expire time.Time
+}
+
+/**
+ * メールアドレスの変更を申請する
+ * 申請は24時間有効
  * @method
  * @memberof Model
- * @param {string} userType "Twitter"または"Facebook"
- * @param {string} oauthId 調べる対象のOAuthId
- * @returns {bool} 存在したらtrue
+ * @param {string} userKey 変更するユーザのエンコード済みキー
+ * @param {string} newMail 新しいメールアドレス
+ * @returns {string} エンコード済みの申請キー、確認リンクに使う
+ * @returns {error} アドレスが使用済みなら ErrMailAlreadyUsed
  */
-func (this *Model) existOAuthUser(userType string, oauthId string) bool {
-	query := datastore.NewQuery("User").Filter("Type =", userType).Filter("OAuthId =", oauthId)
-	iterator := query.Run(this.c)
-	_, err := iterator.Next(nil)
+func (this *Model) requestMailChange(userKey string, newMail string) (string, error) {
+	_, err := this.claimLegacyMail(newMail)
 	if err != nil {
-		return false
+		return "", err
 	}
-	return true
+	used, err := usedMail(this.c, newMail)
+	if err != nil {
+		return "", err
+	}
+	if used {
+		return "", ErrMailAlreadyUsed
+	}
+
+	change := new(MailChange)
+	change.UserKey = userKey
+	change.NewMail = normalizeMail(newMail)
+	change.Expire = time.Now().Add(time.Hour * 24)
+	key, err := datastore.Put(this.c, datastore.NewIncompleteKey(this.c, "MailChange", nil), change)
+	if err != nil {
+		return "", err
+	}
+	return key.Encode(), nil
+}
+
+/**
+ * メールアドレスの変更を確定する
+ * 古いアドレスを解放して新しいアドレスを使用済みにする
+ * @method
+ * @memberof Model
+ * @param {string} encodedKey エンコード済みの申請キー
+ * @returns {string} 変更前のメールアドレス
+ * @returns {string} 変更後のメールアドレス
+ * @returns {error} エラー
+ */
+func (this *Model) confirmMailChange(encodedKey string) (string, string, error) {
+	key, err := datastore.DecodeKey(encodedKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	pending := new(MailChange)
+	err = datastore.Get(this.c, key, pending)
+	if err != nil {
+		return "", "", err
+	}
+	_, err = this.claimLegacyMail(pending.NewMail)
+	if err != nil {
+		return "", "", err
+	}
+
+	oldMail := ""
+	newMail := ""
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		change := new(MailChange)
+		err := datastore.Get(tc, key, change)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(change.Expire) {
+			return ErrMailChangeExpired
+		}
+
+		used, err := usedMail(tc, change.NewMail)
+		if err != nil {
+			return err
+		}
+		if used {
+			return ErrMailAlreadyUsed
+		}
+
+		userKey, err := datastore.DecodeKey(change.UserKey)
+		if err != nil {
+			return err
+		}
+		user := new(User)
+		err = datastore.Get(tc, userKey, user)
+		if err != nil {
+			return err
+		}
+
+		// 古いアドレスはこのユーザが使っている場合のみ解放する
+		oldMail = user.Mail
+		if oldMail != "" {
+			userMail := new(UserMail)
+			err = datastore.Get(tc, userMailKey(tc, oldMail), userMail)
+			if err == nil && userMail.UserKey == change.UserKey {
+				err = datastore.Delete(tc, userMailKey(tc, oldMail))
+			}
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+
+		user.Mail = change.NewMail
+		_, err = datastore.Put(tc, userKey, user)
+		if err != nil {
+			return err
+		}
+		userMail := new(UserMail)
+		userMail.UserKey = change.UserKey
+		_, err = datastore.Put(tc, userMailKey(tc, user.Mail), userMail)
+		if err != nil {
+			return err
+		}
+		newMail = user.Mail
+		return datastore.Delete(tc, key)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return "", "", err
+	}
+	return oldMail, newMail, nil
 }
 
 /**
@@ -336,7 +1139,7 @@ func (this *Model) existOAuthUser(userType string, oauthId string) bool {
 func (this *Model) getUserKey(params map[string]string) string {
 	query := datastore.NewQuery("User")
 	for pkey, pval := range params {
-		query.Filter(fmt.Sprintf("%s =", pkey), pval)
+		query = query.Filter(fmt.Sprintf("%s =", pkey), pval)
 	}
 	iterator := query.Run(this.c)
 	key, err := iterator.Next(nil)
@@ -347,76 +1150,3725 @@ func (this *Model) getUserKey(params map[string]string) string {
 }
 
 /**
- * データストアにゲームを追加する
+ * 外部サービスのアカウント
+ * ひとつのユーザに複数のアカウントを連携できる
+ * キー名を "サービス名:OAuthId" にすることで同じアカウントが複数のユーザに連携されないようにする
+ * @struct
+ * @property {string} UserKey 連携先ユーザのエンコード済みキー
+ * @property {string} Provider サービス名 "Twitter" または OAuth2Provider.Name
+ * @property {string} OAuthId サービスが決めたユーザID
+ * @property {string} Name サービス上の名前
+ * @property {time.Time} Date 連携した日時
+ * @property {string} AccessToken 最後にログインした時のアクセストークン、署名付きでAPIを呼び出す時に使う
+ * @property {string} AccessTokenSecret アクセストークンのシークレット (OAuth 1.0a のみ)
+ */
+type Identity struct {
+	UserKey string
+	Provider string
+	OAuthId string
+	Name string
+	Date time.Time
+	AccessToken string `datastore:",noindex"`
+	AccessTokenSecret string `datastore:",noindex"`
+}
+
+/**
+ * 外部サービスのアカウントを表すキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} provider サービス名
+ * @param {string} oauthId サービスが決めたユーザID
+ * @returns {*datastore.Key} Identity のキー
+ */
+func identityKey(c appengine.Context, provider string, oauthId string) *datastore.Key {
+	return datastore.NewKey(c, "Identity", fmt.Sprintf("%s:%s", provider, oauthId), 0, nil)
+}
+
+/**
+ * 外部サービスのアカウントが連携されているユーザを返す
+ * 連携情報が無い古いユーザは User.Type と User.OAuthId から探して連携情報を作成する
+ * 存在しない場合は空文字を返す
  * @method
  * @memberof Model
- * @param {*Game} game 追加するゲーム
- * @returns {string} エンコード済みのゲームキー
+ * @param {string} provider サービス名
+ * @param {string} oauthId サービスが決めたユーザID
+ * @returns {string} エンコード済みのユーザキー
  */
-func (this *Model) addGame(game *Game) string {
-	incompleteKey := datastore.NewIncompleteKey(this.c, "Game", nil)
-	completeKey, err := datastore.Put(this.c, incompleteKey, game)
+func (this *Model) getIdentityOwner(provider string, oauthId string) string {
+	identity := new(Identity)
+	err := datastore.Get(this.c, identityKey(this.c, provider, oauthId), identity)
+	if err == nil {
+		return identity.UserKey
+	} else if err != datastore.ErrNoSuchEntity {
+		check(this.c, err)
+		return ""
+	}
+
+	params := make(map[string]string, 2)
+	params["Type"] = provider
+	params["OAuthId"] = oauthId
+	userKey := this.getUserKey(params)
+	if userKey == "" {
+		return ""
+	}
+	err = this.linkIdentity(userKey, provider, oauthId, "")
 	check(this.c, err)
-	return completeKey.Encode()
+	return userKey
 }
 
 /**
- * データストアからゲームを取得する
+ * 外部サービスのアカウントでユーザを新規作成する
+ * ユーザとアカウントの連携情報を同時に保存する
  * @method
  * @memberof Model
- * @param {string} encodedGameKey エンコード済みのゲームキー
- * @returns {*Game} ゲームオブジェクト
+ * @param {*User} user 追加するユーザ、Type と OAuthId が設定されていること
+ * @returns {string} エンコード済みのユーザキー
+ * @returns {error} 既に連携済みなら ErrIdentityAlreadyLinked
  */
-func (this *Model) getGame(encodedGameKey string) *Game {
-	gameKey, err := datastore.DecodeKey(encodedGameKey)
-	check(this.c, err)
-	
-	game := new(Game)
-	err = datastore.Get(this.c, gameKey, game)
-	check(this.c, err)
-	
-	return game
+func (this *Model) addOAuthUser(user *User) (string, error) {
+	if user == nil {
+		return "", errors.New("ユーザの追加を中止しました")
+	}
+	encodedKey := ""
+	err := datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		key := identityKey(tc, user.Type, user.OAuthId)
+		err := datastore.Get(tc, key, new(Identity))
+		if err == nil {
+			return ErrIdentityAlreadyLinked
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		userKey, err := datastore.Put(tc, datastore.NewIncompleteKey(tc, "User", nil), user)
+		if err != nil {
+			return err
+		}
+		encodedKey = userKey.Encode()
+
+		identity := new(Identity)
+		identity.UserKey = encodedKey
+		identity.Provider = user.Type
+		identity.OAuthId = user.OAuthId
+		identity.Name = user.Name
+		identity.Date = time.Now()
+		_, err = datastore.Put(tc, key, identity)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return "", err
+	}
+	return encodedKey, nil
 }
 
 /**
- * データストアからゲームを削除する
- * 削除を命令したユーザとゲームの所有者が一致していることを事前に確認すること
- * この関数内ではチェックを行わない
- * @param {string} encodedGameKey エンコード済みのゲームキー
+ * ユーザに外部サービスのアカウントを連携する
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {string} provider サービス名
+ * @param {string} oauthId サービスが決めたユーザID
+ * @param {string} name サービス上の名前
+ * @returns {error} 別のユーザに連携済みなら ErrIdentityAlreadyLinked
  */
-func (this *Model) deleteGame(encodedGameKey string) {
-	gameKey, err := datastore.DecodeKey(encodedGameKey)
-	check(this.c, err)
-	
-	err = datastore.Delete(this.c, gameKey)
+func (this *Model) linkIdentity(userKey string, provider string, oauthId string, name string) error {
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		key := identityKey(tc, provider, oauthId)
+		identity := new(Identity)
+		err := datastore.Get(tc, key, identity)
+		if err == nil && identity.UserKey != userKey {
+			return ErrIdentityAlreadyLinked
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		identity.UserKey = userKey
+		identity.Provider = provider
+		identity.OAuthId = oauthId
+		if name != "" {
+			identity.Name = name
+		}
+		identity.Date = time.Now()
+		_, err = datastore.Put(tc, key, identity)
+		return err
+	}, nil)
+}
+
+/**
+ * 外部サービスのアカウントのアクセストークンを保存する
+ * ログインするたびに新しいトークンで上書きする
+ * @method
+ * @memberof Model
+ * @param {string} provider サービス名
+ * @param {string} oauthId サービスが決めたユーザID
+ * @param {string} token アクセストークン
+ * @param {string} tokenSecret アクセストークンのシークレット
+ * @returns {error} エラー
+ */
+func (this *Model) setIdentityToken(provider string, oauthId string, token string, tokenSecret string) error {
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		key := identityKey(tc, provider, oauthId)
+		identity := new(Identity)
+		err := datastore.Get(tc, key, identity)
+		if err != nil {
+			return err
+		}
+		identity.AccessToken = token
+		identity.AccessTokenSecret = tokenSecret
+		_, err = datastore.Put(tc, key, identity)
+		return err
+	}, nil)
+}
+
+/**
+ * ユーザに連携されている外部サービスのアカウント一覧を返す
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {[]*Identity} 連携されているアカウント
+ */
+func (this *Model) getIdentities(userKey string) []*Identity {
+	// 連携情報が無い古いユーザは先に作成しておく
+	user := this.getUser(userKey)
+	if user.Type != "normal" && user.OAuthId != "" {
+		this.getIdentityOwner(user.Type, user.OAuthId)
+	}
+
+	identities := make([]*Identity, 0)
+	query := datastore.NewQuery("Identity").Filter("UserKey =", userKey)
+	_, err := query.GetAll(this.c, &identities)
 	check(this.c, err)
+	return identities
+}
+
+/**
+ * 外部サービスのアカウントの連携を解除する
+ * メールアドレスでのログインを含めて、ログイン方法がひとつも残らない場合は解除しない
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {string} provider サービス名
+ * @param {string} oauthId サービスが決めたユーザID
+ * @returns {error} エラー
+ */
+func (this *Model) unlinkIdentity(userKey string, provider string, oauthId string) error {
+	identities := this.getIdentities(userKey)
+	user := this.getUser(userKey)
+	logins := len(identities)
+	if user.Mail != "" {
+		logins++
+	}
+	if logins <= 1 {
+		return ErrLastIdentity
+	}
+
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		iKey := identityKey(tc, provider, oauthId)
+		identity := new(Identity)
+		err := datastore.Get(tc, iKey, identity)
+		if err != nil {
+			return err
+		}
+		if identity.UserKey != userKey {
+			return fmt.Errorf("ユーザキー: %s に連携されていないアカウントです", userKey)
+		}
+		err = datastore.Delete(tc, iKey)
+		if err != nil {
+			return err
+		}
+
+		// 古い連携情報から再び連携されないように消しておく
+		user := new(User)
+		err = datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		if user.Type == provider && user.OAuthId == oauthId {
+			user.OAuthId = ""
+			_, err = datastore.Put(tc, key, user)
+		}
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+/**
+ * ユーザのパスワードを設定する
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {string} pass 平文パスワード
+ * @returns {error} エラー
+ */
+func (this *Model) setPassword(userKey string, pass string) error {
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		user.Pass, user.Salt = this.hashPassword(pass, "")
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, nil)
+}
+
+/**
+ * メールアドレスでのログインを解除する
+ * 外部サービスのアカウントがひとつも連携されていない場合は解除しない
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {error} エラー
+ */
+func (this *Model) unlinkMail(userKey string) error {
+	if len(this.getIdentities(userKey)) == 0 {
+		return ErrLastIdentity
+	}
+
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		if user.Mail == "" {
+			return nil
+		}
+		err = datastore.Delete(tc, userMailKey(tc, user.Mail))
+		if err != nil {
+			return err
+		}
+		user.Mail = ""
+		user.Pass = nil
+		user.Salt = ""
+		clearTotp(user)
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+/**
+ * 選択できる表示言語
+ * @const
+ */
+var languages = []string{"ja", "en"}
+
+/**
+ * 公開プロフィールのハンドルに使えない名前
+ * サイト内のページ名と紛らわしいもの
+ * @const
+ */
+var reservedHandles = []string{"admin", "administrator", "api", "debug", "editor", "gamelist", "login", "logout", "root", "support", "system", "u"}
+
+/**
+ * ハンドルを正規化する
+ * 大文字小文字は区別しない
+ * @function
+ * @param {string} handle ハンドル
+ * @returns {string} 正規化したハンドル
+ */
+func normalizeHandle(handle string) string {
+	return strings.ToLower(strings.TrimSpace(handle))
+}
+
+/**
+ * ハンドルが予約された名前でないか調べる
+ * 文字数と使える文字は profileSchema で検証する
+ * @function
+ * @param {string} handle ハンドル
+ * @returns {error} 使えなければ理由を表すエラー
+ */
+func validateHandle(handle string) error {
+	if exist(reservedHandles, normalizeHandle(handle)) {
+		return errors.New("このハンドルは使えません")
+	}
+	return nil
+}
+
+/**
+ * ハンドルの使用状況
+ * キー名は正規化したハンドル
+ * @struct
+ * @property {string} UserKey ハンドルを使っているユーザのエンコード済みキー
+ */
+type UserHandle struct {
+	UserKey string
+}
+
+/**
+ * ハンドルの使用状況を表すキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} handle ハンドル
+ * @returns {*datastore.Key} UserHandle のキー
+ */
+func userHandleKey(c appengine.Context, handle string) *datastore.Key {
+	return datastore.NewKey(c, "UserHandle", normalizeHandle(handle), 0, nil)
+}
+
+/**
+ * ハンドルからユーザキーを返す
+ * 存在しない場合は空文字を返す
+ * @method
+ * @memberof Model
+ * @param {string} handle ハンドル
+ * @returns {string} エンコード済みのユーザキー
+ */
+func (this *Model) getUserKeyByHandle(handle string) string {
+	userHandle := new(UserHandle)
+	err := datastore.Get(this.c, userHandleKey(this.c, handle), userHandle)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			check(this.c, err)
+		}
+		return ""
+	}
+	return userHandle.UserKey
+}
+
+/**
+ * プロフィールの入力値を検証する
+ * @function
+ * @param {map[string]string} profile name, handle, bio, language
+ * @returns {error} 不正な値があれば *ValidationError
+ */
+func validateProfile(profile map[string]string) error {
+	err := profileSchema.validate(profile)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/**
+ * プロフィールを更新する
+ * ハンドルを変えた場合は古いハンドルを解放して新しいハンドルを登録する
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {map[string]string} profile name, handle, bio, language
+ * @returns {error} 検証エラー、ハンドルが使用済みなら ErrHandleAlreadyUsed
+ */
+func (this *Model) updateProfile(userKey string, profile map[string]string) error {
+	err := validateProfile(profile)
+	if err != nil {
+		return err
+	}
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return err
+	}
+	handle := normalizeHandle(profile["handle"])
+
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+
+		if handle != user.Handle {
+			if handle != "" {
+				userHandle := new(UserHandle)
+				err = datastore.Get(tc, userHandleKey(tc, handle), userHandle)
+				if err == nil && userHandle.UserKey != userKey {
+					return ErrHandleAlreadyUsed
+				} else if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				userHandle.UserKey = userKey
+				_, err = datastore.Put(tc, userHandleKey(tc, handle), userHandle)
+				if err != nil {
+					return err
+				}
+			}
+			if user.Handle != "" {
+				err = datastore.Delete(tc, userHandleKey(tc, user.Handle))
+				if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+			}
+			user.Handle = handle
+		}
+
+		user.Name = strings.TrimSpace(profile["name"])
+		user.Bio = profile["bio"]
+		user.Language = profile["language"]
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+	// 作者名で検索できるように索引を更新する
+	this.indexUserGames(userKey)
+	return nil
+}
+
+/**
+ * アイコン画像に使える画像の種類
+ * @const
+ */
+var avatarContentTypes = []string{"image/png", "image/jpeg", "image/gif"}
+
+/**
+ * アイコン画像の最大サイズ
+ * データストアのエンティティの上限より小さくする
+ * @const
+ */
+const avatarMaxSize = 512 * 1024
+
+/**
+ * アイコン画像を設定する
+ * 画像は素材として保存し、古い画像は削除する
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {string} name ファイル名
+ * @param {[]byte} data 画像データ
+ * @returns {error} 画像として使えなければ理由を表すエラー
+ */
+func (this *Model) setAvatar(userKey string, name string, data []byte) error {
+	if len(data) > avatarMaxSize {
+		return errors.New("画像は512KB以下にしてください")
+	}
+	contentType := http.DetectContentType(data)
+	if !exist(avatarContentTypes, contentType) {
+		return errors.New("PNG、JPEG、GIF の画像を選んでください")
+	}
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return err
+	}
+
+	asset := new(Asset)
+	asset.UserKey = userKey
+	asset.Name = name
+	asset.ContentType = contentType
+	asset.Data = data
+	assetKey := this.addAsset(asset)
+
+	old := ""
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		old = user.Avatar
+		user.Avatar = assetKey
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if old != "" {
+		oldKey, err := datastore.DecodeKey(old)
+		if err == nil {
+			err = datastore.Delete(this.c, oldKey)
+		}
+		check(this.c, err)
+	}
+	return nil
+}
+
+/**
+ * 素材を返す
+ * 存在しない場合は nil を返す
+ * @method
+ * @memberof Model
+ * @param {string} encodedAssetKey エンコード済みの素材キー
+ * @returns {*Asset} 素材
+ */
+func (this *Model) getAsset(encodedAssetKey string) *Asset {
+	key, err := datastore.DecodeKey(encodedAssetKey)
+	if err != nil {
+		return nil
+	}
+	asset := new(Asset)
+	err = datastore.Get(this.c, key, asset)
+	if err != nil {
+		return nil
+	}
+	return asset
+}
+
+/**
+ * 現在のパスワードを確認してからパスワードを変更する
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {string} currentPass 現在の平文パスワード
+ * @param {string} newPass 新しい平文パスワード
+ * @returns {error} 現在のパスワードが違えば ErrWrongPassword、入力値が不正なら *ValidationError
+ */
+func (this *Model) changePassword(userKey string, currentPass string, newPass string) error {
+	verr := changePasswordSchema.validate(map[string]string{"current_pass": currentPass, "new_pass": newPass})
+	if verr != nil {
+		return verr
+	}
+	user := this.getUser(userKey)
+	if user.Mail == "" {
+		return errors.New("パスワードが設定されていません")
+	}
+	hashedPass, _ := this.hashPassword(currentPass, user.Salt)
+	if subtle.ConstantTimeCompare(user.Pass, hashedPass) != 1 {
+		return ErrWrongPassword
+	}
+	return this.setPassword(userKey, newPass)
+}
+
+/**
+ * ユーザが公開しているゲーム一覧を返す
+ * ゴミ箱のゲームは含めない
+ * @method
+ * @memberof Model
+ * @param {string} encodedUserKey ユーザキー
+ * @returns {map[string]*Game} エンコード済みのゲームキーとゲームの対応表
+ */
+func (this *Model) getPublishedGames(encodedUserKey string) map[string]*Game {
+	games := make([]*Game, 0)
+	query := datastore.NewQuery("Game").Filter("UserKey =", encodedUserKey).Filter("Published =", true)
+	keys, err := query.GetAll(this.c, &games)
+	check(this.c, err)
+
+	result := make(map[string]*Game, len(keys))
+	for i, key := range keys {
+		if games[i].trashed() {
+			continue
+		}
+		result[key.Encode()] = games[i]
+	}
+	return result
+}
+
+/**
+ * ゲームの情報を更新する
+ * params に含まれる項目だけを変更する
+ * 設定は空白を取り除いて保存し、空文字なら未設定に戻す
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {map[string]string} params name, description, thumbnail, first_scene, settings, published ("true"/"false"), tags, difficulty, length, theme
+ * @returns {*Game} 更新後のゲーム
+ * @returns {error} 入力値が不正なら *ValidationError
+ */
+func (this *Model) updateGame(encodedGameKey string, params map[string]string) (*Game, error) {
+	verr := gameSchema.validatePartial(params)
+	if verr != nil {
+		return nil, verr
+	}
+	// カテゴリは管理者が用意したものだけを選べる
+	verr = &ValidationError{Fields: make(map[string]string)}
+	for _, axis := range categoryAxes {
+		id, ok := params[axis]
+		if ok && id != "" && this.getCategory(axis, id) == nil {
+			verr.add(axis, fmt.Sprintf("%sに選べない値が指定されました", categoryAxisLabels[axis]))
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+	key, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, err
+	}
+
+	game := new(Game)
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		err := datastore.Get(tc, key, game)
+		if err != nil {
+			return err
+		}
+		if name, ok := params["name"]; ok {
+			game.Name = name
+		}
+		if description, ok := params["description"]; ok {
+			game.Description = description
+		}
+		if thumbnail, ok := params["thumbnail"]; ok {
+			game.Thumbnail = thumbnail
+		}
+		if firstScene, ok := params["first_scene"]; ok {
+			game.FirstScene = firstScene
+		}
+		if settings, ok := params["settings"]; ok {
+			compact := new(bytes.Buffer)
+			if settings != "" {
+				err := json.Compact(compact, []byte(settings))
+				if err != nil {
+					return err
+				}
+			}
+			game.Settings = compact.String()
+		}
+		if published, ok := params["published"]; ok {
+			game.Published = published == "true"
+		}
+		if tags, ok := params["tags"]; ok {
+			game.Tags, _ = parseTags(tags)
+		}
+		for _, axis := range categoryAxes {
+			if id, ok := params[axis]; ok {
+				game.setCategory(axis, id)
+			}
+		}
+		game.Updated = time.Now()
+		_, err = datastore.Put(tc, key, game)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	this.indexGame(encodedGameKey)
+	return game, nil
+}
+
+/**
+ * ゲームの公開状態を変更する
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {bool} published 公開するならtrue
+ * @returns {error} エラー
+ */
+func (this *Model) setGamePublished(encodedGameKey string, published bool) error {
+	key, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return err
+	}
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		game := new(Game)
+		err := datastore.Get(tc, key, game)
+		if err != nil {
+			return err
+		}
+		game.Published = published
+		game.Updated = time.Now()
+		_, err = datastore.Put(tc, key, game)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	this.indexGame(encodedGameKey)
+	return nil
+}
+
+/**
+ * API トークンに与えられる権限
+ * read_games: ゲームの取得
+ * write_games: ゲームの作成と更新
+ * upload_assets: 素材のアップロード
+ * @const
+ */
+var apiScopes = []string{"read_games", "write_games", "upload_assets"}
+
+/**
+ * API トークンの先頭に付ける文字列
+ * 漏洩したトークンを検索で見つけやすくする
+ * @const
+ */
+const apiTokenPrefix = "e3ds_"
+
+/**
+ * スクリプトなどから API を呼び出すためのトークン
+ * キー名はトークンの SHA-256 ハッシュで、平文のトークンは保存しない
+ * @struct
+ * @property {string} UserKey 所有者のエンコード済みキー
+ * @property {string} Name 利用者が付けた名前
+ * @property {[]string} Scopes 許可された権限
+ * @property {string} Hint 一覧で見分けるためのトークンの末尾4文字
+ * @property {time.Time} Created 作成日時
+ * @property {time.Time} Expires 有効期限、無期限ならゼロ値
+ * @property {time.Time} LastUsed 最後に使われた日時
+ */
+type APIToken struct {
+	UserKey string
+	Name string
+	Scopes []string
+	Hint string `datastore:",noindex"`
+	Created time.Time
+	Expires time.Time
+	LastUsed time.Time `datastore:",noindex"`
+}
+
+/**
+ * トークンの有効期限が切れているか調べる
+ * @method
+ * @memberof APIToken
+ * @param {time.Time} now 現在時刻
+ * @returns {bool} 切れていればtrue
+ */
+func (this *APIToken) expired(now time.Time) bool {
+	return !this.Expires.IsZero() && !this.Expires.After(now)
+}
+
+/**
+ * トークンに権限が与えられているか調べる
+ * @method
+ * @memberof APIToken
+ * @param {string} scope 必要な権限
+ * @returns {bool} 与えられていればtrue
+ */
+func (this *APIToken) hasScope(scope string) bool {
+	return exist(this.Scopes, scope)
+}
+
+/**
+ * API トークンのキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} token 平文のトークン
+ * @returns {*datastore.Key} APIToken のキー
+ */
+func apiTokenKey(c appengine.Context, token string) *datastore.Key {
+	sum := sha256.Sum256([]byte(token))
+	return datastore.NewKey(c, "APIToken", hex.EncodeToString(sum[:]), 0, nil)
+}
+
+/**
+ * API トークンを作成する
+ * 平文のトークンはこの時だけ返す
+ * @method
+ * @memberof Model
+ * @param {string} userKey 所有者のエンコード済みキー
+ * @param {string} name トークンの名前
+ * @param {[]string} scopes 与える権限
+ * @param {time.Duration} lifetime 有効期間、0なら無期限
+ * @returns {string} 平文のトークン
+ * @returns {error} 名前が不正なら *ValidationError、権限が不正ならエラー
+ */
+func (this *Model) createAPIToken(userKey string, name string, scopes []string, lifetime time.Duration) (string, error) {
+	name = strings.TrimSpace(name)
+	verr := apiTokenSchema.validatePartial(map[string]string{"name": name})
+	if verr != nil {
+		return "", verr
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("権限を選んでください")
+	}
+	for _, scope := range scopes {
+		if !exist(apiScopes, scope) {
+			return "", fmt.Errorf("存在しない権限です: %s", scope)
+		}
+	}
+
+	token := apiTokenPrefix + getSecureRandomString(32)
+	apiToken := new(APIToken)
+	apiToken.UserKey = userKey
+	apiToken.Name = name
+	apiToken.Scopes = scopes
+	apiToken.Hint = token[len(token)-4:]
+	apiToken.Created = time.Now()
+	if lifetime > 0 {
+		apiToken.Expires = apiToken.Created.Add(lifetime)
+	}
+	_, err := datastore.Put(this.c, apiTokenKey(this.c, token), apiToken)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+/**
+ * 平文のトークンから API トークンを返す
+ * 存在しないか期限切れなら nil を返す
+ * 最後に使われた日時を更新する
+ * @method
+ * @memberof Model
+ * @param {string} token 平文のトークン
+ * @returns {*APIToken} API トークン
+ */
+func (this *Model) getAPIToken(token string) *APIToken {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil
+	}
+	key := apiTokenKey(this.c, token)
+	apiToken := new(APIToken)
+	err := datastore.Get(this.c, key, apiToken)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			check(this.c, err)
+		}
+		return nil
+	}
+	now := time.Now()
+	if apiToken.expired(now) {
+		return nil
+	}
+
+	// 毎回書き込まないように1時間単位で更新する
+	if now.Sub(apiToken.LastUsed) > time.Hour {
+		apiToken.LastUsed = now
+		_, err = datastore.Put(this.c, key, apiToken)
+		check(this.c, err)
+	}
+	return apiToken
+}
+
+/**
+ * ユーザの API トークン一覧を返す
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {map[string]*APIToken} エンコード済みのトークンキーと API トークンの対応表
+ */
+func (this *Model) getAPITokens(userKey string) map[string]*APIToken {
+	tokens := make([]*APIToken, 0)
+	keys, err := datastore.NewQuery("APIToken").Filter("UserKey =", userKey).GetAll(this.c, &tokens)
+	check(this.c, err)
+
+	result := make(map[string]*APIToken, len(keys))
+	for i, key := range keys {
+		result[key.Encode()] = tokens[i]
+	}
+	return result
+}
+
+/**
+ * API トークンを無効にする
+ * @method
+ * @memberof Model
+ * @param {string} userKey 所有者のエンコード済みキー
+ * @param {string} encodedTokenKey エンコード済みのトークンキー
+ * @returns {error} 他のユーザのトークンならエラー
+ */
+func (this *Model) revokeAPIToken(userKey string, encodedTokenKey string) error {
+	key, err := datastore.DecodeKey(encodedTokenKey)
+	if err != nil {
+		return err
+	}
+	apiToken := new(APIToken)
+	err = datastore.Get(this.c, key, apiToken)
+	if err != nil {
+		return err
+	}
+	if apiToken.UserKey != userKey {
+		return errors.New("他のユーザのトークンは無効にできません")
+	}
+	return datastore.Delete(this.c, key)
+}
+
+/**
+ * ユーザの二段階認証の設定を消去する
+ * @function
+ * @param {*User} user 対象のユーザ
+ */
+func clearTotp(user *User) {
+	user.TotpEnabled = false
+	user.TotpSecret = ""
+	user.TotpPending = ""
+	user.TotpLastStep = 0
+	user.RecoveryCodes = nil
+}
+
+/**
+ * 二段階認証の登録を始める
+ * 新しいシークレットを確認待ちとして保存する
+ * 確認コードで enableTotp を呼ぶまで有効にはならない
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {string} base32 でエンコードしたシークレット
+ * @returns {error} 既に有効なら ErrTotpAlreadyEnabled
+ */
+func (this *Model) startTotpEnrollment(userKey string) (string, error) {
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return "", err
+	}
+	secret := newTotpSecret()
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		if user.TotpEnabled {
+			return ErrTotpAlreadyEnabled
+		}
+		user.TotpPending = secret
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+/**
+ * 確認コードを検証して二段階認証を有効にする
+ * リカバリーコードはハッシュだけを保存し、平文はこの時だけ返す
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {string} code 認証アプリに表示された確認コード
+ * @returns {[]string} 平文のリカバリーコード
+ * @returns {error} コードが間違っていれば ErrInvalidTotpCode
+ */
+func (this *Model) enableTotp(userKey string, code string) ([]string, error) {
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return nil, err
+	}
+	codes := newRecoveryCodes()
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		if user.TotpEnabled {
+			return ErrTotpAlreadyEnabled
+		}
+		if user.TotpPending == "" {
+			return ErrInvalidTotpCode
+		}
+		step := verifyTotp(user.TotpPending, code, 0, time.Now())
+		if step < 0 {
+			return ErrInvalidTotpCode
+		}
+
+		user.TotpEnabled = true
+		user.TotpSecret = user.TotpPending
+		user.TotpPending = ""
+		user.TotpLastStep = step
+		user.RecoveryCodes = make([]string, len(codes))
+		for i, c := range codes {
+			user.RecoveryCodes[i] = hashRecoveryCode(c)
+		}
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+/**
+ * ログインの2段階目としてワンタイムパスワードまたはリカバリーコードを検証する
+ * 使ったリカバリーコードは削除する
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {string} code ワンタイムパスワードまたはリカバリーコード
+ * @returns {bool} リカバリーコードを使ったらtrue
+ * @returns {error} どちらとも一致しなければ ErrInvalidTotpCode
+ */
+func (this *Model) verifySecondFactor(userKey string, code string) (bool, error) {
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return false, err
+	}
+	usedRecovery := false
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		if !user.TotpEnabled {
+			return ErrInvalidTotpCode
+		}
+
+		usedRecovery = false
+		step := verifyTotp(user.TotpSecret, code, user.TotpLastStep, time.Now())
+		if step >= 0 {
+			user.TotpLastStep = step
+		} else {
+			hash := hashRecoveryCode(code)
+			index := -1
+			for i, h := range user.RecoveryCodes {
+				if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+					index = i
+				}
+			}
+			if index < 0 {
+				return ErrInvalidTotpCode
+			}
+			user.RecoveryCodes = append(user.RecoveryCodes[:index], user.RecoveryCodes[index+1:]...)
+			usedRecovery = true
+		}
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, nil)
+	return usedRecovery, err
+}
+
+/**
+ * 二段階認証を無効にする
+ * 本人が無効にする場合は呼び出す前に verifySecondFactor で確認する
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {error} エラー
+ */
+func (this *Model) disableTotp(userKey string) error {
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		clearTotp(user)
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, nil)
+}
+
+/**
+ * 退会を申請してから実際に削除するまでの猶予期間
+ * この間にログインして申請を取り消せる
+ * @const
+ */
+const accountDeletionGrace = time.Hour * 24 * 14
+
+/**
+ * 退会を申請する
+ * 猶予期間が過ぎると cron で deleteUser が呼ばれる
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {time.Time} 削除予定日時
+ * @returns {error} エラー
+ */
+func (this *Model) requestAccountDeletion(userKey string) (time.Time, error) {
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+	deleteAt := time.Now().Add(accountDeletionGrace)
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		if !user.DeleteAt.IsZero() {
+			deleteAt = user.DeleteAt
+			return nil
+		}
+		user.DeleteAt = deleteAt
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, nil)
+	return deleteAt, err
+}
+
+/**
+ * 退会の申請を取り消す
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {error} エラー
+ */
+func (this *Model) cancelAccountDeletion(userKey string) error {
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return err
+	}
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		user := new(User)
+		err := datastore.Get(tc, key, user)
+		if err != nil {
+			return err
+		}
+		user.DeleteAt = time.Time{}
+		_, err = datastore.Put(tc, key, user)
+		return err
+	}, nil)
+}
+
+/**
+ * 削除予定日時を過ぎたユーザの一覧を返す
+ * @method
+ * @memberof Model
+ * @param {time.Time} now 現在時刻
+ * @returns {[]string} エンコード済みのユーザキー
+ */
+func (this *Model) getExpiredDeletions(now time.Time) []string {
+	query := datastore.NewQuery("User").Filter("DeleteAt >", time.Time{}).Filter("DeleteAt <=", now).KeysOnly()
+	keys, err := query.GetAll(this.c, nil)
+	check(this.c, err)
+
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[i] = key.Encode()
+	}
+	return result
+}
+
+/**
+ * クエリに一致するエンティティをすべて削除する
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Query} query 削除するエンティティのクエリ
+ * @returns {error} エラー
+ */
+func deleteAll(c appengine.Context, query *datastore.Query) error {
+	keys, err := query.KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(keys); i += 500 {
+		end := i + 500
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err = datastore.DeleteMulti(c, keys[i:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * ユーザと、ユーザが所有するすべてのデータを削除する
+ * ゲームとその素材、共同編集者としての参加と招待、下書き、シーンのロック、連携アカウント、メールアドレスの登録、API トークン、セッションを削除する
+ * 監査ログは残す
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {error} エラー
+ */
+func (this *Model) deleteUser(userKey string) error {
+	key, err := datastore.DecodeKey(userKey)
+	if err != nil {
+		return err
+	}
+	user := new(User)
+	err = datastore.Get(this.c, key, user)
+	if err != nil {
+		return err
+	}
+
+	for gameKey := range this.getGameList(userKey) {
+		err = this.purgeGame(gameKey)
+		if err != nil {
+			return err
+		}
+	}
+	queries := []*datastore.Query{
+		datastore.NewQuery("Asset").Filter("UserKey =", userKey),
+		datastore.NewQuery("Game").Filter("UserKey =", userKey),
+		datastore.NewQuery("Collaborator").Filter("UserKey =", userKey),
+		datastore.NewQuery("Invitation").Filter("UserKey =", userKey),
+		datastore.NewQuery("Draft").Filter("UserKey =", userKey),
+		datastore.NewQuery("SceneLock").Filter("UserKey =", userKey),
+		datastore.NewQuery("Identity").Filter("UserKey =", userKey),
+		datastore.NewQuery("MailChange").Filter("UserKey =", userKey),
+		datastore.NewQuery("APIToken").Filter("UserKey =", userKey),
+	}
+	for _, query := range queries {
+		err = deleteAll(this.c, query)
+		if err != nil {
+			return err
+		}
+	}
+
+	if user.Mail != "" {
+		err = datastore.Delete(this.c, userMailKey(this.c, user.Mail))
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		this.resetLoginThrottle(user.Mail)
+	}
+	if user.Handle != "" {
+		err = datastore.Delete(this.c, userHandleKey(this.c, user.Handle))
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	this.removeUserSessions(userKey)
+	return datastore.Delete(this.c, key)
+}
+
+/**
+ * 重複したユーザを統合する
+ * source のゲーム、共同編集者としての参加、連携アカウントを target へ移して source を削除する
+ * target にメールアドレスが無ければ source のメールアドレスとパスワードも引き継ぐ
+ * @method
+ * @memberof Model
+ * @param {string} targetKey 残すユーザのエンコード済みキー
+ * @param {string} sourceKey 削除するユーザのエンコード済みキー
+ * @returns {error} エラー
+ */
+func (this *Model) mergeUsers(targetKey string, sourceKey string) error {
+	if targetKey == sourceKey {
+		return errors.New("同じユーザは統合できません")
+	}
+	target, err := datastore.DecodeKey(targetKey)
+	if err != nil {
+		return err
+	}
+	source, err := datastore.DecodeKey(sourceKey)
+	if err != nil {
+		return err
+	}
+
+	// ゲームの所有者を付け替える
+	games := make([]*Game, 0)
+	gameKeys, err := datastore.NewQuery("Game").Filter("UserKey =", sourceKey).GetAll(this.c, &games)
+	if err != nil {
+		return err
+	}
+	for _, game := range games {
+		game.UserKey = targetKey
+	}
+	for i := 0; i < len(gameKeys); i += 500 {
+		end := i + 500
+		if end > len(gameKeys) {
+			end = len(gameKeys)
+		}
+		_, err = datastore.PutMulti(this.c, gameKeys[i:end], games[i:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	// 素材の所有者を付け替える
+	assets := make([]*Asset, 0)
+	assetKeys, err := datastore.NewQuery("Asset").Filter("UserKey =", sourceKey).GetAll(this.c, &assets)
+	if err != nil {
+		return err
+	}
+	for _, asset := range assets {
+		asset.UserKey = targetKey
+	}
+	for i := 0; i < len(assetKeys); i += 500 {
+		end := i + 500
+		if end > len(assetKeys) {
+			end = len(assetKeys)
+		}
+		_, err = datastore.PutMulti(this.c, assetKeys[i:end], assets[i:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	// API トークンの所有者を付け替える
+	tokens := make([]*APIToken, 0)
+	tokenKeys, err := datastore.NewQuery("APIToken").Filter("UserKey =", sourceKey).GetAll(this.c, &tokens)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		token.UserKey = targetKey
+	}
+	_, err = datastore.PutMulti(this.c, tokenKeys, tokens)
+	if err != nil {
+		return err
+	}
+
+	// 共同編集者としての参加と招待を付け替える
+	err = this.mergeCollaborations(targetKey, sourceKey)
+	if err != nil {
+		return err
+	}
+
+	// 下書きとシーンのロックは一時的なものなので引き継がない
+	for _, kind := range []string{"Draft", "SceneLock"} {
+		err = deleteAll(this.c, datastore.NewQuery(kind).Filter("UserKey =", sourceKey))
+		if err != nil {
+			return err
+		}
+	}
+
+	// 連携アカウントを付け替える
+	identities := this.getIdentities(sourceKey)
+	for _, identity := range identities {
+		identity.UserKey = targetKey
+		_, err = datastore.Put(this.c, identityKey(this.c, identity.Provider, identity.OAuthId), identity)
+		if err != nil {
+			return err
+		}
+	}
+
+	// メールアドレスと権限を引き継いで source を削除する
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		targetUser := new(User)
+		err := datastore.Get(tc, target, targetUser)
+		if err != nil {
+			return err
+		}
+		sourceUser := new(User)
+		err = datastore.Get(tc, source, sourceUser)
+		if err != nil {
+			return err
+		}
+
+		if sourceUser.Mail != "" {
+			if targetUser.Mail == "" {
+				targetUser.Mail = sourceUser.Mail
+				targetUser.Pass = sourceUser.Pass
+				targetUser.Salt = sourceUser.Salt
+				targetUser.TotpEnabled = sourceUser.TotpEnabled
+				targetUser.TotpSecret = sourceUser.TotpSecret
+				targetUser.TotpLastStep = sourceUser.TotpLastStep
+				targetUser.RecoveryCodes = sourceUser.RecoveryCodes
+				userMail := new(UserMail)
+				userMail.UserKey = targetKey
+				_, err = datastore.Put(tc, userMailKey(tc, sourceUser.Mail), userMail)
+			} else {
+				err = datastore.Delete(tc, userMailKey(tc, sourceUser.Mail))
+			}
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		if roleRank(sourceUser.Role) > roleRank(targetUser.Role) {
+			targetUser.Role = sourceUser.Role
+		}
+		if sourceUser.Handle != "" {
+			if targetUser.Handle == "" {
+				targetUser.Handle = sourceUser.Handle
+				userHandle := new(UserHandle)
+				userHandle.UserKey = targetKey
+				_, err = datastore.Put(tc, userHandleKey(tc, sourceUser.Handle), userHandle)
+			} else {
+				err = datastore.Delete(tc, userHandleKey(tc, sourceUser.Handle))
+			}
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		if targetUser.Avatar == "" {
+			targetUser.Avatar = sourceUser.Avatar
+		}
+		if targetUser.Bio == "" {
+			targetUser.Bio = sourceUser.Bio
+		}
+
+		_, err = datastore.Put(tc, target, targetUser)
+		if err != nil {
+			return err
+		}
+		return datastore.Delete(tc, source)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+	this.removeUserSessions(sourceKey)
+	this.indexUserGames(targetKey)
+	return nil
+}
+
+/**
+ * データストアにゲームを追加する
+ * @method
+ * @memberof Model
+ * @param {*Game} game 追加するゲーム
+ * @returns {string} エンコード済みのゲームキー
+ */
+func (this *Model) addGame(game *Game) string {
+	incompleteKey := datastore.NewIncompleteKey(this.c, "Game", nil)
+	completeKey, err := datastore.Put(this.c, incompleteKey, game)
+	check(this.c, err)
+	if err == nil {
+		this.indexGame(completeKey.Encode())
+	}
+	return completeKey.Encode()
+}
+
+/**
+ * ゲームキーをデコードする
+ * UserMail や UserHandle のように UserKey だけを持つエンティティも Game として読めてしまうので、種類が Game のキーだけを受け付ける
+ * @function
+ * @param {string} encodedGameKey エンコード済みのゲームキー
+ * @returns {*datastore.Key} ゲームキー
+ * @returns {error} デコードできないか Game のキーでなければエラー
+ */
+func decodeGameKey(encodedGameKey string) (*datastore.Key, error) {
+	key, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, err
+	}
+	if key.Kind() != "Game" {
+		return nil, fmt.Errorf("ゲームのキーではありません: %s", key.Kind())
+	}
+	return key, nil
+}
+
+/**
+ * データストアからゲームを取得する
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey エンコード済みのゲームキー
+ * @returns {*Game} ゲームオブジェクト
+ */
+func (this *Model) getGame(encodedGameKey string) *Game {
+	gameKey, err := decodeGameKey(encodedGameKey)
+	check(this.c, err)
+	
+	game := new(Game)
+	err = datastore.Get(this.c, gameKey, game)
+	check(this.c, err)
+	
+	return game
+}
+
+/**
+ * ゲームをゴミ箱に移す
+ * ゴミ箱のゲームは一覧や公開プロフィールに表示されず、gameTrashPeriod の間は復元できる
+ * 所有者の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey エンコード済みのゲームキー
+ * @returns {error} エラー
+ */
+func (this *Model) trashGame(encodedGameKey string) error {
+	key, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return err
+	}
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		game := new(Game)
+		err := datastore.Get(tc, key, game)
+		if err != nil {
+			return err
+		}
+		if game.trashed() {
+			return nil
+		}
+		game.Deleted = time.Now()
+		_, err = datastore.Put(tc, key, game)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	this.indexGame(encodedGameKey)
+	return nil
+}
+
+/**
+ * ゲームをゴミ箱から元に戻す
+ * 所有者の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey エンコード済みのゲームキー
+ * @returns {*Game} 元に戻したゲーム
+ * @returns {error} 復元できる期間を過ぎていれば ErrTrashExpired
+ */
+func (this *Model) restoreGame(encodedGameKey string) (*Game, error) {
+	key, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, err
+	}
+	game := new(Game)
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		err := datastore.Get(tc, key, game)
+		if err != nil {
+			return err
+		}
+		if !game.trashed() {
+			return nil
+		}
+		if time.Now().After(game.PurgeAt()) {
+			return ErrTrashExpired
+		}
+		game.Deleted = time.Time{}
+		game.Updated = time.Now()
+		_, err = datastore.Put(tc, key, game)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	this.indexGame(encodedGameKey)
+	return game, nil
+}
+
+/**
+ * ゴミ箱にあるユーザのゲームを新しく移した順に返す
+ * @method
+ * @memberof Model
+ * @param {string} encodedUserKey ユーザキー
+ * @returns {[]GameListItem} ゲーム
+ */
+func (this *Model) getTrashedGames(encodedUserKey string) []GameListItem {
+	games := make([]*Game, 0)
+	query := datastore.NewQuery("Game").Filter("UserKey =", encodedUserKey).Filter("Deleted >", time.Time{}).Order("-Deleted")
+	keys, err := query.GetAll(this.c, &games)
+	check(this.c, err)
+
+	result := make([]GameListItem, len(keys))
+	for i, key := range keys {
+		result[i] = GameListItem{key.Encode(), games[i]}
+	}
+	return result
+}
+
+/**
+ * ゲームとゲームが所有するもの (素材、共同編集者、招待) をすべて削除する
+ * 元に戻せないので、通常はゴミ箱に移し、cron の purgeGames() が getExpiredTrash() で見つけた期限切れのゲームを削除する
+ * 所有者の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey エンコード済みのゲームキー
+ * @returns {error} エラー
+ */
+func (this *Model) purgeGame(encodedGameKey string) error {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return err
+	}
+	// ゲームが所有するものを先に削除し、途中で失敗してもゲームが残って再実行できるようにする
+	queries := []*datastore.Query{
+		datastore.NewQuery("Asset").Filter("GameKey =", encodedGameKey),
+		datastore.NewQuery("Collaborator").Ancestor(gameKey),
+		datastore.NewQuery("Revision").Ancestor(gameKey),
+		datastore.NewQuery("Draft").Ancestor(gameKey),
+		datastore.NewQuery("SceneLock").Ancestor(gameKey),
+		datastore.NewQuery("Invitation").Filter("GameKey =", encodedGameKey),
+	}
+	for _, query := range queries {
+		err = deleteAll(this.c, query)
+		if err != nil {
+			return err
+		}
+	}
+	err = datastore.Delete(this.c, searchIndexKey(this.c, encodedGameKey))
+	if err != nil {
+		return err
+	}
+	return datastore.Delete(this.c, gameKey)
+}
+
+/**
+ * ゴミ箱に移してから gameTrashPeriod を過ぎたゲームの一覧を返す
+ * @method
+ * @memberof Model
+ * @param {time.Time} now 現在時刻
+ * @returns {[]string} エンコード済みのゲームキー
+ */
+func (this *Model) getExpiredTrash(now time.Time) []string {
+	query := datastore.NewQuery("Game").Filter("Deleted >", time.Time{}).Filter("Deleted <=", now.Add(-gameTrashPeriod)).KeysOnly()
+	keys, err := query.GetAll(this.c, nil)
+	check(this.c, err)
+
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[i] = key.Encode()
+	}
+	return result
+}
+
+/**
+ * どこからも参照されていない素材を削除する
+ * ゲームの素材は、ゲームが存在しないか、ゲームの最初のシーン、サムネイル、設定、内容、下書きのどこにもキーが無ければ参照されていないとみなす
+ * 古いリビジョンだけが参照している素材も削除するので、そのリビジョンを復元してもその素材は表示されない
+ * アイコン画像はどのユーザのアイコンでもなければ参照されていないとみなす
+ * アップロード中の素材を消さないように、追加してから assetGracePeriod を過ぎたものだけを削除する
+ * 素材の中身を読まないように射影クエリを使う
+ * @method
+ * @memberof Model
+ * @param {time.Time} now 現在時刻
+ * @returns {int} 削除した素材の数
+ * @returns {error} エラー
+ */
+func (this *Model) purgeOrphanAssets(now time.Time) (int, error) {
+	assets := make([]*Asset, 0)
+	assetKeys, err := datastore.NewQuery("Asset").Project("GameKey", "UserKey", "Date").GetAll(this.c, &assets)
+	if err != nil {
+		return 0, err
+	}
+
+	// アイコン画像として使われている素材
+	users := make([]*User, 0)
+	_, err = datastore.NewQuery("User").Project("Avatar").GetAll(this.c, &users)
+	if err != nil {
+		return 0, err
+	}
+	avatars := make(map[string]bool, len(users))
+	for _, user := range users {
+		avatars[user.Avatar] = true
+	}
+
+	// ゲームの素材はゲームごとにまとめて、ゲームを1つずつ読んで調べる
+	orphans := make([]*datastore.Key, 0)
+	candidates := make(map[string][]*datastore.Key)
+	for i, asset := range assets {
+		if now.Sub(asset.Date) < assetGracePeriod {
+			continue
+		}
+		if asset.GameKey != "" {
+			candidates[asset.GameKey] = append(candidates[asset.GameKey], assetKeys[i])
+		} else if !avatars[assetKeys[i].Encode()] {
+			orphans = append(orphans, assetKeys[i])
+		}
+	}
+	for gameKey, keys := range candidates {
+		unused, err := this.getUnusedAssets(gameKey, keys)
+		if err != nil {
+			return 0, err
+		}
+		orphans = append(orphans, unused...)
+	}
+
+	for i := 0; i < len(orphans); i += 500 {
+		end := i + 500
+		if end > len(orphans) {
+			end = len(orphans)
+		}
+		err = datastore.DeleteMulti(this.c, orphans[i:end])
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(orphans), nil
+}
+
+/**
+ * ゲームの素材のうち使われていないものを返す
+ * ゲームが存在しなければすべてを、存在すれば最初のシーン、サムネイル、設定、内容、下書きのどこにもキーが無いものを返す
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey 素材の GameKey
+ * @param {[]*datastore.Key} assetKeys 調べる素材のキー
+ * @returns {[]*datastore.Key} 使われていない素材のキー
+ * @returns {error} エラー
+ */
+func (this *Model) getUnusedAssets(encodedGameKey string, assetKeys []*datastore.Key) ([]*datastore.Key, error) {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return assetKeys, nil
+	}
+	game := new(Game)
+	err = datastore.Get(this.c, gameKey, game)
+	if err == datastore.ErrNoSuchEntity {
+		return assetKeys, nil
+	} else if err != nil {
+		return nil, err
+	}
+	drafts := make([]*Draft, 0)
+	_, err = datastore.NewQuery("Draft").Ancestor(gameKey).GetAll(this.c, &drafts)
+	if err != nil {
+		return nil, err
+	}
+
+	references := []string{game.FirstScene, game.Thumbnail, game.Settings, game.Content}
+	for _, draft := range drafts {
+		references = append(references, draft.Content)
+	}
+	unused := make([]*datastore.Key, 0)
+	for _, key := range assetKeys {
+		encodedKey := key.Encode()
+		used := false
+		for _, reference := range references {
+			if strings.Contains(reference, encodedKey) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			unused = append(unused, key)
+		}
+	}
+	return unused, nil
+}
+
+/**
+ * 複製したゲームの名前を返す
+ * 名前の最大の文字数を超える場合は元の名前を切り詰める
+ * @function
+ * @param {string} name 元のゲームの名前
+ * @returns {string} 複製したゲームの名前
+ */
+func cloneGameName(name string) string {
+	suffix := []rune(" のコピー")
+	runes := []rune(name)
+	if len(runes) + len(suffix) > gameNameMaxLength {
+		runes = runes[:gameNameMaxLength - len(suffix)]
+	}
+	return string(runes) + string(suffix)
+}
+
+/**
+ * 文字列に含まれるキーを新しいキーに置き換える
+ * @function
+ * @param {string} value 置き換える文字列
+ * @param {map[string]string} keys 元のキーと新しいキーの対応表
+ * @returns {string} 置き換えた文字列
+ */
+func remapKeys(value string, keys map[string]string) string {
+	pairs := make([]string, 0, len(keys) * 2)
+	for oldKey, newKey := range keys {
+		pairs = append(pairs, oldKey, newKey)
+	}
+	return strings.NewReplacer(pairs...).Replace(value)
+}
+
+/**
+ * ゲームを複製する
+ * ゲーム全体をコピーし、userKey が所有する非公開のゲームにする
+ * コピーするのは名前や説明などの情報、タグとカテゴリ、設定、シーンとイベントとアイテムを含む内容 (Game.Content)、素材
+ * 共同編集者、下書き、シーンのロックはコピーせず、リビジョンの履歴は複製した時点の内容だけを最初のリビジョンにする
+ * 新しいキーを先に割り当て、最初のシーン、サムネイル、設定、内容に含まれる元のゲームと素材のキーを置き換えるので、
+ * 複製したゲームは元のゲームを参照しない
+ * 途中で失敗した場合は作成したエンティティを削除する
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey 複製するゲームのキー
+ * @param {string} encodedUserKey 複製したゲームを所有するユーザのキー
+ * @returns {string} 複製したゲームのエンコード済みキー
+ * @returns {*Game} 複製したゲーム
+ * @returns {error} エラー
+ */
+func (this *Model) cloneGame(encodedGameKey string, encodedUserKey string) (string, *Game, error) {
+	sourceKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return "", nil, err
+	}
+	source := new(Game)
+	err = datastore.Get(this.c, sourceKey, source)
+	if err != nil {
+		return "", nil, err
+	}
+	assets := make([]*Asset, 0)
+	assetKeys, err := datastore.NewQuery("Asset").Filter("GameKey =", encodedGameKey).GetAll(this.c, &assets)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 保存する前にキーを割り当てて、元のキーとの対応表を作る
+	low, _, err := datastore.AllocateIDs(this.c, "Game", nil, 1)
+	if err != nil {
+		return "", nil, err
+	}
+	gameKey := datastore.NewKey(this.c, "Game", "", low, nil)
+	keys := map[string]string{encodedGameKey: gameKey.Encode()}
+	newAssetKeys := make([]*datastore.Key, len(assetKeys))
+	if len(assetKeys) > 0 {
+		low, _, err = datastore.AllocateIDs(this.c, "Asset", nil, len(assetKeys))
+		if err != nil {
+			return "", nil, err
+		}
+		for i, key := range assetKeys {
+			newAssetKeys[i] = datastore.NewKey(this.c, "Asset", "", low + int64(i), nil)
+			keys[key.Encode()] = newAssetKeys[i].Encode()
+		}
+	}
+
+	game := *source
+	game.Name = cloneGameName(source.Name)
+	game.UserKey = encodedUserKey
+	game.Published = false
+	game.Thumbnail = remapKeys(source.Thumbnail, keys)
+	game.FirstScene = remapKeys(source.FirstScene, keys)
+	game.Settings = remapKeys(source.Settings, keys)
+	game.Content = remapKeys(source.Content, keys)
+	game.Revision = 0
+	game.Created = time.Now()
+	game.Updated = game.Created
+	game.Deleted = time.Time{}
+
+	// 内容があれば複製した時点を最初のリビジョンにする
+	var revision *Revision
+	if game.Content != "" {
+		game.Revision = 1
+		revision = &Revision{
+			Number: 1,
+			UserKey: encodedUserKey,
+			Message: fmt.Sprintf("「%s」から複製", source.Name),
+			Content: game.Content,
+			Date: game.Created,
+		}
+	}
+
+	// 素材は大きいので1件ずつ保存する
+	saved := make([]*datastore.Key, 0, len(assets) + 1)
+	for i, asset := range assets {
+		copied := *asset
+		copied.GameKey = gameKey.Encode()
+		copied.UserKey = encodedUserKey
+		_, err = datastore.Put(this.c, newAssetKeys[i], &copied)
+		if err != nil {
+			break
+		}
+		saved = append(saved, newAssetKeys[i])
+	}
+	if err == nil && revision != nil {
+		_, err = datastore.Put(this.c, revisionKey(this.c, gameKey, 1), revision)
+	}
+	if err == nil {
+		_, err = datastore.Put(this.c, gameKey, &game)
+	}
+	if err != nil {
+		if revision != nil {
+			saved = append(saved, revisionKey(this.c, gameKey, 1))
+		}
+		if e := datastore.DeleteMulti(this.c, saved); e != nil {
+			this.c.Errorf("複製を中止したゲームの素材を削除できませんでした: %s", e.Error())
+		}
+		return "", nil, err
+	}
+	return gameKey.Encode(), &game, nil
+}
+
+/**
+ * リビジョンのメッセージの最大の文字数
+ * @const
+ */
+const revisionMessageMaxLength = 200
+
+/**
+ * リビジョン一覧の1ページの件数
+ * @const
+ */
+const revisionPageSize = 20
+
+/**
+ * ゲームを保存した時点の内容 (リビジョン)
+ * 一度作成したら変更しない
+ * キーはゲームを親に持ち、ID はリビジョンの番号 (1から順に増える)
+ * @struct
+ * @property {int} Number リビジョンの番号
+ * @property {string} UserKey 保存したユーザのエンコード済みキー
+ * @property {string} Message 変更の説明
+ * @property {string} Content ゲームの内容 (content.go)
+ * @property {int} RestoredFrom 古いリビジョンを復元したものなら元の番号、そうでなければ0
+ * @property {time.Time} Date 保存した日時
+ */
+type Revision struct {
+	Number int
+	UserKey string
+	Message string
+	Content string `datastore:",noindex"`
+	RestoredFrom int
+	Date time.Time
+}
+
+/**
+ * リビジョンのキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} gameKey ゲームキー
+ * @param {int} number リビジョンの番号
+ * @returns {*datastore.Key} Revision のキー
+ */
+func revisionKey(c appengine.Context, gameKey *datastore.Key, number int) *datastore.Key {
+	return datastore.NewKey(c, "Revision", "", int64(number), gameKey)
+}
+
+/**
+ * ゲームの内容を保存し、新しいリビジョンを作成する
+ * ゲームとリビジョンは同じエンティティグループなので、番号はトランザクションで重複なく割り当てる
+ * 他のユーザがロックしているシーンを変更する場合は保存しない
+ * 保存したユーザの下書きは破棄する
+ * 権限の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} userKey 保存したユーザのエンコード済みキー
+ * @param {string} content ゲームの内容 (JSON)
+ * @param {string} message 変更の説明
+ * @param {int} restoredFrom 古いリビジョンを復元するなら元の番号、そうでなければ0
+ * @returns {*Revision} 作成したリビジョン
+ * @returns {error} 内容が不正なら *ValidationError、ロックされたシーンを変更するなら *SceneLockedError
+ */
+func (this *Model) saveGameContent(encodedGameKey string, userKey string, content string, message string, restoredFrom int) (*Revision, error) {
+	verr := saveGameSchema.validate(map[string]string{"content": content, "message": message})
+	if verr != nil {
+		return nil, verr
+	}
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, err
+	}
+
+	revision := &Revision{
+		UserKey: userKey,
+		Message: message,
+		Content: compactGameContent(content),
+		RestoredFrom: restoredFrom,
+	}
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		game := new(Game)
+		err := datastore.Get(tc, gameKey, game)
+		if err != nil {
+			return err
+		}
+		err = checkSceneLocks(tc, gameKey, game.Content, revision.Content, userKey)
+		if err != nil {
+			return err
+		}
+		revision.Number = game.Revision + 1
+		revision.Date = time.Now()
+		game.Content = revision.Content
+		game.Revision = revision.Number
+		game.Updated = revision.Date
+		_, err = datastore.PutMulti(tc, []*datastore.Key{gameKey, revisionKey(tc, gameKey, revision.Number)}, []interface{}{game, revision})
+		if err != nil {
+			return err
+		}
+		// 保存したので、保存したユーザの下書きは不要になる
+		return datastore.Delete(tc, draftKey(tc, gameKey, userKey))
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+/**
+ * ゲームのリビジョンを新しい順に1ページ分返す
+ * 内容は読まないので Content は空文字になる
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} cursor 前のページが返したカーソル、最初のページなら空文字
+ * @param {int} limit 1ページの件数
+ * @returns {[]*Revision} リビジョン
+ * @returns {string} 次のページのカーソル、最後のページなら空文字
+ * @returns {error} カーソルが不正なら ErrInvalidCursor
+ */
+func (this *Model) getRevisionPage(encodedGameKey string, cursor string, limit int) ([]*Revision, string, error) {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, "", err
+	}
+	query := datastore.NewQuery("Revision").Ancestor(gameKey).Order("-Number").Project("Number", "UserKey", "Message", "RestoredFrom", "Date")
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		query = query.Start(start)
+	}
+
+	revisions := make([]*Revision, 0, limit)
+	next := ""
+	iterator := query.Limit(limit + 1).Run(this.c)
+	for {
+		revision := new(Revision)
+		_, err := iterator.Next(revision)
+		if err == datastore.Done {
+			return revisions, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if len(revisions) == limit {
+			// まだ古いリビジョンがあるので、ページの最後の位置を次のカーソルにする
+			return revisions, next, nil
+		}
+		revisions = append(revisions, revision)
+		if len(revisions) == limit {
+			end, err := iterator.Cursor()
+			if err != nil {
+				return nil, "", err
+			}
+			next = end.String()
+		}
+	}
+}
+
+/**
+ * リビジョンを返す
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {int} number リビジョンの番号
+ * @returns {*Revision} リビジョン
+ * @returns {error} 無ければ datastore.ErrNoSuchEntity
+ */
+func (this *Model) getRevision(encodedGameKey string, number int) (*Revision, error) {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, err
+	}
+	if number < 1 {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	revision := new(Revision)
+	err = datastore.Get(this.c, revisionKey(this.c, gameKey, number), revision)
+	if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+/**
+ * 2つのリビジョンの構造的な差分を求める
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {int} from 変更前のリビジョンの番号
+ * @param {int} to 変更後のリビジョンの番号
+ * @returns {*gameContentDiff} 差分
+ * @returns {error} リビジョンが無ければ datastore.ErrNoSuchEntity
+ */
+func (this *Model) diffRevisions(encodedGameKey string, from int, to int) (*gameContentDiff, error) {
+	contents := make([]*gameContent, 0, 2)
+	for _, number := range []int{from, to} {
+		revision, err := this.getRevision(encodedGameKey, number)
+		if err != nil {
+			return nil, err
+		}
+		content, err := parseGameContent(revision.Content)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, content)
+	}
+	return diffGameContent(contents[0], contents[1]), nil
+}
+
+/**
+ * 古いリビジョンの内容を新しいリビジョンとして保存する
+ * 以降のリビジョンは消さないので、復元も履歴に残る
+ * 権限の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} userKey 復元したユーザのエンコード済みキー
+ * @param {int} number 復元するリビジョンの番号
+ * @returns {*Revision} 作成したリビジョン
+ * @returns {error} リビジョンが無ければ datastore.ErrNoSuchEntity
+ */
+func (this *Model) restoreRevision(encodedGameKey string, userKey string, number int) (*Revision, error) {
+	old, err := this.getRevision(encodedGameKey, number)
+	if err != nil {
+		return nil, err
+	}
+	return this.saveGameContent(encodedGameKey, userKey, old.Content, fmt.Sprintf("リビジョン %d を復元", number), number)
+}
+
+/**
+ * 自動保存した下書き
+ * 保存したゲームとは別に、ユーザごとに編集中の内容を1つだけ持つ
+ * キーはゲームを親に持ち、キー名はユーザのエンコード済みキー
+ * @struct
+ * @property {string} UserKey 編集しているユーザのエンコード済みキー
+ * @property {string} Content 編集中のゲームの内容 (content.go)
+ * @property {int} BaseRevision 編集を始めたリビジョンの番号
+ * @property {time.Time} Date 自動保存した日時
+ */
+type Draft struct {
+	UserKey string
+	Content string `datastore:",noindex"`
+	BaseRevision int
+	Date time.Time
+}
+
+/**
+ * 下書きのキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} gameKey ゲームキー
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {*datastore.Key} Draft のキー
+ */
+func draftKey(c appengine.Context, gameKey *datastore.Key, userKey string) *datastore.Key {
+	return datastore.NewKey(c, "Draft", userKey, 0, gameKey)
+}
+
+/**
+ * 編集中の内容を下書きとして自動保存する
+ * 前の下書きは上書きする
+ * 権限の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} userKey 編集しているユーザのエンコード済みキー
+ * @param {string} content 編集中のゲームの内容 (JSON)
+ * @param {int} baseRevision 編集を始めたリビジョンの番号
+ * @returns {*Draft} 保存した下書き
+ * @returns {error} 内容が不正なら *ValidationError
+ */
+func (this *Model) saveDraft(encodedGameKey string, userKey string, content string, baseRevision int) (*Draft, error) {
+	verr := draftSchema.validate(map[string]string{"content": content, "base_revision": strconv.Itoa(baseRevision)})
+	if verr != nil {
+		return nil, verr
+	}
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, err
+	}
+	draft := &Draft{
+		UserKey: userKey,
+		Content: compactGameContent(content),
+		BaseRevision: baseRevision,
+		Date: time.Now(),
+	}
+	_, err = datastore.Put(this.c, draftKey(this.c, gameKey, userKey), draft)
+	if err != nil {
+		return nil, err
+	}
+	return draft, nil
+}
+
+/**
+ * ユーザの下書きを返す
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} userKey 編集しているユーザのエンコード済みキー
+ * @returns {*Draft} 下書き、無ければ nil
+ */
+func (this *Model) getDraft(encodedGameKey string, userKey string) *Draft {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil
+	}
+	draft := new(Draft)
+	err = datastore.Get(this.c, draftKey(this.c, gameKey, userKey), draft)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			check(this.c, err)
+		}
+		return nil
+	}
+	return draft
+}
+
+/**
+ * 下書きが保存したゲームより新しいか調べる
+ * 最後の保存より前の下書きや、保存した内容と同じ下書きは新しくないとみなす
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {*Game} game ゲーム
+ * @param {*Draft} draft 下書き
+ * @returns {bool} 復元する価値があればtrue
+ */
+func (this *Model) isNewerDraft(encodedGameKey string, game *Game, draft *Draft) bool {
+	if draft.Content == compactGameContent(game.Content) {
+		return false
+	}
+	if game.Revision > 0 {
+		saved, err := this.getRevision(encodedGameKey, game.Revision)
+		if err == nil && !draft.Date.After(saved.Date) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * 下書きを破棄する
+ * 下書きが無くてもエラーにしない
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} userKey 編集しているユーザのエンコード済みキー
+ * @returns {error} エラー
+ */
+func (this *Model) discardDraft(encodedGameKey string, userKey string) error {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return err
+	}
+	return datastore.Delete(this.c, draftKey(this.c, gameKey, userKey))
+}
+
+/**
+ * ユーザの下書きの一覧を返す
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {map[string]*Draft} エンコード済みのゲームキーと下書きの対応表
+ */
+func (this *Model) getDrafts(userKey string) map[string]*Draft {
+	drafts := make([]*Draft, 0)
+	keys, err := datastore.NewQuery("Draft").Filter("UserKey =", userKey).GetAll(this.c, &drafts)
+	check(this.c, err)
+
+	result := make(map[string]*Draft, len(keys))
+	for i, key := range keys {
+		result[key.Parent().Encode()] = drafts[i]
+	}
+	return result
+}
+
+/**
+ * ハートビートが途絶えてからシーンのロックが自動的に解除されるまでの時間
+ * @const
+ */
+const sceneLockTimeout = 2 * time.Minute
+
+/**
+ * ハートビートが途絶えてから、他の編集者がロックを解除できるようになるまでの時間
+ * @const
+ */
+const sceneLockStaleAfter = 30 * time.Second
+
+/**
+ * 他のユーザがロックしているシーンをロックしようとした時のエラー
+ * @const
+ */
+var ErrSceneLocked = errors.New("シーンは他のユーザが編集しています")
+
+/**
+ * ロックしていないシーンのハートビートを送った時のエラー
+ * @const
+ */
+var ErrSceneLockLost = errors.New("シーンのロックが解除されています")
+
+/**
+ * まだ有効なロックを所有者以外が解除しようとした時のエラー
+ * @const
+ */
+var ErrSceneLockActive = errors.New("シーンのロックはまだ有効です。しばらく待ってから解除してください")
+
+/**
+ * シーンの編集ロック
+ * 悲観的ロックを使うチームのために、シーンを編集している間は他のユーザが変更を保存できないようにする
+ * キーはゲームを親に持ち、キー名はシーンの ID
+ * @struct
+ * @property {string} UserKey ロックしているユーザのエンコード済みキー
+ * @property {time.Time} Acquired ロックした日時
+ * @property {time.Time} Heartbeat 最後にハートビートを受け取った日時
+ */
+type SceneLock struct {
+	UserKey string
+	Acquired time.Time
+	Heartbeat time.Time
+}
+
+/**
+ * シーンのロックのキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} gameKey ゲームキー
+ * @param {string} sceneId シーンの ID
+ * @returns {*datastore.Key} SceneLock のキー
+ */
+func sceneLockKey(c appengine.Context, gameKey *datastore.Key, sceneId string) *datastore.Key {
+	return datastore.NewKey(c, "SceneLock", sceneId, 0, gameKey)
+}
+
+/**
+ * ロックが自動的に解除されたか調べる
+ * @method
+ * @memberof SceneLock
+ * @param {time.Time} now 現在時刻
+ * @returns {bool} 解除されていればtrue
+ */
+func (this *SceneLock) expired(now time.Time) bool {
+	return now.Sub(this.Heartbeat) > sceneLockTimeout
+}
+
+/**
+ * ハートビートが途絶えて、他の編集者が解除できるか調べる
+ * @method
+ * @memberof SceneLock
+ * @param {time.Time} now 現在時刻
+ * @returns {bool} 解除できればtrue
+ */
+func (this *SceneLock) stale(now time.Time) bool {
+	return now.Sub(this.Heartbeat) > sceneLockStaleAfter
+}
+
+/**
+ * ロックが自動的に解除される日時を返す
+ * @method
+ * @memberof SceneLock
+ * @returns {time.Time} 解除される日時
+ */
+func (this *SceneLock) Expires() time.Time {
+	return this.Heartbeat.Add(sceneLockTimeout)
+}
+
+/**
+ * 他のユーザがロックしているシーンを変更しようとした時のエラー
+ * @class
+ * @property {[]string} Scenes ロックされているシーンの ID
+ */
+type SceneLockedError struct {
+	Scenes []string
+}
+
+/**
+ * エラーメッセージを返す
+ * @method
+ * @memberof SceneLockedError
+ * @returns {string} メッセージ
+ */
+func (this *SceneLockedError) Error() string {
+	return fmt.Sprintf("他のユーザが編集しているシーンは保存できません: %s", strings.Join(this.Scenes, ", "))
+}
+
+/**
+ * ゲームの有効なシーンのロックを返す
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @returns {map[string]*SceneLock} シーンの ID とロックの対応表
+ */
+func (this *Model) getSceneLocks(encodedGameKey string) map[string]*SceneLock {
+	result := make(map[string]*SceneLock)
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return result
+	}
+	locks, err := activeSceneLocks(this.c, gameKey, time.Now())
+	check(this.c, err)
+	return locks
+}
+
+/**
+ * ゲームの有効なシーンのロックを読み込む
+ * 祖先クエリなのでトランザクションの中でも使える
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} gameKey ゲームキー
+ * @param {time.Time} now 現在時刻
+ * @returns {map[string]*SceneLock} シーンの ID とロックの対応表
+ * @returns {error} エラー
+ */
+func activeSceneLocks(c appengine.Context, gameKey *datastore.Key, now time.Time) (map[string]*SceneLock, error) {
+	locks := make([]*SceneLock, 0)
+	keys, err := datastore.NewQuery("SceneLock").Ancestor(gameKey).GetAll(c, &locks)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]*SceneLock, len(keys))
+	for i, key := range keys {
+		if !locks[i].expired(now) {
+			result[key.StringID()] = locks[i]
+		}
+	}
+	return result, nil
+}
+
+/**
+ * 保存する内容が他のユーザのロックしているシーンを変更していないか調べる
+ * saveGameContent() のトランザクションの中で呼び出す
+ * @function
+ * @param {appengine.Context} tc トランザクションのコンテキスト
+ * @param {*datastore.Key} gameKey ゲームキー
+ * @param {string} saved 保存済みの内容
+ * @param {string} content 保存する内容
+ * @param {string} userKey 保存するユーザのエンコード済みキー
+ * @returns {error} 変更していれば *SceneLockedError
+ */
+func checkSceneLocks(tc appengine.Context, gameKey *datastore.Key, saved string, content string, userKey string) error {
+	locks, err := activeSceneLocks(tc, gameKey, time.Now())
+	if err != nil || len(locks) == 0 {
+		return err
+	}
+	from, err := parseGameContent(saved)
+	if err != nil {
+		return err
+	}
+	to, err := parseGameContent(content)
+	if err != nil {
+		return err
+	}
+	locked := make([]string, 0)
+	for _, sceneId := range diffGameContent(from, to).touchedScenes() {
+		if lock, ok := locks[sceneId]; ok && lock.UserKey != userKey {
+			locked = append(locked, sceneId)
+		}
+	}
+	if len(locked) > 0 {
+		return &SceneLockedError{locked}
+	}
+	return nil
+}
+
+/**
+ * 共同編集での変更が他のユーザのロックしているシーンに関わらないか調べる
+ * 保存時の checkSceneLocks() と同じく、有効なロックを他のユーザが持っていれば拒否する
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} sceneId 変更するシーンの ID
+ * @param {string} userKey 変更するユーザのエンコード済みキー
+ * @returns {error} 他のユーザがロックしていれば *SceneLockedError
+ */
+func (this *Model) checkSceneLock(encodedGameKey string, sceneId string, userKey string) error {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return err
+	}
+	locks, err := activeSceneLocks(this.c, gameKey, time.Now())
+	if err != nil {
+		return err
+	}
+	if lock, ok := locks[sceneId]; ok && lock.UserKey != userKey {
+		return &SceneLockedError{[]string{sceneId}}
+	}
+	return nil
+}
+
+/**
+ * シーンをロックする
+ * 自分が既にロックしていれば更新する
+ * 権限の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} sceneId シーンの ID
+ * @param {string} userKey ロックするユーザのエンコード済みキー
+ * @returns {*SceneLock} ロック
+ * @returns {error} 他のユーザがロックしていれば ErrSceneLocked
+ */
+func (this *Model) lockScene(encodedGameKey string, sceneId string, userKey string) (*SceneLock, error) {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, err
+	}
+	key := sceneLockKey(this.c, gameKey, sceneId)
+	lock := new(SceneLock)
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		now := time.Now()
+		err := datastore.Get(tc, key, lock)
+		if err == datastore.ErrNoSuchEntity || (err == nil && lock.expired(now)) {
+			*lock = SceneLock{UserKey: userKey, Acquired: now}
+		} else if err != nil {
+			return err
+		} else if lock.UserKey != userKey {
+			return ErrSceneLocked
+		}
+		lock.Heartbeat = now
+		_, err = datastore.Put(tc, key, lock)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+/**
+ * ロックしているシーンのハートビートを受け取り、ロックを延長する
+ * ロックが解除されていたら延長しない (他のユーザに解除されたロックを取り戻さないようにする)
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} sceneId シーンの ID
+ * @param {string} userKey ロックしているユーザのエンコード済みキー
+ * @returns {*SceneLock} ロック
+ * @returns {error} ロックしていなければ ErrSceneLockLost
+ */
+func (this *Model) heartbeatSceneLock(encodedGameKey string, sceneId string, userKey string) (*SceneLock, error) {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, err
+	}
+	key := sceneLockKey(this.c, gameKey, sceneId)
+	lock := new(SceneLock)
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		now := time.Now()
+		err := datastore.Get(tc, key, lock)
+		if err == datastore.ErrNoSuchEntity || (err == nil && (lock.expired(now) || lock.UserKey != userKey)) {
+			return ErrSceneLockLost
+		} else if err != nil {
+			return err
+		}
+		lock.Heartbeat = now
+		_, err = datastore.Put(tc, key, lock)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+/**
+ * シーンのロックを解除する
+ * 自分のロックはいつでも、他のユーザのロックは所有者ならいつでも、編集者ならハートビートが途絶えていれば解除できる
+ * ロックされていなくてもエラーにしない
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} sceneId シーンの ID
+ * @param {string} userKey 解除するユーザのエンコード済みキー
+ * @param {string} role 解除するユーザのゲームに対する権限
+ * @returns {*SceneLock} 他のユーザのロックを解除したならそのロック、そうでなければ nil
+ * @returns {error} 解除できなければ ErrSceneLockActive
+ */
+func (this *Model) unlockScene(encodedGameKey string, sceneId string, userKey string, role string) (*SceneLock, error) {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return nil, err
+	}
+	key := sceneLockKey(this.c, gameKey, sceneId)
+	var broken *SceneLock
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		broken = nil
+		now := time.Now()
+		lock := new(SceneLock)
+		err := datastore.Get(tc, key, lock)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if lock.UserKey != userKey && !lock.expired(now) {
+			if role != "owner" && !lock.stale(now) {
+				return ErrSceneLockActive
+			}
+			broken = lock
+		}
+		return datastore.Delete(tc, key)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return broken, nil
+}
+
+/**
+ * ゲームの検索の索引
+ * 公開していてゴミ箱に無いゲームごとに1つ作り、キー名はエンコード済みのゲームキー
+ * 検索結果を表示するための項目も持ち、ゲームを読まずに結果を返せるようにする
+ * @struct
+ * @property {[]string} Grams 名前、説明、タグ、作者名の n-gram (search.go)
+ * @property {string} Name ゲームの名前
+ * @property {string} Description ゲームの説明
+ * @property {[]string} Tags ゲームのタグ
+ * @property {string} Thumbnail サムネイルの画像パス
+ * @property {string} UserKey 作者のエンコード済みキー
+ * @property {string} Author 作者の表示名
+ * @property {time.Time} Updated ゲームを最後に変更した日時
+ */
+type SearchIndex struct {
+	Grams []string
+	Name string `datastore:",noindex"`
+	Description string `datastore:",noindex"`
+	Tags []string `datastore:",noindex"`
+	Thumbnail string `datastore:",noindex"`
+	UserKey string `datastore:",noindex"`
+	Author string `datastore:",noindex"`
+	Updated time.Time `datastore:",noindex"`
+}
+
+/**
+ * 検索の索引のキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} gameKey エンコード済みのゲームキー
+ * @returns {*datastore.Key} SearchIndex のキー
+ */
+func searchIndexKey(c appengine.Context, gameKey string) *datastore.Key {
+	return datastore.NewKey(c, "SearchIndex", gameKey, 0, nil)
+}
+
+/**
+ * ゲームの検索の索引を更新する
+ * 公開していないゲームやゴミ箱のゲームは索引から取り除く
+ * 索引の更新に失敗してもゲームの変更は取り消さないので、エラーは記録するだけにする
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ */
+func (this *Model) indexGame(encodedGameKey string) {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return
+	}
+	game := new(Game)
+	err = datastore.Get(this.c, gameKey, game)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		check(this.c, err)
+		return
+	}
+	key := searchIndexKey(this.c, encodedGameKey)
+	if err == datastore.ErrNoSuchEntity || !searchable(game) {
+		check(this.c, datastore.Delete(this.c, key))
+		return
+	}
+
+	author := this.getUser(game.UserKey)
+	index := &SearchIndex{
+		Grams: searchGrams(append([]string{game.Name, game.Description, author.Name}, game.Tags...)...),
+		Name: game.Name,
+		Description: game.Description,
+		Tags: game.Tags,
+		Thumbnail: game.Thumbnail,
+		UserKey: game.UserKey,
+		Author: author.Name,
+		Updated: game.Updated,
+	}
+	_, err = datastore.Put(this.c, key, index)
+	check(this.c, err)
+}
+
+/**
+ * ユーザが所有するゲームの検索の索引をすべて更新する
+ * 作者名を変更した時に呼び出す
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ */
+func (this *Model) indexUserGames(userKey string) {
+	keys, err := datastore.NewQuery("Game").Filter("UserKey =", userKey).KeysOnly().GetAll(this.c, nil)
+	check(this.c, err)
+	for _, key := range keys {
+		this.indexGame(key.Encode())
+	}
+}
+
+/**
+ * すべてのゲームの検索の索引を作り直す
+ * 索引を導入する前のゲームや、索引の形式を変えた時に使う
+ * @method
+ * @memberof Model
+ * @returns {int} 索引に入れたゲームの数
+ * @returns {error} エラー
+ */
+func (this *Model) reindexGames() (int, error) {
+	keys, err := datastore.NewQuery("Game").KeysOnly().GetAll(this.c, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		this.indexGame(key.Encode())
+	}
+	// ゲームが無くなった索引を取り除く
+	indexKeys, err := datastore.NewQuery("SearchIndex").KeysOnly().GetAll(this.c, nil)
+	if err != nil {
+		return 0, err
+	}
+	exists := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		exists[key.Encode()] = true
+	}
+	count := 0
+	for _, key := range indexKeys {
+		if exists[key.StringID()] {
+			count++
+			continue
+		}
+		check(this.c, datastore.Delete(this.c, key))
+	}
+	return count, nil
+}
+
+/**
+ * ゲームを検索して1ページ分返す
+ * 検索語の n-gram をすべて含む索引を候補にし、検索語を含むものに点数を付けて並べる
+ * 候補はキーの順に最大 searchMaxCandidates 件までしか読まないので、それより多く一致する検索語では
+ * 点数の高いゲームが結果に含まれないことがある
+ * ページは並べた結果の位置で表す
+ * @method
+ * @memberof Model
+ * @param {string} query 検索語
+ * @param {int} offset 何件目から返すか
+ * @param {int} limit 1ページの件数
+ * @returns {[]SearchResult} 検索結果
+ * @returns {int} 次のページの位置、最後のページなら0
+ * @returns {error} エラー
+ */
+func (this *Model) searchGames(query string, offset int, limit int) ([]SearchResult, int, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []SearchResult{}, 0, nil
+	}
+	q := datastore.NewQuery("SearchIndex")
+	for _, gram := range searchFilterGrams(terms) {
+		q = q.Filter("Grams =", gram)
+	}
+
+	results := make([]SearchResult, 0)
+	iterator := q.Limit(searchMaxCandidates).Run(this.c)
+	for {
+		index := new(SearchIndex)
+		key, err := iterator.Next(index)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		score := index.score(terms)
+		if score > 0 {
+			results = append(results, SearchResult{key.StringID(), index, score})
+		}
+	}
+	sortSearchResults(results)
+
+	if offset >= len(results) {
+		return []SearchResult{}, 0, nil
+	}
+	end := offset + limit
+	next := end
+	if end >= len(results) {
+		end = len(results)
+		next = 0
+	}
+	return results[offset:end], next, nil
+}
+
+/**
+ * ゲームのカテゴリ
+ * 管理者が軸ごとに用意し、作者はその中からゲームのカテゴリを選ぶ
+ * キー名は "軸:ID"
+ * @struct
+ * @property {string} Axis 軸 (categoryAxes)
+ * @property {string} Id 軸の中で一意な ID、ゲームにはこの値を保存する
+ * @property {string} Name 表示名
+ * @property {int} Order 表示順
+ */
+type Category struct {
+	Axis string
+	Id string
+	Name string `datastore:",noindex"`
+	Order int `datastore:",noindex"`
+}
+
+/**
+ * カテゴリのキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} axis 軸
+ * @param {string} id カテゴリの ID
+ * @returns {*datastore.Key} Category のキー
+ */
+func categoryKey(c appengine.Context, axis string, id string) *datastore.Key {
+	return datastore.NewKey(c, "Category", axis + ":" + id, 0, nil)
+}
+
+/**
+ * すべてのカテゴリを軸ごとに表示順に並べて返す
+ * @method
+ * @memberof Model
+ * @returns {map[string][]*Category} 軸とカテゴリの対応表、すべての軸を含む
+ */
+func (this *Model) getCategories() map[string][]*Category {
+	categories := make([]*Category, 0)
+	_, err := datastore.NewQuery("Category").GetAll(this.c, &categories)
+	check(this.c, err)
+	sort.SliceStable(categories, func(i, j int) bool {
+		if categories[i].Order != categories[j].Order {
+			return categories[i].Order < categories[j].Order
+		}
+		return categories[i].Id < categories[j].Id
+	})
+
+	result := make(map[string][]*Category, len(categoryAxes))
+	for _, axis := range categoryAxes {
+		result[axis] = make([]*Category, 0)
+	}
+	for _, category := range categories {
+		if _, ok := result[category.Axis]; ok {
+			result[category.Axis] = append(result[category.Axis], category)
+		}
+	}
+	return result
+}
+
+/**
+ * カテゴリを返す
+ * @method
+ * @memberof Model
+ * @param {string} axis 軸
+ * @param {string} id カテゴリの ID
+ * @returns {*Category} カテゴリ、無ければ nil
+ */
+func (this *Model) getCategory(axis string, id string) *Category {
+	category := new(Category)
+	err := datastore.Get(this.c, categoryKey(this.c, axis, id), category)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			check(this.c, err)
+		}
+		return nil
+	}
+	return category
+}
+
+/**
+ * カテゴリを追加するか、既にあれば表示名と表示順を変更する
+ * ゲームには ID を保存しているので、表示名を変えてもゲームは変更しない
+ * @method
+ * @memberof Model
+ * @param {string} axis 軸
+ * @param {string} id カテゴリの ID
+ * @param {string} name 表示名
+ * @param {int} order 表示順
+ * @returns {*Category} 保存したカテゴリ
+ * @returns {error} エラー
+ */
+func (this *Model) putCategory(axis string, id string, name string, order int) (*Category, error) {
+	category := &Category{
+		Axis: axis,
+		Id: id,
+		Name: strings.TrimSpace(name),
+		Order: order,
+	}
+	_, err := datastore.Put(this.c, categoryKey(this.c, axis, id), category)
+	if err != nil {
+		return nil, err
+	}
+	return category, nil
+}
+
+/**
+ * カテゴリを削除し、そのカテゴリを選んでいるゲームを未設定に戻す
+ * @method
+ * @memberof Model
+ * @param {string} axis 軸
+ * @param {string} id カテゴリの ID
+ * @returns {int} 未設定に戻したゲームの数
+ * @returns {error} エラー
+ */
+func (this *Model) deleteCategory(axis string, id string) (int, error) {
+	err := datastore.Delete(this.c, categoryKey(this.c, axis, id))
+	if err != nil {
+		return 0, err
+	}
+	keys, err := datastore.NewQuery("Game").Filter(categoryProperty(axis) + " =", id).KeysOnly().GetAll(this.c, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+			game := new(Game)
+			err := datastore.Get(tc, key, game)
+			if err != nil {
+				return err
+			}
+			if game.category(axis) != id {
+				return nil
+			}
+			game.setCategory(axis, "")
+			_, err = datastore.Put(tc, key, game)
+			return err
+		}, nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+/**
+ * 公開しているゲームに付いているタグから、前方一致するものを返す
+ * 公開していないゲームのタグは他のユーザに見せない
+ * @method
+ * @memberof Model
+ * @param {string} prefix 入力中のタグ
+ * @param {int} limit 最大の数
+ * @returns {[]string} タグ (辞書順)
+ * @returns {error} エラー
+ */
+func (this *Model) suggestTags(prefix string, limit int) ([]string, error) {
+	prefix = normalizeTag(prefix)
+	if prefix == "" {
+		return []string{}, nil
+	}
+	query := datastore.NewQuery("Game").
+		Filter("Published =", true).
+		Filter("Tags >=", prefix).
+		Filter("Tags <", prefix + "\uFFFD").
+		Order("Tags").
+		Project("Tags").
+		Distinct().
+		Limit(limit)
+	games := make([]*Game, 0)
+	_, err := query.GetAll(this.c, &games)
+	if err != nil {
+		return nil, err
+	}
+	// 複数の値のプロパティの射影は値ごとに1件になる
+	tags := make([]string, 0, len(games))
+	for _, game := range games {
+		for _, tag := range game.Tags {
+			if strings.HasPrefix(tag, prefix) && !exist(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags, nil
+}
+
+/**
+ * 公開しているゲームをタグとカテゴリで絞り込み、更新日時の新しい順に並べて1ページ分返す
+ * 等価フィルタと並び順の組み合わせは、プロパティごとの (プロパティ, -Updated) のインデックスを
+ * データストアが組み合わせて処理するので、組み合わせごとの複合インデックスは要らない
+ * ゴミ箱のゲームは読み飛ばしてページを埋める
+ * @method
+ * @memberof Model
+ * @param {map[string]string} filters tag と categoryAxes の軸、空文字の項目では絞り込まない
+ * @param {string} cursor 前のページが返したカーソル、最初のページなら空文字
+ * @param {int} limit 1ページの件数
+ * @returns {[]GameListItem} ゲーム
+ * @returns {string} 次のページのカーソル、最後のページなら空文字
+ * @returns {error} カーソルが不正なら ErrInvalidCursor
+ */
+func (this *Model) browseGames(filters map[string]string, cursor string, limit int) ([]GameListItem, string, error) {
+	query := datastore.NewQuery("Game").Filter("Published =", true)
+	if tag := normalizeTag(filters["tag"]); tag != "" {
+		query = query.Filter("Tags =", tag)
+	}
+	for _, axis := range categoryAxes {
+		if id := filters[axis]; id != "" {
+			query = query.Filter(categoryProperty(axis) + " =", id)
+		}
+	}
+	query = query.Order("-Updated")
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		query = query.Start(start)
+	}
+
+	games := make([]GameListItem, 0, limit)
+	next := ""
+	iterator := query.Run(this.c)
+	for {
+		game := new(Game)
+		key, err := iterator.Next(game)
+		if err == datastore.Done {
+			return games, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if game.trashed() {
+			continue
+		}
+		if len(games) == limit {
+			// 一致するゲームがまだあるので、ページの最後の位置を次のカーソルにする
+			return games, next, nil
+		}
+		games = append(games, GameListItem{key.Encode(), game})
+		if len(games) == limit {
+			end, err := iterator.Cursor()
+			if err != nil {
+				return nil, "", err
+			}
+			next = end.String()
+		}
+	}
+}
+
+/**
+ * すべてのゲームのタグを統合する
+ * 統合元のタグを統合先のタグに置き換える、統合元が1つならタグの名前の変更になる
+ * @method
+ * @memberof Model
+ * @param {[]string} sources 統合元のタグ (正規化済み)
+ * @param {string} target 統合先のタグ (正規化済み)
+ * @returns {int} 変更したゲームの数
+ * @returns {error} エラー
+ */
+func (this *Model) mergeTags(sources []string, target string) (int, error) {
+	keys := make([]*datastore.Key, 0)
+	seen := make(map[string]bool)
+	for _, source := range sources {
+		if source == target {
+			continue
+		}
+		found, err := datastore.NewQuery("Game").Filter("Tags =", source).KeysOnly().GetAll(this.c, nil)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range found {
+			if !seen[key.Encode()] {
+				seen[key.Encode()] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	count := 0
+	for _, key := range keys {
+		replaced := false
+		err := datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+			game := new(Game)
+			err := datastore.Get(tc, key, game)
+			if err != nil {
+				return err
+			}
+			game.Tags, replaced = replaceTags(game.Tags, sources, target)
+			if !replaced {
+				return nil
+			}
+			_, err = datastore.Put(tc, key, game)
+			return err
+		}, nil)
+		if err != nil {
+			return count, err
+		}
+		if replaced {
+			count++
+			this.indexGame(key.Encode())
+		}
+	}
+	return count, nil
+}
+
+/**
+ * ゲームに対する権限
+ * viewer: エディタでゲームを見る
+ * editor: ゲームを編集する
+ * owner: ゲームの削除、公開、共同編集者の管理を行う (Game.UserKey のユーザ)
+ * 後ろの権限ほど強く、前の権限でできることはすべてできる
+ * @const
+ */
+var gameRoles = []string{"viewer", "editor", "owner"}
+
+/**
+ * 共同編集者に与えられる権限
+ * @const
+ */
+var collaboratorRoles = []string{"editor", "viewer"}
+
+/**
+ * ゲームへの招待の有効期間
+ * @const
+ */
+const invitationLifetime = 7 * 24 * time.Hour
+
+/**
+ * 期限切れの招待が使われた時のエラー
+ * @const
+ */
+var ErrInvitationExpired = errors.New("招待の有効期限が切れています")
+
+/**
+ * 他のユーザ宛ての招待が使われた時のエラー
+ * @const
+ */
+var ErrInvitationForOther = errors.New("この招待は他のユーザ宛てです")
+
+/**
+ * ゲームに対する権限の強さを返す
+ * @function
+ * @param {string} role 権限
+ * @returns {int} 強さ、権限が無ければ -1
+ */
+func gameRoleRank(role string) int {
+	for i, r := range gameRoles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+/**
+ * ゲームの共同編集者
+ * キーはゲームを親に持ち、キー名はユーザのエンコード済みキー
+ * @struct
+ * @property {string} UserKey 共同編集者のエンコード済みキー
+ * @property {string} Role 権限 (collaboratorRoles)
+ * @property {string} InviterKey 招待したユーザのエンコード済みキー
+ * @property {time.Time} Date 参加した日時
+ */
+type Collaborator struct {
+	UserKey string
+	Role string
+	InviterKey string
+	Date time.Time
+}
+
+/**
+ * 共同編集者のキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} gameKey ゲームキー
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {*datastore.Key} Collaborator のキー
+ */
+func collaboratorKey(c appengine.Context, gameKey *datastore.Key, userKey string) *datastore.Key {
+	return datastore.NewKey(c, "Collaborator", userKey, 0, gameKey)
+}
+
+/**
+ * ゲームへの招待
+ * キー名は推測できないランダムな文字列で、エンコード済みのキーを招待メールのリンクに使う
+ * @struct
+ * @property {string} GameKey 招待先のゲームのエンコード済みキー
+ * @property {string} Role 与える権限 (collaboratorRoles)
+ * @property {string} InviterKey 招待したユーザのエンコード済みキー
+ * @property {string} UserKey 招待されたユーザのエンコード済みキー、未登録のメールアドレスへの招待なら空文字
+ * @property {string} Mail 招待したメールアドレス、ハンドルで招待した場合は空文字
+ * @property {time.Time} Created 招待した日時
+ * @property {time.Time} Expires 有効期限
+ */
+type Invitation struct {
+	GameKey string
+	Role string
+	InviterKey string
+	UserKey string
+	Mail string
+	Created time.Time
+	Expires time.Time
+}
+
+/**
+ * ユーザのゲームに対する権限を返す
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {*Game} game ゲーム
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {string} 権限 (gameRoles)、権限が無ければ空文字
+ */
+func (this *Model) getGameRole(encodedGameKey string, game *Game, userKey string) string {
+	if userKey == "" {
+		return ""
+	}
+	if game.UserKey == userKey {
+		return "owner"
+	}
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return ""
+	}
+	collaborator := new(Collaborator)
+	err = datastore.Get(this.c, collaboratorKey(this.c, gameKey, userKey), collaborator)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			check(this.c, err)
+		}
+		return ""
+	}
+	return collaborator.Role
+}
+
+/**
+ * ゲームの共同編集者の一覧を返す
+ * 所有者は含めない
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @returns {[]*Collaborator} 共同編集者
+ */
+func (this *Model) getCollaborators(encodedGameKey string) []*Collaborator {
+	collaborators := make([]*Collaborator, 0)
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return collaborators
+	}
+	_, err = datastore.NewQuery("Collaborator").Ancestor(gameKey).Order("Date").GetAll(this.c, &collaborators)
+	check(this.c, err)
+	return collaborators
+}
+
+/**
+ * ユーザが共同編集者として参加しているゲーム
+ * @struct
+ * @property {string} Role ゲームに対する権限
+ */
+type SharedGame struct {
+	GameListItem
+	Role string
+}
+
+/**
+ * ユーザが共同編集者として参加しているゲームの一覧を返す
+ * ゴミ箱のゲームは含めない
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {[]SharedGame} ゲーム
+ */
+func (this *Model) getSharedGames(userKey string) []SharedGame {
+	collaborators := make([]*Collaborator, 0)
+	keys, err := datastore.NewQuery("Collaborator").Filter("UserKey =", userKey).GetAll(this.c, &collaborators)
+	check(this.c, err)
+
+	result := make([]SharedGame, 0, len(keys))
+	for i, key := range keys {
+		game := new(Game)
+		err := datastore.Get(this.c, key.Parent(), game)
+		if err != nil {
+			if err != datastore.ErrNoSuchEntity {
+				check(this.c, err)
+			}
+			continue
+		}
+		if game.trashed() {
+			continue
+		}
+		result = append(result, SharedGame{GameListItem{key.Parent().Encode(), game}, collaborators[i].Role})
+	}
+	return result
+}
+
+/**
+ * ゲームにユーザを招待する
+ * target に @ を含む場合はメールアドレス、それ以外はハンドルとみなす
+ * 登録済みのユーザならユーザ宛ての招待にし、未登録のメールアドレスなら招待メールを受け取った人が参加できる
+ * 所有者の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} inviterKey 招待するユーザのエンコード済みキー
+ * @param {string} target 招待するユーザのハンドルまたはメールアドレス
+ * @param {string} role 与える権限
+ * @returns {string} エンコード済みの招待キー
+ * @returns {*Invitation} 招待
+ * @returns {error} 招待できなければ理由を表すエラー
+ */
+func (this *Model) inviteCollaborator(encodedGameKey string, inviterKey string, target string, role string) (string, *Invitation, error) {
+	if !exist(collaboratorRoles, role) {
+		return "", nil, fmt.Errorf("存在しない権限です: %s", role)
+	}
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return "", nil, err
+	}
+	game := new(Game)
+	err = datastore.Get(this.c, gameKey, game)
+	if err != nil {
+		return "", nil, err
+	}
+
+	invitation := new(Invitation)
+	target = strings.TrimSpace(target)
+	if strings.Contains(target, "@") {
+		invitation.Mail = normalizeMail(target)
+		invitation.UserKey = this.getUserKeyByMail(invitation.Mail)
+	} else {
+		invitation.UserKey = this.getUserKeyByHandle(target)
+		if invitation.UserKey == "" {
+			return "", nil, errors.New("ユーザが見つかりません")
+		}
+	}
+	if invitation.UserKey != "" {
+		if this.getGameRole(encodedGameKey, game, invitation.UserKey) != "" {
+			return "", nil, errors.New("既にこのゲームに参加しているユーザです")
+		}
+	}
+
+	invitation.GameKey = encodedGameKey
+	invitation.Role = role
+	invitation.InviterKey = inviterKey
+	invitation.Created = time.Now()
+	invitation.Expires = invitation.Created.Add(invitationLifetime)
+	key := datastore.NewKey(this.c, "Invitation", getSecureRandomString(32), 0, nil)
+	_, err = datastore.Put(this.c, key, invitation)
+	if err != nil {
+		return "", nil, err
+	}
+	return key.Encode(), invitation, nil
+}
+
+/**
+ * 招待を返す
+ * 存在しない場合は nil を返す
+ * @method
+ * @memberof Model
+ * @param {string} encodedKey エンコード済みの招待キー
+ * @returns {*Invitation} 招待
+ */
+func (this *Model) getInvitation(encodedKey string) *Invitation {
+	key, err := datastore.DecodeKey(encodedKey)
+	if err != nil || key.Kind() != "Invitation" {
+		return nil
+	}
+	invitation := new(Invitation)
+	err = datastore.Get(this.c, key, invitation)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			check(this.c, err)
+		}
+		return nil
+	}
+	return invitation
+}
+
+/**
+ * 有効な招待の一覧を返す
+ * @method
+ * @memberof Model
+ * @param {string} property 絞り込む項目 (GameKey または UserKey)
+ * @param {string} value 項目の値
+ * @returns {map[string]*Invitation} エンコード済みの招待キーと招待の対応表
+ */
+func (this *Model) getInvitations(property string, value string) map[string]*Invitation {
+	invitations := make([]*Invitation, 0)
+	keys, err := datastore.NewQuery("Invitation").Filter(property + " =", value).GetAll(this.c, &invitations)
+	check(this.c, err)
+
+	now := time.Now()
+	result := make(map[string]*Invitation, len(keys))
+	for i, key := range keys {
+		if now.After(invitations[i].Expires) {
+			continue
+		}
+		result[key.Encode()] = invitations[i]
+	}
+	return result
+}
+
+/**
+ * 招待を受けて共同編集者になる
+ * ユーザ宛ての招待は本人しか受けられない
+ * @method
+ * @memberof Model
+ * @param {string} encodedKey エンコード済みの招待キー
+ * @param {string} userKey 招待を受けるユーザのエンコード済みキー
+ * @returns {string} 参加したゲームのエンコード済みキー
+ * @returns {error} エラー
+ */
+func (this *Model) acceptInvitation(encodedKey string, userKey string) (string, error) {
+	key, err := datastore.DecodeKey(encodedKey)
+	if err != nil {
+		return "", err
+	}
+	invitation := new(Invitation)
+	err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		err := datastore.Get(tc, key, invitation)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(invitation.Expires) {
+			return ErrInvitationExpired
+		}
+		if invitation.UserKey != "" && invitation.UserKey != userKey {
+			return ErrInvitationForOther
+		}
+		gameKey, err := datastore.DecodeKey(invitation.GameKey)
+		if err != nil {
+			return err
+		}
+		game := new(Game)
+		err = datastore.Get(tc, gameKey, game)
+		if err != nil {
+			return err
+		}
+		if game.trashed() {
+			return datastore.ErrNoSuchEntity
+		}
+
+		// 所有者と既に参加しているユーザは招待を消すだけにする
+		if game.UserKey != userKey {
+			err = datastore.Get(tc, collaboratorKey(tc, gameKey, userKey), new(Collaborator))
+			if err == datastore.ErrNoSuchEntity {
+				collaborator := new(Collaborator)
+				collaborator.UserKey = userKey
+				collaborator.Role = invitation.Role
+				collaborator.InviterKey = invitation.InviterKey
+				collaborator.Date = time.Now()
+				_, err = datastore.Put(tc, collaboratorKey(tc, gameKey, userKey), collaborator)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return datastore.Delete(tc, key)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return "", err
+	}
+	return invitation.GameKey, nil
+}
+
+/**
+ * 招待を削除する
+ * 招待を断る場合と、所有者が取り消す場合に使う
+ * 権限の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedKey エンコード済みの招待キー
+ * @returns {error} エラー
+ */
+func (this *Model) deleteInvitation(encodedKey string) error {
+	key, err := datastore.DecodeKey(encodedKey)
+	if err != nil {
+		return err
+	}
+	return datastore.Delete(this.c, key)
+}
+
+/**
+ * 共同編集者の権限を変更する
+ * 所有者の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} userKey 共同編集者のエンコード済みキー
+ * @param {string} role 新しい権限
+ * @returns {error} エラー
+ */
+func (this *Model) setCollaboratorRole(encodedGameKey string, userKey string, role string) error {
+	if !exist(collaboratorRoles, role) {
+		return fmt.Errorf("存在しない権限です: %s", role)
+	}
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return err
+	}
+	key := collaboratorKey(this.c, gameKey, userKey)
+	return datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+		collaborator := new(Collaborator)
+		err := datastore.Get(tc, key, collaborator)
+		if err != nil {
+			return err
+		}
+		collaborator.Role = role
+		_, err = datastore.Put(tc, key, collaborator)
+		return err
+	}, nil)
+}
+
+/**
+ * 共同編集者をゲームから外す
+ * 権限の確認は呼び出し側で行うこと
+ * @method
+ * @memberof Model
+ * @param {string} encodedGameKey ゲームキー
+ * @param {string} userKey 共同編集者のエンコード済みキー
+ * @returns {error} 共同編集者でなければ datastore.ErrNoSuchEntity
+ */
+func (this *Model) removeCollaborator(encodedGameKey string, userKey string) error {
+	gameKey, err := datastore.DecodeKey(encodedGameKey)
+	if err != nil {
+		return err
+	}
+	key := collaboratorKey(this.c, gameKey, userKey)
+	err = datastore.Get(this.c, key, new(Collaborator))
+	if err != nil {
+		return err
+	}
+	return datastore.Delete(this.c, key)
+}
+
+/**
+ * 統合するユーザの共同編集者としての参加と招待を付け替える
+ * target が既に参加しているゲームは強い方の権限を残す
+ * @method
+ * @memberof Model
+ * @param {string} targetKey 残すユーザのエンコード済みキー
+ * @param {string} sourceKey 削除するユーザのエンコード済みキー
+ * @returns {error} エラー
+ */
+func (this *Model) mergeCollaborations(targetKey string, sourceKey string) error {
+	collaborators := make([]*Collaborator, 0)
+	keys, err := datastore.NewQuery("Collaborator").Filter("UserKey =", sourceKey).GetAll(this.c, &collaborators)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		gameKey := key.Parent()
+		err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+			game := new(Game)
+			err := datastore.Get(tc, gameKey, game)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if err == nil && game.UserKey != targetKey {
+				collaborator := collaborators[i]
+				existing := new(Collaborator)
+				err = datastore.Get(tc, collaboratorKey(tc, gameKey, targetKey), existing)
+				if err == nil && gameRoleRank(existing.Role) >= gameRoleRank(collaborator.Role) {
+					collaborator = existing
+				} else if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				collaborator.UserKey = targetKey
+				_, err = datastore.Put(tc, collaboratorKey(tc, gameKey, targetKey), collaborator)
+				if err != nil {
+					return err
+				}
+			}
+			return datastore.Delete(tc, key)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	invitations := make([]*Invitation, 0)
+	invitationKeys, err := datastore.NewQuery("Invitation").Filter("UserKey =", sourceKey).GetAll(this.c, &invitations)
+	if err != nil {
+		return err
+	}
+	for _, invitation := range invitations {
+		invitation.UserKey = targetKey
+	}
+	_, err = datastore.PutMulti(this.c, invitationKeys, invitations)
+	return err
+}
+
+/**
+ * ユーザが所有しているゲーム一覧を返す
+ * ゴミ箱のゲームも含める
+ * @method
+ * @memberof Model
+ * @param {string} encodedUserKey ユーザキー
+ * @returns {map[string]*Game} エンコード済みのゲームキーとゲームの対応表
+ */
+func (this *Model) getGameList(encodedUserKey string) map[string]*Game {
+	games := make([]*Game, 0)
+	keys, err := datastore.NewQuery("Game").Filter("UserKey =", encodedUserKey).GetAll(this.c, &games)
+	check(this.c, err)
+	
+	result := make(map[string]*Game, len(keys))
+	for i, key := range keys {
+		result[key.Encode()] = games[i]
+	}
+	return result
+}
+
+/**
+ * ゲーム一覧の1ページの件数
+ * @const
+ */
+const gameListPageSize = 20
+
+/**
+ * ゲーム一覧の並び順とデータストアの並び順の対応
+ * 日時は新しい順、名前は昇順に並べる
+ * 組み合わせごとに index.yaml へインデックスを登録すること
+ * @const
+ */
+var gameListOrders = map[string]string{
+	"updated": "-Updated",
+	"created": "-Created",
+	"name": "Name",
+}
+
+/**
+ * 一覧に表示するゲーム
+ * テンプレートからはゲームの項目を直接参照できる
+ * @struct
+ * @property {string} Key エンコード済みのゲームキー
+ */
+type GameListItem struct {
+	Key string
+	*Game
+}
+
+/**
+ * 作成日時と更新日時を持たない古いゲームに日時を保存する
+ * データストアは並び順のプロパティを持たないエンティティをクエリの結果に含めないので、
+ * 日時を追加する前のゲームは日時順の一覧に表示されない
+ * 日時は分からないのでゼロ値を保存し、日時順では最後に並べる
+ * @method
+ * @memberof Model
+ * @param {string} encodedUserKey ユーザキー
+ * @returns {int} 日時を保存したゲームの数
+ * @returns {error} エラー
+ */
+func (this *Model) backfillGameDates(encodedUserKey string) (int, error) {
+	keys, err := datastore.NewQuery("Game").Filter("UserKey =", encodedUserKey).KeysOnly().GetAll(this.c, nil)
+	if err != nil {
+		return 0, err
+	}
+	dated, err := datastore.NewQuery("Game").Filter("UserKey =", encodedUserKey).Order("-Updated").KeysOnly().GetAll(this.c, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(dated) >= len(keys) {
+		return 0, nil
+	}
+	hasDate := make(map[string]bool, len(dated))
+	for _, key := range dated {
+		hasDate[key.Encode()] = true
+	}
+
+	count := 0
+	for _, key := range keys {
+		if hasDate[key.Encode()] {
+			continue
+		}
+		// Game の項目をすべて書き込むので、無かった日時はゼロ値で保存される
+		err = datastore.RunInTransaction(this.c, func(tc appengine.Context) error {
+			game := new(Game)
+			err := datastore.Get(tc, key, game)
+			if err != nil {
+				return err
+			}
+			_, err = datastore.Put(tc, key, game)
+			return err
+		}, nil)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
 }
 
 /**
- * ユーザが所有しているゲーム一覧を返す
+ * ユーザが所有しているゲームを並べて1ページ分返す
+ * ゴミ箱のゲームと filter に一致しないゲームは読み飛ばしてページを埋める
+ * 日時順の最初のページでは、日時を持たない古いゲームに日時を保存してから並べる
  * @method
  * @memberof Model
  * @param {string} encodedUserKey ユーザキー
- * @returns {map[string]*Game} エンコード済みのゲームキーとゲームの対応表
+ * @param {string} sort 並び順 (gameListOrders のキー)、不正なら updated
+ * @param {string} filter 名前か説明に含まれる文字列、空文字なら絞り込まない
+ * @param {string} cursor 前のページが返したカーソル、最初のページなら空文字
+ * @param {int} limit 1ページの件数
+ * @returns {[]GameListItem} ゲーム
+ * @returns {string} 次のページのカーソル、最後のページなら空文字
+ * @returns {error} カーソルが不正なら ErrInvalidCursor
  */
-func (this *Model) getGameList(encodedUserKey string) map[string]*Game {
-	query := datastore.NewQuery("Game").Filter("UserKey =", encodedUserKey)
+func (this *Model) getGamePage(encodedUserKey string, sort string, filter string, cursor string, limit int) ([]GameListItem, string, error) {
+	order, ok := gameListOrders[sort]
+	if !ok {
+		order = gameListOrders["updated"]
+	}
+	if cursor == "" && order != gameListOrders["name"] {
+		_, err := this.backfillGameDates(encodedUserKey)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	query := datastore.NewQuery("Game").Filter("UserKey =", encodedUserKey).Order(order)
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		query = query.Start(start)
+	}
+	filter = strings.ToLower(strings.TrimSpace(filter))
+
+	games := make([]GameListItem, 0, limit)
+	next := ""
 	iterator := query.Run(this.c)
-	
-	count, err := query.Count(this.c)
-	check(this.c, err)
-	
-	result := make(map[string]*Game, count)
-	for ;; {
+	for {
 		game := new(Game)
-		gameKey, err := iterator.Next(game)
+		key, err := iterator.Next(game)
+		if err == datastore.Done {
+			return games, "", nil
+		}
 		if err != nil {
-			break
+			return nil, "", err
+		}
+		if game.trashed() || !game.matches(filter) {
+			continue
+		}
+		if len(games) == limit {
+			// 一致するゲームがまだあるので、ページの最後の位置を次のカーソルにする
+			return games, next, nil
+		}
+		games = append(games, GameListItem{key.Encode(), game})
+		if len(games) == limit {
+			end, err := iterator.Cursor()
+			if err != nil {
+				return nil, "", err
+			}
+			next = end.String()
 		}
-		result[gameKey.Encode()] = game
 	}
-	
-	return result
 }
 
 /**
@@ -470,6 +4922,7 @@ func (this *Model) getAllUser() map[string]*User {
 /**
  * セッションを開始する
  * memcache にセッションIDとユーザキーの対応を保存する
+ * CSRF対策用のトークンもセッションごとに作成して一緒に保存する
  * セッションは最後のページアクセスから24時間有効
  * 24時間経過したものは cron で定期的に削除される
  * @method
@@ -484,9 +4937,10 @@ func (this *Model) startSession(userKey string) string {
 	}
 	expire := time.Now().Add(time.Hour * 24)
 	
-	data := make(map[string]string, 2)
+	data := make(map[string]string, 3)
 	data["u"] = userKey
 	data["e"] = expire.String()
+	data["t"] = getSecureRandomString(32)
 	
 	encodedData, err := json.Marshal(data)
 	item := &memcache.Item {
@@ -495,10 +4949,74 @@ func (this *Model) startSession(userKey string) string {
 	}
 	err = memcache.Set(this.c, item)
 	check(this.c, err)
+	this.addUserSession(userKey, sessionId)
 	
 	return sessionId
 }
 
+/**
+ * ユーザのセッションID一覧の memcache のキーを返す
+ * @function
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {string} memcache のキー
+ */
+func userSessionsKey(userKey string) string {
+	return fmt.Sprintf("sessions:%s", userKey)
+}
+
+/**
+ * ユーザのセッションID一覧にセッションを追加する
+ * 退会した時にすべてのセッションを終了できるように記録しておく
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @param {string} sessionId 追加するセッションID
+ */
+func (this *Model) addUserSession(userKey string, sessionId string) {
+	sessionIds := make([]string, 0)
+	_, err := memcache.JSON.Get(this.c, userSessionsKey(userKey), &sessionIds)
+	if err != nil && err != memcache.ErrCacheMiss {
+		check(this.c, err)
+	}
+
+	// 期限切れのセッションを取り除く
+	alive := make([]string, 0, len(sessionIds) + 1)
+	for _, id := range sessionIds {
+		if this.getUserKeyFromSession(id) == userKey {
+			alive = append(alive, id)
+		}
+	}
+	alive = append(alive, sessionId)
+
+	item := &memcache.Item {
+		Key: userSessionsKey(userKey),
+		Object: alive,
+	}
+	err = memcache.JSON.Set(this.c, item)
+	check(this.c, err)
+}
+
+/**
+ * ユーザのすべてのセッションを終了する
+ * セッションID一覧は memcache から消えることがあるので、すべてを終了できるとは限らない
+ * 削除や統合で消えたユーザのセッションは、残っていても getSessionUser がユーザの存在を確かめて拒否する
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ */
+func (this *Model) removeUserSessions(userKey string) {
+	sessionIds := make([]string, 0)
+	_, err := memcache.JSON.Get(this.c, userSessionsKey(userKey), &sessionIds)
+	if err != nil {
+		return
+	}
+	sessionIds = append(sessionIds, userSessionsKey(userKey))
+	err = memcache.DeleteMulti(this.c, sessionIds)
+	if _, ok := err.(appengine.MultiError); !ok {
+		check(this.c, err)
+	}
+}
+
 /**
  * memcache から指定されたセッション情報を削除する
  * @method
@@ -512,6 +5030,7 @@ func (this *Model) removeSession(sessionId string) {
 
 /**
  * memcache からユーザキーを返す
+ * セッションが存在しない場合は空文字を返す
  * @method
  * @memberof Model
  * @param {string} sessionId セッションID
@@ -519,9 +5038,452 @@ func (this *Model) removeSession(sessionId string) {
  */
 func (this *Model) getUserKeyFromSession(sessionId string) string {
 	item, err := memcache.Get(this.c, sessionId)
-	check(this.c, err)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			check(this.c, err)
+		}
+		return ""
+	}
 	data := make(map[string]string, 2)
 	err = json.Unmarshal(item.Value, &data)
 	check(this.c, err)
 	return data["u"]
+}
+
+/**
+ * memcache からセッションのCSRFトークンを返す
+ * セッションが存在しない場合は空文字を返す
+ * @method
+ * @memberof Model
+ * @param {string} sessionId セッションID
+ * @returns {string} CSRFトークン
+ */
+func (this *Model) getCsrfTokenFromSession(sessionId string) string {
+	item, err := memcache.Get(this.c, sessionId)
+	if err != nil {
+		return ""
+	}
+	data := make(map[string]string, 3)
+	err = json.Unmarshal(item.Value, &data)
+	check(this.c, err)
+	return data["t"]
+}
+
+/**
+ * 連携の確認を待っている外部サービスのアカウント
+ * @struct
+ * @property {string} Provider サービス名
+ * @property {string} OAuthId サービスが決めたユーザID
+ * @property {string} Name サービス上の名前
+ * @property {string} AccessToken アクセストークン
+ * @property {string} AccessTokenSecret アクセストークンのシークレット
+ */
+type PendingLink struct {
+	Provider string
+	OAuthId string
+	Name string
+	AccessToken string
+	AccessTokenSecret string
+}
+
+/**
+ * 連携の確認を待っている外部サービスのアカウントを memcache に保存する
+ * 確認ページで利用者が連携を確定するまで保持する
+ * 10分経過すると無効になる
+ * @method
+ * @memberof Model
+ * @param {string} sessionId 連携先ユーザのセッションID
+ * @param {*PendingLink} link 連携するアカウント
+ */
+func (this *Model) setPendingLink(sessionId string, link *PendingLink) {
+	item := &memcache.Item {
+		Key: fmt.Sprintf("link:%s", sessionId),
+		Object: link,
+		Expiration: time.Minute * 10,
+	}
+	err := memcache.JSON.Set(this.c, item)
+	check(this.c, err)
+}
+
+/**
+ * 連携の確認を待っている外部サービスのアカウントを取り出す
+ * 一度取り出したものは削除する
+ * @method
+ * @memberof Model
+ * @param {string} sessionId 連携先ユーザのセッションID
+ * @returns {*PendingLink} 連携するアカウント、存在しなければ nil
+ */
+func (this *Model) popPendingLink(sessionId string) *PendingLink {
+	key := fmt.Sprintf("link:%s", sessionId)
+	link := new(PendingLink)
+	_, err := memcache.JSON.Get(this.c, key, link)
+	if err != nil {
+		return nil
+	}
+	memcache.Delete(this.c, key)
+	return link
+}
+
+/**
+ * 統合待ちのユーザを memcache に保存する
+ * アカウント連携で別のユーザが見つかった時に、統合の確認が終わるまで保持する
+ * 10分経過すると無効になる
+ * @method
+ * @memberof Model
+ * @param {string} sessionId 統合先ユーザのセッションID
+ * @param {string} sourceKey 統合元ユーザのエンコード済みキー
+ */
+func (this *Model) setPendingMerge(sessionId string, sourceKey string) {
+	item := &memcache.Item {
+		Key: fmt.Sprintf("merge:%s", sessionId),
+		Value: []byte(sourceKey),
+		Expiration: time.Minute * 10,
+	}
+	err := memcache.Set(this.c, item)
+	check(this.c, err)
+}
+
+/**
+ * 統合待ちのユーザを返す
+ * 存在しない場合は空文字を返す
+ * @method
+ * @memberof Model
+ * @param {string} sessionId 統合先ユーザのセッションID
+ * @returns {string} 統合元ユーザのエンコード済みキー
+ */
+func (this *Model) getPendingMerge(sessionId string) string {
+	item, err := memcache.Get(this.c, fmt.Sprintf("merge:%s", sessionId))
+	if err != nil {
+		return ""
+	}
+	return string(item.Value)
+}
+
+/**
+ * 統合待ちのユーザを削除する
+ * @method
+ * @memberof Model
+ * @param {string} sessionId 統合先ユーザのセッションID
+ */
+func (this *Model) removePendingMerge(sessionId string) {
+	err := memcache.Delete(this.c, fmt.Sprintf("merge:%s", sessionId))
+	if err != memcache.ErrCacheMiss {
+		check(this.c, err)
+	}
+}
+
+/**
+ * OAuth 1.0a の認証の途中状態
+ * リクエストトークンをキーにして memcache に保存し、コールバックで取り出したら削除する
+ * @struct
+ * @property {string} Secret リクエストトークンのシークレット
+ * @property {string} SessionId 認証を開始したセッションID、未ログインなら空文字
+ */
+type OAuth1State struct {
+	Secret string
+	SessionId string
+}
+
+/**
+ * OAuth 1.0a のリクエストトークンのシークレットを memcache に保存する
+ * コールバックでアクセストークンと交換する時の署名に使う
+ * 連携を開始したセッションと同じか確かめるためにセッションIDも保存する
+ * 10分経過すると無効になる
+ * @method
+ * @memberof Model
+ * @param {string} token リクエストトークン
+ * @param {string} secret リクエストトークンのシークレット
+ * @param {string} sessionId 認証を開始したセッションID、未ログインなら空文字
+ */
+func (this *Model) setRequestTokenSecret(token string, secret string, sessionId string) {
+	data := new(OAuth1State)
+	data.Secret = secret
+	data.SessionId = sessionId
+	item := &memcache.Item {
+		Key: fmt.Sprintf("oauth1:%s", token),
+		Object: data,
+		Expiration: time.Minute * 10,
+	}
+	err := memcache.JSON.Set(this.c, item)
+	check(this.c, err)
+}
+
+/**
+ * OAuth 1.0a のリクエストトークンのシークレットを取り出す
+ * 一度取り出したシークレットは削除する
+ * @method
+ * @memberof Model
+ * @param {string} token リクエストトークン
+ * @returns {*OAuth1State} シークレットと認証を開始したセッションID、保存されていなければ nil
+ */
+func (this *Model) popRequestTokenSecret(token string) *OAuth1State {
+	key := fmt.Sprintf("oauth1:%s", token)
+	data := new(OAuth1State)
+	_, err := memcache.JSON.Get(this.c, key, data)
+	if err != nil {
+		return nil
+	}
+	memcache.Delete(this.c, key)
+	return data
+}
+
+/**
+ * パスワードの確認が済み、二段階認証を待っているログインを memcache に保存する
+ * 5分経過すると無効になる
+ * @method
+ * @memberof Model
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {string} 二段階目で送り返してもらうトークン
+ */
+func (this *Model) setPendingLogin(userKey string) string {
+	token := getSecureRandomString(32)
+	item := &memcache.Item {
+		Key: fmt.Sprintf("totp:%s", token),
+		Value: []byte(userKey),
+		Expiration: time.Minute * 5,
+	}
+	err := memcache.Set(this.c, item)
+	check(this.c, err)
+	return token
+}
+
+/**
+ * 二段階認証を待っているログインのユーザキーを返す
+ * 存在しない場合は空文字を返す
+ * @method
+ * @memberof Model
+ * @param {string} token setPendingLogin が返したトークン
+ * @returns {string} エンコード済みのユーザキー
+ */
+func (this *Model) getPendingLogin(token string) string {
+	if token == "" {
+		return ""
+	}
+	item, err := memcache.Get(this.c, fmt.Sprintf("totp:%s", token))
+	if err != nil {
+		return ""
+	}
+	return string(item.Value)
+}
+
+/**
+ * 二段階認証を待っているログインを削除する
+ * @method
+ * @memberof Model
+ * @param {string} token setPendingLogin が返したトークン
+ */
+func (this *Model) removePendingLogin(token string) {
+	err := memcache.Delete(this.c, fmt.Sprintf("totp:%s", token))
+	if err != memcache.ErrCacheMiss {
+		check(this.c, err)
+	}
+}
+
+/**
+ * 試行回数の制限を受けずにログインに失敗できる回数
+ * @const
+ */
+const loginFreeAttempts = 3
+
+/**
+ * ログイン失敗後に待たせる時間の上限
+ * @const
+ */
+const loginMaxBackoff = time.Minute * 15
+
+/**
+ * アカウントをロックするまでの失敗回数
+ * @const
+ */
+const accountLockFailures = 10
+
+/**
+ * IPアドレスをロックするまでの失敗回数
+ * 共有IPからの利用者を巻き込みにくいようにアカウントより多くする
+ * @const
+ */
+const ipLockFailures = 50
+
+/**
+ * ロックする時間
+ * @const
+ */
+const loginLockDuration = time.Minute * 30
+
+/**
+ * 失敗回数を数える期間
+ * 最後の失敗からこの期間が過ぎたら回数を数え直す
+ * @const
+ */
+const loginFailureWindow = time.Hour * 24
+
+/**
+ * ログイン失敗の記録
+ * キー名は "mail:正規化したメールアドレス" または "ip:IPアドレス"
+ * 存在しないアドレスも記録するので、ロックの有無からアカウントの存在は分からない
+ * @struct
+ * @property {int} Failures 失敗回数
+ * @property {time.Time} LastFailure 最後に失敗した日時
+ * @property {time.Time} NextAttempt 次にログインを試せる日時
+ * @property {time.Time} LockedUntil ロックが解除される日時
+ */
+type LoginThrottle struct {
+	Failures int
+	LastFailure time.Time
+	NextAttempt time.Time
+	LockedUntil time.Time
+}
+
+/**
+ * ログイン失敗の記録のキーを返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {string} kind "mail" または "ip"
+ * @param {string} id メールアドレスまたはIPアドレス
+ * @returns {*datastore.Key} LoginThrottle のキー
+ */
+func loginThrottleKey(c appengine.Context, kind string, id string) *datastore.Key {
+	if kind == "mail" {
+		id = normalizeMail(id)
+	}
+	return datastore.NewKey(c, "LoginThrottle", fmt.Sprintf("%s:%s", kind, id), 0, nil)
+}
+
+/**
+ * 次にログインを試せるまでの時間を返す
+ * ロック中ならロックが解除されるまでの時間を返す
+ * @method
+ * @memberof LoginThrottle
+ * @param {time.Time} now 現在時刻
+ * @returns {time.Duration} 待ち時間、すぐに試せるなら0
+ */
+func (this *LoginThrottle) wait(now time.Time) time.Duration {
+	until := this.NextAttempt
+	if this.LockedUntil.After(until) {
+		until = this.LockedUntil
+	}
+	if until.After(now) {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+/**
+ * ログインを試せるようになるまでの時間を返す
+ * アカウントとIPアドレスのうち長い方の待ち時間を返す
+ * メールアドレスが空ならIPアドレスの待ち時間だけを返す
+ * @method
+ * @memberof Model
+ * @param {string} mail メールアドレス
+ * @param {string} ip クライアントのIPアドレス
+ * @returns {time.Duration} 待ち時間、すぐに試せるなら0
+ */
+func (this *Model) loginWait(mail string, ip string) time.Duration {
+	keys := []*datastore.Key{loginThrottleKey(this.c, "ip", ip)}
+	if normalizeMail(mail) != "" {
+		keys = append(keys, loginThrottleKey(this.c, "mail", mail))
+	}
+	throttles := make([]LoginThrottle, len(keys))
+	err := datastore.GetMulti(this.c, keys, throttles)
+	if multiError, ok := err.(appengine.MultiError); ok {
+		for _, e := range multiError {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				check(this.c, e)
+			}
+		}
+	} else {
+		check(this.c, err)
+	}
+
+	now := time.Now()
+	var result time.Duration
+	for i := range throttles {
+		wait := throttles[i].wait(now)
+		if wait > result {
+			result = wait
+		}
+	}
+	return result
+}
+
+/**
+ * ログインの失敗を記録する
+ * 失敗が続くと次に試せるまでの時間を指数的に延ばし、一定回数を超えたらロックする
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {*datastore.Key} key LoginThrottle のキー
+ * @param {int} lockFailures ロックするまでの失敗回数
+ * @returns {bool} 今回の失敗でロックされたらtrue
+ */
+func recordLoginFailure(c appengine.Context, key *datastore.Key, lockFailures int) bool {
+	locked := false
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		throttle := new(LoginThrottle)
+		err := datastore.Get(tc, key, throttle)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		now := time.Now()
+		if now.Sub(throttle.LastFailure) > loginFailureWindow {
+			throttle.Failures = 0
+		}
+		throttle.Failures++
+		throttle.LastFailure = now
+
+		if throttle.Failures > loginFreeAttempts {
+			backoff := loginMaxBackoff
+			shift := uint(throttle.Failures - loginFreeAttempts - 1)
+			if shift < 20 && time.Second << shift < loginMaxBackoff {
+				backoff = time.Second << shift
+			}
+			throttle.NextAttempt = now.Add(backoff)
+		}
+		locked = false
+		if throttle.Failures >= lockFailures && !throttle.LockedUntil.After(now) {
+			throttle.LockedUntil = now.Add(loginLockDuration)
+			throttle.Failures = 0
+			locked = true
+		}
+
+		_, err = datastore.Put(tc, key, throttle)
+		return err
+	}, nil)
+	check(c, err)
+	return locked
+}
+
+/**
+ * ログインの失敗をアカウントとIPアドレスの両方に記録する
+ * メールアドレスが空の失敗は全員で1つの記録を共有してしまうので、IPアドレスにだけ記録する
+ * @method
+ * @memberof Model
+ * @param {string} mail メールアドレス
+ * @param {string} ip クライアントのIPアドレス
+ * @returns {bool} 今回の失敗でアカウントがロックされたらtrue
+ */
+func (this *Model) recordLoginFailure(mail string, ip string) bool {
+	recordLoginFailure(this.c, loginThrottleKey(this.c, "ip", ip), ipLockFailures)
+	if normalizeMail(mail) == "" {
+		return false
+	}
+	return recordLoginFailure(this.c, loginThrottleKey(this.c, "mail", mail), accountLockFailures)
+}
+
+/**
+ * アカウントのログイン失敗の記録を削除する
+ * ログインに成功した時と管理者がロックを解除した時に呼ぶ
+ * IPアドレスの記録は自分のアカウントへのログインで消されないように残す
+ * @method
+ * @memberof Model
+ * @param {string} mail メールアドレス
+ */
+func (this *Model) resetLoginThrottle(mail string) {
+	if normalizeMail(mail) == "" {
+		return
+	}
+	err := datastore.Delete(this.c, loginThrottleKey(this.c, "mail", mail))
+	if err != datastore.ErrNoSuchEntity {
+		check(this.c, err)
+	}
 }
\ No newline at end of file
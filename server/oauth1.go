@@ -1,100 +1,223 @@
 /**
  * Twitterとの通信
- * OAuth 1.0 Revision A を使う
+ * OAuth 1.0 Revision A (RFC 5849) を使う
+ * 署名は HMAC-SHA1 のみ対応する
  * @file
  */
 package escape3ds
 
 import (
-	"encoding/base64"
-	"strings"
-	"strconv"
-	"time"
-	"fmt"
-	"net/url"
 	"appengine"
-	"net/http"
+	"appengine/urlfetch"
 	"crypto/hmac"
 	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+/**
+ * 認証を開始したリクエストトークンを保存するクッキーの名前
+ * コールバックの oauth_token と一致しない場合は別のブラウザから開始された認証とみなす
+ * @const
+ */
+const oauth1TokenCookieName = "escape3ds_oauth1_token"
+
 /**
  * OAuth1.0aの通信を行うクラス
  * @class
- * @param {map[string]string} params oauthパラメータの配列
- * @param {appengine.Context} context コンテキスト
+ * @property {appengine.Context} context コンテキスト
+ * @property {string} consumerKey コンシューマキー
+ * @property {string} consumerSecret コンシューマシークレット
  */
 type OAuth1 struct {
-	params map[string]string
 	context appengine.Context
+	consumerKey string
+	consumerSecret string
 }
 
 /**
  * OAuthクラスのインスタンス化
+ * コンシューマキーとシークレットは config から読み込む
  * @function
- * @params {appengine.Context} c コンテキスト
- * @params{appengine.Context} callback コールバックURL
- * @returns {*OAuth} OAuthインスタンス
- */
-func NewOAuth1(c appengine.Context, callback string) *OAuth1 {
-	params := make(map[string]string, 7)
-	params["oauth_callback"] = callback
-	params["oauth_consumer_key"] = config["consumer_key"]
-	params["oauth_signature_method"] = "HMAC-SHA1"
-	params["oauth_version"] = "1.0"
-	
+ * @param {appengine.Context} c コンテキスト
+ * @returns {*OAuth1} OAuthインスタンス
+ */
+func NewOAuth1(c appengine.Context) *OAuth1 {
 	oauth := new(OAuth1)
-	oauth.params = params
 	oauth.context = c
+	oauth.consumerKey = config["consumer_key"]
+	oauth.consumerSecret = config["consumer_secret"]
 	return oauth
 }
 
 /**
- * Twitter へリクエストトークンを要求する
- * @method
- * @memberof OAuth1
- * @param {string} targetUrl リクエスト要求先のURL
- * @returns {map[string]string} リクエスト結果
- */
-func (this *OAuth1) requestToken(targetUrl string) map[string]string {
-	response := this.request(targetUrl, "")
-	datas := strings.Split(response, "&")
-	result := make(map[string]string, len(datas))
-	for i := 0; i < len(datas); i++ {
-		data := strings.Split(datas[i], "=")
-		result[data[0]] = data[1]
-	}
-	
-	return result
+ * RFC 3986 に従ってパーセントエンコードする
+ * 非予約文字 (英数字と - . _ ~) 以外をすべて %XX に変換する
+ * url.QueryEscape と違い空白は %20 になる
+ * @function
+ * @param {string} s エンコードする文字列
+ * @returns {string} エンコードした文字列
+ */
+func percentEncode(s string) string {
+	var buffer []byte
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') || b == '-' || b == '.' || b == '_' || b == '~' {
+			buffer = append(buffer, b)
+		} else {
+			buffer = append(buffer, fmt.Sprintf("%%%02X", b)...)
+		}
+	}
+	return string(buffer)
 }
 
 /**
- * リクエストを送信してレスポンスを受信する
- * メソッドは POST 固定
- * @method
- * @memberof OAuth1
- * @param {string} targetUrl 送信先
- * @param {string} body リクエストボディ
- * @returns {string} レスポンス
- */
-func (this *OAuth1) request(targetUrl string, body string) string {
-
-	// リクエストごとに変わるパラメータを設定
-	this.params["oauth_nonce"] = this.createNonce()
-	this.params["oauth_timestamp"] = strconv.Itoa(int(time.Now().Unix()))
-	this.params["oauth_signature"] = this.createSignature(targetUrl)
-	
-	// リクエスト送信
-	params := make(map[string]string, 1)
-	params["Authorization"] = this.createHeader()
-	response := request(this.context, "POST", targetUrl, params, body)
-	
-	// レスポンスボディの読み取り
-	result := make([]byte, 256)
-	response.Body.Read(result)
-	
-	return string(result)
+ * 署名ベース文字列のURIを作成する
+ * スキームとホストを小文字にして、既定のポートとクエリを取り除く (RFC 5849 3.4.1.2)
+ * @function
+ * @param {*url.URL} u リクエスト先のURL
+ * @returns {string} ベース文字列URI
+ */
+func oauth1BaseUri(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if (scheme == "http" && strings.HasSuffix(host, ":80")) || (scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, path)
+}
+
+/**
+ * パラメータを正規化する
+ * 名前と値をエンコードしてから名前、値の順に並べて連結する (RFC 5849 3.4.1.3.2)
+ * oauth_signature は含めない
+ * realm は Authorization ヘッダに付けた場合だけ除外するもので (RFC 5849 3.4.1.3.1)、このクライアントはヘッダに付けないので、
+ * クエリやボディの realm はほかのパラメータと同じように含める
+ * @function
+ * @param {url.Values} params クエリ、ボディ、oauth パラメータをすべて含んだもの
+ * @returns {string} 正規化したパラメータ
+ */
+func oauth1NormalizeParams(params url.Values) string {
+	pairs := make([]string, 0, len(params))
+	for key, values := range params {
+		if key == "oauth_signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", percentEncode(key), percentEncode(value)))
+		}
+	}
+	// "名前=値" のまま並べると "a=" と "a2=" の順序が崩れるため名前と値を分けて比較する
+	sort.Slice(pairs, func(i, j int) bool {
+		ki, vi := splitPair(pairs[i])
+		kj, vj := splitPair(pairs[j])
+		if ki != kj {
+			return ki < kj
+		}
+		return vi < vj
+	})
+	return strings.Join(pairs, "&")
+}
+
+/**
+ * "名前=値" を名前と値に分ける
+ * @function
+ * @param {string} pair "名前=値"
+ * @returns {string} 名前
+ * @returns {string} 値
+ */
+func splitPair(pair string) (string, string) {
+	i := strings.Index(pair, "=")
+	return pair[:i], pair[i+1:]
+}
+
+/**
+ * 署名ベース文字列を作成する (RFC 5849 3.4.1)
+ * @function
+ * @param {string} method HTTPメソッド
+ * @param {string} targetUrl リクエスト先のURL、クエリを含んでよい
+ * @param {url.Values} params ボディと oauth パラメータ、クエリはURLから読み取る
+ * @returns {string} 署名ベース文字列
+ * @returns {error} URLが不正ならエラー
+ */
+func oauth1BaseString(method string, targetUrl string, params url.Values) (string, error) {
+	u, err := url.Parse(targetUrl)
+	if err != nil {
+		return "", err
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", err
+	}
+
+	all := url.Values{}
+	for key, values := range query {
+		all[key] = append(all[key], values...)
+	}
+	for key, values := range params {
+		all[key] = append(all[key], values...)
+	}
+
+	base := []string{
+		percentEncode(strings.ToUpper(method)),
+		percentEncode(oauth1BaseUri(u)),
+		percentEncode(oauth1NormalizeParams(all)),
+	}
+	return strings.Join(base, "&"), nil
+}
+
+/**
+ * HMAC-SHA1 で oauth_signature を作成する (RFC 5849 3.4.2)
+ * 署名鍵はコンシューマシークレットとトークンシークレットを & で連結したもの
+ * @function
+ * @param {string} method HTTPメソッド
+ * @param {string} targetUrl リクエスト先のURL、クエリを含んでよい
+ * @param {url.Values} params ボディと oauth パラメータ
+ * @param {string} consumerSecret コンシューマシークレット
+ * @param {string} tokenSecret トークンシークレット、トークンが無い場合は空文字
+ * @returns {string} oauth_signature
+ * @returns {error} URLが不正ならエラー
+ */
+func oauth1Signature(method string, targetUrl string, params url.Values, consumerSecret string, tokenSecret string) (string, error) {
+	baseString, err := oauth1BaseString(method, targetUrl, params)
+	if err != nil {
+		return "", err
+	}
+	signatureKey := fmt.Sprintf("%s&%s", percentEncode(consumerSecret), percentEncode(tokenSecret))
+	hash := hmac.New(sha1.New, []byte(signatureKey))
+	hash.Write([]byte(baseString))
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+/**
+ * Authorization ヘッダを作成する (RFC 5849 3.5.1)
+ * @function
+ * @param {map[string]string} oauthParams oauth_signature を含む oauth パラメータ
+ * @returns {string} ヘッダ
+ */
+func oauth1Header(oauthParams map[string]string) string {
+	keys := make([]string, 0, len(oauthParams))
+	for key := range oauthParams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, len(keys))
+	for i, key := range keys {
+		params[i] = fmt.Sprintf(`%s="%s"`, percentEncode(key), percentEncode(oauthParams[key]))
+	}
+	return fmt.Sprintf("OAuth %s", strings.Join(params, ", "))
 }
 
 /**
@@ -104,61 +227,104 @@ func (this *OAuth1) request(targetUrl string, body string) string {
  * @returns {string} 作成したoauth_nonce
  */
 func (this *OAuth1) createNonce() string {
-	nonce := ""
-	for i := 0; i < 4; i++ {
-		nonce = strings.Join([]string{nonce, string(getRandomizedString())}, "")
-	}
-	this.context.Infof("nonce: %s", nonce)
-	return nonce
+	return getSecureRandomString(24)
 }
 
 /**
- * Aouthorization ヘッダを作成する
+ * 署名したリクエストを送信してレスポンスの本文を返す
  * @method
  * @memberof OAuth1
- * @returns {string} ヘッダ
+ * @param {string} method HTTPメソッド
+ * @param {string} targetUrl 送信先、クエリを含んでよい
+ * @param {url.Values} body フォーム形式で送るボディ、無ければ nil
+ * @param {string} token トークン、無ければ空文字
+ * @param {string} tokenSecret トークンシークレット、無ければ空文字
+ * @param {map[string]string} extra 追加の oauth パラメータ、無ければ nil
+ * @returns {[]byte} レスポンスの本文
+ * @returns {error} 通信エラーまたは 2xx 以外の応答ならエラー
  */
-func (this *OAuth1) createHeader() string {
-	params := make([]string, 0)
-	for key, val := range this.params {
-		key = url.QueryEscape(key)
-		val = url.QueryEscape(val)
-		set := fmt.Sprintf(`%s="%s"`, key, val)
-		params = append(params, set)
-	}
-	header := strings.Join(params, ", ")
-	header = fmt.Sprintf("OAuth %s", header)
-	return header
+func (this *OAuth1) request(method string, targetUrl string, body url.Values, token string, tokenSecret string, extra map[string]string) ([]byte, error) {
+	oauthParams := make(map[string]string, 8)
+	oauthParams["oauth_consumer_key"] = this.consumerKey
+	oauthParams["oauth_signature_method"] = "HMAC-SHA1"
+	oauthParams["oauth_timestamp"] = strconv.FormatInt(time.Now().Unix(), 10)
+	oauthParams["oauth_nonce"] = this.createNonce()
+	oauthParams["oauth_version"] = "1.0"
+	if token != "" {
+		oauthParams["oauth_token"] = token
+	}
+	for key, value := range extra {
+		oauthParams[key] = value
+	}
+
+	params := url.Values{}
+	for key, values := range body {
+		params[key] = append(params[key], values...)
+	}
+	for key, value := range oauthParams {
+		params.Set(key, value)
+	}
+	signature, err := oauth1Signature(method, targetUrl, params, this.consumerSecret, tokenSecret)
+	if err != nil {
+		return nil, err
+	}
+	oauthParams["oauth_signature"] = signature
+
+	var request *http.Request
+	if len(body) > 0 {
+		request, err = http.NewRequest(method, targetUrl, strings.NewReader(body.Encode()))
+		if err == nil {
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		request, err = http.NewRequest(method, targetUrl, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", oauth1Header(oauthParams))
+
+	client := urlfetch.Client(this.context)
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	result, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s から %d が返されました: %s", request.URL.Host, response.StatusCode, result)
+	}
+	return result, nil
 }
 
 /**
- * oauth_signature を作成する
+ * リクエストトークンを要求する (RFC 5849 2.1)
  * @method
  * @memberof OAuth1
- * @param {string} targetUrl リクエスト送信先のURL
- * @returns {string} oauth_signature
+ * @param {string} targetUrl リクエスト要求先のURL
+ * @param {string} callback コールバックURL
+ * @returns {url.Values} oauth_token, oauth_token_secret など
+ * @returns {error} エラー
  */
-func (this *OAuth1) createSignature(targetUrl string) string {
-	keys := make([]string, 0)
-	for key := range this.params {
-		keys = append(keys, key)
+func (this *OAuth1) requestToken(targetUrl string, callback string) (url.Values, error) {
+	extra := make(map[string]string, 1)
+	extra["oauth_callback"] = callback
+	response, err := this.request("POST", targetUrl, nil, "", "", extra)
+	if err != nil {
+		return nil, err
 	}
-	sort.Strings(keys)
-	
-	params := make([]string, len(keys))
-	for i := 0; i < len(keys); i++ {
-		key := keys[i]
-		val := this.params[key]
-		params[i] = fmt.Sprintf("%s=%s", url.QueryEscape(key), url.QueryEscape(val))
-	}
-	paramString := strings.Join(params, "&")
-	baseString := fmt.Sprintf("POST&%s&%s", url.QueryEscape(targetUrl), url.QueryEscape(paramString))
-	
-	signatureKey := fmt.Sprintf("%s&", url.QueryEscape(config["consumer_secret"]))
-	hash := hmac.New(sha1.New, []byte(signatureKey))
-	hash.Write([]byte(baseString))
-	signature := hash.Sum(nil)
-	return base64.StdEncoding.EncodeToString(signature)
+	result, err := url.ParseQuery(string(response))
+	if err != nil {
+		return nil, err
+	}
+	if result.Get("oauth_callback_confirmed") != "true" {
+		return nil, fmt.Errorf("oauth_callback_confirmed が true ではありません: %s", response)
+	}
+	return result, nil
 }
 
 /**
@@ -171,30 +337,54 @@ func (this *OAuth1) createSignature(targetUrl string) string {
  * @param {string} token 未認証リクエストトークン
  */
 func (this *OAuth1) authenticate(w http.ResponseWriter, r *http.Request, targetUrl string, token string) {
-	to := fmt.Sprintf("?oauth_token=%s", token)
-	to = strings.Join([]string{targetUrl, to}, "")
+	to := fmt.Sprintf("%s?oauth_token=%s", targetUrl, url.QueryEscape(token))
 	http.Redirect(w, r, to, 302)
 }
 
 /**
- * リクエストトークンをアクセストークンに変換する
+ * リクエストトークンをアクセストークンに変換する (RFC 5849 2.3)
  * @memberof OAuth1
  * @method
+ * @param {string} targetUrl リクエストの送信先
  * @param {string} token リクエストトークン
+ * @param {string} tokenSecret リクエストトークンのシークレット
  * @param {string} verifier 認証データ
- * @param {string} targetUrl リクエストの送信先
- * @returns {map[string]string} アクセストークンとユーザデータ
- */
-func (this *OAuth1) exchangeToken(token string, verifier string, targetUrl string) map[string]string {
-	this.params["oauth_token"] = token
-	body := fmt.Sprintf("oauth_verifier=%s", verifier)
-	response := this.request(targetUrl, body)
-	
-	datas := strings.Split(response, "&")
-	result := make(map[string]string, len(datas))
-	for i := 0; i < len(datas); i++ {
-		data := strings.Split(datas[i], "=")
-		result[data[0]] = data[1]
-	}
-	return result
-}
\ No newline at end of file
+ * @returns {url.Values} アクセストークンとユーザデータ
+ * @returns {error} エラー
+ */
+func (this *OAuth1) exchangeToken(targetUrl string, token string, tokenSecret string, verifier string) (url.Values, error) {
+	body := url.Values{}
+	body.Set("oauth_verifier", verifier)
+	response, err := this.request("POST", targetUrl, body, token, tokenSecret, nil)
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(string(response))
+}
+
+/**
+ * アクセストークンを使って署名付きでAPIを呼び出す
+ * GET ならパラメータをクエリに、それ以外ならボディに入れる
+ * @memberof OAuth1
+ * @method
+ * @param {string} method HTTPメソッド
+ * @param {string} targetUrl APIのURL
+ * @param {url.Values} params APIのパラメータ
+ * @param {string} token アクセストークン
+ * @param {string} tokenSecret アクセストークンのシークレット
+ * @returns {[]byte} レスポンスの本文
+ * @returns {error} エラー
+ */
+func (this *OAuth1) requestAPI(method string, targetUrl string, params url.Values, token string, tokenSecret string) ([]byte, error) {
+	if method == "GET" || method == "DELETE" {
+		if len(params) > 0 {
+			separator := "?"
+			if strings.Contains(targetUrl, "?") {
+				separator = "&"
+			}
+			targetUrl = fmt.Sprintf("%s%s%s", targetUrl, separator, params.Encode())
+		}
+		return this.request(method, targetUrl, nil, token, tokenSecret, nil)
+	}
+	return this.request(method, targetUrl, params, token, tokenSecret, nil)
+}
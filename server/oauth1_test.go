@@ -0,0 +1,86 @@
+package escape3ds
+
+import (
+	"net/url"
+	"testing"
+)
+
+/**
+ * RFC 3986 のパーセントエンコード
+ * 空白は %20 になり、~ はエンコードしない
+ */
+func TestPercentEncode(t *testing.T) {
+	cases := map[string]string{
+		"r b": "r%20b",
+		"a~b": "a~b",
+		"=%3D": "%3D%253D",
+		"c@": "c%40",
+		"-._~": "-._~",
+	}
+	for input, expected := range cases {
+		if actual := percentEncode(input); actual != expected {
+			t.Errorf("percentEncode(%q) = %q, want %q", input, actual, expected)
+		}
+	}
+}
+
+/**
+ * 署名ベース文字列 (RFC 5849 3.4.1.1 の例)
+ * realm は Authorization ヘッダに付けるものなのでパラメータに含めない
+ */
+func TestOAuth1BaseString(t *testing.T) {
+	params := url.Values{
+		"c2": {""},
+		"a3": {"2 q"},
+		"oauth_consumer_key": {"9djdj82h48djs9d2"},
+		"oauth_token": {"kkk9d7dh3k39sjv7"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_timestamp": {"137131201"},
+		"oauth_nonce": {"7d8f3e4a"},
+		"oauth_signature": {"bYT5CMsGcbgUdFHObYMEfcx6bsw="},
+	}
+	expected := "POST&http%3A%2F%2Fexample.com%2Frequest&a2%3Dr%2520b%26a3%3D2%2520q%26a3%3Da%26b5%3D%253D%25253D%26c%2540%3D%26c2%3D%26oauth_consumer_key%3D9djdj82h48djs9d2%26oauth_nonce%3D7d8f3e4a%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D137131201%26oauth_token%3Dkkk9d7dh3k39sjv7"
+	actual, err := oauth1BaseString("POST", "http://example.com/request?b5=%3D%253D&a3=a&c%40=&a2=r%20b", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != expected {
+		t.Errorf("oauth1BaseString() =\n%s\nwant\n%s", actual, expected)
+	}
+}
+
+/**
+ * クエリやボディの realm はほかのパラメータと同じように含める
+ */
+func TestOAuth1BaseStringRealmParameter(t *testing.T) {
+	actual, err := oauth1BaseString("GET", "http://example.com/r?realm=x", url.Values{"oauth_signature": {"s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "GET&http%3A%2F%2Fexample.com%2Fr&realm%3Dx"
+	if actual != expected {
+		t.Errorf("oauth1BaseString() = %s, want %s", actual, expected)
+	}
+}
+
+/**
+ * HMAC-SHA1 の署名 (OAuth Core 1.0 付録 A.5 の例)
+ */
+func TestOAuth1Signature(t *testing.T) {
+	params := url.Values{
+		"oauth_consumer_key": {"dpf43f3p2l4k3l03"},
+		"oauth_token": {"nnch734d00sl2jdk"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_timestamp": {"1191242096"},
+		"oauth_nonce": {"kllo9940pd9333jh"},
+		"oauth_version": {"1.0"},
+	}
+	actual, err := oauth1Signature("GET", "http://photos.example.net/photos?file=vacation.jpg&size=original", params, "kd94hf93k423kf44", "pfkkdhi9sl3r4s00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "tR3+Ty81lMeYAr/Fid0kMTYa/WM="
+	if actual != expected {
+		t.Errorf("oauth1Signature() = %s, want %s", actual, expected)
+	}
+}
@@ -1,47 +1,259 @@
 /**
  * OAuth 2.0 による通信
  * authorization code 方式のみ
+ * サービスごとの違いは OAuth2Provider に設定として記述する
+ * CSRF 対策に state を、認可コードの横取り対策に PKCE を使う
  * @file
  */
 package escape3ds
 
 import (
 	"appengine"
+	"appengine/memcache"
+	"appengine/urlfetch"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
-	"fmt"
+	"time"
 )
 
+/**
+ * OAuth 2.0 のサービスプロバイダ
+ * @struct
+ * @property {string} Name サービス名、ユーザの種類や連携アカウントの識別に使う
+ * @property {string} AuthorizeUrl 認可ページのURL
+ * @property {string} TokenUrl アクセストークンを取得するURL
+ * @property {string} UserInfoUrl ユーザ情報を取得するURL
+ * @property {string} Scope 要求するスコープ
+ * @property {string} ClientIdConfig クライアントIDを保存している config のキー
+ * @property {string} ClientSecretConfig クライアントパスワードを保存している config のキー
+ * @property {string} IdField ユーザ情報のうちユーザIDのフィールド名
+ * @property {string} NameField ユーザ情報のうち名前のフィールド名
+ * @property {string} MailField ユーザ情報のうちメールアドレスのフィールド名
+ * @property {bool} PKCE PKCE に対応していればtrue
+ * @property {string} Button ログインボタンの画像パス、空ならテキストのリンクを表示する
+ */
+type OAuth2Provider struct {
+	Name string
+	AuthorizeUrl string
+	TokenUrl string
+	UserInfoUrl string
+	Scope string
+	ClientIdConfig string
+	ClientSecretConfig string
+	IdField string
+	NameField string
+	MailField string
+	PKCE bool
+	Button string
+}
+
+/**
+ * 利用できる OAuth 2.0 のサービスプロバイダ
+ * 新しいサービスはここに追加して config にクライアントIDとパスワードを設定する
+ * @const
+ */
+var oauth2Providers = []*OAuth2Provider{
+	&OAuth2Provider{
+		Name: "Facebook",
+		AuthorizeUrl: "https://www.facebook.com/dialog/oauth",
+		TokenUrl: "https://graph.facebook.com/oauth/access_token",
+		UserInfoUrl: "https://graph.facebook.com/me?fields=id,name,email",
+		Scope: "email",
+		ClientIdConfig: "facebook_client_id",
+		ClientSecretConfig: "facebook_client_secret",
+		IdField: "id",
+		NameField: "name",
+		MailField: "email",
+		PKCE: false,
+		Button: "/client/img/sign_in_with_facebook.png",
+	},
+	&OAuth2Provider{
+		Name: "Google",
+		AuthorizeUrl: "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenUrl: "https://oauth2.googleapis.com/token",
+		UserInfoUrl: "https://openidconnect.googleapis.com/v1/userinfo",
+		Scope: "openid profile email",
+		ClientIdConfig: "google_client_id",
+		ClientSecretConfig: "google_client_secret",
+		IdField: "sub",
+		NameField: "name",
+		MailField: "email",
+		PKCE: true,
+	},
+	&OAuth2Provider{
+		Name: "GitHub",
+		AuthorizeUrl: "https://github.com/login/oauth/authorize",
+		TokenUrl: "https://github.com/login/oauth/access_token",
+		UserInfoUrl: "https://api.github.com/user",
+		Scope: "read:user user:email",
+		ClientIdConfig: "github_client_id",
+		ClientSecretConfig: "github_client_secret",
+		IdField: "id",
+		NameField: "login",
+		MailField: "email",
+		PKCE: true,
+	},
+}
+
+/**
+ * 名前からサービスプロバイダを探す
+ * 存在しない場合は nil を返す
+ * @function
+ * @param {string} name サービス名
+ * @returns {*OAuth2Provider} サービスプロバイダ
+ */
+func getOAuth2Provider(name string) *OAuth2Provider {
+	for _, provider := range oauth2Providers {
+		if provider.Name == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+/**
+ * config にクライアントIDが設定されているサービスプロバイダの一覧を返す
+ * @function
+ * @returns {[]*OAuth2Provider} 利用可能なサービスプロバイダ
+ */
+func enabledOAuth2Providers() []*OAuth2Provider {
+	result := make([]*OAuth2Provider, 0, len(oauth2Providers))
+	for _, provider := range oauth2Providers {
+		if provider.enabled() {
+			result = append(result, provider)
+		}
+	}
+	return result
+}
+
+/**
+ * クライアントIDが設定されているかどうか
+ * @method
+ * @memberof OAuth2Provider
+ * @returns {bool} 設定されていればtrue
+ */
+func (this *OAuth2Provider) enabled() bool {
+	return config[this.ClientIdConfig] != ""
+}
+
+/**
+ * ログインを開始するパス
+ * @method
+ * @memberof OAuth2Provider
+ * @returns {string} パス
+ */
+func (this *OAuth2Provider) LoginPath() string {
+	return fmt.Sprintf("/login_%s", strings.ToLower(this.Name))
+}
+
+/**
+ * 認可コードを受け取るパス
+ * @method
+ * @memberof OAuth2Provider
+ * @returns {string} パス
+ */
+func (this *OAuth2Provider) CallbackPath() string {
+	return fmt.Sprintf("/callback_%s", strings.ToLower(this.Name))
+}
+
+/**
+ * 認可コードを受け取るURL
+ * @method
+ * @memberof OAuth2Provider
+ * @returns {string} リダイレクトURI
+ */
+func (this *OAuth2Provider) redirectUri() string {
+	return fmt.Sprintf("%s%s", siteUrl, this.CallbackPath())
+}
+
+/**
+ * 認可リクエストの途中状態
+ * state をキーにして memcache に保存し、コールバックで検証したら削除する
+ * @struct
+ * @property {string} Provider サービス名
+ * @property {string} Verifier PKCE の code_verifier
+ * @property {string} SessionId 認可を開始したセッションID、未ログインなら空文字
+ */
+type OAuth2State struct {
+	Provider string
+	Verifier string
+	SessionId string
+}
+
+/**
+ * state を保存するクッキーの名前
+ * memcache の state と一致しない場合は別のブラウザから開始された認可とみなす
+ * @const
+ */
+const oauth2StateCookieName = "escape3ds_oauth2_state"
+
 /**
  * OAuth 2.0
  * @class
  * @property {appengine.Context} context コンテキスト
+ * @property {*OAuth2Provider} provider サービスプロバイダ
  * @property {string} clientId クライアントID
  * @property {string} clientSecret クライアントパスワード
  */
 type OAuth2 struct {
 	context appengine.Context
+	provider *OAuth2Provider
 	clientId string
 	clientSecret string
 }
 
+/**
+ * アクセストークン
+ * JSON 形式とフォーム形式のどちらの応答からも作成する
+ * @struct
+ * @property {string} AccessToken アクセストークン
+ * @property {string} TokenType トークンの種類
+ * @property {string} Scope 許可されたスコープ
+ * @property {int} ExpiresIn 有効期限（秒）
+ */
+type OAuth2Token struct {
+	AccessToken string
+	TokenType string
+	Scope string
+	ExpiresIn int
+}
+
 /**
  * OAuth2.0 インスタンスを返す
  * @function
  * @param {appengine.Context} c コンテキスト
- * @param {string} clientId OAuthクライアントID
- * @param {string} clientSecret OAuthクライアントパスワード
+ * @param {*OAuth2Provider} provider サービスプロバイダ
  * @returns {*OAuth2} インスタンス
  */
-func NewOAuth2(c appengine.Context, clientId string, clientSecret string) *OAuth2 {
+func NewOAuth2(c appengine.Context, provider *OAuth2Provider) *OAuth2 {
 	oauth := new(OAuth2)
 	oauth.context = c
-	oauth.clientId = clientId
-	
-	oauth.clientSecret = clientSecret
+	oauth.provider = provider
+	oauth.clientId = config[provider.ClientIdConfig]
+	oauth.clientSecret = config[provider.ClientSecretConfig]
 	return oauth
 }
 
+/**
+ * PKCE の code_challenge を作成する
+ * S256 方式を使う
+ * @function
+ * @param {string} verifier code_verifier
+ * @returns {string} code_challenge
+ */
+func pkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
 /**
  * 認証コードをリクエストする
  * 認証ページヘのリダイレクトを行いユーザに認証してもらう
@@ -50,12 +262,72 @@ func NewOAuth2(c appengine.Context, clientId string, clientSecret string) *OAuth
  * @memberof OAuth2
  * @param {http.ResponseWriter} w 応答先
  * @param {*http.Request} r リクエスト
- * @param {string} targetUri リクエスト先URI
- * @param {string} redirectUri リダイレクトURI
  */
-func (this *OAuth2) requestAuthorizationCode(w http.ResponseWriter, r *http.Request, targetUri string, redirectUri string) {
-	targetUri = fmt.Sprintf("%s?client_id=%s&redirect_uri=%s&response_type=code", targetUri, this.clientId, redirectUri)
-	http.Redirect(w, r, targetUri, 302)
+func (this *OAuth2) requestAuthorizationCode(w http.ResponseWriter, r *http.Request) {
+	state := getSecureRandomString(32)
+	data := new(OAuth2State)
+	data.Provider = this.provider.Name
+	data.SessionId = getSession(this.context, r)
+
+	params := url.Values{}
+	params.Set("client_id", this.clientId)
+	params.Set("redirect_uri", this.provider.redirectUri())
+	params.Set("response_type", "code")
+	params.Set("state", state)
+	if this.provider.Scope != "" {
+		params.Set("scope", this.provider.Scope)
+	}
+	if this.provider.PKCE {
+		data.Verifier = getSecureRandomString(32)
+		params.Set("code_challenge", pkceChallenge(data.Verifier))
+		params.Set("code_challenge_method", "S256")
+	}
+
+	item := &memcache.Item {
+		Key: fmt.Sprintf("oauth2:%s", state),
+		Object: data,
+		Expiration: time.Minute * 10,
+	}
+	err := memcache.JSON.Set(this.context, item)
+	check(this.context, err)
+	http.SetCookie(w, NewCookie(oauth2StateCookieName, state, "localhost", "/", 1))
+
+	http.Redirect(w, r, fmt.Sprintf("%s?%s", this.provider.AuthorizeUrl, params.Encode()), 302)
+}
+
+/**
+ * コールバックの state を検証する
+ * 検証した state は再利用できないように削除する
+ * @method
+ * @memberof OAuth2
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r コールバックのリクエスト
+ * @returns {*OAuth2State} 認可リクエストの途中状態
+ * @returns {error} state が不正ならエラー
+ */
+func (this *OAuth2) verifyState(w http.ResponseWriter, r *http.Request) (*OAuth2State, error) {
+	state := r.FormValue("state")
+	if state == "" {
+		return nil, errors.New("state がありません")
+	}
+	cookie, err := r.Cookie(oauth2StateCookieName)
+	if err != nil || cookie.Value != state {
+		return nil, errors.New("state がクッキーと一致しません")
+	}
+	http.SetCookie(w, NewCookie(oauth2StateCookieName, "", "localhost", "/", -1))
+
+	key := fmt.Sprintf("oauth2:%s", state)
+	data := new(OAuth2State)
+	_, err = memcache.JSON.Get(this.context, key, data)
+	if err != nil {
+		return nil, fmt.Errorf("state が存在しないか期限切れです: %s", err.Error())
+	}
+	memcache.Delete(this.context, key)
+
+	if data.Provider != this.provider.Name {
+		return nil, errors.New("state のサービスが一致しません")
+	}
+	return data, nil
 }
 
 /**
@@ -63,46 +335,191 @@ func (this *OAuth2) requestAuthorizationCode(w http.ResponseWriter, r *http.Requ
  * 引き換えとして認証コードを渡すこと
  * @method
  * @memberof OAuth2
- * @param {http.ResponseWriter} w 応答先
- * @param {*http.Request} r リクエスト
- * @param {string} targetUri
- * @param {string} redirectUri
- * @param {string} clientSecret
- * @param {string} code
- * @returns {string} アクセストークン
- */
-func (this *OAuth2) requestAccessToken(w http.ResponseWriter, r *http.Request, targetUri string, redirectUri string, code string) string {
-	targetUri = fmt.Sprintf("%s?client_id=%s&redirect_uri=%s&client_secret=%s&code=%s", targetUri, this.clientId, redirectUri, this.clientSecret, code)
-	
-	params := make(map[string]string, 4)
-	params["client_id"] = this.clientId
-	params["redirect_uri"] = redirectUri
-	params["client_secret"] = this.clientSecret
-	params["code"] = code
-	response := request(this.context, "GET", targetUri, params, "")
-	
-	body := make([]byte, 1024)
-	_, err := response.Body.Read(body)
-	check(this.context, err)
-	
-	// response: oauth_token=******&expires=******
-	responseParams := strings.Split(string(body), "&")
-	tokenParam := strings.Split(responseParams[0], "=")
-	return tokenParam[1]
+ * @param {string} code 認証コード
+ * @param {string} verifier PKCE の code_verifier、PKCE を使わない場合は空文字
+ * @returns {*OAuth2Token} アクセストークン
+ * @returns {error} エラー
+ */
+func (this *OAuth2) requestAccessToken(code string, verifier string) (*OAuth2Token, error) {
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+	params.Set("redirect_uri", this.provider.redirectUri())
+	params.Set("client_id", this.clientId)
+	params.Set("client_secret", this.clientSecret)
+	if verifier != "" {
+		params.Set("code_verifier", verifier)
+	}
+
+	request, err := http.NewRequest("POST", this.provider.TokenUrl, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	body, err := this.send(request)
+	if err != nil {
+		return nil, err
+	}
+	return parseOAuth2Token(body)
+}
+
+/**
+ * アクセストークンの応答を解析する
+ * JSON 形式とフォーム形式の両方に対応する
+ * @function
+ * @param {[]byte} body 応答の本文
+ * @returns {*OAuth2Token} アクセストークン
+ * @returns {error} 応答がエラーまたは解析できなければエラー
+ */
+func parseOAuth2Token(body []byte) (*OAuth2Token, error) {
+	token := new(OAuth2Token)
+	errorCode := ""
+	errorDescription := ""
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		data := make(map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		decoder.UseNumber()
+		err := decoder.Decode(&data)
+		if err != nil {
+			return nil, err
+		}
+		token.AccessToken = jsonString(data["access_token"])
+		token.TokenType = jsonString(data["token_type"])
+		token.Scope = jsonString(data["scope"])
+		fmt.Sscan(jsonString(data["expires_in"]), &token.ExpiresIn)
+		errorCode = jsonString(data["error"])
+		errorDescription = jsonString(data["error_description"])
+		// Facebook は error をオブジェクトで返す
+		if object, ok := data["error"].(map[string]interface{}); ok {
+			errorCode = jsonString(object["type"])
+			errorDescription = jsonString(object["message"])
+		}
+	} else {
+		values, err := url.ParseQuery(string(trimmed))
+		if err != nil {
+			return nil, err
+		}
+		token.AccessToken = values.Get("access_token")
+		token.TokenType = values.Get("token_type")
+		token.Scope = values.Get("scope")
+		fmt.Sscan(values.Get("expires_in"), &token.ExpiresIn)
+		if token.ExpiresIn == 0 {
+			fmt.Sscan(values.Get("expires"), &token.ExpiresIn)
+		}
+		errorCode = values.Get("error")
+		errorDescription = values.Get("error_description")
+	}
+
+	if errorCode != "" {
+		return nil, fmt.Errorf("アクセストークンの取得に失敗しました: %s %s", errorCode, errorDescription)
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("アクセストークンが含まれていません")
+	}
+	return token, nil
+}
+
+/**
+ * JSON の値を文字列にする
+ * 数値のIDなども文字列として扱えるようにする
+ * @function
+ * @param {interface{}} value JSON を解析した値
+ * @returns {string} 文字列、値が無ければ空文字
+ */
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+/**
+ * アクセストークンを使ってユーザ情報を取得する
+ * サービスプロバイダのフィールド名に従って共通の形式に変換する
+ * @method
+ * @memberof OAuth2
+ * @param {*OAuth2Token} token アクセストークン
+ * @returns {map[string]string} ユーザ情報 { oauth_id, name, mail }
+ * @returns {error} エラー
+ */
+func (this *OAuth2) requestUserInfo(token *OAuth2Token) (map[string]string, error) {
+	response, err := this.requestAPI("GET", this.provider.UserInfoUrl, token)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(response))
+	decoder.UseNumber()
+	err = decoder.Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, 3)
+	result["oauth_id"] = jsonString(data[this.provider.IdField])
+	result["name"] = jsonString(data[this.provider.NameField])
+	result["mail"] = jsonString(data[this.provider.MailField])
+	if result["oauth_id"] == "" {
+		return nil, errors.New("ユーザ情報にIDが含まれていません")
+	}
+	return result, nil
 }
 
 /**
  * アクセストークンを使ってAPIを呼び出す
  * @method
+ * @memberof OAuth2
+ * @param {string} method HTTPメソッド
+ * @param {string} targetUri 呼び出すAPIのURL
+ * @param {*OAuth2Token} token アクセストークン
+ * @returns {[]byte} 応答の本文
+ * @returns {error} エラー
  */
-func (this *OAuth2) requestAPI(w http.ResponseWriter, targetUri string, accessToken string) []byte {
-	params := make(map[string]string, 1)
-	params["access_token"] = accessToken
-	response := request(this.context, "GET", targetUri, params, "")
-	
-	result := make([]byte, 1024)
-	i, err := response.Body.Read(result)
-	check(this.context, err)
-	result = result[0:i]
-	return result
-}
\ No newline at end of file
+func (this *OAuth2) requestAPI(method string, targetUri string, token *OAuth2Token) ([]byte, error) {
+	request, err := http.NewRequest(method, targetUri, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	request.Header.Set("Accept", "application/json")
+	return this.send(request)
+}
+
+/**
+ * リクエストを送信して応答の本文をすべて読み込む
+ * @method
+ * @memberof OAuth2
+ * @param {*http.Request} request 送信するリクエスト
+ * @returns {[]byte} 応答の本文
+ * @returns {error} 通信エラーまたは 2xx 以外の応答ならエラー
+ */
+func (this *OAuth2) send(request *http.Request) ([]byte, error) {
+	client := urlfetch.Client(this.context)
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	// トークンの応答はエラーでも本文を解析するため 400 は呼び出し元に返す
+	if response.StatusCode >= 300 && response.StatusCode != 400 {
+		return nil, fmt.Errorf("%s から %d が返されました", request.URL.Host, response.StatusCode)
+	}
+	return body, nil
+}
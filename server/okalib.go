@@ -14,6 +14,7 @@ import (
 	"log"
 	"io"
 	"math/rand"
+	crand "crypto/rand"
 	"encoding/binary"
 	"encoding/base64"
 	"crypto/sha1"
@@ -274,6 +275,22 @@ func getRandomizedString() string {
 	return e
 }
 
+/**
+ * 暗号論的に安全なランダム文字列を取得する
+ * トークンなど推測されてはいけない値に使う
+ * @function
+ * @param {int} size ランダムデータのバイト数
+ * @returns {string} URLセーフな Base64 でエンコードしたランダムな文字列
+ */
+func getSecureRandomString(size int) string {
+	b := make([]byte, size)
+	_, err := crand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 /**
  * SHA-1で暗号化した文字列を返す
  * @function
@@ -0,0 +1,588 @@
+/**
+ * QRコードの作成
+ * 二段階認証の登録用 URI を読み取らせるために使う
+ * バイトモード、誤り訂正レベル M、型番 1〜10 のみ対応する
+ * @file
+ */
+package escape3ds
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+/**
+ * 誤り訂正レベル M の型番ごとのブロック構成
+ * @struct
+ * @property {int} ecc ブロックごとの誤り訂正コード語数
+ * @property {[]int} blocks ブロックごとのデータコード語数
+ * @property {[]int} align 位置合わせパターンの中心座標
+ */
+type qrVersionInfo struct {
+	ecc int
+	blocks []int
+	align []int
+}
+
+/**
+ * 型番 1〜10 のブロック構成
+ * 添字が型番 - 1 に対応する
+ * @const
+ */
+var qrVersions = []qrVersionInfo{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+/**
+ * QRコード
+ * @class
+ * @property {int} version 型番
+ * @property {int} size 一辺のモジュール数
+ * @property {[][]bool} modules 暗モジュールならtrue
+ * @property {[][]bool} function 機能パターンのモジュールならtrue
+ */
+type QRCode struct {
+	version int
+	size int
+	modules [][]bool
+	function [][]bool
+}
+
+/**
+ * 文字列を表すQRコードを作成する
+ * 収まる最小の型番を使い、失点が最も少ないマスクを選ぶ
+ * @function
+ * @param {string} text 符号化する文字列
+ * @returns {*QRCode} QRコード
+ * @returns {error} 型番 10 に収まらなければエラー
+ */
+func NewQRCode(text string) (*QRCode, error) {
+	for version := 1; version <= len(qrVersions); version++ {
+		if len(text) <= qrCapacity(version) {
+			best := (*QRCode)(nil)
+			bestPenalty := 0
+			for mask := 0; mask < 8; mask++ {
+				code := newQRCodeWithMask(text, version, mask)
+				penalty := code.penalty()
+				if best == nil || penalty < bestPenalty {
+					best = code
+					bestPenalty = penalty
+				}
+			}
+			return best, nil
+		}
+	}
+	return nil, errors.New("QRコードに収まらない長さです")
+}
+
+/**
+ * 型番に収まるバイト数を返す
+ * @function
+ * @param {int} version 型番
+ * @returns {int} バイト数
+ */
+func qrCapacity(version int) int {
+	dataBytes := 0
+	for _, n := range qrVersions[version-1].blocks {
+		dataBytes += n
+	}
+	return (dataBytes * 8 - 4 - qrCountBits(version)) / 8
+}
+
+/**
+ * バイトモードの文字数指示子のビット数を返す
+ * @function
+ * @param {int} version 型番
+ * @returns {int} ビット数
+ */
+func qrCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+/**
+ * 型番とマスクを指定してQRコードを作成する
+ * @function
+ * @param {string} text 符号化する文字列
+ * @param {int} version 型番
+ * @param {int} mask マスクパターン参照子 0〜7
+ * @returns {*QRCode} QRコード
+ */
+func newQRCodeWithMask(text string, version int, mask int) *QRCode {
+	code := new(QRCode)
+	code.version = version
+	code.size = version * 4 + 17
+	code.modules = make([][]bool, code.size)
+	code.function = make([][]bool, code.size)
+	for i := range code.modules {
+		code.modules[i] = make([]bool, code.size)
+		code.function[i] = make([]bool, code.size)
+	}
+
+	code.drawFunctionPatterns()
+	code.drawCodewords(qrCodewords(text, version))
+	code.applyMask(mask)
+	code.drawFormatBits(mask)
+	return code
+}
+
+/**
+ * モジュールを設定して機能パターンとして記録する
+ * @method
+ * @memberof QRCode
+ * @param {int} x 列
+ * @param {int} y 行
+ * @param {bool} dark 暗モジュールならtrue
+ */
+func (this *QRCode) setFunction(x int, y int, dark bool) {
+	this.modules[y][x] = dark
+	this.function[y][x] = true
+}
+
+/**
+ * 機能パターンを描画する
+ * 形式情報の領域はマスク決定後に描画するので、ここでは予約だけする
+ * @method
+ * @memberof QRCode
+ */
+func (this *QRCode) drawFunctionPatterns() {
+	// タイミングパターン
+	for i := 0; i < this.size; i++ {
+		this.setFunction(6, i, i % 2 == 0)
+		this.setFunction(i, 6, i % 2 == 0)
+	}
+
+	// 位置検出パターンと分離パターン
+	corners := [][2]int{{3, 3}, {this.size - 4, 3}, {3, this.size - 4}}
+	for _, corner := range corners {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x := corner[0] + dx
+				y := corner[1] + dy
+				if x < 0 || x >= this.size || y < 0 || y >= this.size {
+					continue
+				}
+				distance := qrMax(qrAbs(dx), qrAbs(dy))
+				this.setFunction(x, y, distance != 2 && distance != 4)
+			}
+		}
+	}
+
+	// 位置合わせパターン
+	align := qrVersions[this.version-1].align
+	for i, ax := range align {
+		for j, ay := range align {
+			// 位置検出パターンと重なるものは描かない
+			if (i == 0 && j == 0) || (i == 0 && j == len(align)-1) || (i == len(align)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					this.setFunction(ax + dx, ay + dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// 形式情報の予約
+	this.drawFormatBits(0)
+
+	// 型番情報
+	if this.version >= 7 {
+		rem := this.version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := this.version << 12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits >> uint(i)) & 1 != 0
+			a := this.size - 11 + i % 3
+			b := i / 3
+			this.setFunction(a, b, dark)
+			this.setFunction(b, a, dark)
+		}
+	}
+}
+
+/**
+ * 形式情報を描画する
+ * 誤り訂正レベル M の指示子は 00
+ * @method
+ * @memberof QRCode
+ * @param {int} mask マスクパターン参照子
+ */
+func (this *QRCode) drawFormatBits(mask int) {
+	data := 0 << 3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data << 10 | rem) ^ 0x5412
+	bit := func(i int) bool {
+		return (bits >> uint(i)) & 1 != 0
+	}
+
+	// 左上
+	for i := 0; i <= 5; i++ {
+		this.setFunction(8, i, bit(i))
+	}
+	this.setFunction(8, 7, bit(6))
+	this.setFunction(8, 8, bit(7))
+	this.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		this.setFunction(14 - i, 8, bit(i))
+	}
+
+	// 右上と左下
+	for i := 0; i < 8; i++ {
+		this.setFunction(this.size - 1 - i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		this.setFunction(8, this.size - 15 + i, bit(i))
+	}
+	this.setFunction(8, this.size - 8, true)
+}
+
+/**
+ * データと誤り訂正のコード語を作成する
+ * ブロックごとに誤り訂正コード語を計算してから交互に並べる
+ * @function
+ * @param {string} text 符号化する文字列
+ * @param {int} version 型番
+ * @returns {[]byte} 配置する順に並んだコード語
+ */
+func qrCodewords(text string, version int) []byte {
+	info := qrVersions[version-1]
+	dataBytes := 0
+	for _, n := range info.blocks {
+		dataBytes += n
+	}
+
+	// モード指示子、文字数指示子、データ、終端パターン
+	bits := make([]bool, 0, dataBytes * 8)
+	appendBits := func(value int, length int) {
+		for i := length - 1; i >= 0; i-- {
+			bits = append(bits, (value >> uint(i)) & 1 != 0)
+		}
+	}
+	appendBits(0x4, 4)
+	appendBits(len(text), qrCountBits(version))
+	for i := 0; i < len(text); i++ {
+		appendBits(int(text[i]), 8)
+	}
+	appendBits(0, qrMin(4, dataBytes * 8 - len(bits)))
+	for len(bits) % 8 != 0 {
+		bits = append(bits, false)
+	}
+
+	data := make([]byte, 0, dataBytes)
+	for i := 0; i < len(bits); i += 8 {
+		b := byte(0)
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << uint(7 - j)
+			}
+		}
+		data = append(data, b)
+	}
+	// 埋め草コード語
+	for pad := byte(0xEC); len(data) < dataBytes; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+
+	// ブロックに分けて誤り訂正コード語を計算する
+	divisor := qrReedSolomonDivisor(info.ecc)
+	dataBlocks := make([][]byte, len(info.blocks))
+	eccBlocks := make([][]byte, len(info.blocks))
+	offset := 0
+	for i, n := range info.blocks {
+		dataBlocks[i] = data[offset : offset + n]
+		eccBlocks[i] = qrReedSolomonRemainder(dataBlocks[i], divisor)
+		offset += n
+	}
+
+	result := make([]byte, 0, dataBytes + info.ecc * len(info.blocks))
+	longest := info.blocks[len(info.blocks)-1]
+	for i := 0; i < longest; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < info.ecc; i++ {
+		for _, block := range eccBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+/**
+ * GF(256) 上の乗算
+ * 原始多項式は x^8 + x^4 + x^3 + x^2 + 1
+ * @function
+ * @param {byte} x
+ * @param {byte} y
+ * @returns {byte} x * y
+ */
+func qrMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		if (y >> uint(i)) & 1 != 0 {
+			z ^= int(x)
+		}
+	}
+	return byte(z)
+}
+
+/**
+ * リード・ソロモン符号の生成多項式を返す
+ * 最高次の係数 1 は省略する
+ * @function
+ * @param {int} degree 次数
+ * @returns {[]byte} 係数
+ */
+func qrReedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			result[j] = qrMultiply(result[j], root)
+			if j + 1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+/**
+ * データを生成多項式で割った余り (誤り訂正コード語) を返す
+ * @function
+ * @param {[]byte} data データコード語
+ * @param {[]byte} divisor 生成多項式
+ * @returns {[]byte} 誤り訂正コード語
+ */
+func qrReedSolomonRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= qrMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+/**
+ * コード語を右下から2列ずつジグザグに配置する
+ * @method
+ * @memberof QRCode
+ * @param {[]byte} codewords 配置するコード語
+ */
+func (this *QRCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := this.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < this.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right + 1) & 2 == 0 {
+					y = this.size - 1 - vert
+				}
+				if !this.function[y][x] && i < len(codewords) * 8 {
+					this.modules[y][x] = (codewords[i >> 3] >> uint(7 - (i & 7))) & 1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+/**
+ * 機能パターン以外のモジュールにマスクをかける
+ * @method
+ * @memberof QRCode
+ * @param {int} mask マスクパターン参照子
+ */
+func (this *QRCode) applyMask(mask int) {
+	for y := 0; y < this.size; y++ {
+		for x := 0; x < this.size; x++ {
+			if this.function[y][x] {
+				continue
+			}
+			invert := false
+			switch mask {
+			case 0:
+				invert = (x + y) % 2 == 0
+			case 1:
+				invert = y % 2 == 0
+			case 2:
+				invert = x % 3 == 0
+			case 3:
+				invert = (x + y) % 3 == 0
+			case 4:
+				invert = (x / 3 + y / 2) % 2 == 0
+			case 5:
+				invert = x * y % 2 + x * y % 3 == 0
+			case 6:
+				invert = (x * y % 2 + x * y % 3) % 2 == 0
+			case 7:
+				invert = ((x + y) % 2 + x * y % 3) % 2 == 0
+			}
+			if invert {
+				this.modules[y][x] = !this.modules[y][x]
+			}
+		}
+	}
+}
+
+/**
+ * マスク評価の失点を計算する
+ * 同色の連続、2x2 のブロック、位置検出パターンに似た並び、暗モジュールの割合を評価する
+ * @method
+ * @memberof QRCode
+ * @returns {int} 失点
+ */
+func (this *QRCode) penalty() int {
+	result := 0
+	get := func(x int, y int, horizontal bool) bool {
+		if horizontal {
+			return this.modules[y][x]
+		}
+		return this.modules[x][y]
+	}
+	finder := []bool{true, false, true, true, true, false, true, false, false, false, false}
+
+	for _, horizontal := range []bool{true, false} {
+		for y := 0; y < this.size; y++ {
+			run := 1
+			for x := 1; x < this.size; x++ {
+				if get(x, y, horizontal) == get(x-1, y, horizontal) {
+					run++
+					if run == 5 {
+						result += 3
+					} else if run > 5 {
+						result++
+					}
+				} else {
+					run = 1
+				}
+			}
+			for x := 0; x + len(finder) <= this.size; x++ {
+				forward := true
+				backward := true
+				for k := range finder {
+					if get(x + k, y, horizontal) != finder[k] {
+						forward = false
+					}
+					if get(x + k, y, horizontal) != finder[len(finder)-1-k] {
+						backward = false
+					}
+				}
+				if forward {
+					result += 40
+				}
+				if backward {
+					result += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < this.size; y++ {
+		for x := 0; x < this.size; x++ {
+			if this.modules[y][x] {
+				dark++
+			}
+			if x + 1 < this.size && y + 1 < this.size {
+				c := this.modules[y][x]
+				if c == this.modules[y][x+1] && c == this.modules[y+1][x] && c == this.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+	total := this.size * this.size
+	k := qrAbs(dark * 20 - total * 10) / total
+	result += k * 10
+	return result
+}
+
+/**
+ * PNG 画像にする
+ * 周囲に4モジュールのクワイエットゾーンを付ける
+ * @method
+ * @memberof QRCode
+ * @param {int} scale 1モジュールあたりのピクセル数
+ * @returns {[]byte} PNG 画像
+ * @returns {error} エラー
+ */
+func (this *QRCode) PNG(scale int) ([]byte, error) {
+	quiet := 4
+	width := (this.size + quiet * 2) * scale
+	img := image.NewGray(image.Rect(0, 0, width, width))
+	for py := 0; py < width; py++ {
+		for px := 0; px < width; px++ {
+			x := px / scale - quiet
+			y := py / scale - quiet
+			c := color.Gray{255}
+			if x >= 0 && x < this.size && y >= 0 && y < this.size && this.modules[y][x] {
+				c = color.Gray{0}
+			}
+			img.SetGray(px, py, c)
+		}
+	}
+
+	buffer := new(bytes.Buffer)
+	err := png.Encode(buffer, img)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func qrMax(x int, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+func qrMin(x int, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,446 @@
+/**
+ * URL の振り分け
+ * メソッドと URL パターンの組で処理を登録する
+ * パターンの {name} の部分は任意の1階層に一致し、pathParam() で取り出せる
+ * パスが一致してメソッドが一致しなければ 405 を、パスが一致しなければ 404 を返す
+ * @file
+ */
+package escape3ds
+
+import (
+	"appengine"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+ * ミドルウェア
+ * 処理を受け取り、前後に処理を加えた処理を返す
+ * @type
+ */
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+/**
+ * ミドルウェアを順に適用する
+ * 先に指定したものほど外側 (先に実行される) になる
+ * @function
+ * @param {http.HandlerFunc} handler 処理
+ * @param {[]Middleware} middlewares ミドルウェア
+ * @returns {http.HandlerFunc} ミドルウェアを適用した処理
+ */
+func chain(handler http.HandlerFunc, middlewares []Middleware) http.HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+/**
+ * 登録された処理
+ * @struct
+ * @property {string} method HTTP メソッド、空文字ならすべてのメソッド
+ * @property {[]string} segments パターンを / で区切ったもの
+ * @property {http.HandlerFunc} handler ミドルウェアを適用済みの処理
+ */
+type route struct {
+	method string
+	segments []string
+	handler http.HandlerFunc
+}
+
+/**
+ * パスが一致するか調べる
+ * @method
+ * @memberof route
+ * @param {[]string} segments リクエストのパスを / で区切ったもの
+ * @returns {map[string]string} 一致すればパスパラメータ、一致しなければ nil
+ */
+func (this *route) match(segments []string) map[string]string {
+	if len(segments) != len(this.segments) {
+		return nil
+	}
+	params := make(map[string]string)
+	for i, segment := range this.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if segments[i] == "" {
+				return nil
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+		} else if segment != segments[i] {
+			return nil
+		}
+	}
+	return params
+}
+
+/**
+ * パスを / で区切る
+ * 先頭と末尾の / は無視する
+ * @function
+ * @param {string} path パス
+ * @returns {[]string} 区切ったパス、"/" なら空のスライス
+ */
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+/**
+ * ルータ
+ * Group() で作成したルータは登録先を共有し、接頭辞とミドルウェアを引き継ぐ
+ * @class
+ * @property {*routeTable} table 登録先
+ * @property {string} prefix URL の接頭辞
+ * @property {[]Middleware} middlewares このルータに登録する処理に適用するミドルウェア
+ * @property {bool} group Group() で作成したルータならtrue
+ */
+type Router struct {
+	table *routeTable
+	prefix string
+	middlewares []Middleware
+	group bool
+}
+
+/**
+ * 処理の登録先
+ * @struct
+ * @property {[]*route} routes 登録された処理
+ * @property {[]Middleware} middlewares 見つからなかった場合も含めてすべてのリクエストに適用するミドルウェア
+ * @property {http.HandlerFunc} notFound パスが一致しなかった場合の処理
+ */
+type routeTable struct {
+	routes []*route
+	middlewares []Middleware
+	notFound http.HandlerFunc
+}
+
+/**
+ * ルータのインスタンスを作成する
+ * @function
+ * @returns {*Router} ルータ
+ */
+func NewRouter() *Router {
+	router := new(Router)
+	router.table = new(routeTable)
+	router.table.notFound = notFound
+	return router
+}
+
+/**
+ * ミドルウェアを追加する
+ * 最上位のルータに追加したものは 404 や 405 も含めたすべてのリクエストに、
+ * グループに追加したものはその後に登録する処理に適用する
+ * @method
+ * @memberof Router
+ * @param {...Middleware} middlewares ミドルウェア
+ */
+func (this *Router) Use(middlewares ...Middleware) {
+	if !this.group {
+		this.table.middlewares = append(this.table.middlewares, middlewares...)
+		return
+	}
+	this.middlewares = append(this.middlewares, middlewares...)
+}
+
+/**
+ * 接頭辞とミドルウェアを共有するグループを作成する
+ * @method
+ * @memberof Router
+ * @param {string} prefix URL の接頭辞
+ * @param {...Middleware} middlewares グループ内の処理に適用するミドルウェア
+ * @returns {*Router} グループ
+ */
+func (this *Router) Group(prefix string, middlewares ...Middleware) *Router {
+	group := new(Router)
+	group.table = this.table
+	group.prefix = this.prefix + prefix
+	group.middlewares = make([]Middleware, 0, len(this.middlewares) + len(middlewares))
+	group.middlewares = append(group.middlewares, this.middlewares...)
+	group.middlewares = append(group.middlewares, middlewares...)
+	group.group = true
+	return group
+}
+
+/**
+ * パスが一致しなかった場合の処理を設定する
+ * @method
+ * @memberof Router
+ * @param {http.HandlerFunc} handler 処理
+ */
+func (this *Router) NotFound(handler http.HandlerFunc) {
+	this.table.notFound = handler
+}
+
+/**
+ * 処理を登録する
+ * @method
+ * @memberof Router
+ * @param {string} method HTTP メソッド、空文字ならすべてのメソッド
+ * @param {string} pattern URL パターン
+ * @param {http.HandlerFunc} handler 処理
+ * @param {...Middleware} middlewares この処理だけに適用するミドルウェア
+ */
+func (this *Router) Handle(method string, pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	handler = chain(handler, middlewares)
+	handler = chain(handler, this.middlewares)
+	this.table.routes = append(this.table.routes, &route{method, splitPath(this.prefix + pattern), handler})
+}
+
+/**
+ * GET の処理を登録する
+ * HEAD も同じ処理で受け付ける
+ * @method
+ * @memberof Router
+ */
+func (this *Router) GET(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	this.Handle("GET", pattern, handler, middlewares...)
+}
+
+/**
+ * POST の処理を登録する
+ * @method
+ * @memberof Router
+ */
+func (this *Router) POST(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	this.Handle("POST", pattern, handler, middlewares...)
+}
+
+/**
+ * PUT の処理を登録する
+ * @method
+ * @memberof Router
+ */
+func (this *Router) PUT(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	this.Handle("PUT", pattern, handler, middlewares...)
+}
+
+/**
+ * PATCH の処理を登録する
+ * @method
+ * @memberof Router
+ */
+func (this *Router) PATCH(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	this.Handle("PATCH", pattern, handler, middlewares...)
+}
+
+/**
+ * DELETE の処理を登録する
+ * @method
+ * @memberof Router
+ */
+func (this *Router) DELETE(pattern string, handler http.HandlerFunc, middlewares ...Middleware) {
+	this.Handle("DELETE", pattern, handler, middlewares...)
+}
+
+/**
+ * リクエストを振り分ける
+ * 登録された順に調べて最初に一致した処理を呼び出す
+ * @method
+ * @memberof Router
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func (this *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+	allowed := make([]string, 0)
+	for _, route := range this.table.routes {
+		params := route.match(segments)
+		if params == nil {
+			continue
+		}
+		if route.method == "" || route.method == r.Method || (route.method == "GET" && r.Method == "HEAD") {
+			chain(route.handler, append([]Middleware{withContext(params)}, this.table.middlewares...))(w, r)
+			return
+		}
+		if !exist(allowed, route.method) {
+			allowed = append(allowed, route.method)
+		}
+	}
+
+	handler := this.table.notFound
+	if len(allowed) > 0 {
+		if exist(allowed, "GET") {
+			allowed = append(allowed, "HEAD")
+		}
+		sort.Strings(allowed)
+		handler = methodNotAllowed(allowed)
+	}
+	chain(handler, append([]Middleware{withContext(map[string]string{})}, this.table.middlewares...))(w, r)
+}
+
+/**
+ * パスが一致しなかった場合の既定の処理
+ * API なら API のエラーを、Ajax なら JSON を、それ以外ならメッセージページを返す
+ * @function
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ */
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if isAPI(r) {
+		apiError(w, http.StatusNotFound, "not_found", "リソースが見つかりません")
+		return
+	}
+	if isAjax(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"result":false, "error":"not_found", "message":"ページが見つかりません"}`)
+		return
+	}
+	c := appengine.NewContext(r)
+	view := NewView(c, w, r)
+	w.WriteHeader(http.StatusNotFound)
+	view.message("ページが見つかりません", "指定されたページは存在しません")
+}
+
+/**
+ * メソッドが一致しなかった場合の処理を返す
+ * @function
+ * @param {[]string} allowed 許可するメソッド
+ * @returns {http.HandlerFunc} Allow ヘッダを付けて 405 を返す処理
+ */
+func methodNotAllowed(allowed []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isAPI(r) {
+			apiMethodNotAllowed(w, allowed...)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, `{"result":false, "error":"method_not_allowed", "message":"%s で送信してください"}`, strings.Join(allowed, "、"))
+	}
+}
+
+/**
+ * リクエストごとの情報
+ * ミドルウェアで取得した値を処理へ渡すために使う
+ * @class
+ * @property {appengine.Context} c コンテキスト
+ * @property {map[string]string} Params パスパラメータ
+ * @property {string} UserKey 認証したユーザのエンコード済みキー
+ * @property {*User} User 認証したユーザ
+ * @property {*APIToken} APIToken 認証に使われた API トークン
+ * @property {string} GameKey ownGame() などで確認したゲームのエンコード済みキー
+ * @property {*Game} Game ownGame() などで確認したゲーム
+ * @property {string} GameRole 確認したゲームに対するユーザの権限
+ */
+type RequestContext struct {
+	c appengine.Context
+	Params map[string]string
+	UserKey string
+	User *User
+	APIToken *APIToken
+	GameKey string
+	Game *Game
+	GameRole string
+	sessionLoaded bool
+	sessionUserKey string
+	sessionUser *User
+	apiLoaded bool
+	apiUserKey string
+	apiUser *User
+	apiToken *APIToken
+}
+
+/**
+ * 処理中のリクエストの情報
+ * 古い App Engine ではリクエストに値を持たせられないので、リクエストをキーにして保持する
+ * @var
+ */
+var requestContexts = struct {
+	sync.Mutex
+	m map[*http.Request]*RequestContext
+}{m: make(map[*http.Request]*RequestContext)}
+
+/**
+ * リクエストの情報を返す
+ * ルータを経由しない呼び出しでは、その場で作成した保持されない情報を返す
+ * @function
+ * @param {*http.Request} r リクエスト
+ * @returns {*RequestContext} リクエストの情報
+ */
+func requestContext(r *http.Request) *RequestContext {
+	requestContexts.Lock()
+	ctx := requestContexts.m[r]
+	requestContexts.Unlock()
+	if ctx == nil {
+		ctx = &RequestContext{c: appengine.NewContext(r), Params: map[string]string{}}
+	}
+	return ctx
+}
+
+/**
+ * リクエストの情報を用意するミドルウェア
+ * 処理が終わったら破棄する
+ * @function
+ * @param {map[string]string} params パスパラメータ
+ * @returns {Middleware} ミドルウェア
+ */
+func withContext(params map[string]string) Middleware {
+	return func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := &RequestContext{c: appengine.NewContext(r), Params: params}
+			requestContexts.Lock()
+			requestContexts.m[r] = ctx
+			requestContexts.Unlock()
+			defer func() {
+				requestContexts.Lock()
+				delete(requestContexts.m, r)
+				requestContexts.Unlock()
+			}()
+			handler(w, r)
+		}
+	}
+}
+
+/**
+ * パスパラメータを返す
+ * @function
+ * @param {*http.Request} r リクエスト
+ * @param {string} name パターンの {} 内の名前
+ * @returns {string} 値、無ければ空文字
+ */
+func pathParam(r *http.Request, name string) string {
+	return requestContext(r).Params[name]
+}
+
+/**
+ * セッションのユーザを返す
+ * 同じリクエストでは一度だけ取得する
+ * @method
+ * @memberof RequestContext
+ * @param {*http.Request} r リクエスト
+ * @returns {string} エンコード済みのユーザキー
+ * @returns {*User} ユーザ、ログインしていなければ nil
+ */
+func (this *RequestContext) getSessionUser(r *http.Request) (string, *User) {
+	if !this.sessionLoaded {
+		this.sessionUserKey, this.sessionUser = getSessionUser(this.c, r)
+		this.sessionLoaded = true
+	}
+	return this.sessionUserKey, this.sessionUser
+}
+
+/**
+ * API を呼び出したユーザを返す
+ * 同じリクエストでは一度だけ取得する
+ * @method
+ * @memberof RequestContext
+ * @param {*http.Request} r リクエスト
+ * @returns {string} エンコード済みのユーザキー
+ * @returns {*User} ユーザ、認証できなければ nil
+ * @returns {*APIToken} 使われたトークン、セッションで認証した場合は nil
+ */
+func (this *RequestContext) getAPIUser(r *http.Request) (string, *User, *APIToken) {
+	if !this.apiLoaded {
+		this.apiUserKey, this.apiUser, this.apiToken = apiUser(this.c, r)
+		this.apiLoaded = true
+	}
+	return this.apiUserKey, this.apiUser, this.apiToken
+}
@@ -0,0 +1,362 @@
+/**
+ * 処理ごとの入力値のスキーマ
+ * 規則は validate.go にある
+ * HTML のフォームからは formSchemas の名前で参照する
+ * @file
+ */
+package escape3ds
+
+import (
+	"math"
+)
+
+/**
+ * パスワードの最小の文字数
+ * @const
+ */
+const passwordMinLength = 8
+
+/**
+ * パスワードの最大の文字数
+ * @const
+ */
+const passwordMaxLength = 100
+
+/**
+ * ゲームの名前の最大の文字数
+ * @const
+ */
+const gameNameMaxLength = 50
+
+/**
+ * ゲームの説明の最大の文字数
+ * @const
+ */
+const gameDescriptionMaxLength = 500
+
+/**
+ * ゲームの設定の最大のバイト数 (JSON)
+ * @const
+ */
+const gameSettingsMaxLength = 10000
+
+/**
+ * 共同編集で配信する変更の内容の最大のバイト数 (JSON)
+ * @const
+ */
+const liveChangeMaxLength = 100000
+
+/**
+ * ログイン
+ * @var
+ */
+var loginSchema = Schema{
+	field("mail", "メールアドレス", required(), length(0, 254)),
+	field("pass", "パスワード", required(), length(0, passwordMaxLength)),
+}
+
+/**
+ * 仮登録
+ * @var
+ */
+var interimRegistrationSchema = Schema{
+	field("name", "ユーザ名", required(), length(0, 30)),
+	field("mail", "メールアドレス", required(), email()),
+	field("password", "パスワード", required(), length(passwordMinLength, passwordMaxLength)),
+}
+
+/**
+ * ゲームの追加 (ゲーム一覧画面)
+ * @var
+ */
+var addGameSchema = Schema{
+	field("game_name", "ゲームの名前", required(), length(0, gameNameMaxLength)),
+	field("game_description", "ゲームの説明", required(), length(0, gameDescriptionMaxLength)),
+}
+
+/**
+ * ゲームの作成と更新 (API とエディタ)
+ * サムネイルは外部のサーバを参照しないようにサイト内のパスに限る
+ * 最初のシーンはエンコード済みのシーンキー
+ * @var
+ */
+var gameSchema = Schema{
+	field("name", "ゲームの名前", required(), length(0, gameNameMaxLength)),
+	field("description", "ゲームの説明", required(), length(0, gameDescriptionMaxLength)),
+	field("thumbnail", "サムネイル", length(0, 500), pattern("/(?:[A-Za-z0-9_.~?=&%-][A-Za-z0-9_.~/?=&%-]*)?", "%sにはサイト内の画像のパスを指定してください")),
+	field("first_scene", "最初のシーン", length(0, 500), pattern("[A-Za-z0-9_-]+", "%sの形式が正しくありません")),
+	field("settings", "ゲームの設定", custom(validateGameSettings)),
+	field("published", "公開状態", enum("true", "false")),
+	field("tags", "タグ", custom(validateTags)),
+	field("difficulty", "難易度", categoryIdRules...),
+	field("length", "長さ", categoryIdRules...),
+	field("theme", "テーマ", categoryIdRules...),
+}
+
+/**
+ * ゲームのカテゴリの ID
+ * 存在するカテゴリかどうかは Model.updateGame() で確かめる
+ * @var
+ */
+var categoryIdRules = []Rule{length(0, 30), pattern("[a-z0-9_-]+", "%sの形式が正しくありません")}
+
+/**
+ * ゲームの内容の保存
+ * 保存するたびにリビジョンを作成する
+ * @var
+ */
+var saveGameSchema = Schema{
+	field("content", "ゲームの内容", required(), custom(validateGameContent)),
+	field("message", "変更の説明", length(0, revisionMessageMaxLength)),
+}
+
+/**
+ * 下書きの自動保存
+ * @var
+ */
+var draftSchema = Schema{
+	field("content", "ゲームの内容", required(), custom(validateGameContent)),
+	field("base_revision", "編集を始めたリビジョン", number(0, math.MaxInt32)),
+}
+
+/**
+ * シーンのロック
+ * @var
+ */
+var sceneLockSchema = Schema{
+	field("scene", "シーン", required(), length(0, 100), pattern("[A-Za-z0-9_-]+", "%sの形式が正しくありません")),
+}
+
+/**
+ * リビジョン一覧のページング
+ * @var
+ */
+var revisionListSchema = Schema{
+	field("cursor", "カーソル", length(0, 1000)),
+	field("limit", "件数", number(1, 100)),
+}
+
+/**
+ * リビジョンの比較
+ * @var
+ */
+var revisionDiffSchema = Schema{
+	field("from", "比較元のリビジョン", required(), number(1, math.MaxInt32)),
+	field("to", "比較先のリビジョン", required(), number(1, math.MaxInt32)),
+}
+
+/**
+ * ゲームへの招待
+ * 招待する相手は @ を含めばメールアドレス、それ以外はハンドルとみなす
+ * @var
+ */
+var invitationSchema = Schema{
+	field("target", "ハンドルまたはメールアドレス", required(), length(0, 254)),
+	field("role", "権限", required(), enum(collaboratorRoles...)),
+}
+
+/**
+ * 共同編集での変更の配信
+ * 削除以外では変更後の内容を JSON で送る
+ * @var
+ */
+var liveChangeSchema = Schema{
+	field("target", "変更したもの", required(), enum("scene", "event", "item")),
+	field("op", "操作", required(), enum("add", "update", "remove")),
+	field("id", "ID", required(), length(0, 100), pattern("[A-Za-z0-9_-]+", "%sの形式が正しくありません")),
+	field("scene", "シーン", length(0, 100), pattern("[A-Za-z0-9_-]+", "%sの形式が正しくありません")),
+	field("data", "内容", custom(validateLiveChangeData)),
+	field("client_id", "エディタのID", length(0, 64), pattern("[A-Za-z0-9_-]+", "%sの形式が正しくありません")),
+}
+
+/**
+ * 共同編集での在席状況の更新
+ * @var
+ */
+var livePresenceSchema = Schema{
+	field("scene", "シーン", length(0, 100), pattern("[A-Za-z0-9_-]+", "%sの形式が正しくありません")),
+	field("leave", "退席", enum("true", "false")),
+}
+
+/**
+ * ゲーム一覧の並び順、絞り込み、ページング
+ * @var
+ */
+var gameListSchema = Schema{
+	field("sort", "並び順", enum("updated", "created", "name")),
+	field("q", "検索する文字列", length(0, 100)),
+	field("cursor", "カーソル", length(0, 1000)),
+	field("limit", "件数", number(1, 100)),
+}
+
+/**
+ * ゲームの検索
+ * cursor は検索結果の何件目から返すかを表す
+ * @var
+ */
+var searchSchema = Schema{
+	field("q", "検索語", length(0, 100)),
+	field("cursor", "カーソル", number(0, searchMaxCandidates)),
+	field("limit", "件数", number(1, 50)),
+}
+
+/**
+ * タグとカテゴリでゲームを探す
+ * @var
+ */
+var browseSchema = Schema{
+	field("tag", "タグ", length(0, gameTagMaxLength + 10)),
+	field("difficulty", "難易度", categoryIdRules...),
+	field("length", "長さ", categoryIdRules...),
+	field("theme", "テーマ", categoryIdRules...),
+	field("cursor", "カーソル", length(0, 1000)),
+	field("limit", "件数", number(1, 50)),
+}
+
+/**
+ * タグの入力の補完
+ * @var
+ */
+var tagSuggestSchema = Schema{
+	field("q", "入力中のタグ", length(0, gameTagMaxLength + 10)),
+	field("limit", "件数", number(1, 50)),
+}
+
+/**
+ * タグの統合と名前の変更 (管理者)
+ * sources はカンマか読点で区切って複数指定できる
+ * @var
+ */
+var mergeTagsSchema = Schema{
+	field("sources", "統合元のタグ", required(), custom(validateTagList)),
+	field("target", "統合先のタグ", required(), custom(validateTag)),
+}
+
+/**
+ * カテゴリの追加と変更 (管理者)
+ * @var
+ */
+var categorySchema = Schema{
+	field("axis", "軸", required(), enum(categoryAxes...)),
+	field("id", "ID", required(), length(0, 30), pattern("[a-z0-9_-]+", "%sには英小文字、数字、_ と - だけを使ってください")),
+	field("name", "表示名", required(), length(0, 30)),
+	field("order", "表示順", number(0, 1000)),
+}
+
+/**
+ * カテゴリの削除 (管理者)
+ * @var
+ */
+var deleteCategorySchema = Schema{
+	field("axis", "軸", required(), enum(categoryAxes...)),
+	field("id", "ID", required(), length(0, 30)),
+}
+
+/**
+ * メールアドレスの変更
+ * @var
+ */
+var changeMailSchema = Schema{
+	field("mail", "メールアドレス", required(), email()),
+}
+
+/**
+ * メールアドレスでのログインの連携
+ * @var
+ */
+var linkMailSchema = Schema{
+	field("mail", "メールアドレス", required(), email()),
+	field("pass", "パスワード", required(), length(passwordMinLength, passwordMaxLength)),
+}
+
+/**
+ * プロフィールの更新
+ * ハンドルは保存する時に小文字にする
+ * @var
+ */
+var profileSchema = Schema{
+	field("name", "表示名", required(), length(0, 30)),
+	field("handle", "ハンドル", length(3, 20), pattern("[A-Za-z][A-Za-z0-9_]*", "%sには英字から始まる英数字とアンダースコアのみ使えます"), custom(validateHandle)),
+	field("bio", "自己紹介", length(0, 500)),
+	field("language", "言語", enum(languages...)),
+}
+
+/**
+ * パスワードの変更
+ * @var
+ */
+var changePasswordSchema = Schema{
+	field("current_pass", "現在のパスワード", required()),
+	field("new_pass", "新しいパスワード", required(), length(passwordMinLength, passwordMaxLength)),
+}
+
+/**
+ * API トークンの作成
+ * 権限は複数の値を持つので createAPIToken() で検証する
+ * @var
+ */
+var apiTokenSchema = Schema{
+	field("name", "トークンの名前", required(), length(0, 50)),
+	field("expires_days", "有効期間", number(0, 3650)),
+}
+
+/**
+ * ユーザの種類
+ * メールアドレスで登録した normal と、OAuth のサービス名
+ * @function
+ * @returns {[]string} ユーザの種類
+ */
+func userTypes() []string {
+	types := []string{"normal", "Twitter"}
+	for _, provider := range oauth2Providers {
+		types = append(types, provider.Name)
+	}
+	return types
+}
+
+/**
+ * ユーザの作成
+ * ユーザの種類によって必須の項目が変わる
+ * @function
+ * @param {string} userType ユーザの種類
+ * @returns {Schema} スキーマ
+ */
+func userSchema(userType string) Schema {
+	schema := Schema{
+		field("user_type", "ユーザの種類", required(), enum(userTypes()...)),
+		field("user_role", "権限", enum(roles...)),
+	}
+	if userType == "normal" {
+		schema = append(schema,
+			field("user_mail", "メールアドレス", required(), email()),
+			field("user_pass", "パスワード", required(), length(0, passwordMaxLength)),
+		)
+	} else {
+		schema = append(schema, field("user_oauth_id", "OAuth ID", required()))
+	}
+	return schema
+}
+
+/**
+ * テンプレートから参照できるスキーマ
+ * @var
+ */
+var formSchemas = map[string]Schema{
+	"login": loginSchema,
+	"interim_registration": interimRegistrationSchema,
+	"add_game": addGameSchema,
+	"game": gameSchema,
+	"save_game": saveGameSchema,
+	"invitation": invitationSchema,
+	"game_list": gameListSchema,
+	"search": searchSchema,
+	"browse": browseSchema,
+	"merge_tags": mergeTagsSchema,
+	"category": categorySchema,
+	"change_mail": changeMailSchema,
+	"link_mail": linkMailSchema,
+	"profile": profileSchema,
+	"change_password": changePasswordSchema,
+	"api_token": apiTokenSchema,
+	"add_user": userSchema("normal"),
+}
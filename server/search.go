@@ -0,0 +1,239 @@
+/**
+ * ゲームの全文検索
+ * 日本語は空白で単語に区切れないので、文字の 1-gram と 2-gram で索引を作る
+ * 索引はデータストアの複数値のプロパティに持ち、検索語の n-gram をすべて含むものを等価フィルタで絞り込んでから、
+ * 検索語が実際に含まれているかを確かめて順位を付ける
+ * @file
+ */
+package escape3ds
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/**
+ * 検索で1回のクエリに使う n-gram の最大の数
+ * 多すぎるとクエリが遅くなる
+ * @const
+ */
+const searchMaxFilters = 6
+
+/**
+ * 検索で順位を付ける候補の最大の数
+ * 検索結果はこの件数を超えないので、検索ページにも件数の上限を表示する
+ * @const
+ */
+const searchMaxCandidates = 500
+
+/**
+ * 検索結果の1ページの件数
+ * @const
+ */
+const searchPageSize = 20
+
+/**
+ * 項目ごとの検索の重み
+ * @const
+ */
+const (
+	searchWeightName = 10
+	searchWeightNamePrefix = 5
+	searchWeightTag = 6
+	searchWeightAuthor = 4
+	searchWeightDescription = 1
+)
+
+/**
+ * 検索のために文字列を正規化する
+ * 全角英数字を半角に、カタカナをひらがなに、英字を小文字にして、文字と数字以外を空白にする
+ * @function
+ * @param {string} text 文字列
+ * @returns {string} 正規化した文字列
+ */
+func normalizeSearchText(text string) string {
+	runes := []rune(text)
+	for i, r := range runes {
+		switch {
+		case r >= 0xFF01 && r <= 0xFF5E:
+			// 全角英数字と記号
+			r -= 0xFEE0
+		case r >= 0x30A1 && r <= 0x30F6:
+			// カタカナ
+			r -= 0x60
+		}
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			runes[i] = unicode.ToLower(r)
+		} else {
+			runes[i] = ' '
+		}
+	}
+	return string(runes)
+}
+
+/**
+ * 検索語を単語に分ける
+ * 空白と記号で区切り、正規化した単語を重複なく返す
+ * @function
+ * @param {string} query 検索語
+ * @returns {[]string} 単語
+ */
+func searchTerms(query string) []string {
+	terms := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, term := range strings.Fields(normalizeSearchText(query)) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+/**
+ * 索引に入れる n-gram を返す
+ * 単語ごとに 1-gram と 2-gram を作り、単語をまたぐ n-gram は作らない
+ * @function
+ * @param {[]string} texts 索引に入れる文字列
+ * @returns {[]string} n-gram (重複なし)
+ */
+func searchGrams(texts ...string) []string {
+	grams := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(gram string) {
+		if !seen[gram] {
+			seen[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+	for _, text := range texts {
+		for _, word := range strings.Fields(normalizeSearchText(text)) {
+			runes := []rune(word)
+			for i := range runes {
+				add(string(runes[i]))
+				if i + 1 < len(runes) {
+					add(string(runes[i:i + 2]))
+				}
+			}
+		}
+	}
+	return grams
+}
+
+/**
+ * 検索語の単語を含む文書の絞り込みに使う n-gram を返す
+ * 1文字の単語は 1-gram、それ以外は 2-gram を使い、最大 searchMaxFilters 個に抑える
+ * @function
+ * @param {[]string} terms 正規化した単語
+ * @returns {[]string} n-gram
+ */
+func searchFilterGrams(terms []string) []string {
+	grams := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		runes := []rune(term)
+		if len(runes) == 1 {
+			if !seen[term] {
+				seen[term] = true
+				grams = append(grams, term)
+			}
+			continue
+		}
+		for i := 0; i + 1 < len(runes); i++ {
+			gram := string(runes[i:i + 2])
+			if !seen[gram] {
+				seen[gram] = true
+				grams = append(grams, gram)
+			}
+		}
+	}
+	if len(grams) > searchMaxFilters {
+		// 全体から均等に選べば十分に絞り込める
+		picked := make([]string, 0, searchMaxFilters)
+		step := float64(len(grams) - 1) / float64(searchMaxFilters - 1)
+		for i := 0; i < searchMaxFilters; i++ {
+			picked = append(picked, grams[int(float64(i) * step + 0.5)])
+		}
+		grams = picked
+	}
+	return grams
+}
+
+/**
+ * 文書の点数を計算する
+ * すべての単語がいずれかの項目に含まれていなければ0を返す
+ * @method
+ * @memberof SearchIndex
+ * @param {[]string} terms 正規化した単語
+ * @returns {int} 点数
+ */
+func (this *SearchIndex) score(terms []string) int {
+	name := normalizeSearchText(this.Name)
+	description := normalizeSearchText(this.Description)
+	author := normalizeSearchText(this.Author)
+	score := 0
+	for _, term := range terms {
+		termScore := 0
+		if strings.Contains(name, term) {
+			termScore += searchWeightName
+			if strings.HasPrefix(strings.TrimSpace(name), term) {
+				termScore += searchWeightNamePrefix
+			}
+		}
+		for _, tag := range this.Tags {
+			if strings.Contains(normalizeSearchText(tag), term) {
+				termScore += searchWeightTag
+				break
+			}
+		}
+		if strings.Contains(author, term) {
+			termScore += searchWeightAuthor
+		}
+		if strings.Contains(description, term) {
+			termScore += searchWeightDescription
+		}
+		if termScore == 0 {
+			return 0
+		}
+		score += termScore
+	}
+	return score
+}
+
+/**
+ * 検索結果の1件
+ * @struct
+ * @property {string} Key エンコード済みのゲームキー
+ * @property {int} Score 点数
+ */
+type SearchResult struct {
+	Key string
+	*SearchIndex
+	Score int
+}
+
+/**
+ * 検索結果を点数の高い順に、同じ点数なら新しく更新した順に並べる
+ * @function
+ * @param {[]SearchResult} results 検索結果
+ */
+func sortSearchResults(results []SearchResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Updated.After(results[j].Updated)
+	})
+}
+
+/**
+ * ゲームを索引に入れるか調べる
+ * 公開していてゴミ箱に無いゲームだけを索引に入れる
+ * @function
+ * @param {*Game} game ゲーム
+ * @returns {bool} 索引に入れるならtrue
+ */
+func searchable(game *Game) bool {
+	return game.Published && !game.trashed()
+}
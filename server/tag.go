@@ -0,0 +1,237 @@
+/**
+ * ゲームのタグとカテゴリ
+ * タグは作者が自由に付けるもので、表記の揺れを減らすために正規化して保存する
+ * カテゴリは管理者が用意した選択肢から作者が選ぶもので、難易度、長さ、テーマの3つの軸がある
+ * @file
+ */
+package escape3ds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/**
+ * 1つのゲームに付けられるタグの最大の数
+ * @const
+ */
+const gameTagMaxCount = 10
+
+/**
+ * タグの最大の文字数
+ * @const
+ */
+const gameTagMaxLength = 20
+
+/**
+ * タグの候補を返す最大の数
+ * @const
+ */
+const tagSuggestLimit = 10
+
+/**
+ * ゲームを一覧で探す時の1ページの件数
+ * @const
+ */
+const browsePageSize = 20
+
+/**
+ * カテゴリの軸
+ * 軸の名前は Game のプロパティと対応する (difficulty なら Game.Difficulty)
+ * @var
+ */
+var categoryAxes = []string{"difficulty", "length", "theme"}
+
+/**
+ * カテゴリの軸の表示名
+ * @var
+ */
+var categoryAxisLabels = map[string]string{
+	"difficulty": "難易度",
+	"length": "長さ",
+	"theme": "テーマ",
+}
+
+/**
+ * タグを正規化する
+ * 全角英数字を半角に、英字を小文字にして、前後の空白と先頭の # を取り除き、連続した空白を1つにまとめる
+ * @function
+ * @param {string} tag タグ
+ * @returns {string} 正規化したタグ
+ */
+func normalizeTag(tag string) string {
+	runes := []rune(tag)
+	for i, r := range runes {
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		}
+		if unicode.IsSpace(r) {
+			r = ' '
+		}
+		runes[i] = unicode.ToLower(r)
+	}
+	tag = strings.TrimLeft(strings.TrimSpace(string(runes)), "#")
+	return strings.Join(strings.Fields(tag), " ")
+}
+
+/**
+ * 入力されたタグを正規化して重複なく返す
+ * JSON の文字列の配列か、カンマか読点で区切った文字列を受け付ける
+ * @function
+ * @param {string} value タグ
+ * @returns {[]string} 正規化したタグ
+ * @returns {error} 数や長さが制限を超えていればエラー
+ */
+func parseTags(value string) ([]string, error) {
+	var items []string
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		err := json.Unmarshal([]byte(value), &items)
+		if err != nil {
+			return nil, errors.New("タグの形式が正しくありません")
+		}
+	} else {
+		items = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == '、' || r == '，'
+		})
+	}
+
+	tags := make([]string, 0, len(items))
+	for _, item := range items {
+		tag := normalizeTag(item)
+		if tag == "" || exist(tags, tag) {
+			continue
+		}
+		if len([]rune(tag)) > gameTagMaxLength {
+			return nil, fmt.Errorf("タグは%d文字以内にしてください", gameTagMaxLength)
+		}
+		if strings.ContainsAny(tag, ",、，") {
+			return nil, errors.New("タグにカンマと読点は使えません")
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > gameTagMaxCount {
+		return nil, fmt.Errorf("タグは%d個までにしてください", gameTagMaxCount)
+	}
+	return tags, nil
+}
+
+/**
+ * タグの入力値を検証する
+ * @function
+ * @param {string} value タグ
+ * @returns {error} エラー
+ */
+func validateTags(value string) error {
+	_, err := parseTags(value)
+	return err
+}
+
+/**
+ * タグを1つだけ指定する入力値を検証する
+ * @function
+ * @param {string} value タグ
+ * @returns {error} エラー
+ */
+func validateTag(value string) error {
+	tags, err := parseTags(value)
+	if err != nil {
+		return err
+	}
+	if len(tags) != 1 {
+		return errors.New("タグを1つ指定してください")
+	}
+	return nil
+}
+
+/**
+ * 統合するタグの入力値を検証する
+ * 統合元はカンマか読点で区切って複数指定できる
+ * @function
+ * @param {string} value タグ
+ * @returns {error} エラー
+ */
+func validateTagList(value string) error {
+	tags, err := parseTags(value)
+	if err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return errors.New("タグを指定してください")
+	}
+	return nil
+}
+
+/**
+ * タグの一覧の中の統合元のタグを統合先のタグに置き換える
+ * 統合先のタグが既にあれば重複させない
+ * @function
+ * @param {[]string} tags タグの一覧
+ * @param {[]string} sources 統合元のタグ
+ * @param {string} target 統合先のタグ
+ * @returns {[]string} 置き換えたタグの一覧
+ * @returns {bool} 置き換えたならtrue
+ */
+func replaceTags(tags []string, sources []string, target string) ([]string, bool) {
+	result := make([]string, 0, len(tags))
+	replaced := false
+	for _, tag := range tags {
+		if exist(sources, tag) {
+			replaced = true
+			tag = target
+		}
+		if !exist(result, tag) {
+			result = append(result, tag)
+		}
+	}
+	return result, replaced
+}
+
+/**
+ * カテゴリの軸に対応するゲームのプロパティ名を返す
+ * @function
+ * @param {string} axis カテゴリの軸
+ * @returns {string} プロパティ名
+ */
+func categoryProperty(axis string) string {
+	return strings.ToUpper(axis[:1]) + axis[1:]
+}
+
+/**
+ * ゲームに設定されたカテゴリを返す
+ * @method
+ * @memberof Game
+ * @param {string} axis カテゴリの軸
+ * @returns {string} カテゴリの ID、未設定なら空文字
+ */
+func (this *Game) category(axis string) string {
+	switch axis {
+	case "difficulty":
+		return this.Difficulty
+	case "length":
+		return this.Length
+	case "theme":
+		return this.Theme
+	}
+	return ""
+}
+
+/**
+ * ゲームのカテゴリを設定する
+ * @method
+ * @memberof Game
+ * @param {string} axis カテゴリの軸
+ * @param {string} id カテゴリの ID、空文字なら未設定に戻す
+ */
+func (this *Game) setCategory(axis string, id string) {
+	switch axis {
+	case "difficulty":
+		this.Difficulty = id
+	case "length":
+		this.Length = id
+	case "theme":
+		this.Theme = id
+	}
+}
@@ -0,0 +1,198 @@
+/**
+ * 二段階認証 (RFC 6238 TOTP)
+ * メールアドレスでログインするユーザが任意で有効にできる
+ * 認証アプリには登録用 URI を QR コードで読み取らせる
+ * @file
+ */
+package escape3ds
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/**
+ * 認証アプリに表示する発行者名
+ * @const
+ */
+const totpIssuer = "ESCAPE 3DS"
+
+/**
+ * ワンタイムパスワードが切り替わる間隔
+ * @const
+ */
+const totpPeriod = 30
+
+/**
+ * ワンタイムパスワードの桁数
+ * @const
+ */
+const totpDigits = 6
+
+/**
+ * 時計のずれを許容するステップ数
+ * 前後1ステップ (30秒) まで受け付ける
+ * @const
+ */
+const totpSkew = 1
+
+/**
+ * 二段階認証を有効にした時に発行するリカバリーコードの数
+ * @const
+ */
+const recoveryCodeCount = 10
+
+/**
+ * シークレットの base32 表現
+ * 認証アプリはパディングを受け付けないことがあるので付けない
+ * @const
+ */
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/**
+ * 新しいシークレットを作成する
+ * HMAC-SHA1 の鍵長に合わせて 160 ビットにする
+ * @function
+ * @returns {string} base32 でエンコードしたシークレット
+ */
+func newTotpSecret() string {
+	secret := make([]byte, 20)
+	_, err := crand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(secret)
+}
+
+/**
+ * 認証アプリに登録するための URI を返す
+ * @function
+ * @param {string} secret base32 でエンコードしたシークレット
+ * @param {string} account 認証アプリに表示するアカウント名
+ * @returns {string} otpauth:// 形式の URI
+ */
+func totpProvisioningUri(secret string, account string) string {
+	label := url.QueryEscape(totpIssuer) + ":" + url.QueryEscape(account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + strings.Replace(label, "+", "%20", -1) + "?" + strings.Replace(params.Encode(), "+", "%20", -1)
+}
+
+/**
+ * 時刻に対応するステップ数を返す
+ * @function
+ * @param {time.Time} t 時刻
+ * @returns {int64} Unix 時間を totpPeriod で割った値
+ */
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+/**
+ * ステップ数に対応するワンタイムパスワードを返す (RFC 4226 HOTP)
+ * @function
+ * @param {[]byte} secret シークレット
+ * @param {int64} step ステップ数
+ * @param {int} digits 桁数
+ * @returns {string} 先頭を0で埋めたワンタイムパスワード
+ */
+func totpCode(secret []byte, step int64, digits int) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value % modulo)
+}
+
+/**
+ * ワンタイムパスワードを検証する
+ * 同じパスワードを二度使えないように、前回受け付けたステップ以前のものは拒否する
+ * @function
+ * @param {string} secret base32 でエンコードしたシークレット
+ * @param {string} code 入力されたワンタイムパスワード
+ * @param {int64} lastStep 前回受け付けたステップ数
+ * @param {time.Time} now 現在時刻
+ * @returns {int64} 一致したステップ数、一致しなければ -1
+ */
+func verifyTotp(secret string, code string, lastStep int64, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return -1
+	}
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return -1
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current + totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step, totpDigits)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+/**
+ * リカバリーコードを作成する
+ * 読み間違えやすい文字を除いた 10 文字を 5 文字ずつハイフンでつなぐ
+ * @function
+ * @returns {[]string} 平文のリカバリーコード
+ */
+func newRecoveryCodes() []string {
+	const letters = "123456789abcdefghjkmnpqrstuvwxyz"
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 10)
+		_, err := crand.Read(random)
+		if err != nil {
+			panic(err)
+		}
+		code := make([]byte, len(random))
+		for j, b := range random {
+			code[j] = letters[int(b) % len(letters)]
+		}
+		codes[i] = string(code[:5]) + "-" + string(code[5:])
+	}
+	return codes
+}
+
+/**
+ * リカバリーコードをハッシュ化する
+ * 大文字小文字と区切り文字の違いは無視する
+ * @function
+ * @param {string} code 平文のリカバリーコード
+ * @returns {string} SHA-256 の16進表現
+ */
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,118 @@
+package escape3ds
+
+import (
+	"testing"
+	"time"
+)
+
+/**
+ * RFC 6238 Appendix B のシークレット "12345678901234567890" の base32 表現
+ * @const
+ */
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+/**
+ * ワンタイムパスワード (RFC 6238 Appendix B の SHA-1 の例)
+ * 例は8桁なので8桁で計算する
+ */
+func TestTotpCode(t *testing.T) {
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	key := []byte("12345678901234567890")
+	for _, c := range cases {
+		step := totpStep(time.Unix(c.unix, 0))
+		if actual := totpCode(key, step, 8); actual != c.code {
+			t.Errorf("totpCode(T=%d) = %s, want %s", c.unix, actual, c.code)
+		}
+	}
+}
+
+/**
+ * 6桁のワンタイムパスワードは8桁の下6桁になる
+ */
+func TestTotpCodeDigits(t *testing.T) {
+	key := []byte("12345678901234567890")
+	if actual := totpCode(key, totpStep(time.Unix(59, 0)), totpDigits); actual != "287082" {
+		t.Errorf("totpCode(T=59) = %s, want 287082", actual)
+	}
+}
+
+/**
+ * 前後1ステップまでのワンタイムパスワードを受け付け、それより離れたものは拒否する
+ */
+func TestVerifyTotpWindow(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+
+	cases := []struct {
+		step int64
+		expected int64
+	}{
+		{current - 2, -1},
+		{current - 1, current - 1},
+		{current, current},
+		{current + 1, current + 1},
+		{current + 2, -1},
+	}
+	for _, c := range cases {
+		code := totpCode(key, c.step, totpDigits)
+		if actual := verifyTotp(rfc6238Secret, code, 0, now); actual != c.expected {
+			t.Errorf("verifyTotp(step %+d) = %d, want %d", c.step - current, actual, c.expected)
+		}
+	}
+}
+
+/**
+ * 前回受け付けたステップ以前のワンタイムパスワードは再利用できない
+ */
+func TestVerifyTotpReplay(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	code := totpCode(key, current, totpDigits)
+
+	if actual := verifyTotp(rfc6238Secret, code, current, now); actual != -1 {
+		t.Errorf("verifyTotp(lastStep = current) = %d, want -1", actual)
+	}
+	if actual := verifyTotp(rfc6238Secret, code, current - 1, now); actual != current {
+		t.Errorf("verifyTotp(lastStep = current - 1) = %d, want %d", actual, current)
+	}
+}
+
+/**
+ * 小文字のシークレット、空白を含むコード、桁数の違うコード
+ */
+func TestVerifyTotpInput(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(59, 0)
+	code := totpCode(key, totpStep(now), totpDigits)
+
+	if actual := verifyTotp("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code[:3] + " " + code[3:], 0, now); actual != totpStep(now) {
+		t.Errorf("verifyTotp(lower case, spaced) = %d, want %d", actual, totpStep(now))
+	}
+	if actual := verifyTotp(rfc6238Secret, "94287082", 0, now); actual != -1 {
+		t.Errorf("verifyTotp(8 digits) = %d, want -1", actual)
+	}
+	if actual := verifyTotp("!!!", code, 0, now); actual != -1 {
+		t.Errorf("verifyTotp(invalid secret) = %d, want -1", actual)
+	}
+}
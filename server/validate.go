@@ -0,0 +1,441 @@
+/**
+ * 入力値の検証
+ * 処理ごとに項目と規則の組 (スキーマ) を宣言し、サーバでの検証と HTML フォームの属性の両方に使う
+ * 必須以外の規則は空の値を検証しない (HTML の制約検証と同じ)
+ * 検証に失敗した場合は項目ごとのエラーを返す
+ * @file
+ */
+package escape3ds
+
+import (
+	"appengine"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/**
+ * 検証の規則
+ * @struct
+ * @property {func(string, string) string} test 項目名と値を受け取り、不正ならメッセージを返す
+ * @property {[][2]string} attrs 同じ制約を表す HTML の属性
+ * @property {bool} required 空の値も検証するならtrue
+ */
+type Rule struct {
+	test func(label string, value string) string
+	attrs [][2]string
+	required bool
+}
+
+/**
+ * 検証する項目
+ * @struct
+ * @property {string} Name フォームや JSON の項目名
+ * @property {string} Label メッセージに使う項目の表示名
+ * @property {[]Rule} Rules 規則
+ */
+type Field struct {
+	Name string
+	Label string
+	Rules []Rule
+}
+
+/**
+ * 処理ごとの項目と規則の組
+ * @type
+ */
+type Schema []Field
+
+/**
+ * 検証する項目を作成する
+ * @function
+ * @param {string} name 項目名
+ * @param {string} label 表示名
+ * @param {...Rule} rules 規則
+ * @returns {Field} 項目
+ */
+func field(name string, label string, rules ...Rule) Field {
+	return Field{name, label, rules}
+}
+
+/**
+ * 必須の規則
+ * 空白だけの値も空とみなす
+ * @function
+ * @returns {Rule} 規則
+ */
+func required() Rule {
+	return Rule{
+		test: func(label string, value string) string {
+			if strings.TrimSpace(value) == "" {
+				return fmt.Sprintf("%sを入力してください", label)
+			}
+			return ""
+		},
+		attrs: [][2]string{{"required", ""}},
+		required: true,
+	}
+}
+
+/**
+ * 文字数の規則
+ * バイト数ではなく文字数で数える
+ * @function
+ * @param {int} min 最小の文字数、0なら制限しない
+ * @param {int} max 最大の文字数、0なら制限しない
+ * @returns {Rule} 規則
+ */
+func length(min int, max int) Rule {
+	attrs := make([][2]string, 0, 2)
+	if min > 0 {
+		attrs = append(attrs, [2]string{"minlength", strconv.Itoa(min)})
+	}
+	if max > 0 {
+		attrs = append(attrs, [2]string{"maxlength", strconv.Itoa(max)})
+	}
+	return Rule{
+		test: func(label string, value string) string {
+			n := len([]rune(value))
+			if (min > 0 && n < min) || (max > 0 && n > max) {
+				switch {
+				case min > 0 && max > 0:
+					return fmt.Sprintf("%sは%d〜%d文字で入力してください", label, min, max)
+				case max > 0:
+					return fmt.Sprintf("%sは%d文字以内で入力してください", label, max)
+				default:
+					return fmt.Sprintf("%sは%d文字以上で入力してください", label, min)
+				}
+			}
+			return ""
+		},
+		attrs: attrs,
+	}
+}
+
+/**
+ * 正規表現の規則
+ * 値全体が一致する必要がある
+ * HTML の pattern 属性にも使うので、JavaScript と共通の書き方にすること
+ * @function
+ * @param {string} expr 正規表現
+ * @param {string} message 一致しない場合のメッセージ、%s は表示名に置き換える
+ * @returns {Rule} 規則
+ */
+func pattern(expr string, message string) Rule {
+	re := regexp.MustCompile("^(?:" + expr + ")$")
+	return Rule{
+		test: func(label string, value string) string {
+			if !re.MatchString(value) {
+				return fmt.Sprintf(message, label)
+			}
+			return ""
+		},
+		attrs: [][2]string{{"pattern", expr}},
+	}
+}
+
+/**
+ * メールアドレスの形式
+ * RFC 5322 のすべての形式ではなく、実際に使われる形式だけを受け付ける
+ * @const
+ */
+var mailPattern = regexp.MustCompile(`^[a-zA-Z0-9.!#$%&'*+/=?^_{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)+$`)
+
+/**
+ * メールアドレスの規則
+ * @function
+ * @returns {Rule} 規則
+ */
+func email() Rule {
+	return Rule{
+		test: func(label string, value string) string {
+			value = strings.TrimSpace(value)
+			if len(value) > 254 || !mailPattern.MatchString(value) {
+				return fmt.Sprintf("%sの形式が正しくありません", label)
+			}
+			return ""
+		},
+		attrs: [][2]string{{"type", "email"}, {"maxlength", "254"}},
+	}
+}
+
+/**
+ * 選択肢の規則
+ * @function
+ * @param {...string} values 選べる値
+ * @returns {Rule} 規則
+ */
+func enum(values ...string) Rule {
+	return Rule{
+		test: func(label string, value string) string {
+			if !exist(values, value) {
+				return fmt.Sprintf("%sに選べない値が指定されました", label)
+			}
+			return ""
+		},
+	}
+}
+
+/**
+ * 整数の範囲の規則
+ * @function
+ * @param {int} min 最小値
+ * @param {int} max 最大値
+ * @returns {Rule} 規則
+ */
+func number(min int, max int) Rule {
+	return Rule{
+		test: func(label string, value string) string {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || n < min || n > max {
+				return fmt.Sprintf("%sは%d〜%dの整数で入力してください", label, min, max)
+			}
+			return ""
+		},
+		attrs: [][2]string{{"type", "number"}, {"min", strconv.Itoa(min)}, {"max", strconv.Itoa(max)}},
+	}
+}
+
+/**
+ * 関数で検証する規則
+ * HTML の属性では表せない検証に使う
+ * @function
+ * @param {func(string) error} test 値が不正ならエラーを返す関数
+ * @returns {Rule} 規則
+ */
+func custom(test func(value string) error) Rule {
+	return Rule{
+		test: func(label string, value string) string {
+			err := test(value)
+			if err != nil {
+				return err.Error()
+			}
+			return ""
+		},
+	}
+}
+
+/**
+ * 検証エラー
+ * @class
+ * @property {map[string]string} Fields 項目名とメッセージの対応表
+ * @property {[]string} names エラーのある項目名 (スキーマの順)
+ */
+type ValidationError struct {
+	Fields map[string]string
+	names []string
+}
+
+/**
+ * 項目のエラーを追加する
+ * 同じ項目には最初のエラーだけを残す
+ * @method
+ * @memberof ValidationError
+ * @param {string} name 項目名
+ * @param {string} message メッセージ
+ */
+func (this *ValidationError) add(name string, message string) {
+	if _, ok := this.Fields[name]; ok {
+		return
+	}
+	this.Fields[name] = message
+	this.names = append(this.names, name)
+}
+
+/**
+ * エラーのメッセージを返す
+ * 項目ごとのメッセージをスキーマの順に並べる
+ * @method
+ * @memberof ValidationError
+ * @returns {string} メッセージ
+ */
+func (this *ValidationError) Error() string {
+	messages := make([]string, len(this.names))
+	for i, name := range this.names {
+		messages[i] = this.Fields[name]
+	}
+	return strings.Join(messages, "\n")
+}
+
+/**
+ * 値を検証する
+ * @method
+ * @memberof Schema
+ * @param {map[string]string} values 項目名と値の対応表
+ * @returns {*ValidationError} エラー、すべて正しければ nil
+ */
+func (this Schema) validate(values map[string]string) *ValidationError {
+	return this.check(values, false)
+}
+
+/**
+ * 送信された項目だけを検証する
+ * 一部の項目だけを変更する処理 (PATCH など) に使う
+ * @method
+ * @memberof Schema
+ * @param {map[string]string} values 項目名と値の対応表
+ * @returns {*ValidationError} エラー、すべて正しければ nil
+ */
+func (this Schema) validatePartial(values map[string]string) *ValidationError {
+	return this.check(values, true)
+}
+
+/**
+ * 値を検証する
+ * @method
+ * @memberof Schema
+ * @param {map[string]string} values 項目名と値の対応表
+ * @param {bool} partial 送信されなかった項目を無視するならtrue
+ * @returns {*ValidationError} エラー、すべて正しければ nil
+ */
+func (this Schema) check(values map[string]string, partial bool) *ValidationError {
+	result := &ValidationError{Fields: make(map[string]string)}
+	for _, field := range this {
+		value, ok := values[field.Name]
+		if !ok && partial {
+			continue
+		}
+		for _, rule := range field.Rules {
+			if value == "" && !rule.required {
+				continue
+			}
+			message := rule.test(field.Label, value)
+			if message != "" {
+				result.add(field.Name, message)
+				break
+			}
+		}
+	}
+	if len(result.names) == 0 {
+		return nil
+	}
+	return result
+}
+
+/**
+ * スキーマの項目の値をフォームから取り出す
+ * @method
+ * @memberof Schema
+ * @param {*http.Request} r リクエスト
+ * @returns {map[string]string} 項目名と値の対応表
+ */
+func (this Schema) formValues(r *http.Request) map[string]string {
+	values := make(map[string]string, len(this))
+	for _, field := range this {
+		values[field.Name] = r.FormValue(field.Name)
+	}
+	return values
+}
+
+/**
+ * 送信されたスキーマの項目の値だけをフォームから取り出す
+ * validatePartial() と組み合わせて一部の項目だけを変更する処理に使う
+ * @method
+ * @memberof Schema
+ * @param {*http.Request} r リクエスト
+ * @returns {map[string]string} 項目名と値の対応表
+ */
+func (this Schema) submittedValues(r *http.Request) map[string]string {
+	// FormValue() と同じく未解析なら解析する
+	if r.Form == nil {
+		r.ParseMultipartForm(32 << 20)
+	}
+	values := make(map[string]string, len(this))
+	for _, field := range this {
+		if v, ok := r.Form[field.Name]; ok && len(v) > 0 {
+			values[field.Name] = v[0]
+		}
+	}
+	return values
+}
+
+/**
+ * 項目の制約を HTML の属性にする
+ * name 属性も含める
+ * @method
+ * @memberof Schema
+ * @param {string} name 項目名
+ * @returns {template.HTMLAttr} 属性
+ */
+func (this Schema) attrs(name string) template.HTMLAttr {
+	attrs := []string{fmt.Sprintf(`name="%s"`, html.EscapeString(name))}
+	seen := make(map[string]bool)
+	for _, field := range this {
+		if field.Name != name {
+			continue
+		}
+		for _, rule := range field.Rules {
+			for _, attr := range rule.attrs {
+				if seen[attr[0]] {
+					continue
+				}
+				seen[attr[0]] = true
+				if attr[1] == "" {
+					attrs = append(attrs, attr[0])
+				} else {
+					attrs = append(attrs, fmt.Sprintf(`%s="%s"`, attr[0], html.EscapeString(attr[1])))
+				}
+			}
+		}
+	}
+	return template.HTMLAttr(strings.Join(attrs, " "))
+}
+
+/**
+ * テンプレートから {{rules "スキーマ名" "項目名"}} で属性を出力する
+ * @function
+ * @param {string} schema formSchemas のスキーマ名
+ * @param {string} name 項目名
+ * @returns {template.HTMLAttr} 属性
+ */
+func formRules(schema string, name string) template.HTMLAttr {
+	s, ok := formSchemas[schema]
+	if !ok {
+		panic(fmt.Sprintf("存在しないスキーマです: %s", schema))
+	}
+	return s.attrs(name)
+}
+
+/**
+ * 検証エラーを返す
+ * API なら 400 の API のエラーに、それ以外は Ajax の JSON に項目ごとのエラーを含める
+ * Ajax は他の処理と同じく result を false にして 200 で返す
+ * @function
+ * @param {appengine.Context} c コンテキスト
+ * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
+ * @param {*ValidationError} err 検証エラー
+ */
+func validationError(c appengine.Context, w http.ResponseWriter, r *http.Request, err *ValidationError) {
+	var result map[string]interface{}
+	status := http.StatusOK
+	if isAPI(r) {
+		status = http.StatusBadRequest
+		result = map[string]interface{}{
+			"result": false,
+			"error": map[string]interface{}{
+				"status": http.StatusBadRequest,
+				"code": "invalid_parameter",
+				"message": err.Error(),
+				"fields": err.Fields,
+			},
+		}
+	} else {
+		result = map[string]interface{}{
+			"result": false,
+			"error": "invalid_parameter",
+			"message": err.Error(),
+			"fields": err.Fields,
+		}
+	}
+	bytes, e := json.Marshal(result)
+	check(c, e)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
@@ -7,9 +7,22 @@ package escape3ds
 import(
 	"net/http"
 	"html/template"
+	"path"
+	"strings"
 	"appengine"
 )
 
+/**
+ * テンプレートから呼び出せる関数
+ * rules はスキーマの規則を HTML の属性にする (validate.go)
+ * join はタグなどの一覧を区切り文字でつなげる
+ * @var
+ */
+var templateFuncs = template.FuncMap{
+	"rules": formRules,
+	"join": strings.Join,
+}
+
 /**
  * 画面表示を行うクラス
  * @class
@@ -20,6 +33,7 @@ import(
 type View struct {
 	c appengine.Context
 	w http.ResponseWriter
+	r *http.Request
 }
 
 /**
@@ -27,36 +41,73 @@ type View struct {
  * @function
  * @param {appengine.Context} c コンテキスト
  * @param {http.ResponseWriter} w 応答先
+ * @param {*http.Request} r リクエスト
  * @returns {*View} 作成したView
  */
-func NewView(c appengine.Context, w http.ResponseWriter) *View {
+func NewView(c appengine.Context, w http.ResponseWriter, r *http.Request) *View {
 	view := new(View)
 	view.c = c
 	view.w = w
+	view.r = r
 	return view
 }
 
+/**
+ * テンプレートを表示する
+ * すべてのページのフォームと Ajax で使えるようにCSRFトークンを渡す
+ * @method
+ * @memberof View
+ * @param {string} file テンプレートのパス
+ * @param {map[string]interface{}} data テンプレートに渡すデータ、不要なら nil
+ */
+func (this *View) render(file string, data map[string]interface{}) {
+	t, err := template.New(path.Base(file)).Funcs(templateFuncs).ParseFiles(file)
+	check(this.c, err)
+
+	if data == nil {
+		data = make(map[string]interface{}, 1)
+	}
+	data["CsrfToken"] = csrfToken(this.c, this.w, this.r)
+	err = t.Execute(this.w, data)
+	check(this.c, err)
+}
+
 /**
  * ログイン画面を表示する
  * @method
  * @memberof View
  */
 func (this *View) login() {
-	t, err := template.ParseFiles("server/html/login.html")
-	check(this.c, err)
-	t.Execute(this.w, nil)
+	data := make(map[string]interface{}, 1)
+	data["Providers"] = enabledOAuth2Providers()
+	this.render("server/html/login.html", data)
 }
 
 /**
  * エディタ画面を表示する
  * @method
  * @memberof View
- * @param {string} key ユーザキー
+ * @param {string} key エンコード済みのゲームキー
+ * @param {*Game} game 編集するゲーム
+ * @param {string} role ゲームに対するユーザの権限
  */
-func (this *View) editor(key string) {
-	t, err := template.ParseFiles("server/html/editor.html")
-	check(this.c, err)
-	t.Execute(this.w, nil)
+func (this *View) editor(key string, game *Game, role string) {
+	data := make(map[string]interface{}, 10)
+	data["Key"] = key
+	data["Game"] = game
+	data["Role"] = role
+	data["CanEdit"] = gameRoleRank(role) >= gameRoleRank("editor")
+	data["IsOwner"] = role == "owner"
+	data["Settings"] = string(game.settings())
+	data["Content"] = string(game.content())
+	data["Categories"] = NewModel(this.c).getCategories()
+	data["AxisLabels"] = categoryAxisLabels
+	selected := make(map[string]string, len(categoryAxes))
+	for _, axis := range categoryAxes {
+		selected[axis] = game.category(axis)
+	}
+	data["SelectedCategories"] = selected
+	this.render("server/html/editor.html", data)
 }
 
 /**
@@ -65,9 +116,7 @@ func (this *View) editor(key string) {
  * @memberof View
  */
 func (this *View) debug() {
-	t, err := template.ParseFiles("server/html/debug.html")
-	check(this.c, err)
-	t.Execute(this.w, nil)
+	this.render("server/html/debug.html", nil)
 }
 
 /**
@@ -76,9 +125,7 @@ func (this *View) debug() {
  * @memberof View
  */
 func (this *View) interimRegistration() {
-	t, err := template.ParseFiles("server/html/interim_registration.html")
-	check(this.c, err)
-	t.Execute(this.w, nil)
+	this.render("server/html/interim_registration.html", nil)
 }
 
 /**
@@ -87,9 +134,72 @@ func (this *View) interimRegistration() {
  * @memberof View
  */
 func (this *View) registration() {
-	t, err := template.ParseFiles("server/html/registration.html")
-	check(this.c, err)
-	t.Execute(this.w, nil)
+	this.render("server/html/registration.html", nil)
+}
+
+/**
+ * メッセージページの表示
+ * 処理結果やエラーを利用者に伝える
+ * @method
+ * @memberof View
+ * @param {string} title ページのタイトル
+ * @param {string} message 表示するメッセージ
+ */
+func (this *View) message(title string, message string) {
+	data := make(map[string]interface{}, 2)
+	data["Title"] = title
+	data["Message"] = message
+	this.render("server/html/message.html", data)
+}
+
+/**
+ * 確認ページの表示
+ * ボタンを押すと key を action へ POST で送信する
+ * @method
+ * @memberof View
+ * @param {string} title ページのタイトル
+ * @param {string} message 表示するメッセージ
+ * @param {string} action 送信先の URL
+ * @param {string} key 送信するキー
+ */
+func (this *View) confirm(title string, message string, action string, key string) {
+	data := make(map[string]interface{}, 4)
+	data["Title"] = title
+	data["Message"] = message
+	data["Action"] = action
+	data["Key"] = key
+	this.render("server/html/confirm.html", data)
+}
+
+/**
+ * 個人データのダウンロードページを表示する
+ * @method
+ * @memberof View
+ * @param {int} assetParts 素材の ZIP の数
+ */
+func (this *View) exportAccount(assetParts int) {
+	parts := make([]int, assetParts)
+	for i := range parts {
+		parts[i] = i + 1
+	}
+	data := make(map[string]interface{}, 2)
+	data["Parts"] = parts
+	data["PartCount"] = assetParts
+	this.render("server/html/export_account.html", data)
+}
+
+/**
+ * ユーザ統合の確認ページを表示する
+ * @method
+ * @memberof View
+ * @param {*User} source 統合されて削除されるユーザ
+ * @param {*User} target 統合先のユーザ
+ */
+func (this *View) mergeAccount(source *User, target *User) {
+	data := make(map[string]interface{}, 2)
+	data["Source"] = source
+	data["Target"] = target
+	this.render("server/html/merge_account.html", data)
 }
 
 /**
@@ -97,12 +207,100 @@ func (this *View) registration() {
  * @method
  * @memberof View
  * @param {string} userKey
+ * @param {[]GameListItem} games 表示するページのゲーム
+ * @param {string} sort 並び順、空文字なら updated
+ * @param {string} filter 絞り込みに使った文字列
+ * @param {string} next 次のページのカーソル、最後のページなら空文字
+ * @param {[]GameListItem} trash ゴミ箱のゲーム
  */
-func (this *View) gamelist(userKey string) {
+func (this *View) gamelist(userKey string, games []GameListItem, sort string, filter string, next string, trash []GameListItem) {
 	model := NewModel(this.c)
-	gameList := model.getGameList(userKey)
-	
-	t, err := template.ParseFiles("server/html/gamelist.html")
-	check(this.c, err)
-	t.Execute(this.w, gameList)
-}
\ No newline at end of file
+	if sort == "" {
+		sort = "updated"
+	}
+
+	data := make(map[string]interface{}, 12)
+	data["Games"] = games
+	data["Trash"] = trash
+	data["SharedGames"] = model.getSharedGames(userKey)
+	data["Invitations"] = this.invitations(userKey)
+	data["Sort"] = sort
+	data["Query"] = filter
+	data["Next"] = next
+	data["Key"] = userKey
+	data["User"] = model.getUser(userKey)
+	data["Identities"] = model.getIdentities(userKey)
+	data["Providers"] = enabledOAuth2Providers()
+	this.render("server/html/gamelist.html", data)
+}
+
+/**
+ * ユーザ宛ての招待を表示用にまとめる
+ * @method
+ * @memberof View
+ * @param {string} userKey エンコード済みのユーザキー
+ * @returns {[]map[string]interface{}} 招待キー (Key)、ゲーム (Game)、招待したユーザ (Inviter)、権限 (Role)
+ */
+func (this *View) invitations(userKey string) []map[string]interface{} {
+	model := NewModel(this.c)
+	result := make([]map[string]interface{}, 0)
+	for key, invitation := range model.getInvitations("UserKey", userKey) {
+		result = append(result, map[string]interface{}{
+			"Key": key,
+			"Game": model.getGame(invitation.GameKey),
+			"Inviter": model.getUser(invitation.InviterKey),
+			"Role": invitation.Role,
+		})
+	}
+	return result
+}
+
+/**
+ * 公開プロフィールページを表示する
+ * @method
+ * @memberof View
+ * @param {string} userKey 表示するユーザのエンコード済みキー
+ */
+func (this *View) publicProfile(userKey string) {
+	model := NewModel(this.c)
+	data := make(map[string]interface{}, 3)
+	data["Key"] = userKey
+	data["User"] = model.getUser(userKey)
+	data["Games"] = model.getPublishedGames(userKey)
+	this.render("server/html/profile.html", data)
+}
+
+/**
+ * ゲームの検索ページを表示する
+ * @method
+ * @memberof View
+ * @param {string} query 検索語
+ * @param {[]SearchResult} results 表示するページの検索結果
+ * @param {int} next 次のページの位置、最後のページなら0
+ */
+func (this *View) search(query string, results []SearchResult, next int) {
+	data := make(map[string]interface{}, 4)
+	data["Query"] = query
+	data["Results"] = results
+	data["Next"] = next
+	data["MaxCandidates"] = searchMaxCandidates
+	this.render("server/html/search.html", data)
+}
+
+/**
+ * タグとカテゴリでゲームを探すページを表示する
+ * @method
+ * @memberof View
+ * @param {map[string]string} filters 絞り込みに使ったタグ (tag) とカテゴリ (categoryAxes)
+ * @param {[]GameListItem} games 表示するページのゲーム
+ * @param {string} next 次のページのカーソル、最後のページなら空文字
+ */
+func (this *View) browse(filters map[string]string, games []GameListItem, next string) {
+	data := make(map[string]interface{}, 5)
+	data["Filters"] = filters
+	data["Games"] = games
+	data["Next"] = next
+	data["Categories"] = NewModel(this.c).getCategories()
+	data["AxisLabels"] = categoryAxisLabels
+	this.render("server/html/browse.html", data)
+}